@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"github.com/chromz/wiki-backend/internal/backup"
+	"github.com/chromz/wiki-backend/pkg/log"
+	"github.com/chromz/wiki-backend/pkg/persistence"
+	_ "github.com/mattn/go-sqlite3"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func main() {
+	logger := log.GetLogger()
+	defer logger.Sync()
+	dbPath := flag.String("D", "./ecommunity.db",
+		"backup -D [PATH TO DATABASE]")
+	directory := flag.String("dir", "sync/", "backup -dir [DIR PATH]")
+	output := flag.String("o", "", "backup -o [ARCHIVE PATH]")
+	incremental := flag.String("i", "",
+		"backup -i [PATH TO BASE ARCHIVE]")
+	restore := flag.String("r", "", "backup -r [ARCHIVE TO RESTORE]")
+	bases := flag.String("b", "",
+		"backup -r [ARCHIVE] -b [COMMA SEPARATED BASE ARCHIVES]")
+	force := flag.Bool("f", false,
+		"backup -r [ARCHIVE] -f, replace the current data")
+	flag.Parse()
+	if (*directory)[len(*directory)-1] != '/' {
+		*directory += "/"
+	}
+
+	if *restore != "" {
+		logger.InitMessage("backup", "restoring "+*restore+" to "+
+			*directory)
+		var baseArchives []string
+		for _, base := range strings.Split(*bases, ",") {
+			if base = strings.TrimSpace(base); base != "" {
+				baseArchives = append(baseArchives, base)
+			}
+		}
+		manifest, err := backup.Restore(*restore, baseArchives, *dbPath,
+			*directory, *force)
+		if err != nil {
+			logger.FatalError("Could not restore backup", err)
+		}
+		logger.Info("Restored " + strconv.Itoa(len(manifest.Files)) +
+			" files")
+		return
+	}
+
+	if *output == "" {
+		*output = "backup-" + time.Now().Format("20060102-150405") + ".zip"
+	}
+	logger.InitMessage("backup", "with directory "+*directory)
+	persistence.SetDbPath(*dbPath)
+	manifest, err := backup.Create(persistence.GetDb(), *directory, *output,
+		*incremental)
+	if err != nil {
+		logger.FatalError("Could not write backup", err)
+	}
+	copied := 0
+	for _, entry := range manifest.Files {
+		if entry.Backup == "" {
+			copied++
+		}
+	}
+	logger.Info("Backed up " + strconv.Itoa(len(manifest.Files)) +
+		" files, " + strconv.Itoa(copied) + " copied")
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"github.com/chromz/wiki-backend/internal/imgproc"
+	"github.com/chromz/wiki-backend/internal/schema"
+	"github.com/chromz/wiki-backend/pkg/log"
+	"github.com/chromz/wiki-backend/pkg/persistence"
+	_ "github.com/mattn/go-sqlite3"
+	"strconv"
+	"strings"
+)
+
+func main() {
+	logger := log.GetLogger()
+	defer logger.Sync()
+	dbPath := flag.String("D", "./ecommunity.db",
+		"imgproc -D [PATH TO DATABASE]")
+	directory := flag.String("dir", "sync/", "imgproc -dir [DIR PATH]")
+	pollingRate := flag.Int("p", 5000, "imgproc -p [POLLING RATE]")
+	widthsFlag := flag.String("w", "320,640,1280",
+		"imgproc -w [COMMA SEPARATED WIDTHS]")
+	thumbnail := flag.Int("t", 200, "imgproc -t [THUMBNAIL SIZE]")
+	quality := flag.Int("q", 82, "imgproc -q [QUALITY]")
+	flag.Parse()
+	if (*directory)[len(*directory)-1] != '/' {
+		*directory += "/"
+	}
+	var widths []int
+	for _, field := range strings.Split(*widthsFlag, ",") {
+		width, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || width <= 0 {
+			logger.FatalError("Invalid width "+field, err)
+		}
+		widths = append(widths, width)
+	}
+	logger.InitMessage("imgproc", "with directory "+*directory)
+	persistence.SetDbPath(*dbPath)
+	if err := schema.Migrate(); err != nil {
+		logger.FatalError("Could not migrate database", err)
+	}
+	processor := imgproc.NewProcessor(*directory, *pollingRate, widths,
+		*thumbnail, *quality)
+	processor.Run()
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"flag"
+	"github.com/chromz/wiki-backend/internal/schema"
+	"github.com/chromz/wiki-backend/internal/search"
 	"github.com/chromz/wiki-backend/internal/ticker"
 	"github.com/chromz/wiki-backend/pkg/log"
 	"github.com/chromz/wiki-backend/pkg/persistence"
@@ -22,6 +24,12 @@ func main() {
 	}
 	logger.InitMessage("mdproc", "with directory "+*directory)
 	persistence.SetDbPath(*dbPath)
+	if err := schema.Migrate(); err != nil {
+		logger.FatalError("Could not migrate database", err)
+	}
+	if err := search.Migrate(); err != nil {
+		logger.FatalError("Could not migrate database", err)
+	}
 	ticker := ticker.NewTicker(*userAgent,
 		*directory, *pollingRate)
 	ticker.Run()
@@ -2,7 +2,13 @@ package main
 
 import (
 	"flag"
+	"github.com/chromz/wiki-backend/internal/collab"
+	"github.com/chromz/wiki-backend/internal/editlock"
+	"github.com/chromz/wiki-backend/internal/export"
+	"github.com/chromz/wiki-backend/internal/publication"
 	"github.com/chromz/wiki-backend/internal/routes"
+	"github.com/chromz/wiki-backend/internal/schema"
+	"github.com/chromz/wiki-backend/internal/search"
 	"github.com/chromz/wiki-backend/internal/textclass"
 	"github.com/chromz/wiki-backend/pkg/log"
 	"github.com/chromz/wiki-backend/pkg/persistence"
@@ -18,9 +24,19 @@ func main() {
 		"wiki -d [PATH TO DATABASE]")
 	directory := flag.String("dir", "sync/", "wiki -dir [DIR PATH]")
 	baseURI := flag.String("U", "http://localhost:3000/static/", "wiki -U [URI]")
+	schedulerRate := flag.Int("s", 30000, "wiki -s [SCHEDULER POLLING RATE]")
+	checkpointRate := flag.Int("k", 10000,
+		"wiki -k [COLLABORATIVE CHECKPOINT RATE]")
+	lockTTL := flag.Int("l", 300000, "wiki -l [EDIT LOCK TTL]")
 	flag.Parse()
 	logger.InitMessage("backend", "port:"+*port)
 	persistence.SetDbPath(*dbPath)
+	if err := schema.Migrate(); err != nil {
+		logger.FatalError("Could not migrate database", err)
+	}
+	if err := search.Migrate(); err != nil {
+		logger.FatalError("Could not migrate database", err)
+	}
 	if (*directory)[len(*directory)-1] != '/' {
 		*directory += "/"
 	}
@@ -30,6 +46,11 @@ func main() {
 	}
 	textclass.NewSyncDir(*directory)
 	textclass.NewBaseURI(*baseURI)
+	export.Sweep()
+	collab.NewCheckpointRate(*checkpointRate)
+	editlock.NewTTL(*lockTTL)
+	scheduler := publication.NewScheduler(*schedulerRate)
+	go scheduler.Run()
 	logger.FatalError("Could not listen and serve",
 		http.ListenAndServe(":"+*port, routes.RouteHandler()))
 }
@@ -0,0 +1,468 @@
+package attachment
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/chromz/wiki-backend/internal/editlock"
+	"github.com/chromz/wiki-backend/internal/session"
+	"github.com/chromz/wiki-backend/internal/textclass"
+	"github.com/chromz/wiki-backend/pkg/errormessages"
+	"github.com/chromz/wiki-backend/pkg/persistence"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AttachmentDDL is the query to create the table of files uploaded to
+// text classes, file names are unique per class since copies of a class
+// keep the names of its files
+const AttachmentDDL = `
+CREATE TABLE IF NOT EXISTS "attachment" (
+	"id"	INTEGER PRIMARY KEY AUTOINCREMENT UNIQUE,
+	"text_class_id"	INTEGER NOT NULL,
+	"file_name"	TEXT NOT NULL,
+	"original_name"	TEXT NOT NULL,
+	"content_type"	TEXT NOT NULL,
+	"size"	INTEGER NOT NULL,
+	"uploaded_by"	TEXT NOT NULL,
+	"created_at"	INTEGER NOT NULL,
+	UNIQUE("text_class_id", "file_name"),
+	FOREIGN KEY("text_class_id") REFERENCES "text_class"("id") ON DELETE CASCADE
+);
+`
+
+// Migrate rebuilds the attachment tables created when file names were
+// unique across every class, sqlite can not drop the constraint in place
+func Migrate() error {
+	db := persistence.GetDb()
+	var ddl string
+	findQuery := `
+		SELECT sql
+		FROM sqlite_master
+		WHERE type = 'table'
+		AND name = 'attachment'
+	`
+	if err := db.QueryRow(findQuery).Scan(&ddl); err != nil {
+		return err
+	}
+	if !strings.Contains(ddl, `"file_name"	TEXT NOT NULL UNIQUE`) {
+		return nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	statements := []string{
+		`ALTER TABLE "attachment" RENAME TO "attachment_old"`,
+		AttachmentDDL,
+		`INSERT INTO "attachment"
+		SELECT id, text_class_id, file_name, original_name, content_type,
+		size, uploaded_by, created_at
+		FROM "attachment_old"`,
+		`DROP TABLE "attachment_old"`,
+	}
+	for _, statement := range statements {
+		if _, err = tx.Exec(statement); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Copy gives a class the attachment records of another one, the files
+// are copied with the rest of its assets
+func Copy(tx *sql.Tx, srcClassID, dstClassID int64) error {
+	insertQuery := `
+		INSERT INTO attachment(text_class_id, file_name, original_name,
+		content_type, size, uploaded_by, created_at)
+		SELECT ?, file_name, original_name, content_type, size,
+		uploaded_by, created_at
+		FROM attachment
+		WHERE text_class_id = ?
+		ORDER BY id
+	`
+	_, err := tx.Exec(insertQuery, dstClassID, srcClassID)
+	return err
+}
+
+// maxSize is the maximum size of an attachment
+const maxSize = 20 << 20
+
+// dirName is the directory inside the assets of a class holding its
+// attachments
+const dirName = "attachments/"
+
+// allowed maps the sniffed content types that can be attached to the
+// extension of their generated names
+var allowed = map[string]string{
+	"image/png":       ".png",
+	"image/jpeg":      ".jpg",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"application/pdf": ".pdf",
+	"audio/mpeg":      ".mp3",
+	"audio/wave":      ".wav",
+	"application/ogg": ".ogg",
+	"video/mp4":       ".mp4",
+	"video/webm":      ".webm",
+}
+
+// Attachment is a file uploaded to a text class
+type Attachment struct {
+	ID           int64     `json:"id"`
+	ClassID      int64     `json:"classId"`
+	OriginalName string    `json:"originalName"`
+	ContentType  string    `json:"contentType"`
+	Size         int64     `json:"size"`
+	UploadedBy   string    `json:"uploadedBy"`
+	CreatedAt    time.Time `json:"createdAt"`
+	URL          string    `json:"url"`
+	fileName     string
+}
+
+// location is where the attachments of a class are stored and served
+type location struct {
+	dir string
+	url string
+}
+
+// route is the class of an attachment url
+type route struct {
+	gradeID  int64
+	courseID int64
+	classID  int64
+}
+
+// findLocation returns where the attachments of the class of a route are,
+// it returns sql.ErrNoRows when the class is not in that grade and course
+// or the user can not see it
+func findLocation(rt *route, role string) (*location, error) {
+	db := persistence.GetDb()
+	findQuery := `
+		SELECT 1
+		FROM text_class
+		JOIN course ON course.id = text_class.course_id
+		WHERE text_class.id = ?
+		AND text_class.course_id = ?
+		AND course.grade_id = ?
+		AND ` + textclass.VisibleFilter + `
+	`
+	var found int
+	err := db.QueryRow(findQuery, rt.classID, rt.courseID, rt.gradeID,
+		role).Scan(&found)
+	if err != nil {
+		return nil, err
+	}
+	_, assets := textclass.Dirs(rt.gradeID, rt.courseID, rt.classID)
+	midDir := strings.TrimPrefix(assets, textclass.SyncDir()+"assets/")
+	return &location{
+		dir: assets + dirName,
+		url: textclass.BaseURI() + midDir + dirName,
+	}, nil
+}
+
+// sniff detects the content type of a file from its first bytes
+func sniff(file io.ReadSeeker) (string, error) {
+	header := make([]byte, 512)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	contentType := http.DetectContentType(header[:n])
+	if i := strings.Index(contentType, ";"); i >= 0 {
+		contentType = contentType[:i]
+	}
+	return contentType, nil
+}
+
+// generateName returns a random file name that can not collide with or
+// traverse to other files
+func generateName(extension string) (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(random) + extension, nil
+}
+
+func parseIDs(w http.ResponseWriter, r *http.Request, p httprouter.Params,
+	teacher bool) (*route, bool) {
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	if teacher && claims.Role != "TEACHER" {
+		errormessages.WriteErrorInterface(w, "Not enough privileges",
+			http.StatusUnauthorized)
+		return nil, false
+	}
+	rt := &route{}
+	var err error
+	rt.gradeID, err = strconv.ParseInt(p.ByName("id"), 0, 64)
+	if err == nil {
+		rt.courseID, err = strconv.ParseInt(p.ByName("courseid"), 0, 64)
+	}
+	if err == nil {
+		rt.classID, err = strconv.ParseInt(p.ByName("classid"), 0, 64)
+	}
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid id",
+			http.StatusBadRequest)
+		return nil, false
+	}
+	return rt, true
+}
+
+// Create is an endpoint to upload a file to a text class, the response
+// has the url to use in the markdown
+func Create(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	rt, ok := parseIDs(w, r, p, true)
+	if !ok {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize+1<<20)
+	if err := r.ParseMultipartForm(10 << 20); err != nil {
+		errormessages.WriteErrorMessage(w, "File is too large",
+			http.StatusRequestEntityTooLarge)
+		return
+	}
+	file, multipartHeader, err := r.FormFile("file")
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to get file",
+			http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	if multipartHeader.Size > maxSize {
+		errormessages.WriteErrorMessage(w, "File is too large",
+			http.StatusRequestEntityTooLarge)
+		return
+	}
+	contentType, err := sniff(file)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to read file",
+			http.StatusBadRequest)
+		return
+	}
+	extension, ok := allowed[contentType]
+	if !ok {
+		errormessages.WriteErrorMessage(w, "File type is not allowed",
+			http.StatusUnsupportedMediaType)
+		return
+	}
+	loc, err := findLocation(rt, claims.Role)
+	if err == sql.ErrNoRows {
+		errormessages.WriteErrorInterface(w, "Class does not exists",
+			http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to find class",
+			http.StatusInternalServerError)
+		return
+	}
+	if !editlock.Allow(w, persistence.GetDb(), rt.classID, claims.UserID) {
+		return
+	}
+	fileName, err := generateName(extension)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to name file",
+			http.StatusInternalServerError)
+		return
+	}
+	if err = os.MkdirAll(loc.dir, 0700); err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to create directory",
+			http.StatusInternalServerError)
+		return
+	}
+	dest, err := os.OpenFile(loc.dir+fileName,
+		os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Could not write os file",
+			http.StatusInternalServerError)
+		return
+	}
+	size, err := io.Copy(dest, file)
+	dest.Close()
+	if err != nil {
+		os.Remove(loc.dir + fileName)
+		errormessages.WriteErrorMessage(w, "Could not write os file",
+			http.StatusInternalServerError)
+		return
+	}
+
+	attachment := &Attachment{
+		ClassID:      rt.classID,
+		OriginalName: filepath.Base(multipartHeader.Filename),
+		ContentType:  contentType,
+		Size:         size,
+		UploadedBy:   claims.UserID,
+		CreatedAt:    time.Now().UTC().Truncate(time.Second),
+		URL:          loc.url + fileName,
+	}
+	db := persistence.GetDb()
+	insertQuery := `
+		INSERT INTO attachment(text_class_id, file_name, original_name,
+		content_type, size, uploaded_by, created_at)
+		VALUES(?, ?, ?, ?, ?, ?, ?)
+	`
+	res, err := db.Exec(insertQuery, rt.classID, fileName,
+		attachment.OriginalName, contentType, size, claims.UserID,
+		attachment.CreatedAt.Unix())
+	if err == nil {
+		attachment.ID, err = res.LastInsertId()
+	}
+	if err != nil {
+		os.Remove(loc.dir + fileName)
+		errormessages.WriteErrorMessage(w, "Unable to store attachment",
+			http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(attachment)
+}
+
+// Read returns the attachments of a text class, students only see the
+// ones of published classes
+func Read(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	rt, ok := parseIDs(w, r, p, false)
+	if !ok {
+		return
+	}
+	loc, err := findLocation(rt, claims.Role)
+	if err == sql.ErrNoRows {
+		errormessages.WriteErrorInterface(w, "Class does not exists",
+			http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to find class",
+			http.StatusInternalServerError)
+		return
+	}
+	db := persistence.GetDb()
+	findQuery := `
+		SELECT id, text_class_id, file_name, original_name, content_type,
+		size, uploaded_by, created_at
+		FROM attachment
+		WHERE text_class_id = ?
+		ORDER BY id
+	`
+	rows, err := db.Query(findQuery, rt.classID)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to find attachments",
+			http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	attachments := []*Attachment{}
+	for rows.Next() {
+		attachment := &Attachment{}
+		var createdAt int64
+		err = rows.Scan(&attachment.ID, &attachment.ClassID,
+			&attachment.fileName, &attachment.OriginalName,
+			&attachment.ContentType, &attachment.Size,
+			&attachment.UploadedBy, &createdAt)
+		if err != nil {
+			errormessages.WriteErrorMessage(w,
+				"Unable to find attachments",
+				http.StatusInternalServerError)
+			return
+		}
+		attachment.CreatedAt = time.Unix(createdAt, 0).UTC()
+		attachment.URL = loc.url + attachment.fileName
+		attachments = append(attachments, attachment)
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(attachments)
+}
+
+// Delete is an endpoint to remove an attachment of a text class
+func Delete(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	rt, ok := parseIDs(w, r, p, true)
+	if !ok {
+		return
+	}
+	attachmentID, err := strconv.ParseInt(p.ByName("attachmentid"), 0, 64)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid attachment id",
+			http.StatusBadRequest)
+		return
+	}
+	loc, err := findLocation(rt, claims.Role)
+	if err == sql.ErrNoRows {
+		errormessages.WriteErrorInterface(w, "Class does not exists",
+			http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to find class",
+			http.StatusInternalServerError)
+		return
+	}
+	db := persistence.GetDb()
+	tx, err := db.Begin()
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to reach database",
+			http.StatusInternalServerError)
+		return
+	}
+	if !editlock.Allow(w, tx, rt.classID, claims.UserID) {
+		tx.Rollback()
+		return
+	}
+	var fileName string
+	findQuery := `
+		SELECT file_name
+		FROM attachment
+		WHERE id = ?
+		AND text_class_id = ?
+	`
+	err = tx.QueryRow(findQuery, attachmentID, rt.classID).Scan(&fileName)
+	if err == sql.ErrNoRows {
+		errormessages.WriteErrorInterface(w, "Attachment does not exists",
+			http.StatusNotFound)
+		tx.Rollback()
+		return
+	}
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to find attachment",
+			http.StatusInternalServerError)
+		tx.Rollback()
+		return
+	}
+	deleteQuery := `
+		DELETE FROM attachment
+		WHERE id = ?
+	`
+	if _, err = tx.Exec(deleteQuery, attachmentID); err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to delete",
+			http.StatusInternalServerError)
+		tx.Rollback()
+		return
+	}
+	err = os.Remove(loc.dir + fileName)
+	if err != nil && !os.IsNotExist(err) {
+		errormessages.WriteErrorMessage(w, "Unable to remove file",
+			http.StatusInternalServerError)
+		tx.Rollback()
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to delete",
+			http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,350 @@
+package backup
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/chromz/wiki-backend/pkg/log"
+	"github.com/google/uuid"
+	"github.com/mattn/go-sqlite3"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var logger = log.GetLogger()
+
+// manifestVersion changes when the layout of the archives changes
+const manifestVersion = 1
+
+// Names of the entries of an archive, the manifest is written last since
+// the hashes are known once the files are copied
+const (
+	manifestName = "manifest.json"
+	databaseName = "database.db"
+	filesDir     = "files/"
+)
+
+// excludedDirs hold files derived from the rest, they are rebuilt by the
+// wiki when they are missing
+var excludedDirs = []string{"exports/", "rendered/"}
+
+// busyTimeout is how long a backup waits for the writers of the database
+const busyTimeout = 30 * time.Second
+
+// Entry is a file of a backup. Backup is the id of an older backup holding
+// its content when it did not change since then, it is empty when the
+// content is in the archive itself
+type Entry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	Backup string `json:"backup,omitempty"`
+}
+
+// Manifest describes the content of a backup, Base is the backup an
+// incremental one was made from. Directory is the sync directory the paths
+// stored in the database point to, Directories are its subdirectories
+// since the wiki expects the ones of grades and courses to exist
+type Manifest struct {
+	Version     int       `json:"version"`
+	ID          string    `json:"id"`
+	CreatedAt   time.Time `json:"createdAt"`
+	Base        string    `json:"base,omitempty"`
+	Directory   string    `json:"directory"`
+	Database    Entry     `json:"database"`
+	Directories []string  `json:"directories"`
+	Files       []Entry   `json:"files"`
+}
+
+func hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// readManifest returns the manifest of an opened archive
+func readManifest(reader *zip.Reader) (*Manifest, error) {
+	for _, file := range reader.File {
+		if file.Name != manifestName {
+			continue
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		manifest := &Manifest{}
+		if err = json.NewDecoder(rc).Decode(manifest); err != nil {
+			return nil, err
+		}
+		if manifest.Version != manifestVersion {
+			return nil, errors.New("Unsupported backup version")
+		}
+		return manifest, nil
+	}
+	return nil, errors.New("Backup has no manifest")
+}
+
+// ReadManifest returns the manifest of a backup
+func ReadManifest(archive string) (*Manifest, error) {
+	reader, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return readManifest(&reader.Reader)
+}
+
+// snapshot copies the database to a file with the online backup api of
+// sqlite, the wiki and mdproc can keep using it meanwhile
+func snapshot(db *sql.DB, fileName string) error {
+	ctx := context.Background()
+	src, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	destDb, err := sql.Open("sqlite3", fileName)
+	if err != nil {
+		return err
+	}
+	defer destDb.Close()
+	dest, err := destDb.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+	return dest.Raw(func(destConn interface{}) error {
+		return src.Raw(func(srcConn interface{}) error {
+			b, err := destConn.(*sqlite3.SQLiteConn).Backup("main",
+				srcConn.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			deadline := time.Now().Add(busyTimeout)
+			for {
+				// Every page in one step, the copy is a snapshot of a
+				// single transaction
+				done, err := b.Step(-1)
+				if err != nil {
+					b.Close()
+					return err
+				}
+				if done {
+					return b.Close()
+				}
+				// The database is locked by a writer
+				if time.Now().After(deadline) {
+					b.Close()
+					return errors.New("Database is busy")
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+		})
+	})
+}
+
+func excluded(relative string) bool {
+	for _, dir := range excludedDirs {
+		if strings.HasPrefix(relative, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+func absolute(name string) string {
+	if abs, err := filepath.Abs(name); err == nil {
+		return abs
+	}
+	return filepath.Clean(name)
+}
+
+func writeEntry(writer *zip.Writer, name string, data []byte) error {
+	entry, err := writer.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = entry.Write(data)
+	return err
+}
+
+// archiver writes the content of a backup
+type archiver struct {
+	writer   *zip.Writer
+	manifest *Manifest
+	// base maps the paths of the base backup to their entries
+	base map[string]Entry
+	// skip has the files of the backup itself, for archives written inside
+	// the sync directory
+	skip map[string]bool
+}
+
+func (a *archiver) addDatabase(db *sql.DB, output string) error {
+	fileName := output + ".db"
+	os.Remove(fileName)
+	defer os.Remove(fileName)
+	if err := snapshot(db, fileName); err != nil {
+		return err
+	}
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	entry, err := a.writer.CreateHeader(&zip.FileHeader{
+		Name:     databaseName,
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	digest := sha256.New()
+	size, err := io.Copy(io.MultiWriter(entry, digest), file)
+	if err != nil {
+		return err
+	}
+	a.manifest.Database = Entry{
+		Path:   databaseName,
+		Size:   size,
+		SHA256: hex.EncodeToString(digest.Sum(nil)),
+	}
+	return nil
+}
+
+// addFiles adds the files of the sync directory, the ones that did not
+// change since the base backup are only listed in the manifest
+func (a *archiver) addFiles(directory string) error {
+	return filepath.Walk(directory, func(name string, info os.FileInfo,
+		err error) error {
+		if err != nil {
+			// Files can be removed by the wiki while they are walked
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		relative, err := filepath.Rel(directory, name)
+		if err != nil {
+			return err
+		}
+		relative = filepath.ToSlash(relative)
+		if info.IsDir() {
+			if excluded(relative + "/") {
+				return filepath.SkipDir
+			}
+			if relative != "." {
+				a.manifest.Directories = append(a.manifest.Directories,
+					relative)
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || a.skip[absolute(name)] {
+			return nil
+		}
+		// Files are read at once so the hash matches what is archived
+		// even if they are written meanwhile
+		data, err := ioutil.ReadFile(name)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		entry := Entry{
+			Path:   relative,
+			Size:   int64(len(data)),
+			SHA256: hash(data),
+		}
+		if old, ok := a.base[relative]; ok && old.SHA256 == entry.SHA256 {
+			entry.Backup = old.Backup
+			a.manifest.Files = append(a.manifest.Files, entry)
+			return nil
+		}
+		a.manifest.Files = append(a.manifest.Files, entry)
+		return writeEntry(a.writer, filesDir+relative, data)
+	})
+}
+
+// Create writes a backup of the database and the sync directory to a zip
+// archive. The database is copied first, files written after it may be
+// newer but every file it references is there. When base is not empty
+// the backup is incremental, the files that did not change since that
+// backup are not copied again
+func Create(db *sql.DB, directory, output, base string) (*Manifest, error) {
+	manifest := &Manifest{
+		Version:     manifestVersion,
+		ID:          uuid.New().String(),
+		CreatedAt:   time.Now().UTC(),
+		Directory:   directory,
+		Directories: []string{},
+		Files:       []Entry{},
+	}
+	tmpName := output + ".tmp"
+	a := &archiver{
+		manifest: manifest,
+		base:     make(map[string]Entry),
+		skip: map[string]bool{
+			absolute(output):         true,
+			absolute(tmpName):        true,
+			absolute(output + ".db"): true,
+		},
+	}
+	if base != "" {
+		baseManifest, err := ReadManifest(base)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Base = baseManifest.ID
+		for _, entry := range baseManifest.Files {
+			if entry.Backup == "" {
+				entry.Backup = baseManifest.ID
+			}
+			a.base[entry.Path] = entry
+		}
+	}
+	file, err := os.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
+		0600)
+	if err != nil {
+		return nil, err
+	}
+	a.writer = zip.NewWriter(file)
+	err = a.addDatabase(db, output)
+	if err == nil {
+		err = a.addFiles(directory)
+	}
+	if err == nil {
+		var data []byte
+		data, err = json.MarshalIndent(manifest, "", "\t")
+		if err == nil {
+			err = writeEntry(a.writer, manifestName, data)
+		}
+	}
+	if closeErr := a.writer.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, output)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return nil, err
+	}
+	logger.Info("Backup " + manifest.ID + " written to " + output)
+	return manifest, nil
+}
@@ -0,0 +1,317 @@
+package backup
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"github.com/chromz/wiki-backend/pkg/relpath"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// source is an opened backup, incremental backups read the unchanged
+// files from their bases
+type source struct {
+	manifest *Manifest
+	reader   *zip.ReadCloser
+	files    map[string]*zip.File
+}
+
+func openSource(archive string) (*source, error) {
+	reader, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := readManifest(&reader.Reader)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	s := &source{
+		manifest: manifest,
+		reader:   reader,
+		files:    make(map[string]*zip.File),
+	}
+	for _, file := range reader.File {
+		s.files[file.Name] = file
+	}
+	return s, nil
+}
+
+// extract copies an entry of an archive to a file, the content must match
+// the size and hash of the manifest
+func extract(file *zip.File, entry Entry, fileName string) error {
+	if file == nil {
+		return errors.New("Backup is missing " + entry.Path)
+	}
+	if err := os.MkdirAll(filepath.Dir(fileName), 0700); err != nil {
+		return err
+	}
+	rc, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	out, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
+		0600)
+	if err != nil {
+		return err
+	}
+	digest := sha256.New()
+	// One more byte to find content longer than the manifest says
+	size, err := io.Copy(io.MultiWriter(out, digest),
+		io.LimitReader(rc, entry.Size+1))
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if size != entry.Size ||
+		hex.EncodeToString(digest.Sum(nil)) != entry.SHA256 {
+		return errors.New("Hash mismatch for " + entry.Path)
+	}
+	return nil
+}
+
+// checkDatabase runs the integrity check of sqlite on a restored database
+func checkDatabase(fileName string) error {
+	db, err := sql.Open("sqlite3", fileName)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var result string
+	err = db.QueryRow("PRAGMA integrity_check").Scan(&result)
+	if err != nil {
+		return err
+	}
+	if result != "ok" {
+		return errors.New("Database integrity check failed: " + result)
+	}
+	return nil
+}
+
+// isEmpty reports if a directory is missing or has no files
+func isEmpty(directory string) bool {
+	dir, err := os.Open(directory)
+	if err != nil {
+		return os.IsNotExist(err)
+	}
+	defer dir.Close()
+	_, err = dir.Readdirnames(1)
+	return err == io.EOF
+}
+
+func exists(fileName string) bool {
+	_, err := os.Stat(fileName)
+	return err == nil
+}
+
+// pathColumns are the columns holding paths inside the sync directory
+var pathColumns = []struct{ table, column string }{
+	{"text_class", "file_name"},
+	{"text_class", "proc_file_name"},
+	{"revision", "file_name"},
+}
+
+// relocate rewrites the paths of a restored database from the directory
+// the backup was made from to the one it is restored to
+func relocate(fileName, from, to string) error {
+	db, err := sql.Open("sqlite3", fileName)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, path := range pathColumns {
+		var exists bool
+		err = tx.QueryRow(`
+			SELECT EXISTS (
+				SELECT 1
+				FROM sqlite_master
+				WHERE type = 'table'
+				AND name = ?
+			)
+		`, path.table).Scan(&exists)
+		if err != nil || !exists {
+			continue
+		}
+		// Columns are never user input
+		_, err = tx.Exec(`
+			UPDATE `+path.table+`
+			SET `+path.column+` = ? || substr(`+path.column+`, ?)
+			WHERE substr(`+path.column+`, 1, ?) = ?
+		`, to, len(from)+1, len(from), from)
+		if err != nil {
+			break
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// swap replaces the directory and the database with the restored ones,
+// when a step fails the ones done before are undone
+func swap(stagingDir, stagingDb, directory, dbPath string) error {
+	oldDir := directory + ".old"
+	os.RemoveAll(oldDir)
+	movedDir := exists(directory)
+	if movedDir {
+		if err := os.Rename(directory, oldDir); err != nil {
+			return err
+		}
+	}
+	undoDir := func() {
+		os.RemoveAll(directory)
+		if movedDir {
+			os.Rename(oldDir, directory)
+		}
+	}
+	if err := os.Rename(stagingDir, directory); err != nil {
+		undoDir()
+		return err
+	}
+	// A journal left by the old database would be applied to the new one,
+	// it is moved aside with the database
+	var moved []string
+	undoDb := func() {
+		os.Remove(dbPath)
+		for _, name := range moved {
+			os.Rename(name+".old", name)
+		}
+	}
+	for _, suffix := range []string{"", "-journal", "-wal", "-shm"} {
+		name := dbPath + suffix
+		if !exists(name) {
+			continue
+		}
+		os.Remove(name + ".old")
+		if err := os.Rename(name, name+".old"); err != nil {
+			undoDb()
+			undoDir()
+			return err
+		}
+		moved = append(moved, name)
+	}
+	if err := os.Rename(stagingDb, dbPath); err != nil {
+		undoDb()
+		undoDir()
+		return err
+	}
+	os.RemoveAll(oldDir)
+	for _, name := range moved {
+		os.Remove(name + ".old")
+	}
+	return nil
+}
+
+// Restore rebuilds the database and the sync directory from a backup, the
+// files of incremental backups are read from the bases, which must include
+// every backup the manifest refers to. Everything is extracted and checked
+// against the manifest before the current data is replaced, which only
+// happens when force is true. The paths in the database are moved to the
+// directory restored to. The wiki and the processors must be stopped
+func Restore(archive string, bases []string, dbPath, directory string,
+	force bool) (*Manifest, error) {
+	directory = strings.TrimSuffix(directory, "/")
+	if !force && (exists(dbPath) || !isEmpty(directory)) {
+		return nil, errors.New("Database or directory already exist")
+	}
+	primary, err := openSource(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer primary.reader.Close()
+	sources := map[string]*source{primary.manifest.ID: primary}
+	for _, base := range bases {
+		s, err := openSource(base)
+		if err != nil {
+			return nil, err
+		}
+		defer s.reader.Close()
+		sources[s.manifest.ID] = s
+	}
+	manifest := primary.manifest
+	if !relpath.Valid(manifest.Database.Path) {
+		return nil, errors.New("Invalid manifest")
+	}
+	for _, dir := range manifest.Directories {
+		if !relpath.Valid(dir) {
+			return nil, errors.New("Invalid path " + dir)
+		}
+	}
+	for _, entry := range manifest.Files {
+		if !relpath.Valid(entry.Path) {
+			return nil, errors.New("Invalid path " + entry.Path)
+		}
+		if _, ok := sources[entry.Backup]; entry.Backup != "" && !ok {
+			return nil, errors.New("Missing base backup " + entry.Backup)
+		}
+	}
+
+	// Everything is extracted next to the current data so it can be
+	// replaced with renames
+	stagingDir := directory + ".restore"
+	stagingDb := dbPath + ".restore"
+	os.RemoveAll(stagingDir)
+	os.Remove(stagingDb)
+	err = extract(primary.files[databaseName], manifest.Database, stagingDb)
+	if err == nil {
+		err = checkDatabase(stagingDb)
+	}
+	if err == nil {
+		err = os.MkdirAll(stagingDir, 0700)
+	}
+	for _, dir := range manifest.Directories {
+		if err != nil {
+			break
+		}
+		dir = filepath.Join(stagingDir, filepath.FromSlash(dir))
+		err = os.MkdirAll(dir, 0700)
+	}
+	for _, entry := range manifest.Files {
+		if err != nil {
+			break
+		}
+		s := primary
+		if entry.Backup != "" {
+			s = sources[entry.Backup]
+		}
+		err = extract(s.files[filesDir+entry.Path], entry,
+			filepath.Join(stagingDir, filepath.FromSlash(entry.Path)))
+	}
+	if err != nil {
+		os.RemoveAll(stagingDir)
+		os.Remove(stagingDb)
+		return nil, err
+	}
+
+	// The paths of the files in the database start with the directory
+	// the backup was made from
+	if manifest.Directory != directory+"/" {
+		err = relocate(stagingDb, manifest.Directory, directory+"/")
+		if err != nil {
+			os.RemoveAll(stagingDir)
+			os.Remove(stagingDb)
+			return nil, err
+		}
+	}
+	if err = swap(stagingDir, stagingDb, directory, dbPath); err != nil {
+		os.RemoveAll(stagingDir)
+		os.Remove(stagingDb)
+		return nil, err
+	}
+	logger.Info("Backup " + manifest.ID + " restored")
+	return manifest, nil
+}
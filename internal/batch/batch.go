@@ -0,0 +1,462 @@
+package batch
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/chromz/wiki-backend/internal/course"
+	"github.com/chromz/wiki-backend/internal/editlock"
+	"github.com/chromz/wiki-backend/internal/grade"
+	"github.com/chromz/wiki-backend/internal/publication"
+	"github.com/chromz/wiki-backend/internal/session"
+	"github.com/chromz/wiki-backend/internal/textclass"
+	"github.com/chromz/wiki-backend/pkg/errormessages"
+	"github.com/chromz/wiki-backend/pkg/log"
+	"github.com/chromz/wiki-backend/pkg/persistence"
+	"github.com/julienschmidt/httprouter"
+	"github.com/mattn/go-sqlite3"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const maxOperations = 1000
+
+const (
+	statusOk         = "ok"
+	statusFailed     = "failed"
+	statusRolledBack = "rolled_back"
+	statusSkipped    = "skipped"
+)
+
+var logger = log.GetLogger()
+
+// Operation is a single create, update or delete inside a batch. Id and
+// parentId are either numbers or "$ref" strings pointing to the ref of
+// a create operation earlier in the same batch
+type Operation struct {
+	Ref      string          `json:"ref"`
+	Action   string          `json:"action"`
+	Resource string          `json:"resource"`
+	ID       json.RawMessage `json:"id"`
+	ParentID json.RawMessage `json:"parentId"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// Batch is the body of a batch request
+type Batch struct {
+	Operations []Operation `json:"operations"`
+}
+
+// Result is the outcome of a single operation
+type Result struct {
+	Index    int         `json:"index"`
+	Ref      string      `json:"ref,omitempty"`
+	Action   string      `json:"action"`
+	Resource string      `json:"resource"`
+	ID       int64       `json:"id,omitempty"`
+	Status   string      `json:"status"`
+	Error    string      `json:"error,omitempty"`
+	Data     interface{} `json:"data,omitempty"`
+}
+
+// Response is the body returned by the batch endpoint
+type Response struct {
+	Status  string   `json:"status"`
+	Results []Result `json:"results"`
+}
+
+// operationError is an error caused by the content of an operation
+type operationError struct {
+	status  int
+	message string
+}
+
+func (e *operationError) Error() string {
+	return e.message
+}
+
+func invalid(message string) error {
+	return &operationError{http.StatusBadRequest, message}
+}
+
+func notFound(message string) error {
+	return &operationError{http.StatusNotFound, message}
+}
+
+// executor applies operations and keeps track of the filesystem changes
+// so they can be compensated or completed
+type executor struct {
+	tx          *sql.Tx
+	userID      string
+	refs        map[string]int64
+	createdDirs []string
+	removedDirs []string
+}
+
+// Validate checks the batch size and that refs are unique
+func (b *Batch) Validate() error {
+	if len(b.Operations) == 0 {
+		return errors.New("Operations are missing")
+	}
+	if len(b.Operations) > maxOperations {
+		return errors.New("Too many operations")
+	}
+	refs := make(map[string]bool)
+	for _, op := range b.Operations {
+		if op.Ref == "" {
+			continue
+		}
+		if refs[op.Ref] {
+			return errors.New("Duplicated ref " + op.Ref)
+		}
+		refs[op.Ref] = true
+	}
+	return nil
+}
+
+func (e *executor) resolve(raw json.RawMessage, field string) (int64, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return 0, invalid(field + " is missing")
+	}
+	var id int64
+	if err := json.Unmarshal(raw, &id); err == nil {
+		return id, nil
+	}
+	var ref string
+	if err := json.Unmarshal(raw, &ref); err != nil ||
+		!strings.HasPrefix(ref, "$") {
+		return 0, invalid("Invalid " + field)
+	}
+	id, ok := e.refs[ref[1:]]
+	if !ok {
+		return 0, invalid("Unknown ref " + ref)
+	}
+	return id, nil
+}
+
+func (e *executor) mkdirs(dirs ...string) error {
+	for _, dir := range dirs {
+		if err := os.Mkdir(dir, 0700); err != nil {
+			return err
+		}
+		e.createdDirs = append(e.createdDirs, dir)
+	}
+	return nil
+}
+
+// compensate removes the directories created by a failed batch
+func (e *executor) compensate() {
+	for i := len(e.createdDirs) - 1; i >= 0; i-- {
+		if err := os.RemoveAll(e.createdDirs[i]); err != nil {
+			logger.Error("Unable to remove batch directory", err)
+		}
+	}
+}
+
+// complete removes the directories of deleted resources once the batch
+// is committed
+func (e *executor) complete() {
+	for _, dir := range e.removedDirs {
+		if err := os.RemoveAll(dir); err != nil {
+			logger.Error("Unable to remove batch directory", err)
+		}
+	}
+}
+
+func decode(raw json.RawMessage, dest interface{}) error {
+	if len(raw) == 0 {
+		return invalid("Data is missing")
+	}
+	if err := json.Unmarshal(raw, dest); err != nil {
+		return invalid("Invalid data")
+	}
+	return nil
+}
+
+func translate(err error, message string) error {
+	if err == sql.ErrNoRows {
+		return notFound(message + " not found")
+	}
+	if locked, ok := err.(*editlock.LockedError); ok {
+		return &operationError{http.StatusLocked, locked.Error()}
+	}
+	if sqliteErr, ok := err.(sqlite3.Error); ok {
+		if sqliteErr.ExtendedCode == sqlite3.ErrConstraintForeignKey {
+			return invalid("Invalid parent id")
+		}
+	}
+	return err
+}
+
+func (e *executor) courseGrade(courseID int64) (int64, error) {
+	var gradeID int64
+	findQuery := `
+		SELECT grade_id
+		FROM course
+		WHERE id = ?
+	`
+	err := e.tx.QueryRow(findQuery, courseID).Scan(&gradeID)
+	return gradeID, translate(err, "Course")
+}
+
+func (e *executor) classParents(classID int64) (int64, int64, error) {
+	var gradeID, courseID int64
+	findQuery := `
+		SELECT course.grade_id, text_class.course_id
+		FROM text_class
+		JOIN course ON course.id = text_class.course_id
+		WHERE text_class.id = ?
+	`
+	err := e.tx.QueryRow(findQuery, classID).Scan(&gradeID, &courseID)
+	return gradeID, courseID, translate(err, "Class")
+}
+
+func (e *executor) applyGrade(op Operation, result *Result) error {
+	var err error
+	if op.Action != "create" {
+		if result.ID, err = e.resolve(op.ID, "id"); err != nil {
+			return err
+		}
+	}
+	switch op.Action {
+	case "create", "update":
+		g := &grade.Grade{}
+		if err = decode(op.Data, g); err != nil {
+			return err
+		}
+		if err = g.Validate(); err != nil {
+			return invalid(err.Error())
+		}
+		if op.Action == "update" {
+			g.ID = result.ID
+			err = g.Save(e.tx)
+		} else {
+			if err = g.Insert(e.tx); err == nil {
+				err = e.mkdirs(textclass.Dirs(g.ID))
+			}
+		}
+		result.ID = g.ID
+		result.Data = g
+		return translate(err, "Grade")
+	case "delete":
+		if err = grade.Remove(e.tx, result.ID); err != nil {
+			return translate(err, "Grade")
+		}
+		dir, assetsDir := textclass.Dirs(result.ID)
+		e.removedDirs = append(e.removedDirs, dir, assetsDir)
+		return nil
+	}
+	return invalid("Invalid action")
+}
+
+func (e *executor) applyCourse(op Operation, result *Result) error {
+	var err error
+	var gradeID int64
+	if op.Action == "create" {
+		gradeID, err = e.resolve(op.ParentID, "parentId")
+	} else if result.ID, err = e.resolve(op.ID, "id"); err == nil {
+		gradeID, err = e.courseGrade(result.ID)
+	}
+	if err != nil {
+		return err
+	}
+	switch op.Action {
+	case "create", "update":
+		c := &course.Course{}
+		if err = decode(op.Data, c); err != nil {
+			return err
+		}
+		c.GradeID = gradeID
+		if op.Action == "create" && c.Status == "" {
+			c.Status = publication.Draft
+		}
+		if err = c.Validate(); err != nil {
+			return invalid(err.Error())
+		}
+		if op.Action == "update" {
+			c.ID = result.ID
+			err = c.Save(e.tx)
+		} else {
+			if err = c.Insert(e.tx); err == nil {
+				err = e.mkdirs(textclass.Dirs(gradeID, c.ID))
+			}
+		}
+		result.ID = c.ID
+		result.Data = c
+		return translate(err, "Course")
+	case "delete":
+		if err = course.Remove(e.tx, result.ID); err != nil {
+			return translate(err, "Course")
+		}
+		dir, assetsDir := textclass.Dirs(gradeID, result.ID)
+		e.removedDirs = append(e.removedDirs, dir, assetsDir)
+		return nil
+	}
+	return invalid("Invalid action")
+}
+
+func (e *executor) applyTextClass(op Operation, result *Result) error {
+	var err error
+	var courseID int64
+	if op.Action == "create" {
+		courseID, err = e.resolve(op.ParentID, "parentId")
+	} else if result.ID, err = e.resolve(op.ID, "id"); err == nil {
+		_, courseID, err = e.classParents(result.ID)
+	}
+	if err != nil {
+		return err
+	}
+	switch op.Action {
+	case "create", "update":
+		t := &textclass.TextClass{}
+		if err = decode(op.Data, t); err != nil {
+			return err
+		}
+		t.CourseID = courseID
+		if op.Action == "create" && t.Status == "" {
+			t.Status = publication.Draft
+		}
+		if err = t.Validate(); err != nil {
+			return invalid(err.Error())
+		}
+		if op.Action == "update" {
+			t.ID = result.ID
+			err = t.Save(e.tx, e.userID)
+		} else {
+			err = t.Insert(e.tx)
+		}
+		result.ID = t.ID
+		result.Data = t
+		return translate(err, "Class")
+	case "delete":
+		gradeID, err := e.courseGrade(courseID)
+		if err != nil {
+			return err
+		}
+		if err = textclass.Remove(e.tx, result.ID, e.userID); err != nil {
+			return translate(err, "Class")
+		}
+		dir, assetsDir := textclass.Dirs(gradeID, courseID, result.ID)
+		e.removedDirs = append(e.removedDirs, dir, assetsDir)
+		return nil
+	}
+	return invalid("Invalid action")
+}
+
+func (e *executor) apply(op Operation, result *Result) error {
+	var err error
+	switch op.Resource {
+	case "grade":
+		err = e.applyGrade(op, result)
+	case "course":
+		err = e.applyCourse(op, result)
+	case "textclass":
+		err = e.applyTextClass(op, result)
+	default:
+		err = invalid("Invalid resource")
+	}
+	if err == nil && op.Ref != "" && op.Action == "create" {
+		e.refs[op.Ref] = result.ID
+	}
+	return err
+}
+
+func fail(w http.ResponseWriter, results []Result, index int, err error) {
+	status := http.StatusInternalServerError
+	message := "Unable to apply operation"
+	if opErr, ok := err.(*operationError); ok {
+		status = opErr.status
+		message = opErr.message
+	} else {
+		logger.Error("Batch operation failed", err)
+	}
+	for i := range results {
+		switch {
+		case i < index:
+			results[i].Status = statusRolledBack
+			results[i].Data = nil
+			if results[i].Action == "create" {
+				results[i].ID = 0
+			}
+		case i == index:
+			results[i].Status = statusFailed
+			results[i].Error = message
+			results[i].Data = nil
+		default:
+			results[i].Status = statusSkipped
+		}
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&Response{
+		Status:  "ERROR",
+		Results: results,
+	})
+}
+
+// Execute is an endpoint that applies an ordered list of operations over
+// grades, courses and text classes in a single transaction
+func Execute(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	if claims.Role != "TEACHER" {
+		errormessages.WriteErrorInterface(w, "Not enough privileges",
+			http.StatusUnauthorized)
+		return
+	}
+	batch := &Batch{}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(batch)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid body type",
+			http.StatusBadRequest)
+		return
+	}
+	if err = batch.Validate(); err != nil {
+		errormessages.WriteErrorMessage(w, err.Error(),
+			http.StatusBadRequest)
+		return
+	}
+
+	db := persistence.GetDb()
+	tx, err := db.Begin()
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to reach database",
+			http.StatusInternalServerError)
+		return
+	}
+	e := &executor{
+		tx:     tx,
+		userID: claims.UserID,
+		refs:   make(map[string]int64),
+	}
+	results := make([]Result, len(batch.Operations))
+	for i, op := range batch.Operations {
+		results[i] = Result{
+			Index:    i,
+			Ref:      op.Ref,
+			Action:   op.Action,
+			Resource: op.Resource,
+		}
+	}
+	for i, op := range batch.Operations {
+		if err = e.apply(op, &results[i]); err != nil {
+			tx.Rollback()
+			e.compensate()
+			fail(w, results, i, err)
+			return
+		}
+		results[i].Status = statusOk
+	}
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		e.compensate()
+		fail(w, results, len(results), err)
+		return
+	}
+	e.complete()
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(&Response{
+		Status:  "OK",
+		Results: results,
+	})
+}
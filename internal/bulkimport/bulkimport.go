@@ -0,0 +1,633 @@
+package bulkimport
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/chromz/wiki-backend/internal/permalink"
+	"github.com/chromz/wiki-backend/internal/publication"
+	"github.com/chromz/wiki-backend/internal/session"
+	"github.com/chromz/wiki-backend/internal/textclass"
+	"github.com/chromz/wiki-backend/pkg/errormessages"
+	"github.com/chromz/wiki-backend/pkg/log"
+	"github.com/chromz/wiki-backend/pkg/markdown"
+	"github.com/chromz/wiki-backend/pkg/persistence"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var logger = log.GetLogger()
+
+// maxArchiveSize is the maximum size of an uploaded zip, maxEntrySize and
+// maxTotalSize limit what it holds once uncompressed
+const (
+	maxArchiveSize = 100 << 20
+	maxEntrySize   = 20 << 20
+	maxTotalSize   = 500 << 20
+)
+
+// importedDir is the directory of the class assets holding the copied
+// images, it is shared with the documents converted on upload
+const importedDir = "imported/"
+
+var markdownExtensions = map[string]bool{
+	".md":       true,
+	".markdown": true,
+	".mdown":    true,
+}
+
+// imageTypes are the sniffed types of the images that are copied
+var imageTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// linkRegex matches inline links and images, the destination may be
+// wrapped in <> and followed by a title
+var linkRegex = regexp.MustCompile(
+	`(!?)\[([^\[\]\n]*)\]\(\s*(<[^<>\n]*>|[^\s()<>]*)((?:\s+(?:"[^"\n]*"|'[^'\n]*'|\([^()\n]*\)))?)\s*\)`)
+
+// referenceRegex matches the definitions of reference links
+var referenceRegex = regexp.MustCompile(
+	`(?m)^ {0,3}\[[^\[\]\n]+\]:[ \t]*(<[^<>\n]*>|\S+)`)
+
+var headingRegex = regexp.MustCompile(`^ {0,3}#{1,6}[ \t]+(.+?)(?:[ \t]+#+)?[ \t]*$`)
+
+// prefixRegex matches the numbers used to order files, they are left out
+// of titles taken from file names
+var prefixRegex = regexp.MustCompile(`^[0-9]+[ ._-]*`)
+
+var errTooLarge = errors.New("Archive is too large")
+
+// Class is a text class created from a markdown file
+type Class struct {
+	ID       int64  `json:"id"`
+	Title    string `json:"title"`
+	FileName string `json:"fileName"`
+	Images   int    `json:"images"`
+}
+
+// Skipped is a file of the archive that was not imported
+type Skipped struct {
+	FileName string `json:"fileName"`
+	Reason   string `json:"reason"`
+}
+
+// BrokenLink is a relative link that could not be resolved inside the
+// archive, it is left as it was
+type BrokenLink struct {
+	FileName string `json:"fileName"`
+	Line     int    `json:"line"`
+	Target   string `json:"target"`
+	Reason   string `json:"reason"`
+}
+
+// Report is the result of an import
+type Report struct {
+	Classes     []Class      `json:"classes"`
+	Skipped     []Skipped    `json:"skipped"`
+	BrokenLinks []BrokenLink `json:"brokenLinks"`
+}
+
+// document is a markdown file of the archive being imported
+type document struct {
+	name    string
+	content string
+	class   *textclass.TextClass
+	images  map[string]bool
+}
+
+// importer holds the files of an archive while they are imported
+type importer struct {
+	gradeID  int64
+	courseID int64
+	// slugs are the slugs of the grade and the course
+	slugs []string
+	files map[string]*zip.File
+	read  int64
+	// documents maps the paths of the markdown files to their document
+	documents map[string]*document
+	// used are the images copied at least once and rejected the linked
+	// files that are not images
+	used     map[string]bool
+	rejected map[string]bool
+	report   *Report
+}
+
+// cleanName normalizes the path of a file of the archive, it is empty for
+// files that should not be imported
+func cleanName(name string) string {
+	name = strings.Replace(name, "\\", "/", -1)
+	if strings.HasSuffix(name, "/") {
+		return ""
+	}
+	cleaned := path.Clean("/" + name)[1:]
+	for _, part := range strings.Split(cleaned, "/") {
+		if strings.HasPrefix(part, ".") || part == "__MACOSX" {
+			return ""
+		}
+	}
+	return cleaned
+}
+
+// load reads a file of the archive, uncompressed sizes are checked as
+// they are read since headers can lie
+func (im *importer) load(name string) ([]byte, error) {
+	reader, err := im.files[name].Open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(reader, maxEntrySize+1))
+	if err != nil {
+		return nil, err
+	}
+	im.read += int64(len(data))
+	if len(data) > maxEntrySize || im.read > maxTotalSize {
+		return nil, errTooLarge
+	}
+	return data, nil
+}
+
+// title returns the title of front matter, the first heading or the file
+// name of a markdown file
+func title(name, content string) string {
+	lines := strings.Split(strings.Replace(content, "\r\n", "\n", -1), "\n")
+	if len(lines) > 0 && strings.TrimSpace(lines[0]) == "---" {
+		for _, line := range lines[1:] {
+			trimmed := strings.TrimSpace(line)
+			if trimmed == "---" || trimmed == "..." {
+				break
+			}
+			if strings.HasPrefix(trimmed, "title:") {
+				value := strings.TrimSpace(strings.TrimPrefix(trimmed,
+					"title:"))
+				value = strings.Trim(value, `"'`)
+				if value != "" {
+					return value
+				}
+			}
+		}
+	}
+	masked := strings.Split(markdown.MaskCode(content), "\n")
+	for _, line := range masked {
+		if match := headingRegex.FindStringSubmatch(line); match != nil {
+			return strings.TrimSpace(match[1])
+		}
+	}
+	base := path.Base(name)
+	base = strings.TrimSuffix(base, path.Ext(base))
+	if trimmed := prefixRegex.ReplaceAllString(base, ""); trimmed != "" {
+		base = trimmed
+	}
+	return strings.TrimSpace(strings.NewReplacer("-", " ", "_", " ").
+		Replace(base))
+}
+
+// line returns the line of an offset of a text
+func line(text string, offset int) int {
+	return strings.Count(text[:offset], "\n") + 1
+}
+
+func escapePath(name string) string {
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// resolve finds the file of the archive a relative link of a document
+// points to, links with a scheme, absolute links and anchors are not
+// relative and are ignored
+func resolve(doc *document, target string) (string, bool) {
+	target = strings.TrimSuffix(strings.TrimPrefix(target, "<"), ">")
+	if target == "" || strings.HasPrefix(target, "#") ||
+		strings.HasPrefix(target, "/") {
+		return "", false
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return target, true
+	}
+	if u.Scheme != "" || u.Host != "" {
+		return "", false
+	}
+	resolved := path.Join(path.Dir(doc.name), u.Path)
+	if resolved == ".." || strings.HasPrefix(resolved, "../") {
+		return target, true
+	}
+	return resolved, true
+}
+
+// asset copies an image into the assets of the class of a document and
+// returns its url, the reason is set when it can not be copied
+func (im *importer) asset(doc *document, name string) (string, string,
+	error) {
+	if _, ok := im.files[name]; !ok {
+		return "", "File not found", nil
+	}
+	_, assets := textclass.Dirs(im.gradeID, im.courseID, doc.class.ID)
+	midDir := strings.TrimPrefix(assets, textclass.SyncDir()+"assets/")
+	uri := textclass.BaseURI() + midDir + importedDir + escapePath(name)
+	if doc.images[name] {
+		return uri, "", nil
+	}
+	data, err := im.load(name)
+	if err != nil {
+		return "", "", err
+	}
+	if !imageTypes[http.DetectContentType(data)] {
+		im.rejected[name] = true
+		return "", "Unsupported file type", nil
+	}
+	fileName := assets + importedDir + name
+	if err = os.MkdirAll(path.Dir(fileName), 0700); err != nil {
+		return "", "", err
+	}
+	if err = ioutil.WriteFile(fileName, data, 0600); err != nil {
+		return "", "", err
+	}
+	doc.images[name] = true
+	im.used[name] = true
+	return uri, "", nil
+}
+
+// titleEscaper escapes the characters of a title that markdown would
+// interpret inside the text of a link
+var titleEscaper = strings.NewReplacer(
+	"\\", "\\\\", "`", "\\`", "*", "\\*", "_", "\\_", "[", "\\[",
+	"]", "\\]", "<", "\\<", ">", "\\>",
+)
+
+// fragment returns the escaped anchor of a link target with its #, it is
+// empty when there is none
+func fragment(target string) string {
+	target = strings.TrimSuffix(strings.TrimPrefix(target, "<"), ">")
+	u, err := url.Parse(target)
+	if err != nil || u.Fragment == "" {
+		return ""
+	}
+	return "#" + url.PathEscape(u.Fragment)
+}
+
+// classLink returns the link to the class of a document. Links to a
+// heading and titles that can not be written inside a wiki link become
+// markdown links to the permalink of the class
+func (im *importer) classLink(linked *document, label,
+	anchor string) string {
+	title := linked.class.Title
+	if anchor == "" && !strings.ContainsAny(title, "[]|/\n") {
+		if label == "" || strings.ContainsAny(label, "[]|\n") {
+			return "[[" + title + "]]"
+		}
+		return "[[" + title + "|" + label + "]]"
+	}
+	if strings.TrimSpace(label) == "" {
+		label = titleEscaper.Replace(title)
+	}
+	slugs := append(append([]string{}, im.slugs...), linked.class.Slug)
+	return "[" + label + "](" + permalink.Path(slugs...) + anchor + ")"
+}
+
+// link returns the replacement of a relative link of a document, links
+// to other imported files become links to their class
+func (im *importer) link(doc *document, image bool, label,
+	target string) (string, string, error) {
+	name, ok := resolve(doc, target)
+	if !ok {
+		return "", "", nil
+	}
+	if linked, ok := im.documents[name]; ok && !image {
+		return im.classLink(linked, label, fragment(target)), "", nil
+	}
+	if markdownExtensions[strings.ToLower(path.Ext(name))] {
+		return "", "File not found", nil
+	}
+	return im.asset(doc, name)
+}
+
+func (im *importer) broken(doc *document, offset int, target,
+	reason string) {
+	im.report.BrokenLinks = append(im.report.BrokenLinks, BrokenLink{
+		FileName: doc.name,
+		Line:     line(doc.content, offset),
+		Target:   target,
+		Reason:   reason,
+	})
+}
+
+// rewrite copies the images of a document and rewrites its relative
+// links, code is left alone
+func (im *importer) rewrite(doc *document) (string, error) {
+	text := doc.content
+	masked := markdown.MaskCode(text)
+	var builder strings.Builder
+	last := 0
+	for _, match := range linkRegex.FindAllStringSubmatchIndex(masked, -1) {
+		image := match[3] > match[2]
+		label := text[match[4]:match[5]]
+		target := text[match[6]:match[7]]
+		replacement, reason, err := im.link(doc, image, label, target)
+		if err != nil {
+			return "", err
+		}
+		if reason != "" {
+			im.broken(doc, match[0], target, reason)
+			continue
+		}
+		if replacement == "" {
+			continue
+		}
+		builder.WriteString(text[last:match[0]])
+		if strings.HasPrefix(replacement, "[") {
+			builder.WriteString(replacement)
+		} else {
+			builder.WriteString(text[match[0]:match[6]])
+			builder.WriteString(replacement)
+			builder.WriteString(text[match[7]:match[1]])
+		}
+		last = match[1]
+	}
+	builder.WriteString(text[last:])
+	text = builder.String()
+
+	// Reference definitions can only point to images
+	masked = markdown.MaskCode(text)
+	builder.Reset()
+	last = 0
+	for _, match := range referenceRegex.FindAllStringSubmatchIndex(masked, -1) {
+		target := text[match[2]:match[3]]
+		name, ok := resolve(doc, target)
+		if !ok {
+			continue
+		}
+		if _, ok = im.documents[name]; ok {
+			continue
+		}
+		replacement, reason, err := im.asset(doc, name)
+		if err != nil {
+			return "", err
+		}
+		if reason != "" {
+			im.broken(doc, match[0], target, reason)
+			continue
+		}
+		builder.WriteString(text[last:match[2]])
+		builder.WriteString(replacement)
+		last = match[3]
+	}
+	builder.WriteString(text[last:])
+	return builder.String(), nil
+}
+
+// open classifies the files of an archive, markdown files are read and
+// the rest is kept to be copied when a document links to it
+func (im *importer) open(reader *zip.Reader) ([]string, error) {
+	var names []string
+	for _, file := range reader.File {
+		name := cleanName(file.Name)
+		if name == "" {
+			continue
+		}
+		im.files[name] = file
+		if !markdownExtensions[strings.ToLower(path.Ext(name))] {
+			continue
+		}
+		data, err := im.load(name)
+		if err != nil {
+			return nil, err
+		}
+		if !utf8.Valid(data) {
+			im.report.Skipped = append(im.report.Skipped, Skipped{
+				FileName: name,
+				Reason:   "Invalid UTF-8",
+			})
+			continue
+		}
+		content := strings.TrimPrefix(string(data), "\ufeff")
+		im.documents[name] = &document{
+			name:    name,
+			content: content,
+			images:  make(map[string]bool),
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// run creates a class for each document in order, the markdown is
+// stored once every class exists so links between them resolve
+func (im *importer) run(tx *sql.Tx, names []string, authorID,
+	message string) error {
+	im.slugs = make([]string, 2)
+	slugQuery := `
+		SELECT grade.slug, course.slug
+		FROM course
+		JOIN grade ON grade.id = course.grade_id
+		WHERE course.id = ?
+	`
+	err := tx.QueryRow(slugQuery, im.courseID).Scan(&im.slugs[0],
+		&im.slugs[1])
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		doc := im.documents[name]
+		doc.class = &textclass.TextClass{
+			CourseID: im.courseID,
+			Title:    title(name, doc.content),
+			Status:   publication.Draft,
+		}
+		if doc.class.Title == "" {
+			doc.class.Title = name
+		}
+		if err := doc.class.Insert(tx); err != nil {
+			return err
+		}
+	}
+	for _, name := range names {
+		doc := im.documents[name]
+		content, err := im.rewrite(doc)
+		if err != nil {
+			return err
+		}
+		_, err = textclass.StoreMarkdown(tx, doc.class.ID, authorID, message,
+			[]byte(content))
+		if err != nil {
+			return err
+		}
+		im.report.Classes = append(im.report.Classes, Class{
+			ID:       doc.class.ID,
+			Title:    doc.class.Title,
+			FileName: name,
+			Images:   len(doc.images),
+		})
+	}
+	var unused []string
+	for name := range im.files {
+		if im.documents[name] == nil && !im.used[name] {
+			unused = append(unused, name)
+		}
+	}
+	sort.Strings(unused)
+	for _, name := range unused {
+		if markdownExtensions[strings.ToLower(path.Ext(name))] {
+			continue
+		}
+		reason := "Not linked from any markdown file"
+		if im.rejected[name] {
+			reason = "Unsupported file type"
+		}
+		im.report.Skipped = append(im.report.Skipped, Skipped{
+			FileName: name,
+			Reason:   reason,
+		})
+	}
+	return nil
+}
+
+// cleanup removes the directories of the classes of a failed import
+func (im *importer) cleanup() {
+	for _, doc := range im.documents {
+		if doc.class == nil || doc.class.ID == 0 {
+			continue
+		}
+		dir, assets := textclass.Dirs(im.gradeID, im.courseID, doc.class.ID)
+		os.RemoveAll(dir)
+		os.RemoveAll(assets)
+	}
+}
+
+// Course is an endpoint to import a zipped folder of markdown files as
+// text classes of a course, one for each file ordered by file name
+func Course(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	if claims.Role != "TEACHER" {
+		errormessages.WriteErrorInterface(w, "Not enough privileges",
+			http.StatusUnauthorized)
+		return
+	}
+	gradeID, err := strconv.ParseInt(p.ByName("id"), 0, 64)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid id",
+			http.StatusBadRequest)
+		return
+	}
+	courseID, err := strconv.ParseInt(p.ByName("courseid"), 0, 64)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid id",
+			http.StatusBadRequest)
+		return
+	}
+	db := persistence.GetDb()
+	var exists int
+	existsQuery := `
+		SELECT COUNT(*)
+		FROM course
+		WHERE id = ? AND grade_id = ?
+	`
+	err = db.QueryRow(existsQuery, courseID, gradeID).Scan(&exists)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to find course",
+			http.StatusInternalServerError)
+		return
+	}
+	if exists == 0 {
+		errormessages.WriteErrorInterface(w, "Course does not exists",
+			http.StatusNotFound)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxArchiveSize+1<<20)
+	if err = r.ParseMultipartForm(10 << 20); err != nil {
+		errormessages.WriteErrorMessage(w, "File is too large",
+			http.StatusRequestEntityTooLarge)
+		return
+	}
+	file, multipartHeader, err := r.FormFile("file")
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to get file",
+			http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	if multipartHeader.Size > maxArchiveSize {
+		errormessages.WriteErrorMessage(w, "File is too large",
+			http.StatusRequestEntityTooLarge)
+		return
+	}
+	reader, err := zip.NewReader(file, multipartHeader.Size)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid zip file",
+			http.StatusBadRequest)
+		return
+	}
+
+	im := &importer{
+		gradeID:   gradeID,
+		courseID:  courseID,
+		files:     make(map[string]*zip.File),
+		documents: make(map[string]*document),
+		used:      make(map[string]bool),
+		rejected:  make(map[string]bool),
+		report: &Report{
+			Classes:     []Class{},
+			Skipped:     []Skipped{},
+			BrokenLinks: []BrokenLink{},
+		},
+	}
+	names, err := im.open(reader)
+	if err == errTooLarge {
+		errormessages.WriteErrorMessage(w, err.Error(),
+			http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid zip file",
+			http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to reach database",
+			http.StatusInternalServerError)
+		return
+	}
+	message := "Imported from " + path.Base(multipartHeader.Filename)
+	err = im.run(tx, names, claims.UserID, message)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		tx.Rollback()
+		im.cleanup()
+		if err == errTooLarge {
+			errormessages.WriteErrorMessage(w, err.Error(),
+				http.StatusRequestEntityTooLarge)
+			return
+		}
+		logger.Error("Unable to import course", err)
+		errormessages.WriteErrorMessage(w, "Unable to import files",
+			http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(im.report)
+}
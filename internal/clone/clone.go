@@ -0,0 +1,524 @@
+package clone
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/chromz/wiki-backend/internal/attachment"
+	"github.com/chromz/wiki-backend/internal/course"
+	"github.com/chromz/wiki-backend/internal/grade"
+	"github.com/chromz/wiki-backend/internal/job"
+	"github.com/chromz/wiki-backend/internal/publication"
+	"github.com/chromz/wiki-backend/internal/session"
+	"github.com/chromz/wiki-backend/internal/textclass"
+	"github.com/chromz/wiki-backend/pkg/errormessages"
+	"github.com/chromz/wiki-backend/pkg/log"
+	"github.com/chromz/wiki-backend/pkg/persistence"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var logger = log.GetLogger()
+
+// Request is the body of a clone request, empty fields are copied from
+// the source
+type Request struct {
+	GradeID     int64  `json:"gradeId"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// Result is the result of a finished clone job
+type Result struct {
+	GradeID   int64   `json:"gradeId"`
+	CourseIDs []int64 `json:"courseIds"`
+	ClassIDs  []int64 `json:"classIds"`
+}
+
+type classCopy struct {
+	id       int64
+	newID    int64
+	title    string
+	fileName string
+	baseURI  string
+}
+
+type courseCopy struct {
+	id          int64
+	newID       int64
+	name        string
+	description string
+	classes     []*classCopy
+}
+
+// plan holds everything needed to copy a grade or a list of courses
+type plan struct {
+	srcGradeID  int64
+	dstGradeID  int64
+	newGrade    *grade.Grade
+	courses     []*courseCopy
+	createdDirs []string
+}
+
+func loadClasses(db *sql.DB, c *courseCopy) error {
+	findQuery := `
+		SELECT id, title, file_name, base_uri
+		FROM text_class
+		WHERE course_id = ?
+		ORDER BY id
+	`
+	rows, err := db.Query(findQuery, c.id)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		class := &classCopy{}
+		err = rows.Scan(&class.id, &class.title, &class.fileName,
+			&class.baseURI)
+		if err != nil {
+			return err
+		}
+		c.classes = append(c.classes, class)
+	}
+	return rows.Err()
+}
+
+func loadCourses(db *sql.DB, gradeID, courseID int64) ([]*courseCopy,
+	error) {
+	findQuery := `
+		SELECT id, name, IFNULL(description, '')
+		FROM course
+		WHERE grade_id = ?
+		AND (? = 0 OR id = ?)
+		ORDER BY id
+	`
+	rows, err := db.Query(findQuery, gradeID, courseID, courseID)
+	if err != nil {
+		return nil, err
+	}
+	var courses []*courseCopy
+	for rows.Next() {
+		c := &courseCopy{}
+		err = rows.Scan(&c.id, &c.name, &c.description)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		courses = append(courses, c)
+	}
+	rows.Close()
+	for _, c := range courses {
+		if err = loadClasses(db, c); err != nil {
+			return nil, err
+		}
+	}
+	return courses, nil
+}
+
+func (pl *plan) mkdirs(dirs ...string) error {
+	for _, dir := range dirs {
+		if err := os.Mkdir(dir, 0700); err != nil {
+			return err
+		}
+		pl.createdDirs = append(pl.createdDirs, dir)
+	}
+	return nil
+}
+
+// insert creates the new rows as drafts so students do not see them
+// while the files are being copied, the classes get the tags and the
+// attachment records of their sources
+func (pl *plan) insert(tx *sql.Tx) error {
+	if pl.newGrade != nil {
+		if err := pl.newGrade.Insert(tx); err != nil {
+			return err
+		}
+		pl.dstGradeID = pl.newGrade.ID
+		if err := pl.mkdirs(textclass.Dirs(pl.dstGradeID)); err != nil {
+			return err
+		}
+	}
+	tagsQuery := `
+		INSERT INTO text_class_tag(text_class_id, tag_id)
+		SELECT ?, tag_id
+		FROM text_class_tag
+		WHERE text_class_id = ?
+	`
+	for _, c := range pl.courses {
+		newCourse := &course.Course{
+			GradeID:     pl.dstGradeID,
+			Name:        c.name,
+			Description: c.description,
+			Status:      publication.Draft,
+		}
+		if err := newCourse.Insert(tx); err != nil {
+			return err
+		}
+		c.newID = newCourse.ID
+		err := pl.mkdirs(textclass.Dirs(pl.dstGradeID, c.newID))
+		if err != nil {
+			return err
+		}
+		for _, class := range c.classes {
+			newClass := &textclass.TextClass{
+				CourseID: c.newID,
+				Title:    class.title,
+				Status:   publication.Draft,
+			}
+			if err = newClass.Insert(tx); err != nil {
+				return err
+			}
+			class.newID = newClass.ID
+			_, err = tx.Exec(tagsQuery, class.newID, class.id)
+			if err != nil {
+				return err
+			}
+			err = attachment.Copy(tx, class.id, class.newID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rewriter replaces the urls pointing to the assets of the source class
+func rewriter(srcBaseURI string, srcMid, dstMid string) *strings.Replacer {
+	return strings.NewReplacer(srcBaseURI+srcMid,
+		textclass.BaseURI()+dstMid)
+}
+
+func copyFile(src, dst string, replacer *strings.Replacer) error {
+	extension := strings.ToLower(filepath.Ext(src))
+	if replacer != nil && (extension == ".md" || extension == ".html") {
+		data, err := ioutil.ReadFile(src)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(dst, []byte(replacer.Replace(string(data))),
+			0700)
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0700)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// copyTree copies a directory recursively, text files are rewritten
+// with the replacer
+func copyTree(src, dst string, replacer *strings.Replacer) error {
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		return os.MkdirAll(dst, 0700)
+	}
+	return filepath.Walk(src, func(path string, info os.FileInfo,
+		err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0700)
+		}
+		return copyFile(path, target, replacer)
+	})
+}
+
+func midDir(ids ...int64) string {
+	var dir string
+	for _, id := range ids {
+		dir += strconv.FormatInt(id, 10) + "/"
+	}
+	return dir
+}
+
+// copyClass copies the markdown and assets of a class and points the
+// new row to the copied files. The copy is queued to be processed so its
+// links, search body, outline, readability and front matter are built for
+// the new class
+func (pl *plan) copyClass(c *courseCopy, class *classCopy) error {
+	srcMid := midDir(pl.srcGradeID, c.id, class.id)
+	dstMid := midDir(pl.dstGradeID, c.newID, class.newID)
+	srcDir, srcAssetsDir := textclass.Dirs(pl.srcGradeID, c.id, class.id)
+	dstDir, dstAssetsDir := textclass.Dirs(pl.dstGradeID, c.newID,
+		class.newID)
+	replacer := rewriter(class.baseURI, srcMid, dstMid)
+	if err := copyTree(srcDir, dstDir, replacer); err != nil {
+		return err
+	}
+	pl.createdDirs = append(pl.createdDirs, dstDir)
+	if err := copyTree(srcAssetsDir, dstAssetsDir, replacer); err != nil {
+		return err
+	}
+	pl.createdDirs = append(pl.createdDirs, dstAssetsDir)
+
+	var fileName string
+	if class.fileName != "" {
+		fileName = dstDir + filepath.Base(class.fileName)
+	}
+	updateQuery := `
+		UPDATE text_class
+		SET file_name = ?, proc_file_name = ''
+		WHERE id = ?
+	`
+	db := persistence.GetDb()
+	_, err := db.Exec(updateQuery, fileName, class.newID)
+	return err
+}
+
+func (pl *plan) removeRows() error {
+	db := persistence.GetDb()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if pl.newGrade != nil {
+		err = grade.Remove(tx, pl.newGrade.ID)
+	}
+	for _, c := range pl.courses {
+		if err == nil && pl.newGrade == nil {
+			err = course.Remove(tx, c.newID)
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// rollback removes everything created by a failed clone, rows only
+// need to be deleted once they have been committed
+func (pl *plan) rollback(committed bool) {
+	if committed {
+		if err := pl.removeRows(); err != nil {
+			logger.Error("Unable to remove cloned rows", err)
+		}
+	}
+	for i := len(pl.createdDirs) - 1; i >= 0; i-- {
+		if err := os.RemoveAll(pl.createdDirs[i]); err != nil {
+			logger.Error("Unable to remove cloned directory", err)
+		}
+	}
+}
+
+// steps is the number of progress steps of the clone job, one for the
+// rows and one per class
+func (pl *plan) steps() int {
+	total := 1
+	for _, c := range pl.courses {
+		total += len(c.classes)
+	}
+	return total
+}
+
+func (pl *plan) run(j *job.Job) {
+	db := persistence.GetDb()
+	tx, err := db.Begin()
+	if err != nil {
+		j.Fail(errors.New("Unable to reach database"))
+		return
+	}
+	if err = pl.insert(tx); err != nil {
+		logger.Error("Unable to insert cloned rows", err)
+		tx.Rollback()
+		pl.rollback(false)
+		j.Fail(errors.New("Unable to create cloned resources"))
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		pl.rollback(false)
+		j.Fail(errors.New("Unable to create cloned resources"))
+		return
+	}
+	j.Advance()
+
+	result := &Result{
+		GradeID:   pl.dstGradeID,
+		CourseIDs: []int64{},
+		ClassIDs:  []int64{},
+	}
+	for _, c := range pl.courses {
+		result.CourseIDs = append(result.CourseIDs, c.newID)
+		for _, class := range c.classes {
+			if err = pl.copyClass(c, class); err != nil {
+				logger.Error("Unable to copy class files", err)
+				pl.rollback(true)
+				j.Fail(errors.New("Unable to copy class files"))
+				return
+			}
+			result.ClassIDs = append(result.ClassIDs, class.newID)
+			j.Advance()
+		}
+	}
+	logger.Info("Clone job finished: " + j.ID)
+	j.Finish(result)
+}
+
+func decodeRequest(r *http.Request) (*Request, error) {
+	request := &Request{}
+	if r.ContentLength == 0 {
+		return request, nil
+	}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(request); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// Grade is an endpoint that starts a job copying a grade with all its
+// courses, classes, files and assets into new ids
+func Grade(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	if claims.Role != "TEACHER" {
+		errormessages.WriteErrorInterface(w, "Not enough privileges",
+			http.StatusUnauthorized)
+		return
+	}
+	gradeID, err := strconv.ParseInt(p.ByName("id"), 0, 64)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid id",
+			http.StatusBadRequest)
+		return
+	}
+	request, err := decodeRequest(r)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid body type",
+			http.StatusBadRequest)
+		return
+	}
+
+	db := persistence.GetDb()
+	newGrade := &grade.Grade{}
+	findQuery := `
+		SELECT name, IFNULL(description, '')
+		FROM grade
+		WHERE id = ?
+	`
+	err = db.QueryRow(findQuery, gradeID).Scan(&newGrade.Name,
+		&newGrade.Description)
+	if err == sql.ErrNoRows {
+		errormessages.WriteErrorInterface(w, "Grade does not exists",
+			http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to find grade",
+			http.StatusInternalServerError)
+		return
+	}
+	if request.Name != "" {
+		newGrade.Name = request.Name
+	}
+	if request.Description != "" {
+		newGrade.Description = request.Description
+	}
+	courses, err := loadCourses(db, gradeID, 0)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to find courses",
+			http.StatusInternalServerError)
+		return
+	}
+	pl := &plan{
+		srcGradeID: gradeID,
+		newGrade:   newGrade,
+		courses:    courses,
+	}
+	j := job.New("clone", claims.UserID)
+	j.SetTotal(pl.steps())
+	go pl.run(j)
+	j.Write(w, http.StatusAccepted)
+}
+
+// Course is an endpoint that starts a job copying a course with all its
+// classes, files and assets into new ids, optionally into another grade
+func Course(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	if claims.Role != "TEACHER" {
+		errormessages.WriteErrorInterface(w, "Not enough privileges",
+			http.StatusUnauthorized)
+		return
+	}
+	gradeID, err := strconv.ParseInt(p.ByName("id"), 0, 64)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid id",
+			http.StatusBadRequest)
+		return
+	}
+	courseID, err := strconv.ParseInt(p.ByName("courseid"), 0, 64)
+	if err != nil || courseID <= 0 {
+		errormessages.WriteErrorMessage(w, "Invalid id",
+			http.StatusBadRequest)
+		return
+	}
+	request, err := decodeRequest(r)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid body type",
+			http.StatusBadRequest)
+		return
+	}
+
+	db := persistence.GetDb()
+	courses, err := loadCourses(db, gradeID, courseID)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to find course",
+			http.StatusInternalServerError)
+		return
+	}
+	if len(courses) == 0 {
+		errormessages.WriteErrorInterface(w, "Course does not exists",
+			http.StatusNotFound)
+		return
+	}
+	dstGradeID := gradeID
+	if request.GradeID > 0 {
+		dstGradeID = request.GradeID
+		var exists int
+		existsQuery := `
+			SELECT COUNT(*)
+			FROM grade
+			WHERE id = ?
+		`
+		db.QueryRow(existsQuery, dstGradeID).Scan(&exists)
+		if exists == 0 {
+			errormessages.WriteErrorMessage(w, "Invalid grade id",
+				http.StatusBadRequest)
+			return
+		}
+	}
+	if request.Name != "" {
+		courses[0].name = request.Name
+	}
+	if request.Description != "" {
+		courses[0].description = request.Description
+	}
+	pl := &plan{
+		srcGradeID: gradeID,
+		dstGradeID: dstGradeID,
+		courses:    courses,
+	}
+	j := job.New("clone", claims.UserID)
+	j.SetTotal(pl.steps())
+	go pl.run(j)
+	j.Write(w, http.StatusAccepted)
+}
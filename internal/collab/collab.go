@@ -0,0 +1,594 @@
+package collab
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/chromz/wiki-backend/internal/editlock"
+	"github.com/chromz/wiki-backend/internal/revision"
+	"github.com/chromz/wiki-backend/internal/session"
+	"github.com/chromz/wiki-backend/internal/textclass"
+	"github.com/chromz/wiki-backend/pkg/diff"
+	"github.com/chromz/wiki-backend/pkg/errormessages"
+	"github.com/chromz/wiki-backend/pkg/log"
+	"github.com/chromz/wiki-backend/pkg/ot"
+	"github.com/chromz/wiki-backend/pkg/persistence"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// maxMessageSize is the maximum size of a message sent by a client
+	maxMessageSize = 1 << 20
+	// maxHistory is the number of operations kept to transform late
+	// operations, clients further behind must reconnect
+	maxHistory = 1000
+	// sendBuffer is the number of messages queued for a slow client
+	// before it is disconnected
+	sendBuffer = 256
+	writeWait  = 10 * time.Second
+	pongWait   = 60 * time.Second
+	pingPeriod = pongWait * 9 / 10
+	// checkpointMessage is the message of the revisions created by
+	// collaborative sessions
+	checkpointMessage = "Collaborative edit"
+)
+
+var logger = log.GetLogger()
+
+var checkpointRate = 10 * time.Second
+
+// NewCheckpointRate sets how often the documents being edited are
+// written to their markdown file
+func NewCheckpointRate(ms int) {
+	checkpointRate = time.Millisecond * time.Duration(ms)
+}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	// Sessions are authenticated with a token, not cookies, so any
+	// origin is allowed like in the rest of the api
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// Selection is the cursor of a client, anchor and head are equal when
+// nothing is selected. Positions count unicode code points
+type Selection struct {
+	Anchor int `json:"anchor"`
+	Head   int `json:"head"`
+}
+
+func (s *Selection) transform(op ot.Operation) *Selection {
+	if s == nil {
+		return nil
+	}
+	return &Selection{
+		Anchor: op.TransformIndex(s.Anchor),
+		Head:   op.TransformIndex(s.Head),
+	}
+}
+
+// Participant is a client connected to a document
+type Participant struct {
+	ClientID  string     `json:"clientId"`
+	UserID    string     `json:"userId"`
+	Username  string     `json:"username"`
+	Selection *Selection `json:"selection"`
+}
+
+// message is sent in both directions, the type tells which fields are
+// used:
+//
+//	op: an operation based on a revision, acknowledged with ack
+//	selection: the cursor of a participant
+//	join and leave: participants connecting and disconnecting
+//	saved: the document was written to the markdown file
+//	error: the last message was rejected, or the session ended because
+//	the class was checked out by someone else
+type message struct {
+	Type        string       `json:"type"`
+	ClientID    string       `json:"clientId,omitempty"`
+	Revision    *int         `json:"revision,omitempty"`
+	Operation   ot.Operation `json:"operation,omitempty"`
+	Selection   *Selection   `json:"selection,omitempty"`
+	Participant *Participant `json:"participant,omitempty"`
+	Hash        string       `json:"hash,omitempty"`
+	Message     string       `json:"message,omitempty"`
+}
+
+// initMessage is the first message of a session, it has the document and
+// who else is editing it
+type initMessage struct {
+	Type         string         `json:"type"`
+	ClientID     string         `json:"clientId"`
+	Revision     int            `json:"revision"`
+	Content      string         `json:"content"`
+	Participants []*Participant `json:"participants"`
+}
+
+type client struct {
+	participant *Participant
+	conn        *websocket.Conn
+	send        chan []byte
+	doc         *document
+}
+
+// document is the shared state of a class being edited
+type document struct {
+	classID int64
+	mutex   sync.Mutex
+	content []rune
+	// history holds the operations from revision first onwards
+	history []ot.Operation
+	first   int
+	clients map[*client]bool
+	closed  bool
+	// saved is the content and revision last written to or read from
+	// the markdown file, external changes are merged against it
+	savedContent  string
+	savedHash     string
+	savedRevision int
+	lastAuthor    string
+	// evicted is set when the class is checked out by a user outside of
+	// the session, nothing else is written and the clients are dropped
+	evicted bool
+}
+
+// evictedMessage tells the clients why their session ended
+const evictedMessage = "Class is checked out by another user, the " +
+	"changes since the last save were not stored"
+
+var documentsMutex sync.Mutex
+var documents = make(map[int64]*document)
+
+func (d *document) revision() int {
+	return d.first + len(d.history)
+}
+
+func (d *document) broadcast(msg *message, except *client) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		logger.Error("Unable to encode message", err)
+		return
+	}
+	for c := range d.clients {
+		if c != except {
+			c.queue(data)
+		}
+	}
+}
+
+// queue sends data to a client, clients that fall too far behind are
+// disconnected instead of blocking the document
+func (c *client) queue(data []byte) {
+	select {
+	case c.send <- data:
+	default:
+		c.conn.Close()
+	}
+}
+
+func (c *client) sendMessage(msg interface{}) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		logger.Error("Unable to encode message", err)
+		return
+	}
+	c.queue(data)
+}
+
+// open returns the document of a class, loading it from its markdown
+// file when nobody is editing it
+func open(classID int64) (*document, error) {
+	documentsMutex.Lock()
+	defer documentsMutex.Unlock()
+	if doc, ok := documents[classID]; ok {
+		doc.mutex.Lock()
+		evicted := doc.evicted
+		doc.mutex.Unlock()
+		if !evicted {
+			return doc, nil
+		}
+	}
+	content, err := textclass.LoadMarkdown(classID)
+	if err != nil {
+		return nil, err
+	}
+	doc := &document{
+		classID:      classID,
+		content:      []rune(string(content)),
+		clients:      make(map[*client]bool),
+		savedContent: string(content),
+		savedHash:    revision.Hash(content),
+	}
+	documents[classID] = doc
+	go doc.run()
+	return doc, nil
+}
+
+func (d *document) join(c *client) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed || d.evicted {
+		return false
+	}
+	participants := []*Participant{}
+	for other := range d.clients {
+		participants = append(participants, other.participant)
+	}
+	d.clients[c] = true
+	c.sendMessage(&initMessage{
+		Type:         "init",
+		ClientID:     c.participant.ClientID,
+		Revision:     d.revision(),
+		Content:      string(d.content),
+		Participants: participants,
+	})
+	d.broadcast(&message{Type: "join", Participant: c.participant}, c)
+	return true
+}
+
+// leave removes a client, the last one to leave closes the document
+// after writing it to its markdown file
+func (d *document) leave(c *client) {
+	documentsMutex.Lock()
+	d.mutex.Lock()
+	delete(d.clients, c)
+	close(c.send)
+	d.broadcast(&message{
+		Type:     "leave",
+		ClientID: c.participant.ClientID,
+	}, nil)
+	last := len(d.clients) == 0
+	if last {
+		d.closed = true
+		if documents[d.classID] == d {
+			delete(documents, d.classID)
+		}
+	}
+	d.mutex.Unlock()
+	documentsMutex.Unlock()
+	if last {
+		d.checkpoint()
+	}
+}
+
+// receive applies an operation of a client, operations based on an older
+// revision are transformed against the ones applied since
+func (d *document) receive(c *client, base int, op ot.Operation,
+	selection *Selection) string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.evicted {
+		return evictedMessage
+	}
+	if base < d.first || base > d.revision() {
+		return "Revision is too old, reconnect to continue"
+	}
+	var err error
+	for _, concurrent := range d.history[base-d.first:] {
+		op, _, err = ot.Transform(op, concurrent)
+		if err != nil {
+			return "Invalid operation"
+		}
+	}
+	content, err := op.Apply(d.content)
+	if err != nil {
+		return "Invalid operation"
+	}
+	d.apply(content, op)
+	d.lastAuthor = c.participant.UserID
+	c.participant.Selection = selection
+	rev := d.revision()
+	c.sendMessage(&message{Type: "ack", Revision: &rev})
+	d.broadcast(&message{
+		Type:      "op",
+		ClientID:  c.participant.ClientID,
+		Revision:  &rev,
+		Operation: op,
+		Selection: selection,
+	}, c)
+	return ""
+}
+
+// apply stores an operation already applied to content and moves the
+// cursors of every participant
+func (d *document) apply(content []rune, op ot.Operation) {
+	d.content = content
+	d.history = append(d.history, op)
+	for other := range d.clients {
+		other.participant.Selection = other.participant.Selection.transform(op)
+	}
+	keep := d.revision() - maxHistory
+	if keep > d.savedRevision {
+		keep = d.savedRevision
+	}
+	if keep > d.first {
+		d.history = append([]ot.Operation(nil), d.history[keep-d.first:]...)
+		d.first = keep
+	}
+}
+
+func (d *document) selection(c *client, selection *Selection) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	c.participant.Selection = selection
+	d.broadcast(&message{
+		Type:      "selection",
+		ClientID:  c.participant.ClientID,
+		Selection: selection,
+	}, c)
+}
+
+// run writes the document periodically until it is closed
+func (d *document) run() {
+	ticker := time.NewTicker(checkpointRate)
+	defer ticker.Stop()
+	for range ticker.C {
+		d.mutex.Lock()
+		closed := d.closed
+		d.mutex.Unlock()
+		if closed {
+			return
+		}
+		d.checkpoint()
+	}
+}
+
+// checkpoint writes the document to the markdown file of the class as a
+// new revision. Changes made to the file outside of the session since
+// the last checkpoint are merged into the document first
+func (d *document) checkpoint() {
+	unlock := revision.Lock(d.classID)
+	defer unlock()
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.evicted {
+		return
+	}
+	current, err := textclass.LoadMarkdown(d.classID)
+	if err == sql.ErrNoRows {
+		return
+	}
+	if err != nil {
+		logger.Error("Unable to read class markdown", err)
+		return
+	}
+	currentHash := revision.Hash(current)
+	if currentHash != d.savedHash {
+		if err = d.merge(string(current)); err != nil {
+			logger.Error("Unable to merge class markdown", err)
+			return
+		}
+	}
+	content := []byte(string(d.content))
+	hash := revision.Hash(content)
+	if hash != currentHash {
+		_, err = textclass.SaveMarkdown(d.classID, d.lastAuthor,
+			checkpointMessage, content)
+		// The class may have been checked out since the session started
+		if _, locked := err.(*editlock.LockedError); locked {
+			d.evict()
+			return
+		}
+		if err != nil {
+			logger.Error("Unable to save class markdown", err)
+			return
+		}
+		rev := d.revision()
+		d.broadcast(&message{Type: "saved", Revision: &rev, Hash: hash},
+			nil)
+	}
+	d.savedContent = string(d.content)
+	d.savedHash = hash
+	d.savedRevision = d.revision()
+}
+
+// evict ends the session after the class was checked out by someone
+// else. The clients get an error and their connections are read no more,
+// so they leave and the document is closed
+func (d *document) evict() {
+	d.evicted = true
+	d.broadcast(&message{Type: "error", Message: evictedMessage}, nil)
+	for c := range d.clients {
+		c.conn.SetReadDeadline(time.Now())
+	}
+}
+
+// merge applies the changes made to the markdown file since the last
+// checkpoint as an operation of the server
+func (d *document) merge(external string) error {
+	op := lineOperation(d.savedContent, external)
+	var err error
+	for _, concurrent := range d.history[d.savedRevision-d.first:] {
+		op, _, err = ot.Transform(op, concurrent)
+		if err != nil {
+			return err
+		}
+	}
+	content, err := op.Apply(d.content)
+	if err != nil {
+		return err
+	}
+	d.apply(content, op)
+	rev := d.revision()
+	d.broadcast(&message{Type: "op", Revision: &rev, Operation: op}, nil)
+	return nil
+}
+
+// lineOperation builds an operation turning from into to out of their
+// line diff
+func lineOperation(from, to string) ot.Operation {
+	var op ot.Operation
+	lines := diff.Lines(strings.SplitAfter(from, "\n"),
+		strings.SplitAfter(to, "\n"))
+	for _, line := range lines {
+		switch line.Op {
+		case diff.Equal:
+			op = op.Retain(utf8.RuneCountInString(line.Text))
+		case diff.Delete:
+			op = op.Delete(utf8.RuneCountInString(line.Text))
+		case diff.Insert:
+			op = op.Insert(line.Text)
+		}
+	}
+	return op
+}
+
+// readPump reads the messages of a client until it disconnects, leaving
+// closes the send queue and writePump closes the connection once the
+// queued messages are written
+func (c *client) readPump() {
+	defer c.doc.leave(c)
+	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		c.doc.mutex.Lock()
+		evicted := c.doc.evicted
+		c.doc.mutex.Unlock()
+		if evicted {
+			return nil
+		}
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		msg := &message{}
+		if err = json.Unmarshal(data, msg); err != nil {
+			c.sendMessage(&message{Type: "error",
+				Message: "Invalid message"})
+			continue
+		}
+		switch msg.Type {
+		case "op":
+			if msg.Revision == nil {
+				c.sendMessage(&message{Type: "error",
+					Message: "Missing revision"})
+				continue
+			}
+			errString := c.doc.receive(c, *msg.Revision, msg.Operation,
+				msg.Selection)
+			if errString != "" {
+				c.sendMessage(&message{Type: "error",
+					Message: errString})
+			}
+		case "selection":
+			c.doc.selection(c, msg.Selection)
+		default:
+			c.sendMessage(&message{Type: "error",
+				Message: "Unknown message type"})
+		}
+	}
+}
+
+func (c *client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+	for {
+		select {
+		case data, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			err := c.conn.WriteMessage(websocket.TextMessage, data)
+			if err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			err := c.conn.WriteMessage(websocket.PingMessage, nil)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Connect is the WebSocket endpoint to edit the markdown of a text class
+// together with other teachers
+func Connect(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	if claims.Role != "TEACHER" {
+		errormessages.WriteErrorInterface(w, "Not enough privileges",
+			http.StatusUnauthorized)
+		return
+	}
+	classID, err := strconv.ParseInt(p.ByName("classid"), 0, 64)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid id",
+			http.StatusBadRequest)
+		return
+	}
+	db := persistence.GetDb()
+	var username string
+	userQuery := `
+		SELECT username
+		FROM user
+		WHERE id = ?
+	`
+	err = db.QueryRow(userQuery, claims.UserID).Scan(&username)
+	if err != nil && err != sql.ErrNoRows {
+		errormessages.WriteErrorMessage(w, "Unable to fetch user",
+			http.StatusInternalServerError)
+		return
+	}
+	if !editlock.Allow(w, db, classID, claims.UserID) {
+		return
+	}
+	_, err = textclass.LoadMarkdown(classID)
+	if err == sql.ErrNoRows {
+		errormessages.WriteErrorInterface(w, "Class does not exists",
+			http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to open class",
+			http.StatusInternalServerError)
+		return
+	}
+	w.Header().Del("Content-Type")
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Error("Unable to upgrade connection", err)
+		return
+	}
+	c := &client{
+		participant: &Participant{
+			ClientID: uuid.New().String(),
+			UserID:   claims.UserID,
+			Username: username,
+		},
+		conn: conn,
+		send: make(chan []byte, sendBuffer),
+	}
+	// The document may close between opening and joining when its last
+	// participant leaves, a new one is opened then
+	for {
+		c.doc, err = open(classID)
+		if err != nil {
+			logger.Error("Unable to open class", err)
+			conn.Close()
+			return
+		}
+		if c.doc.join(c) {
+			break
+		}
+	}
+	go c.writePump()
+	c.readPump()
+}
@@ -1,10 +1,14 @@
 package course
 
 import (
+	"database/sql"
 	"encoding/json"
 	"errors"
+	"github.com/chromz/wiki-backend/internal/permalink"
+	"github.com/chromz/wiki-backend/internal/publication"
 	"github.com/chromz/wiki-backend/internal/session"
 	"github.com/chromz/wiki-backend/internal/textclass"
+	"github.com/chromz/wiki-backend/internal/wikilink"
 	"github.com/chromz/wiki-backend/pkg/errormessages"
 	"github.com/chromz/wiki-backend/pkg/pagination"
 	"github.com/chromz/wiki-backend/pkg/persistence"
@@ -13,6 +17,7 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"time"
 )
 
 // CourseDDL is the query to create the clasroom table
@@ -22,16 +27,37 @@ CREATE TABLE IF NOT EXISTS "classroom" (
 	"grade_id"	INTEGER NOT NULL,
 	"name"	TEXT NOT NULL,
 	"description"	TEXT,
+	"status"	TEXT NOT NULL DEFAULT 'published',
+	"publish_at"	INTEGER,
+	"unpublish_at"	INTEGER,
+	"slug"	TEXT NOT NULL DEFAULT '',
 	FOREIGN KEY("grade_id") REFERENCES "grade"("id") ON DELETE CASCADE
 );
 `
 
 // Course struct that represents a course in a grade
 type Course struct {
-	ID          int64  `json:"id"`
-	GradeID     int64  `json:"gradeId"`
-	Name        string `json:"name"`
-	Description string `json:"description"`
+	ID          int64      `json:"id"`
+	GradeID     int64      `json:"gradeId"`
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	Status      string     `json:"status"`
+	PublishAt   *time.Time `json:"publishAt"`
+	UnpublishAt *time.Time `json:"unpublishAt"`
+	Slug        string     `json:"slug"`
+	schedule    publication.Schedule
+}
+
+// UnmarshalJSON reads a course and remembers which publishing dates the
+// body sets, so updates leave the missing ones unchanged
+func (c *Course) UnmarshalJSON(data []byte) error {
+	type plain Course
+	if err := json.Unmarshal(data, (*plain)(c)); err != nil {
+		return err
+	}
+	var err error
+	c.schedule, err = publication.ReadSchedule(data)
+	return err
 }
 
 // Validate validates the integrity of Course
@@ -42,8 +68,103 @@ func (c *Course) Validate() error {
 	if c.GradeID <= 0 {
 		return errors.New("Invalid grade id")
 	}
-	return nil
+	return publication.ValidateSchedule(c.Status, c.PublishAt,
+		c.UnpublishAt)
+
+}
+
+// Insert adds the course to the database inside a transaction
+func (c *Course) Insert(tx *sql.Tx) error {
+	var err error
+	c.Slug, err = permalink.Course.Unique(tx, c.GradeID, 0, c.Name)
+	if err != nil {
+		return err
+	}
+	insertQuery := `
+		INSERT INTO course(grade_id, name, description, status,
+		publish_at, unpublish_at, slug)
+		VALUES(?, ?, ?, ?, ?, ?, ?)
+	`
+	res, err := tx.Exec(insertQuery, c.GradeID, c.Name, c.Description,
+		c.Status, publication.Unix(c.PublishAt),
+		publication.Unix(c.UnpublishAt), c.Slug)
+	if err != nil {
+		return err
+	}
+	c.ID, err = res.LastInsertId()
+	return err
+}
+
+// Save updates the course inside a transaction, it returns sql.ErrNoRows
+// when the course does not exist. The old slug redirects to the course
+// when the name changes, the status and the publishing dates are only
+// changed when they are given
+func (c *Course) Save(tx *sql.Tx) error {
+	var oldSlug string
+	findQuery := `
+		SELECT grade_id, slug
+		FROM course
+		WHERE id = ?
+	`
+	err := tx.QueryRow(findQuery, c.ID).Scan(&c.GradeID, &oldSlug)
+	if err != nil {
+		return err
+	}
+	c.Slug, err = permalink.Course.Unique(tx, c.GradeID, c.ID, c.Name)
+	if err != nil {
+		return err
+	}
+	updateQuery := `
+		UPDATE course
+		SET name = ?, description = ?,
+		status = COALESCE(NULLIF(?, ''), status),
+		publish_at = CASE WHEN ? THEN ? ELSE publish_at END,
+		unpublish_at = CASE WHEN ? THEN ? ELSE unpublish_at END,
+		slug = ?
+		WHERE id = ?
+	`
+	_, err = tx.Exec(updateQuery, c.Name, c.Description, c.Status,
+		c.schedule.PublishAt, publication.Unix(c.PublishAt),
+		c.schedule.UnpublishAt, publication.Unix(c.UnpublishAt), c.Slug,
+		c.ID)
+	if err != nil {
+		return err
+	}
+	var publishAt, unpublishAt sql.NullInt64
+	findQuery = `
+		SELECT status, publish_at, unpublish_at
+		FROM course
+		WHERE id = ?
+	`
+	err = tx.QueryRow(findQuery, c.ID).Scan(&c.Status, &publishAt,
+		&unpublishAt)
+	if err != nil {
+		return err
+	}
+	c.PublishAt = publication.Time(publishAt)
+	c.UnpublishAt = publication.Time(unpublishAt)
+	err = permalink.Course.Rename(tx, c.GradeID, c.ID, oldSlug, c.Slug)
+	if err != nil || c.Slug == oldSlug {
+		return err
+	}
+	return wikilink.Relink(tx, c.ID, c.Slug)
+}
 
+// Remove deletes a course inside a transaction, it returns sql.ErrNoRows
+// when the course does not exist
+func Remove(tx *sql.Tx, courseID int64) error {
+	deleteQuery := `
+		DELETE FROM course
+		WHERE id = ?
+	`
+	res, err := tx.Exec(deleteQuery, courseID)
+	if err != nil {
+		return err
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected != 1 {
+		return sql.ErrNoRows
+	}
+	return nil
 }
 
 // Create is an endpoint to create a course
@@ -71,6 +192,9 @@ func Create(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 
 	}
 	course.GradeID = gradeID
+	if course.Status == "" {
+		course.Status = publication.Draft
+	}
 	if err = course.Validate(); err != nil {
 		errormessages.WriteErrorMessage(w, "Invalid course data",
 			http.StatusBadRequest)
@@ -85,12 +209,7 @@ func Create(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		return
 	}
 
-	insertQuery := `
-		INSERT INTO course(grade_id, name, description)
-		VALUES(?, ?, ?)
-	`
-	res, err := tx.Exec(insertQuery, course.GradeID, course.Name,
-		course.Description)
+	err = course.Insert(tx)
 	if err != nil {
 		if sqliteErr, ok := err.(sqlite3.Error); ok {
 			if sqliteErr.ExtendedCode == sqlite3.ErrConstraintForeignKey {
@@ -106,7 +225,6 @@ func Create(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		tx.Rollback()
 		return
 	}
-	course.ID, _ = res.LastInsertId()
 	dirName := textclass.SyncDir() +
 		strconv.FormatInt(gradeID, 10) + "/" +
 		strconv.FormatInt(course.ID, 10) + "/"
@@ -137,8 +255,10 @@ func Create(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	json.NewEncoder(w).Encode(course)
 }
 
-// Read returns available courses, paginated
+// Read returns available courses, paginated, unpublished courses are only
+// listed for teachers
 func Read(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
 	params := r.URL.Query()
 
 	gradeID, err := strconv.ParseInt(p.ByName("id"), 0, 64)
@@ -172,14 +292,17 @@ func Read(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 
 	db := persistence.GetDb()
 	findQuery := `
-		SELECT id, grade_id, name, description
+		SELECT id, grade_id, name, description, status, publish_at,
+		unpublish_at, slug
 		FROM course
 		WHERE id > ?
 		AND grade_id = ?
+		AND (` + publication.RoleFilter + ` OR status = 'published')
 		LIMIT ?
 	`
 
-	rows, err := db.Query(findQuery, page.NextToken, gradeID, page.Size)
+	rows, err := db.Query(findQuery, page.NextToken, gradeID, claims.Role,
+		page.Size)
 	if err != nil {
 		errormessages.WriteErrorMessage(w, "Unable to find courses",
 			http.StatusInternalServerError)
@@ -189,14 +312,18 @@ func Read(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	var courses []Course
 	for rows.Next() {
 		course := Course{}
+		var publishAt, unpublishAt sql.NullInt64
 		err = rows.Scan(&course.ID, &course.GradeID,
-			&course.Name, &course.Description)
+			&course.Name, &course.Description, &course.Status,
+			&publishAt, &unpublishAt, &course.Slug)
 		if err != nil {
 			errormessages.WriteErrorMessage(w,
 				"Unable to find courses",
 				http.StatusInternalServerError)
 			return
 		}
+		course.PublishAt = publication.Time(publishAt)
+		course.UnpublishAt = publication.Time(unpublishAt)
 		courses = append(courses, course)
 	}
 	page.Data = courses
@@ -210,6 +337,55 @@ func Read(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	json.NewEncoder(w).Encode(page)
 }
 
+// ReadBySlug returns a course by its grade and course slugs, old slugs
+// redirect to the current ones
+func ReadBySlug(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	db := persistence.GetDb()
+	ids, slugs, redirected, err := permalink.ResolvePath(db,
+		p.ByName("grade"), p.ByName("course"))
+	if err == sql.ErrNoRows {
+		errormessages.WriteErrorInterface(w, "Course does not exists",
+			http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to find course",
+			http.StatusInternalServerError)
+		return
+	}
+	if redirected {
+		permalink.Redirect(w, r, slugs)
+		return
+	}
+	course := &Course{}
+	var publishAt, unpublishAt sql.NullInt64
+	findQuery := `
+		SELECT id, grade_id, name, IFNULL(description, ''), status,
+		publish_at, unpublish_at, slug
+		FROM course
+		WHERE id = ?
+		AND (` + publication.RoleFilter + ` OR status = 'published')
+	`
+	err = db.QueryRow(findQuery, ids[1], claims.Role).Scan(&course.ID,
+		&course.GradeID, &course.Name, &course.Description,
+		&course.Status, &publishAt, &unpublishAt, &course.Slug)
+	if err == sql.ErrNoRows {
+		errormessages.WriteErrorInterface(w, "Course does not exists",
+			http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to find course",
+			http.StatusInternalServerError)
+		return
+	}
+	course.PublishAt = publication.Time(publishAt)
+	course.UnpublishAt = publication.Time(unpublishAt)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(course)
+}
+
 // Update updates a course resource
 func Update(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
@@ -257,23 +433,31 @@ func Update(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	}
 
 	db := persistence.GetDb()
-	updateQuery := `
-		UPDATE course
-		SET name = ?, description = ?
-		WHERE id = ?
-	`
-	res, err := db.Exec(updateQuery, course.Name, course.Description,
-		course.ID)
-	rowsAffected, _ := res.RowsAffected()
-	if rowsAffected != 1 {
+	tx, err := db.Begin()
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to reach database",
+			http.StatusInternalServerError)
+		return
+	}
+	err = course.Save(tx)
+	if err == sql.ErrNoRows {
 		errormessages.WriteErrorInterface(w, "Id not found",
 			http.StatusNotFound)
+		tx.Rollback()
 		return
-
 	}
 	if err != nil {
 		errormessages.WriteErrorInterface(w, "Unable to update course",
 			http.StatusInternalServerError)
+		tx.Rollback()
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		errString := "Unable to update course"
+		errormessages.WriteErrorMessage(w, errString,
+			http.StatusInternalServerError)
+		tx.Rollback()
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
@@ -0,0 +1,323 @@
+package editlock
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/chromz/wiki-backend/internal/session"
+	"github.com/chromz/wiki-backend/pkg/errormessages"
+	"github.com/chromz/wiki-backend/pkg/persistence"
+	"github.com/julienschmidt/httprouter"
+	"github.com/mattn/go-sqlite3"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// LockDDL is the query to create the table of checked out text classes
+const LockDDL = `
+CREATE TABLE IF NOT EXISTS "edit_lock" (
+	"text_class_id"	INTEGER NOT NULL PRIMARY KEY,
+	"holder_id"	TEXT NOT NULL,
+	"acquired_at"	INTEGER NOT NULL,
+	"expires_at"	INTEGER NOT NULL,
+	FOREIGN KEY("text_class_id") REFERENCES "text_class"("id") ON DELETE CASCADE
+);
+`
+
+var ttl = 5 * time.Minute
+
+// NewTTL sets how long a lock lasts without a heartbeat
+func NewTTL(ms int) {
+	ttl = time.Millisecond * time.Duration(ms)
+}
+
+// Lock is the check out of a text class by a teacher
+type Lock struct {
+	ClassID    int64     `json:"classId"`
+	HolderID   string    `json:"holderId"`
+	Holder     string    `json:"holder"`
+	AcquiredAt time.Time `json:"acquiredAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+type lockedMessage struct {
+	Message string `json:"message"`
+	Lock    *Lock  `json:"lock"`
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx
+type queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Find returns the lock of a class, expired locks are not returned
+func Find(q queryer, classID int64) (*Lock, error) {
+	findQuery := `
+		SELECT text_class_id, holder_id, IFNULL(user.username, ''),
+		acquired_at, expires_at
+		FROM edit_lock
+		LEFT JOIN user ON user.id = edit_lock.holder_id
+		WHERE text_class_id = ?
+		AND expires_at > ?
+	`
+	lock := &Lock{}
+	var acquiredAt, expiresAt int64
+	err := q.QueryRow(findQuery, classID, time.Now().Unix()).Scan(
+		&lock.ClassID, &lock.HolderID, &lock.Holder, &acquiredAt,
+		&expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	lock.AcquiredAt = time.Unix(acquiredAt, 0).UTC()
+	lock.ExpiresAt = time.Unix(expiresAt, 0).UTC()
+	return lock, nil
+}
+
+// Check returns the lock of a class when it is held by someone other
+// than the user, nil means the user may edit the class
+func Check(q queryer, classID int64, userID string) (*Lock, error) {
+	lock, err := Find(q, classID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if lock.HolderID == userID {
+		return nil, nil
+	}
+	return lock, nil
+}
+
+// LockedError is returned by the writes of a class that is checked out
+// by someone else
+type LockedError struct {
+	Lock *Lock
+}
+
+func (e *LockedError) Error() string {
+	return "Class is checked out by another user"
+}
+
+// Guard is called by every write of a class, it returns a *LockedError
+// when the class is checked out by someone other than the user
+func Guard(q queryer, classID int64, userID string) error {
+	lock, err := Check(q, classID, userID)
+	if err != nil {
+		return err
+	}
+	if lock != nil {
+		return &LockedError{Lock: lock}
+	}
+	return nil
+}
+
+// WriteLocked responds that the class is checked out by someone else
+func WriteLocked(w http.ResponseWriter, lock *Lock) {
+	errormessages.WriteErrorInterface(w, &lockedMessage{
+		Message: "Class is checked out by another user",
+		Lock:    lock,
+	}, http.StatusLocked)
+}
+
+// WriteError writes the response of a *LockedError, it returns false and
+// writes nothing for any other error
+func WriteError(w http.ResponseWriter, err error) bool {
+	locked, ok := err.(*LockedError)
+	if ok {
+		WriteLocked(w, locked.Lock)
+	}
+	return ok
+}
+
+// Allow checks the lock of a class before changing it and writes the
+// response when the user can not, it returns whether the change may go on
+func Allow(w http.ResponseWriter, q queryer, classID int64,
+	userID string) bool {
+	err := Guard(q, classID, userID)
+	if err != nil && !WriteError(w, err) {
+		errormessages.WriteErrorMessage(w, "Unable to check class lock",
+			http.StatusInternalServerError)
+	}
+	return err == nil
+}
+
+func teacherOnly(w http.ResponseWriter, r *http.Request) bool {
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	if claims.Role != "TEACHER" {
+		errormessages.WriteErrorInterface(w, "Not enough privileges",
+			http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func parseClassID(w http.ResponseWriter, p httprouter.Params) (int64, bool) {
+	classID, err := strconv.ParseInt(p.ByName("classid"), 0, 64)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid id",
+			http.StatusBadRequest)
+		return 0, false
+	}
+	return classID, true
+}
+
+// Read returns the current lock of a text class
+func Read(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	classID, ok := parseClassID(w, p)
+	if !ok {
+		return
+	}
+	lock, err := Find(persistence.GetDb(), classID)
+	if err == sql.ErrNoRows {
+		errormessages.WriteErrorInterface(w, "Class is not checked out",
+			http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to find lock",
+			http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(lock)
+}
+
+// Acquire is an endpoint to check out a text class, checking out a class
+// already held by the same user renews the lock
+func Acquire(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if !teacherOnly(w, r) {
+		return
+	}
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	classID, ok := parseClassID(w, p)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	db := persistence.GetDb()
+	upsertQuery := `
+		INSERT INTO edit_lock(text_class_id, holder_id, acquired_at,
+		expires_at)
+		VALUES(?, ?, ?, ?)
+		ON CONFLICT(text_class_id) DO UPDATE
+		SET acquired_at = CASE
+			WHEN holder_id = excluded.holder_id
+			THEN acquired_at
+			ELSE excluded.acquired_at
+		END,
+		holder_id = excluded.holder_id,
+		expires_at = excluded.expires_at
+		WHERE holder_id = excluded.holder_id
+		OR expires_at <= excluded.acquired_at
+	`
+	_, err := db.Exec(upsertQuery, classID, claims.UserID, now.Unix(),
+		now.Add(ttl).Unix())
+	if sqliteErr, ok := err.(sqlite3.Error); ok &&
+		sqliteErr.Code == sqlite3.ErrConstraint {
+		errormessages.WriteErrorInterface(w, "Class does not exists",
+			http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to check out class",
+			http.StatusInternalServerError)
+		return
+	}
+	lock, err := Find(db, classID)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to check out class",
+			http.StatusInternalServerError)
+		return
+	}
+	if lock.HolderID != claims.UserID {
+		WriteLocked(w, lock)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(lock)
+}
+
+// Renew is the heartbeat endpoint that extends a lock held by the user
+func Renew(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if !teacherOnly(w, r) {
+		return
+	}
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	classID, ok := parseClassID(w, p)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	db := persistence.GetDb()
+	updateQuery := `
+		UPDATE edit_lock
+		SET expires_at = ?
+		WHERE text_class_id = ?
+		AND holder_id = ?
+		AND expires_at > ?
+	`
+	res, err := db.Exec(updateQuery, now.Add(ttl).Unix(), classID,
+		claims.UserID, now.Unix())
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to renew lock",
+			http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected != 1 {
+		lock, err := Check(db, classID, claims.UserID)
+		if err == nil && lock != nil {
+			WriteLocked(w, lock)
+			return
+		}
+		errormessages.WriteErrorInterface(w,
+			"The lock expired, check out the class again",
+			http.StatusConflict)
+		return
+	}
+	lock, err := Find(db, classID)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to renew lock",
+			http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(lock)
+}
+
+// Release is an endpoint to check in a text class. Admins can break the
+// lock of another user with the force parameter
+func Release(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	force := r.URL.Query().Get("force") == "true"
+	if force && claims.Role != session.AdminRole {
+		errormessages.WriteErrorInterface(w, "Not enough privileges",
+			http.StatusUnauthorized)
+		return
+	}
+	if !force && !teacherOnly(w, r) {
+		return
+	}
+	classID, ok := parseClassID(w, p)
+	if !ok {
+		return
+	}
+	db := persistence.GetDb()
+	if !force && !Allow(w, db, classID, claims.UserID) {
+		return
+	}
+	deleteQuery := `
+		DELETE FROM edit_lock
+		WHERE text_class_id = ?
+		AND (? OR holder_id = ? OR expires_at <= ?)
+	`
+	_, err := db.Exec(deleteQuery, classID, force, claims.UserID,
+		time.Now().Unix())
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to check in class",
+			http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
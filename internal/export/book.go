@@ -0,0 +1,395 @@
+package export
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/chromz/wiki-backend/internal/job"
+	"github.com/chromz/wiki-backend/internal/publication"
+	"github.com/chromz/wiki-backend/internal/session"
+	"github.com/chromz/wiki-backend/internal/textclass"
+	"github.com/chromz/wiki-backend/pkg/errormessages"
+	"github.com/chromz/wiki-backend/pkg/markdown"
+	"github.com/google/uuid"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// bookVersion identifies the output of the book writers, it must change
+// whenever they change so cached books are discarded
+const bookVersion = "2"
+
+// bookPrefix starts the names of the cached books
+const bookPrefix = "course_"
+
+// bookFormat writes a course as a book or as a package for an LMS,
+// packages are only for teachers
+type bookFormat struct {
+	contentType string
+	extension   string
+	write       func(col *collection, w io.Writer) error
+	teachers    bool
+}
+
+var bookFormats = map[string]bookFormat{
+	"epub": {contentType: "application/epub+zip", extension: "epub",
+		write: writeEPUB},
+	"pdf": {contentType: "application/pdf", extension: "pdf",
+		write: writePDF},
+	"imscc": {contentType: "application/vnd.ims.imsccv1p1",
+		extension: "imscc", write: writeCartridge, teachers: true},
+	"scorm": {contentType: "application/zip", extension: "zip",
+		write: writeSCORM, teachers: true},
+}
+
+// courseUUID identifies the books of a course, it does not change between
+// exports so readers and platforms can recognize updated copies
+func courseUUID(c *course) string {
+	return uuid.NewSHA1(uuid.NameSpaceURL, []byte(textclass.BaseURI()+
+		"course/"+strconv.FormatInt(c.id, 10))).String()
+}
+
+// chapter is a rendered class of a book
+type chapter struct {
+	class *class
+	nodes []*html.Node
+}
+
+// chapters renders the classes of a course, a heading with the title is
+// added to the classes that do not start with one
+func chapters(c *course) ([]*chapter, error) {
+	var result []*chapter
+	for _, cl := range c.classes {
+		content, err := cl.content()
+		if err != nil {
+			return nil, err
+		}
+		rendered, err := markdown.Render(content)
+		if err != nil {
+			return nil, err
+		}
+		body := &html.Node{
+			Type:     html.ElementNode,
+			Data:     "body",
+			DataAtom: atom.Body,
+		}
+		nodes, err := html.ParseFragment(strings.NewReader(string(rendered)),
+			body)
+		if err != nil {
+			return nil, err
+		}
+		if !startsWithHeading(nodes) {
+			title := &html.Node{Type: html.ElementNode, Data: "h1",
+				DataAtom: atom.H1}
+			title.AppendChild(&html.Node{Type: html.TextNode, Data: cl.title})
+			nodes = append([]*html.Node{title}, nodes...)
+		}
+		result = append(result, &chapter{class: cl, nodes: nodes})
+	}
+	return result, nil
+}
+
+func startsWithHeading(nodes []*html.Node) bool {
+	for _, n := range nodes {
+		if n.Type == html.TextNode && strings.TrimSpace(n.Data) == "" {
+			continue
+		}
+		_, ok := headingLevels[n.DataAtom]
+		return ok
+	}
+	return false
+}
+
+var headingLevels = map[atom.Atom]int{
+	atom.H1: 1, atom.H2: 2, atom.H3: 3, atom.H4: 4, atom.H5: 5, atom.H6: 6,
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// textContent returns the text of a node and its descendants
+func textContent(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var builder strings.Builder
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		builder.WriteString(textContent(child))
+	}
+	return builder.String()
+}
+
+// localAsset returns the file of an asset served by the wiki, images of
+// other sites are not embedded
+func localAsset(cl *class, src string) (string, bool) {
+	for _, uri := range []string{cl.baseURI, textclass.BaseURI()} {
+		if uri == "" || !strings.HasPrefix(src, uri) {
+			continue
+		}
+		relative, err := url.PathUnescape(strings.TrimPrefix(src, uri))
+		if err != nil {
+			return "", false
+		}
+		relative = path.Clean("/" + relative)[1:]
+		return textclass.SyncDir() + "assets/" + relative, true
+	}
+	return "", false
+}
+
+// wikiPath returns the wiki path of a class link, see permalink.Path
+func wikiPath(href string) (string, bool) {
+	if !strings.HasPrefix(href, "/wiki/") {
+		return "", false
+	}
+	target := strings.TrimPrefix(href, "/wiki/")
+	if i := strings.IndexAny(target, "#?"); i >= 0 {
+		target = target[:i]
+	}
+	if strings.Count(target, "/") != 2 {
+		return "", false
+	}
+	return target, true
+}
+
+// stamp writes the name, size and modification time of a file to a hash,
+// missing files are skipped
+func stamp(hash io.Writer, name string) error {
+	if name == "" {
+		return nil
+	}
+	info, err := os.Stat(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(hash, "%s\x00%d\x00%d\x00", name, info.Size(),
+		info.ModTime().UnixNano())
+	return nil
+}
+
+// fingerprint identifies the content of a book, it changes when a class,
+// its assets or the names of the course and grade change. Files are
+// compared by size and modification time, they are not read
+func fingerprint(col *collection, format string) (string, error) {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\x00%s\x00%s\x00%s\x00%s\x00", bookVersion,
+		markdown.Version, format, col.name, col.description)
+	for _, c := range col.courses {
+		fmt.Fprintf(hash, "%s\x00%s\x00%s\x00", c.name, c.description,
+			c.slug)
+		for _, cl := range c.classes {
+			fmt.Fprintf(hash, "%d\x00%s\x00%s\x00%s\x00", cl.id, cl.title,
+				cl.slug, cl.baseURI)
+			err := stamp(hash, cl.fileName)
+			if err == nil {
+				err = stamp(hash, cl.procFileName)
+			}
+			if err != nil {
+				return "", err
+			}
+			_, assets := textclass.Dirs(col.gradeID, c.id, cl.id)
+			err = filepath.Walk(assets, func(name string, info os.FileInfo,
+				err error) error {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				if err != nil || info.IsDir() {
+					return err
+				}
+				return stamp(hash, name)
+			})
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// variant tells the books with drafts, read by teachers, from the books
+// with only the published classes
+func variant(drafts bool) string {
+	if drafts {
+		return "drafts"
+	}
+	return "published"
+}
+
+// bookPath returns the prefix of the cached copies of a course book and
+// the file of the copy with a fingerprint
+func bookPath(col *collection, format string, drafts bool,
+	hash string) (string, string) {
+	prefix := exportDir() + bookPrefix +
+		strconv.FormatInt(col.courses[0].id, 10) + "_" + variant(drafts) +
+		"_"
+	return prefix, prefix + hash[:16] + "." + format
+}
+
+// writeBook writes the file of a book and removes the older copies of the
+// same variant
+func writeBook(col *collection, format, prefix, fileName string) error {
+	if err := os.MkdirAll(exportDir(), 0700); err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(exportDir(), "book")
+	if err != nil {
+		return err
+	}
+	err = bookFormats[format].write(col, tmpFile)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), fileName)
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	old, _ := filepath.Glob(prefix + "*." + format)
+	for _, oldFile := range old {
+		if oldFile != fileName {
+			os.Remove(oldFile)
+		}
+	}
+	return nil
+}
+
+// writing has the jobs writing books by user and file, a user asking
+// again for a book being written gets the same job
+var (
+	writing      = make(map[string]*job.Job)
+	writingMutex sync.Mutex
+)
+
+// startBook returns the job writing a book, it is started unless the user
+// already has one writing the same file
+func startBook(col *collection, format, prefix, fileName, url,
+	userID string) *job.Job {
+	key := userID + "\x00" + fileName
+	writingMutex.Lock()
+	defer writingMutex.Unlock()
+	if j, ok := writing[key]; ok {
+		return j
+	}
+	j := job.New("book", userID)
+	j.SetTotal(1)
+	writing[key] = j
+	go func() {
+		err := writeBook(col, format, prefix, fileName)
+		writingMutex.Lock()
+		delete(writing, key)
+		writingMutex.Unlock()
+		if err != nil {
+			logger.Error("Unable to write book", err)
+			j.Fail(errors.New("Unable to write book"))
+			return
+		}
+		var size int64
+		if info, err := os.Stat(fileName); err == nil {
+			size = info.Size()
+		}
+		j.Finish(&Result{URL: url, Size: size, Classes: col.classCount()})
+	}()
+	return j
+}
+
+// Book is an endpoint that returns a course as an EPUB 3 or PDF book, or
+// as an IMS Common Cartridge or SCORM 1.2 package for an LMS. Books are
+// cached until the course changes. When there is no copy of the current
+// content a job writing it is started, the book is returned by the same
+// endpoint once the job finishes. Students only get the published classes
+// of books, packages are only for teachers
+func Book(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	format := p.ByName("format")
+	if _, ok := bookFormats[format]; !ok {
+		errormessages.WriteErrorInterface(w, "Format not supported",
+			http.StatusNotFound)
+		return
+	}
+	if bookFormats[format].teachers && claims.Role != "TEACHER" {
+		errormessages.WriteErrorInterface(w, "Not enough privileges",
+			http.StatusUnauthorized)
+		return
+	}
+	gradeID, err := strconv.ParseInt(p.ByName("id"), 0, 64)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid id",
+			http.StatusBadRequest)
+		return
+	}
+	courseID, err := strconv.ParseInt(p.ByName("courseid"), 0, 64)
+	if err != nil || courseID <= 0 {
+		errormessages.WriteErrorMessage(w, "Invalid id",
+			http.StatusBadRequest)
+		return
+	}
+	drafts := publication.SeesAll(claims.Role)
+	col, err := load(gradeID, courseID, drafts)
+	if err == sql.ErrNoRows {
+		errormessages.WriteErrorInterface(w, "Course does not exists",
+			http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to find classes",
+			http.StatusInternalServerError)
+		return
+	}
+	hash, err := fingerprint(col, format)
+	if err != nil {
+		logger.Error("Unable to read course files", err)
+		errormessages.WriteErrorMessage(w, "Unable to read course files",
+			http.StatusInternalServerError)
+		return
+	}
+	prefix, fileName := bookPath(col, format, drafts, hash)
+	file, err := os.Open(fileName)
+	if os.IsNotExist(err) {
+		j := startBook(col, format, prefix, fileName, r.URL.Path,
+			claims.UserID)
+		j.Write(w, http.StatusAccepted)
+		return
+	}
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to read book",
+			http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to read book",
+			http.StatusInternalServerError)
+		return
+	}
+	name := col.slug + "-" + col.courses[0].slug + "." +
+		bookFormats[format].extension
+	w.Header().Set("Content-Type", bookFormats[format].contentType)
+	w.Header().Set("Content-Disposition",
+		`attachment; filename="`+name+`"`)
+	w.Header().Set("ETag", `"`+hash+`"`)
+	http.ServeContent(w, r, name, info.ModTime(), file)
+}
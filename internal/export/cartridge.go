@@ -0,0 +1,453 @@
+package export
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"github.com/chromz/wiki-backend/pkg/markdown"
+	"html/template"
+	"io"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	textTemplate "text/template"
+)
+
+// manifestName is the name the content packaging specification gives to
+// the manifest of a package
+const manifestName = "imsmanifest.xml"
+
+// scormScript marks a page as completed in the LMS that launched it, pages
+// opened outside of one do nothing
+const scormScript = `(function () {
+	function findAPI(win) {
+		for (var i = 0; win && i < 10; i++) {
+			if (win.API) {
+				return win.API;
+			}
+			if (win.parent === win) {
+				break;
+			}
+			win = win.parent;
+		}
+		return null;
+	}
+	var api = findAPI(window) || (window.opener && findAPI(window.opener));
+	if (!api) {
+		return;
+	}
+	api.LMSInitialize("");
+	api.LMSSetValue("cmi.core.lesson_status", "completed");
+	api.LMSCommit("");
+	window.addEventListener("unload", function () {
+		api.LMSFinish("");
+	});
+})();
+`
+
+// The organizations follow the hierarchy of the wiki, the grade holds the
+// course and the course holds an item for each class
+var manifestTemplates = textTemplate.Must(textTemplate.New("manifest").Funcs(
+	textTemplate.FuncMap{"xml": escapeXML},
+).Parse(`
+{{define "items"}}<item identifier="I_grade"><title>{{xml .Grade}}</title>
+<item identifier="I_course"><title>{{xml .Title}}</title>
+{{range .Items}}<item identifier="{{.ID}}" identifierref="{{.Resource}}"><title>{{xml .Title}}</title></item>
+{{end}}</item>
+</item>
+{{end}}
+{{define "resources"}}<resources>
+{{range .Resources}}<resource identifier="{{.ID}}" type="webcontent"{{if $.SCORM}} adlcp:scormtype="sco"{{end}} href="{{xml .Href}}">
+{{range .Files}}<file href="{{xml .}}"/>
+{{end}}</resource>
+{{end}}</resources>
+{{end}}
+{{define "imscc"}}<?xml version="1.0" encoding="UTF-8"?>
+<manifest identifier="{{.ID}}" xmlns="http://www.imsglobal.org/xsd/imsccv1p1/imscp_v1p1" xmlns:lomimscc="http://ltsc.ieee.org/xsd/imsccv1p1/LOM/manifest" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:schemaLocation="http://www.imsglobal.org/xsd/imsccv1p1/imscp_v1p1 http://www.imsglobal.org/profile/cc/ccv1p1/ccv1p1_imscp_v1p2_v1p0.xsd http://ltsc.ieee.org/xsd/imsccv1p1/LOM/manifest http://www.imsglobal.org/profile/cc/ccv1p1/LOM/ccv1p1_lommanifest_v1p0.xsd">
+<metadata>
+<schema>IMS Common Cartridge</schema>
+<schemaversion>1.1.0</schemaversion>
+<lomimscc:lom>
+<lomimscc:general>
+<lomimscc:title><lomimscc:string language="es">{{xml .Title}}</lomimscc:string></lomimscc:title>
+{{with .Description}}<lomimscc:description><lomimscc:string language="es">{{xml .}}</lomimscc:string></lomimscc:description>
+{{end}}<lomimscc:keyword><lomimscc:string language="es">{{xml .Grade}}</lomimscc:string></lomimscc:keyword>
+</lomimscc:general>
+</lomimscc:lom>
+</metadata>
+<organizations>
+<organization identifier="O_1" structure="rooted-hierarchy">
+<item identifier="I_root">
+{{template "items" .}}</item>
+</organization>
+</organizations>
+{{template "resources" .}}</manifest>
+{{end}}
+{{define "scorm"}}<?xml version="1.0" encoding="UTF-8"?>
+<manifest identifier="{{.ID}}" version="1.0" xmlns="http://www.imsproject.org/xsd/imscp_rootv1p1p2" xmlns:adlcp="http://www.adlnet.org/xsd/adlcp_rootv1p2" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:schemaLocation="http://www.imsproject.org/xsd/imscp_rootv1p1p2 imscp_rootv1p1p2.xsd http://www.imsglobal.org/xsd/imsmd_rootv1p2p1 imsmd_rootv1p2p1.xsd http://www.adlnet.org/xsd/adlcp_rootv1p2 adlcp_rootv1p2.xsd">
+<metadata>
+<schema>ADL SCORM</schema>
+<schemaversion>1.2</schemaversion>
+</metadata>
+<organizations default="O_1">
+<organization identifier="O_1">
+<title>{{xml .Title}}</title>
+{{template "items" .}}</organization>
+</organizations>
+{{template "resources" .}}</manifest>
+{{end}}
+`))
+
+type packageItem struct {
+	ID       string
+	Resource string
+	Title    string
+}
+
+type packageResource struct {
+	ID    string
+	Href  string
+	Files []string
+}
+
+type contentPackage struct {
+	ID          string
+	Title       string
+	Description string
+	Grade       string
+	SCORM       bool
+	Items       []packageItem
+	Resources   []packageResource
+}
+
+// The parsed manifest holds what is checked, elements are matched by
+// their local names
+type manifestItem struct {
+	Identifier    string         `xml:"identifier,attr"`
+	IdentifierRef string         `xml:"identifierref,attr"`
+	Title         *string        `xml:"title"`
+	Items         []manifestItem `xml:"item"`
+}
+
+type parsedManifest struct {
+	XMLName       xml.Name
+	Identifier    string `xml:"identifier,attr"`
+	Schema        string `xml:"metadata>schema"`
+	SchemaVersion string `xml:"metadata>schemaversion"`
+	Organizations struct {
+		Default      string `xml:"default,attr"`
+		Organization []struct {
+			Identifier string         `xml:"identifier,attr"`
+			Structure  string         `xml:"structure,attr"`
+			Title      *string        `xml:"title"`
+			Items      []manifestItem `xml:"item"`
+		} `xml:"organization"`
+	} `xml:"organizations"`
+	Resources struct {
+		Resource []struct {
+			Identifier string `xml:"identifier,attr"`
+			Type       string `xml:"type,attr"`
+			Href       string `xml:"href,attr"`
+			ScormType  string `xml:"http://www.adlnet.org/xsd/adlcp_rootv1p2 scormtype,attr"`
+			Files      []struct {
+				Href string `xml:"href,attr"`
+			} `xml:"file"`
+			Dependencies []struct {
+				IdentifierRef string `xml:"identifierref,attr"`
+			} `xml:"dependency"`
+		} `xml:"resource"`
+	} `xml:"resources"`
+}
+
+// ncNameRegex matches the xsd:ID values used as identifiers
+var ncNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+// manifestSchema has what the schemas of a kind of package require
+type manifestSchema struct {
+	namespace     string
+	schema        string
+	schemaVersion string
+	scorm         bool
+}
+
+var manifestSchemas = map[bool]manifestSchema{
+	false: {
+		namespace:     "http://www.imsglobal.org/xsd/imsccv1p1/imscp_v1p1",
+		schema:        "IMS Common Cartridge",
+		schemaVersion: "1.1.0",
+	},
+	true: {
+		namespace:     "http://www.imsproject.org/xsd/imscp_rootv1p1p2",
+		schema:        "ADL SCORM",
+		schemaVersion: "1.2",
+		scorm:         true,
+	},
+}
+
+// validator checks in go some constraints of the schemas of the packages
+// on a manifest, the identifiers are unique and every reference and file of
+// the manifest exists
+type validator struct {
+	schema      manifestSchema
+	files       map[string]bool
+	identifiers map[string]bool
+	refs        []string
+}
+
+func (v *validator) identifier(id string) error {
+	if !ncNameRegex.MatchString(id) {
+		return errors.New("Invalid identifier " + strconv.Quote(id))
+	}
+	if v.identifiers[id] {
+		return errors.New("Duplicated identifier " + id)
+	}
+	v.identifiers[id] = true
+	return nil
+}
+
+func (v *validator) href(href string) error {
+	if href == "" || strings.HasPrefix(href, "/") ||
+		strings.Contains(href, "://") || path.Clean(href) != href ||
+		strings.HasPrefix(href, "../") {
+		return errors.New("Invalid href " + strconv.Quote(href))
+	}
+	if !v.files[href] {
+		return errors.New("Package is missing " + href)
+	}
+	return nil
+}
+
+func (v *validator) items(items []manifestItem) error {
+	for _, item := range items {
+		if err := v.identifier(item.Identifier); err != nil {
+			return err
+		}
+		if item.Title == nil || strings.TrimSpace(*item.Title) == "" {
+			return errors.New("Item " + item.Identifier + " has no title")
+		}
+		if item.IdentifierRef != "" {
+			v.refs = append(v.refs, item.IdentifierRef)
+		}
+		if err := v.items(item.Items); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkManifest is a structural check of a manifest before it is added
+// to its package, files has the names of the other entries of the
+// package. It checks the root element, the schema metadata, the
+// organization, the types of the resources and the identifiers,
+// references and files. It is not a validation against the official XSD
+// schemas, which are not bundled, so neither the order of the elements
+// nor the content models are checked
+func checkManifest(data []byte, scorm bool, files map[string]bool) error {
+	v := &validator{
+		schema:      manifestSchemas[scorm],
+		files:       files,
+		identifiers: make(map[string]bool),
+	}
+	m := &parsedManifest{}
+	if err := xml.Unmarshal(data, m); err != nil {
+		return err
+	}
+	if m.XMLName.Space != v.schema.namespace || m.XMLName.Local != "manifest" {
+		return errors.New("Invalid manifest element")
+	}
+	if err := v.identifier(m.Identifier); err != nil {
+		return err
+	}
+	if m.Schema != v.schema.schema ||
+		m.SchemaVersion != v.schema.schemaVersion {
+		return errors.New("Invalid manifest schema")
+	}
+	organizations := m.Organizations.Organization
+	if len(organizations) != 1 {
+		return errors.New("Manifest must have one organization")
+	}
+	org := organizations[0]
+	if err := v.identifier(org.Identifier); err != nil {
+		return err
+	}
+	if v.schema.scorm {
+		if m.Organizations.Default != org.Identifier {
+			return errors.New("Invalid default organization")
+		}
+		if org.Title == nil || strings.TrimSpace(*org.Title) == "" {
+			return errors.New("Organization has no title")
+		}
+		if err := v.items(org.Items); err != nil {
+			return err
+		}
+	} else {
+		// Cartridges have a single root item without title or resource
+		if org.Structure != "rooted-hierarchy" || len(org.Items) != 1 {
+			return errors.New("Organization must be a rooted hierarchy")
+		}
+		root := org.Items[0]
+		if root.Title != nil || root.IdentifierRef != "" {
+			return errors.New("Invalid root item")
+		}
+		if err := v.identifier(root.Identifier); err != nil {
+			return err
+		}
+		if err := v.items(root.Items); err != nil {
+			return err
+		}
+	}
+
+	resources := make(map[string]bool)
+	for _, r := range m.Resources.Resource {
+		if err := v.identifier(r.Identifier); err != nil {
+			return err
+		}
+		resources[r.Identifier] = true
+		if r.Type != "webcontent" {
+			return errors.New("Invalid type of resource " + r.Identifier)
+		}
+		if v.schema.scorm && r.ScormType != "sco" && r.ScormType != "asset" {
+			return errors.New("Invalid scorm type of resource " +
+				r.Identifier)
+		}
+		listed := make(map[string]bool)
+		for _, f := range r.Files {
+			if err := v.href(f.Href); err != nil {
+				return err
+			}
+			listed[f.Href] = true
+		}
+		// The launched file must be one of the files of the resource
+		if r.Href != "" && !listed[r.Href] {
+			return errors.New("Resource " + r.Identifier +
+				" does not list " + r.Href)
+		}
+		for _, d := range r.Dependencies {
+			v.refs = append(v.refs, d.IdentifierRef)
+		}
+	}
+	for _, ref := range v.refs {
+		if !resources[ref] {
+			return errors.New("Missing resource " + ref)
+		}
+	}
+	return nil
+}
+
+// writeCartridge writes a course as an IMS Common Cartridge 1.1
+func writeCartridge(col *collection, w io.Writer) error {
+	return writePackage(col, w, false)
+}
+
+// writeSCORM writes a course as a SCORM 1.2 package, every class is a sco
+// that is completed once it is opened
+func writeSCORM(col *collection, w io.Writer) error {
+	return writePackage(col, w, true)
+}
+
+// writePackage writes a course as a content package with a web content
+// resource for each class, the pages and assets are laid out like the
+// static site so the same links work
+func writePackage(col *collection, w io.Writer, scorm bool) error {
+	c := col.courses[0]
+	s := &site{
+		col:    col,
+		writer: zip.NewWriter(w),
+		pages:  make(map[string]string),
+	}
+	for _, cl := range c.classes {
+		s.pages[col.slug+"/"+c.slug+"/"+cl.slug] = "../" + coursePath(c) +
+			classPath(cl)
+	}
+	p := &contentPackage{
+		ID:          "M_" + courseUUID(c),
+		Title:       c.name,
+		Description: c.description,
+		Grade:       col.name,
+		SCORM:       scorm,
+	}
+	files := map[string]bool{"style.css": true}
+	shared := []string{"style.css"}
+	if scorm {
+		files["scorm.js"] = true
+		shared = append(shared, "scorm.js")
+	}
+	for _, cl := range c.classes {
+		content, err := cl.content()
+		if err != nil {
+			return err
+		}
+		rendered, err := markdown.Render(content)
+		if err != nil {
+			return err
+		}
+		page := &page{
+			Title:   cl.title,
+			Root:    "../",
+			Content: template.HTML(s.rewrite(cl, string(rendered))),
+		}
+		if scorm {
+			page.Script = "../scorm.js"
+		}
+		name := coursePath(c) + classPath(cl)
+		if err = s.writePage(name, "package", page); err != nil {
+			return err
+		}
+		assets, err := s.copyAssets(c, cl)
+		if err != nil {
+			return err
+		}
+		files[name] = true
+		for _, asset := range assets {
+			files[asset] = true
+		}
+		id := strconv.FormatInt(cl.id, 10)
+		p.Items = append(p.Items, packageItem{
+			ID:       "I_" + id,
+			Resource: "R_" + id,
+			Title:    cl.title,
+		})
+		resourceFiles := append([]string{name}, shared...)
+		p.Resources = append(p.Resources, packageResource{
+			ID:    "R_" + id,
+			Href:  name,
+			Files: append(resourceFiles, assets...),
+		})
+	}
+	sharedFiles := map[string]string{"style.css": siteStyle}
+	if scorm {
+		sharedFiles["scorm.js"] = scormScript
+	}
+	for _, name := range shared {
+		writer, err := s.create(name)
+		if err != nil {
+			return err
+		}
+		if _, err = io.WriteString(writer, sharedFiles[name]); err != nil {
+			return err
+		}
+	}
+
+	templateName := "imscc"
+	if scorm {
+		templateName = "scorm"
+	}
+	var manifest strings.Builder
+	err := manifestTemplates.ExecuteTemplate(&manifest, templateName, p)
+	if err != nil {
+		return err
+	}
+	data := []byte(manifest.String())
+	if err = checkManifest(data, scorm, files); err != nil {
+		return err
+	}
+	writer, err := s.create(manifestName)
+	if err != nil {
+		return err
+	}
+	if _, err = writer.Write(data); err != nil {
+		return err
+	}
+	return s.writer.Close()
+}
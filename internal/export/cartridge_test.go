@@ -0,0 +1,99 @@
+package export
+
+import (
+	"strings"
+	"testing"
+)
+
+func testManifest(t *testing.T, scorm bool) (string, map[string]bool) {
+	t.Helper()
+	p := &contentPackage{
+		ID:          "M_course",
+		Title:       "Matemáticas & <ciencias>",
+		Description: "Primer ciclo",
+		Grade:       "Primero",
+		SCORM:       scorm,
+		Items: []packageItem{
+			{ID: "I_1", Resource: "R_1", Title: "Fracciones"},
+			{ID: "I_2", Resource: "R_2", Title: "Decimales"},
+		},
+		Resources: []packageResource{
+			{ID: "R_1", Href: "course/fracciones.html",
+				Files: []string{"course/fracciones.html", "style.css",
+					"course/fracciones/pizza.png"}},
+			{ID: "R_2", Href: "course/decimales.html",
+				Files: []string{"course/decimales.html", "style.css"}},
+		},
+	}
+	name := "imscc"
+	if scorm {
+		name = "scorm"
+	}
+	var manifest strings.Builder
+	err := manifestTemplates.ExecuteTemplate(&manifest, name, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]bool{
+		"style.css":                   true,
+		"course/fracciones.html":      true,
+		"course/fracciones/pizza.png": true,
+		"course/decimales.html":       true,
+	}
+	return manifest.String(), files
+}
+
+func TestCheckManifest(t *testing.T) {
+	for _, scorm := range []bool{false, true} {
+		manifest, files := testManifest(t, scorm)
+		if err := checkManifest([]byte(manifest), scorm, files); err != nil {
+			t.Errorf("checkManifest(scorm: %v) = %v, want nil", scorm, err)
+		}
+	}
+}
+
+func TestCheckManifestRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		scorm   bool
+		replace [2]string
+		missing string
+	}{
+		{name: "wrong schema version", replace: [2]string{
+			"<schemaversion>1.1.0", "<schemaversion>1.3.0"}},
+		{name: "duplicated identifier", replace: [2]string{
+			`identifier="I_2"`, `identifier="I_1"`}},
+		{name: "untitled item", replace: [2]string{
+			"<title>Decimales</title>", ""}},
+		{name: "flat cartridge organization", replace: [2]string{
+			`structure="rooted-hierarchy"`, `structure="hierarchical"`}},
+		{name: "unknown resource type", replace: [2]string{
+			`type="webcontent"`, `type="webpage"`}},
+		{name: "reference to an item", replace: [2]string{
+			`identifierref="R_2"`, `identifierref="I_1"`}},
+		{name: "missing file", missing: "course/fracciones/pizza.png"},
+		{name: "scorm title after items", scorm: true, replace: [2]string{
+			"<organization identifier=\"O_1\">\n<title>Matemáticas &amp; &lt;ciencias&gt;</title>",
+			"<organization identifier=\"O_1\">"}},
+		{name: "scorm resource without scorm type", scorm: true,
+			replace: [2]string{` adlcp:scormtype="sco"`, ""}},
+		{name: "scorm schema", scorm: true, replace: [2]string{
+			"<schema>ADL SCORM", "<schema>SCORM"}},
+	}
+	for _, test := range tests {
+		manifest, files := testManifest(t, test.scorm)
+		if test.replace[0] != "" {
+			if !strings.Contains(manifest, test.replace[0]) {
+				t.Fatalf("%s: manifest has no %q", test.name,
+					test.replace[0])
+			}
+			manifest = strings.Replace(manifest, test.replace[0],
+				test.replace[1], 1)
+		}
+		delete(files, test.missing)
+		if err := checkManifest([]byte(manifest), test.scorm,
+			files); err == nil {
+			t.Errorf("%s: checkManifest = nil, want an error", test.name)
+		}
+	}
+}
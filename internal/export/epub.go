@@ -0,0 +1,366 @@
+package export
+
+import (
+	"archive/zip"
+	"golang.org/x/net/html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// epubImageTypes are the sniffed types of the images embedded in books,
+// they are core media types of EPUB 3
+var epubImageTypes = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// voidElements are written as empty xml elements
+var voidElements = map[string]bool{
+	"br": true, "hr": true, "img": true, "col": true, "wbr": true,
+	"input": true,
+}
+
+const epubStyle = `body { font-family: serif; line-height: 1.4; }
+img { max-width: 100%; }
+pre { white-space: pre-wrap; font-size: 0.85em; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #999; padding: 0.2em 0.4em; }
+`
+
+const containerXML = `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+<rootfiles>
+<rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+</rootfiles>
+</container>
+`
+
+// The templates write xml, the values are escaped with xml
+var epubTemplates = template.Must(template.New("epub").Funcs(
+	template.FuncMap{"xml": escapeXML},
+).Parse(`
+{{define "opf"}}<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="book-id" xml:lang="es">
+<metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+<dc:identifier id="book-id">urn:uuid:{{.ID}}</dc:identifier>
+<dc:title>{{xml .Title}}</dc:title>
+<dc:language>es</dc:language>
+{{with .Description}}<dc:description>{{xml .}}</dc:description>
+{{end}}<dc:subject>{{xml .Grade}}</dc:subject>
+<meta property="belongs-to-collection" id="grade">{{xml .Grade}}</meta>
+<meta property="dcterms:modified">{{.Modified}}</meta>
+</metadata>
+<manifest>
+<item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+<item id="style" href="style.css" media-type="text/css"/>
+{{range .Chapters}}<item id="{{.ID}}" href="{{.Href}}" media-type="application/xhtml+xml"/>
+{{end}}{{range .Images}}<item id="{{.ID}}" href="{{.Href}}" media-type="{{.MediaType}}"/>
+{{end}}</manifest>
+<spine>
+{{range .Chapters}}<itemref idref="{{.ID}}"/>
+{{end}}</spine>
+</package>
+{{end}}
+{{define "nav"}}<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" lang="es" xml:lang="es">
+<head>
+<meta charset="utf-8"/>
+<title>{{xml .Title}}</title>
+</head>
+<body>
+<nav epub:type="toc" id="toc">
+<h1>{{xml .Title}}</h1>
+<ol>
+{{range .Chapters}}<li><a href="{{.Href}}">{{xml .Title}}</a></li>
+{{end}}</ol>
+</nav>
+</body>
+</html>
+{{end}}
+{{define "chapter"}}<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" lang="es" xml:lang="es">
+<head>
+<meta charset="utf-8"/>
+<title>{{xml .Title}}</title>
+<link rel="stylesheet" type="text/css" href="style.css"/>
+</head>
+<body>
+<section epub:type="chapter">
+{{.Body}}
+</section>
+</body>
+</html>
+{{end}}
+`))
+
+// xmlEscaper escapes text and attribute values, unlike xml.EscapeText it
+// keeps new lines so code blocks stay readable
+var xmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;",
+	`"`, "&quot;")
+
+func escapeXML(text string) string {
+	return xmlEscaper.Replace(text)
+}
+
+type epubItem struct {
+	ID        string
+	Href      string
+	MediaType string
+	Title     string
+	Body      string
+}
+
+// epubBook collects the chapters and images of a book
+type epubBook struct {
+	Title       string
+	Description string
+	Grade       string
+	ID          string
+	Modified    string
+	Chapters    []*epubItem
+	Images      []*epubItem
+	// images maps the files of the embedded images to their items
+	images map[string]*epubItem
+	// pages maps the wiki paths of the classes to their chapters
+	pages map[string]string
+	data  map[string][]byte
+}
+
+// image embeds an image of a class, it returns an empty href for images
+// that are not served by the wiki or not supported
+func (b *epubBook) image(cl *class, src string) string {
+	fileName, ok := localAsset(cl, src)
+	if !ok {
+		return ""
+	}
+	if item, ok := b.images[fileName]; ok {
+		return item.Href
+	}
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return ""
+	}
+	mediaType := http.DetectContentType(data)
+	extension, ok := epubImageTypes[mediaType]
+	if !ok {
+		return ""
+	}
+	id := "image-" + strconv.Itoa(len(b.Images)+1)
+	item := &epubItem{ID: id, Href: "images/" + id + extension,
+		MediaType: mediaType}
+	b.images[fileName] = item
+	b.Images = append(b.Images, item)
+	b.data[item.Href] = data
+	return item.Href
+}
+
+// writeAttributes writes the attributes of an element as xml, boolean
+// attributes get their name as value
+func writeAttributes(builder *strings.Builder, attributes []html.Attribute) {
+	for _, a := range attributes {
+		value := a.Val
+		if value == "" && (a.Key == "checked" || a.Key == "disabled") {
+			value = a.Key
+		}
+		// Footnote ids have colons, which xml ids can not have
+		if a.Key == "id" || (a.Key == "href" && strings.HasPrefix(value, "#")) {
+			value = strings.Replace(value, ":", "-", -1)
+		}
+		builder.WriteString(" " + a.Key + `="` + escapeXML(value) + `"`)
+	}
+}
+
+// xhtml writes rendered html as xhtml, images are embedded and links to
+// classes point to their chapters
+func (b *epubBook) xhtml(builder *strings.Builder, cl *class, n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		builder.WriteString(escapeXML(n.Data))
+		return
+	case html.ElementNode:
+	default:
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			b.xhtml(builder, cl, child)
+		}
+		return
+	}
+	var attributes []html.Attribute
+	switch n.Data {
+	case "picture":
+		// The fallback image is enough, sources are only variants
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			if child.Data == "img" {
+				b.xhtml(builder, cl, child)
+			}
+		}
+		return
+	case "source":
+		return
+	case "img":
+		href := b.image(cl, attr(n, "src"))
+		if href == "" {
+			builder.WriteString(escapeXML(attr(n, "alt")))
+			return
+		}
+		attributes = append(attributes, html.Attribute{Key: "src", Val: href},
+			html.Attribute{Key: "alt", Val: attr(n, "alt")})
+		for _, key := range []string{"title", "width", "height"} {
+			if value := attr(n, key); value != "" {
+				attributes = append(attributes,
+					html.Attribute{Key: key, Val: value})
+			}
+		}
+	case "a":
+		href := attr(n, "href")
+		if target, ok := wikiPath(href); ok {
+			href = b.pages[target]
+		} else if !strings.HasPrefix(href, "#") &&
+			!strings.HasPrefix(href, "http://") &&
+			!strings.HasPrefix(href, "https://") &&
+			!strings.HasPrefix(href, "mailto:") {
+			href = ""
+		}
+		if href != "" {
+			attributes = append(attributes,
+				html.Attribute{Key: "href", Val: href})
+		}
+		for _, a := range n.Attr {
+			if a.Key == "id" || a.Key == "title" {
+				attributes = append(attributes, a)
+			}
+		}
+	default:
+		for _, a := range n.Attr {
+			if a.Key == "align" {
+				// Obsolete in xhtml, tables use it for alignments
+				a = html.Attribute{Key: "style", Val: "text-align: " + a.Val}
+			}
+			attributes = append(attributes, a)
+		}
+	}
+	builder.WriteString("<" + n.Data)
+	writeAttributes(builder, attributes)
+	if voidElements[n.Data] {
+		builder.WriteString("/>")
+		return
+	}
+	builder.WriteString(">")
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		b.xhtml(builder, cl, child)
+	}
+	builder.WriteString("</" + n.Data + ">")
+}
+
+func writeEntry(writer *zip.Writer, name string, method uint16,
+	data []byte) error {
+	entry, err := writer.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   method,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = entry.Write(data)
+	return err
+}
+
+func executeTemplate(name string, data interface{}) ([]byte, error) {
+	var builder strings.Builder
+	err := epubTemplates.ExecuteTemplate(&builder, name, data)
+	return []byte(builder.String()), err
+}
+
+// writeEPUB writes a course as an EPUB 3 package with a chapter for each
+// class
+func writeEPUB(col *collection, w io.Writer) error {
+	c := col.courses[0]
+	b := &epubBook{
+		Title:       c.name,
+		Description: c.description,
+		Grade:       col.name,
+		ID:          courseUUID(c),
+		Modified:    time.Now().UTC().Format("2006-01-02T15:04:05Z"),
+		images:      make(map[string]*epubItem),
+		pages:       make(map[string]string),
+		data:        make(map[string][]byte),
+	}
+	for i, cl := range c.classes {
+		href := "chapter-" + strconv.Itoa(i+1) + ".xhtml"
+		b.pages[col.slug+"/"+c.slug+"/"+cl.slug] = href
+	}
+	rendered, err := chapters(c)
+	if err != nil {
+		return err
+	}
+	for i, ch := range rendered {
+		var body strings.Builder
+		for _, n := range ch.nodes {
+			b.xhtml(&body, ch.class, n)
+		}
+		b.Chapters = append(b.Chapters, &epubItem{
+			ID:    "chapter-" + strconv.Itoa(i+1),
+			Href:  "chapter-" + strconv.Itoa(i+1) + ".xhtml",
+			Title: ch.class.title,
+			Body:  body.String(),
+		})
+	}
+
+	writer := zip.NewWriter(w)
+	// The mimetype goes first and uncompressed so readers can sniff it
+	err = writeEntry(writer, "mimetype", zip.Store,
+		[]byte("application/epub+zip"))
+	if err != nil {
+		return err
+	}
+	err = writeEntry(writer, "META-INF/container.xml", zip.Deflate,
+		[]byte(containerXML))
+	if err != nil {
+		return err
+	}
+	files := map[string]string{
+		"OEBPS/content.opf": "opf",
+		"OEBPS/nav.xhtml":   "nav",
+	}
+	for name, templateName := range files {
+		data, err := executeTemplate(templateName, b)
+		if err != nil {
+			return err
+		}
+		if err = writeEntry(writer, name, zip.Deflate, data); err != nil {
+			return err
+		}
+	}
+	err = writeEntry(writer, "OEBPS/style.css", zip.Deflate,
+		[]byte(epubStyle))
+	if err != nil {
+		return err
+	}
+	for _, item := range b.Chapters {
+		data, err := executeTemplate("chapter", item)
+		if err != nil {
+			return err
+		}
+		err = writeEntry(writer, "OEBPS/"+item.Href, zip.Deflate, data)
+		if err != nil {
+			return err
+		}
+	}
+	for _, item := range b.Images {
+		err = writeEntry(writer, "OEBPS/"+item.Href, zip.Store,
+			b.data[item.Href])
+		if err != nil {
+			return err
+		}
+	}
+	return writer.Close()
+}
@@ -0,0 +1,313 @@
+package export
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/chromz/wiki-backend/internal/job"
+	"github.com/chromz/wiki-backend/internal/session"
+	"github.com/chromz/wiki-backend/internal/textclass"
+	"github.com/chromz/wiki-backend/pkg/errormessages"
+	"github.com/chromz/wiki-backend/pkg/frontmatter"
+	"github.com/chromz/wiki-backend/pkg/log"
+	"github.com/chromz/wiki-backend/pkg/persistence"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var logger = log.GetLogger()
+
+// retention is how long exported files can be downloaded, it matches the
+// retention of finished jobs
+const retention = time.Hour
+
+// Request is the body of an export request
+type Request struct {
+	IncludeDrafts bool `json:"includeDrafts"`
+}
+
+// Result is the result of a finished export job
+type Result struct {
+	URL     string `json:"url"`
+	Size    int64  `json:"size"`
+	Classes int    `json:"classes"`
+}
+
+type class struct {
+	id           int64
+	title        string
+	slug         string
+	fileName     string
+	procFileName string
+	baseURI      string
+}
+
+type course struct {
+	id          int64
+	name        string
+	description string
+	slug        string
+	classes     []*class
+}
+
+// collection is a grade, or a course of it, with the classes to export
+type collection struct {
+	gradeID     int64
+	name        string
+	description string
+	slug        string
+	courses     []*course
+}
+
+// content returns the processed markdown of a class, or the uploaded one
+// without its front matter when it has not been processed yet
+func (c *class) content() ([]byte, error) {
+	if c.procFileName != "" {
+		return ioutil.ReadFile(c.procFileName)
+	}
+	if c.fileName == "" {
+		return []byte{}, nil
+	}
+	content, err := ioutil.ReadFile(c.fileName)
+	if err != nil {
+		return nil, err
+	}
+	return frontmatter.Strip(content), nil
+}
+
+func (col *collection) classCount() int {
+	count := 0
+	for _, c := range col.courses {
+		count += len(c.classes)
+	}
+	return count
+}
+
+func loadClasses(db *sql.DB, c *course, drafts bool) error {
+	findQuery := `
+		SELECT id, title, slug, file_name, proc_file_name, base_uri
+		FROM text_class
+		WHERE course_id = ?
+		AND (? OR status = 'published')
+		ORDER BY id
+	`
+	rows, err := db.Query(findQuery, c.id, drafts)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		cl := &class{}
+		err = rows.Scan(&cl.id, &cl.title, &cl.slug, &cl.fileName,
+			&cl.procFileName, &cl.baseURI)
+		if err != nil {
+			return err
+		}
+		c.classes = append(c.classes, cl)
+	}
+	return rows.Err()
+}
+
+// load returns a grade with its courses in order, or only one course when
+// courseID is not 0. Drafts are left out unless they are asked for
+func load(gradeID, courseID int64, drafts bool) (*collection, error) {
+	db := persistence.GetDb()
+	col := &collection{gradeID: gradeID}
+	findQuery := `
+		SELECT name, IFNULL(description, ''), slug
+		FROM grade
+		WHERE id = ?
+	`
+	err := db.QueryRow(findQuery, gradeID).Scan(&col.name,
+		&col.description, &col.slug)
+	if err != nil {
+		return nil, err
+	}
+	coursesQuery := `
+		SELECT id, name, IFNULL(description, ''), slug
+		FROM course
+		WHERE grade_id = ?
+		AND (? = 0 OR id = ?)
+		AND (? OR status = 'published')
+		ORDER BY id
+	`
+	rows, err := db.Query(coursesQuery, gradeID, courseID, courseID, drafts)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		c := &course{}
+		err = rows.Scan(&c.id, &c.name, &c.description, &c.slug)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		col.courses = append(col.courses, c)
+	}
+	rows.Close()
+	if courseID != 0 && len(col.courses) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	for _, c := range col.courses {
+		if err = loadClasses(db, c, drafts); err != nil {
+			return nil, err
+		}
+	}
+	return col, nil
+}
+
+// download is an exported file waiting to be downloaded by the user that
+// started the job
+type download struct {
+	fileName  string
+	name      string
+	userID    string
+	createdAt time.Time
+}
+
+var (
+	downloads = make(map[string]*download)
+	mutex     sync.Mutex
+)
+
+func exportDir() string {
+	return textclass.SyncDir() + "exports/"
+}
+
+// register makes the file of a job downloadable, expired files are
+// removed
+func register(jobID string, d *download) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	for id, old := range downloads {
+		if time.Since(old.createdAt) > retention {
+			os.Remove(old.fileName)
+			delete(downloads, id)
+		}
+	}
+	downloads[jobID] = d
+}
+
+// Sweep removes the exports left by a previous run, they can not be
+// downloaded since downloads are only kept in memory. Cached books are
+// kept, they are found by the content of the course
+func Sweep() {
+	names, err := filepath.Glob(exportDir() + "*")
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		if strings.HasPrefix(filepath.Base(name), bookPrefix) {
+			continue
+		}
+		if err = os.Remove(name); err != nil {
+			logger.Error("Unable to remove export "+name, err)
+		}
+	}
+}
+
+func decodeRequest(r *http.Request) (*Request, error) {
+	request := &Request{}
+	if r.ContentLength == 0 {
+		return request, nil
+	}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(request); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// start loads what is exported and starts the job writing the site
+func start(w http.ResponseWriter, r *http.Request, gradeID,
+	courseID int64) {
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	if claims.Role != "TEACHER" {
+		errormessages.WriteErrorInterface(w, "Not enough privileges",
+			http.StatusUnauthorized)
+		return
+	}
+	request, err := decodeRequest(r)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid body type",
+			http.StatusBadRequest)
+		return
+	}
+	col, err := load(gradeID, courseID, request.IncludeDrafts)
+	if err == sql.ErrNoRows {
+		errormessages.WriteErrorInterface(w, "Resource does not exists",
+			http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to find classes",
+			http.StatusInternalServerError)
+		return
+	}
+	j := job.New("export", claims.UserID)
+	// One step per class and one to write the indexes
+	j.SetTotal(col.classCount() + 1)
+	go runSite(j, col, claims.UserID)
+	j.Write(w, http.StatusAccepted)
+}
+
+// Grade is an endpoint that starts a job exporting a grade as a static
+// html site
+func Grade(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	gradeID, err := strconv.ParseInt(p.ByName("id"), 0, 64)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid id",
+			http.StatusBadRequest)
+		return
+	}
+	start(w, r, gradeID, 0)
+}
+
+// Course is an endpoint that starts a job exporting a course as a static
+// html site
+func Course(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	gradeID, err := strconv.ParseInt(p.ByName("id"), 0, 64)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid id",
+			http.StatusBadRequest)
+		return
+	}
+	courseID, err := strconv.ParseInt(p.ByName("courseid"), 0, 64)
+	if err != nil || courseID <= 0 {
+		errormessages.WriteErrorMessage(w, "Invalid id",
+			http.StatusBadRequest)
+		return
+	}
+	start(w, r, gradeID, courseID)
+}
+
+// Download is an endpoint that returns the zip of a finished export job,
+// only the user that started the job can download it
+func Download(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	mutex.Lock()
+	d, ok := downloads[p.ByName("jobid")]
+	mutex.Unlock()
+	if !ok || d.userID != claims.UserID {
+		errormessages.WriteErrorInterface(w, "Export not found",
+			http.StatusNotFound)
+		return
+	}
+	file, err := os.Open(d.fileName)
+	if err != nil {
+		errormessages.WriteErrorInterface(w, "Export not found",
+			http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition",
+		`attachment; filename="`+d.name+`"`)
+	http.ServeContent(w, r, d.name, d.createdAt, file)
+}
@@ -0,0 +1,562 @@
+package export
+
+import (
+	"bytes"
+	"github.com/chai2010/webp"
+	"github.com/jung-kurt/gofpdf"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	pdfMargin         = 20
+	pdfFontSize       = 11
+	pdfLineHeight     = 5.5
+	pdfCodeSize       = 9
+	pdfCodeHeight     = 4.5
+	pdfListIndent     = 8
+	pdfMaxImageHeight = 150
+)
+
+var pdfHeadingSizes = map[int]float64{1: 20, 2: 16, 3: 14, 4: 12, 5: 11, 6: 11}
+
+// pdfImageTypes are the sniffed types of the images gofpdf can read, webp
+// images are converted to png
+var pdfImageTypes = map[string]string{
+	"image/png":  "PNG",
+	"image/jpeg": "JPG",
+	"image/gif":  "GIF",
+}
+
+// blockElements start on a new line
+var blockElements = map[atom.Atom]bool{
+	atom.P: true, atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true,
+	atom.H5: true, atom.H6: true, atom.Ul: true, atom.Ol: true, atom.Li: true,
+	atom.Pre: true, atom.Blockquote: true, atom.Hr: true, atom.Table: true,
+	atom.Div: true, atom.Section: true, atom.Figure: true, atom.Dl: true,
+	atom.Dt: true, atom.Dd: true, atom.Details: true, atom.Summary: true,
+}
+
+// pdfStyle is the style of inline text
+type pdfStyle struct {
+	bold   bool
+	italic bool
+	strike bool
+	code   bool
+	size   float64
+	href   string
+	link   int
+}
+
+func (s pdfStyle) lineHeight() float64 {
+	if s.size > 0 {
+		return s.size * 0.5
+	}
+	return pdfLineHeight
+}
+
+// pdfBook lays out a course, it is written twice since the table of
+// contents needs the pages where the classes start
+type pdfBook struct {
+	pdf    *gofpdf.Fpdf
+	tr     func(string) string
+	col    *collection
+	class  *class
+	images map[string]*gofpdf.ImageInfoType
+	// links maps the wiki paths of the classes to their internal links
+	links      map[string]int
+	classLinks []int
+	pages      []int
+}
+
+func (b *pdfBook) setFont(style pdfStyle) {
+	family := "Helvetica"
+	if style.code {
+		family = "Courier"
+	}
+	var fontStyle string
+	if style.bold {
+		fontStyle += "B"
+	}
+	if style.italic {
+		fontStyle += "I"
+	}
+	if style.strike {
+		fontStyle += "S"
+	}
+	size := float64(pdfFontSize)
+	if style.size > 0 {
+		size = style.size
+	}
+	b.pdf.SetFont(family, fontStyle, size)
+	if style.href != "" || style.link != 0 {
+		b.pdf.SetTextColor(0, 70, 160)
+	} else {
+		b.pdf.SetTextColor(0, 0, 0)
+	}
+}
+
+func (b *pdfBook) contentWidth() float64 {
+	left, _, right, _ := b.pdf.GetMargins()
+	width, _ := b.pdf.GetPageSize()
+	return width - left - right
+}
+
+// newLine moves to the start of the next line unless it is already there
+func (b *pdfBook) newLine() {
+	left, _, _, _ := b.pdf.GetMargins()
+	if b.pdf.GetX() > left+0.1 {
+		b.pdf.Ln(pdfLineHeight)
+	}
+}
+
+func (b *pdfBook) endBlock() {
+	b.newLine()
+	b.pdf.Ln(2)
+}
+
+// ensureSpace starts a new page when less than height is left in this one
+func (b *pdfBook) ensureSpace(height float64) {
+	_, pageHeight := b.pdf.GetPageSize()
+	_, _, _, bottom := b.pdf.GetMargins()
+	if b.pdf.GetY()+height > pageHeight-bottom {
+		b.pdf.AddPage()
+	}
+}
+
+func (b *pdfBook) indented(width float64, fn func()) {
+	left, _, _, _ := b.pdf.GetMargins()
+	b.pdf.SetLeftMargin(left + width)
+	b.pdf.SetX(left + width)
+	fn()
+	b.newLine()
+	b.pdf.SetLeftMargin(left)
+	b.pdf.SetX(left)
+}
+
+// flow writes the children of a node, blocks start on new lines
+func (b *pdfBook) flow(n *html.Node, style pdfStyle) {
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type == html.ElementNode && blockElements[child.DataAtom] {
+			b.newLine()
+			b.block(child)
+			continue
+		}
+		b.inline(child, style)
+	}
+}
+
+func (b *pdfBook) block(n *html.Node) {
+	if level, ok := headingLevels[n.DataAtom]; ok {
+		b.heading(n, level)
+		return
+	}
+	switch n.DataAtom {
+	case atom.P, atom.Dt, atom.Summary:
+		b.flow(n, pdfStyle{bold: n.DataAtom != atom.P})
+		b.endBlock()
+	case atom.Ul, atom.Ol:
+		b.list(n)
+	case atom.Pre:
+		b.code(n)
+	case atom.Blockquote, atom.Dd:
+		b.indented(pdfListIndent, func() {
+			b.flow(n, pdfStyle{italic: n.DataAtom == atom.Blockquote})
+		})
+		b.pdf.Ln(2)
+	case atom.Hr:
+		left, _, _, _ := b.pdf.GetMargins()
+		y := b.pdf.GetY() + 2
+		b.pdf.SetDrawColor(180, 180, 180)
+		b.pdf.Line(left, y, left+b.contentWidth(), y)
+		b.pdf.SetY(y + 4)
+	case atom.Table:
+		b.table(n)
+	default:
+		b.flow(n, pdfStyle{})
+		b.newLine()
+	}
+}
+
+func (b *pdfBook) heading(n *html.Node, level int) {
+	size := pdfHeadingSizes[level]
+	// Headings are not left alone at the bottom of a page
+	b.ensureSpace(size*0.5 + 3*pdfLineHeight)
+	b.pdf.Ln(2)
+	if level == 2 {
+		b.pdf.Bookmark(b.tr(strings.TrimSpace(textContent(n))), 1, -1)
+	}
+	style := pdfStyle{bold: true, size: size}
+	b.flow(n, style)
+	b.pdf.Ln(style.lineHeight() + 2)
+}
+
+func (b *pdfBook) list(n *html.Node) {
+	number := 1
+	if start, err := strconv.Atoi(attr(n, "start")); err == nil {
+		number = start
+	}
+	for li := n.FirstChild; li != nil; li = li.NextSibling {
+		if li.DataAtom != atom.Li {
+			continue
+		}
+		b.newLine()
+		marker := "-"
+		if n.DataAtom == atom.Ol {
+			marker = strconv.Itoa(number) + "."
+			number++
+		}
+		b.setFont(pdfStyle{})
+		b.pdf.CellFormat(pdfListIndent-2, pdfLineHeight, marker, "", 0, "R",
+			false, 0, "")
+		b.pdf.SetX(b.pdf.GetX() + 2)
+		b.indented(pdfListIndent, func() {
+			b.flow(li, pdfStyle{})
+		})
+	}
+	b.pdf.Ln(2)
+}
+
+func (b *pdfBook) code(n *html.Node) {
+	text := strings.TrimSuffix(textContent(n), "\n")
+	text = strings.Replace(text, "\t", "    ", -1)
+	b.setFont(pdfStyle{code: true, size: pdfCodeSize})
+	b.pdf.SetFillColor(245, 245, 245)
+	b.pdf.MultiCell(b.contentWidth(), pdfCodeHeight, b.tr(text), "", "L",
+		true)
+	b.pdf.Ln(2)
+}
+
+// table writes a table with columns of the same width, the cells are
+// written as plain text
+func (b *pdfBook) table(n *html.Node) {
+	var rows []*html.Node
+	var collect func(*html.Node)
+	collect = func(n *html.Node) {
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			if child.DataAtom == atom.Tr {
+				rows = append(rows, child)
+			} else if child.Type == html.ElementNode {
+				collect(child)
+			}
+		}
+	}
+	collect(n)
+	columns := 0
+	cells := make([][]*html.Node, len(rows))
+	for i, row := range rows {
+		for cell := row.FirstChild; cell != nil; cell = cell.NextSibling {
+			if cell.DataAtom == atom.Td || cell.DataAtom == atom.Th {
+				cells[i] = append(cells[i], cell)
+			}
+		}
+		if len(cells[i]) > columns {
+			columns = len(cells[i])
+		}
+	}
+	if columns == 0 {
+		return
+	}
+	left, _, _, _ := b.pdf.GetMargins()
+	width := b.contentWidth() / float64(columns)
+	b.pdf.SetDrawColor(150, 150, 150)
+	for _, row := range cells {
+		texts := make([]string, len(row))
+		lines := 1
+		for i, cell := range row {
+			b.setFont(pdfStyle{bold: cell.DataAtom == atom.Th})
+			text := strings.Join(strings.Fields(textContent(cell)), " ")
+			texts[i] = b.tr(text)
+			count := len(b.pdf.SplitLines([]byte(texts[i]), width-2))
+			if count > lines {
+				lines = count
+			}
+		}
+		height := float64(lines) * pdfLineHeight
+		b.ensureSpace(height)
+		y := b.pdf.GetY()
+		for i := 0; i < columns; i++ {
+			x := left + float64(i)*width
+			b.pdf.Rect(x, y, width, height, "D")
+			if i >= len(row) {
+				continue
+			}
+			align := "L"
+			switch attr(row[i], "align") {
+			case "center":
+				align = "C"
+			case "right":
+				align = "R"
+			}
+			b.setFont(pdfStyle{bold: row[i].DataAtom == atom.Th})
+			b.pdf.SetXY(x, y)
+			b.pdf.MultiCell(width, pdfLineHeight, texts[i], "", align, false)
+		}
+		b.pdf.SetXY(left, y+height)
+	}
+	b.pdf.Ln(2)
+}
+
+// register reads an image once, it returns nil for images that can not be
+// embedded
+func (b *pdfBook) register(fileName string) *gofpdf.ImageInfoType {
+	if info, ok := b.images[fileName]; ok {
+		return info
+	}
+	b.images[fileName] = nil
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil
+	}
+	mediaType := http.DetectContentType(data)
+	imageType, ok := pdfImageTypes[mediaType]
+	if mediaType == "image/webp" {
+		decoded, err := webp.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil
+		}
+		var buffer bytes.Buffer
+		if err = png.Encode(&buffer, decoded); err != nil {
+			return nil
+		}
+		data, imageType, ok = buffer.Bytes(), "PNG", true
+	}
+	if !ok {
+		return nil
+	}
+	info := b.pdf.RegisterImageOptionsReader(fileName,
+		gofpdf.ImageOptions{ImageType: imageType, ReadDpi: true},
+		bytes.NewReader(data))
+	if b.pdf.Err() {
+		// A broken image must not fail the whole book
+		b.pdf.ClearError()
+		return nil
+	}
+	b.images[fileName] = info
+	return info
+}
+
+// image embeds an image scaled to the page, the alternative text is
+// written for images that are not served by the wiki
+func (b *pdfBook) image(n *html.Node, style pdfStyle) {
+	fileName, ok := localAsset(b.class, attr(n, "src"))
+	var info *gofpdf.ImageInfoType
+	if ok {
+		info = b.register(fileName)
+	}
+	if info == nil {
+		if alt := attr(n, "alt"); alt != "" {
+			style.italic = true
+			b.text("["+alt+"]", style)
+		}
+		return
+	}
+	b.newLine()
+	width, height := info.Width(), info.Height()
+	if maxWidth := b.contentWidth(); width > maxWidth {
+		height, width = height*maxWidth/width, maxWidth
+	}
+	if height > pdfMaxImageHeight {
+		width, height = width*pdfMaxImageHeight/height, pdfMaxImageHeight
+	}
+	b.ensureSpace(height)
+	left, _, _, _ := b.pdf.GetMargins()
+	y := b.pdf.GetY()
+	b.pdf.ImageOptions(fileName, left, y, width, height, false,
+		gofpdf.ImageOptions{}, 0, "")
+	b.pdf.SetXY(left, y+height+2)
+}
+
+func (b *pdfBook) text(text string, style pdfStyle) {
+	b.setFont(style)
+	text = b.tr(text)
+	switch {
+	case style.link != 0:
+		b.pdf.WriteLinkID(style.lineHeight(), text, style.link)
+	case style.href != "":
+		b.pdf.WriteLinkString(style.lineHeight(), text, style.href)
+	default:
+		b.pdf.Write(style.lineHeight(), text)
+	}
+}
+
+func (b *pdfBook) inline(n *html.Node, style pdfStyle) {
+	switch n.Type {
+	case html.TextNode:
+		text := strings.Join(strings.Fields(n.Data), " ")
+		if text == "" {
+			if n.Data != "" && n.PrevSibling != nil {
+				b.text(" ", style)
+			}
+			return
+		}
+		if strings.TrimLeft(n.Data, " \t\n") != n.Data && n.PrevSibling != nil {
+			text = " " + text
+		}
+		if strings.TrimRight(n.Data, " \t\n") != n.Data && n.NextSibling != nil {
+			text += " "
+		}
+		b.text(text, style)
+		return
+	case html.ElementNode:
+	default:
+		return
+	}
+	switch n.DataAtom {
+	case atom.Br:
+		b.pdf.Ln(style.lineHeight())
+		return
+	case atom.Img:
+		b.image(n, style)
+		return
+	case atom.Source, atom.Script, atom.Style:
+		return
+	case atom.Input:
+		marker := "[ ] "
+		if hasAttr(n, "checked") {
+			marker = "[x] "
+		}
+		b.text(marker, style)
+		return
+	case atom.Strong, atom.B:
+		style.bold = true
+	case atom.Em, atom.I:
+		style.italic = true
+	case atom.Del, atom.S:
+		style.strike = true
+	case atom.Code, atom.Kbd, atom.Samp:
+		style.code = true
+	case atom.A:
+		href := attr(n, "href")
+		if target, ok := wikiPath(href); ok {
+			style.link = b.links[target]
+		} else if strings.HasPrefix(href, "http://") ||
+			strings.HasPrefix(href, "https://") ||
+			strings.HasPrefix(href, "mailto:") {
+			style.href = href
+		}
+	}
+	b.flow(n, style)
+}
+
+func hasAttr(n *html.Node, key string) bool {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *pdfBook) cover() {
+	c := b.col.courses[0]
+	b.pdf.AddPage()
+	b.pdf.SetY(80)
+	b.setFont(pdfStyle{bold: true, size: 28})
+	b.pdf.MultiCell(0, 12, b.tr(c.name), "", "C", false)
+	b.pdf.Ln(4)
+	b.setFont(pdfStyle{size: 16})
+	b.pdf.MultiCell(0, 8, b.tr(b.col.name), "", "C", false)
+	if c.description != "" {
+		b.pdf.Ln(10)
+		b.setFont(pdfStyle{italic: true, size: 12})
+		b.pdf.MultiCell(0, 6, b.tr(c.description), "", "C", false)
+	}
+}
+
+// contents writes the table of contents, the page numbers are left empty
+// when they are not known yet
+func (b *pdfBook) contents(pages []int) {
+	const numberWidth = 15
+	b.pdf.AddPage()
+	b.setFont(pdfStyle{bold: true, size: 18})
+	b.pdf.CellFormat(0, 10, "Contents", "", 1, "L", false, 0, "")
+	b.pdf.Ln(4)
+	width := b.contentWidth() - numberWidth
+	for i, cl := range b.col.courses[0].classes {
+		b.setFont(pdfStyle{})
+		title := b.tr(cl.title)
+		for len(title) > 0 && b.pdf.GetStringWidth(title) > width-2 {
+			title = title[:len(title)-1]
+		}
+		number := ""
+		if pages != nil {
+			number = strconv.Itoa(pages[i])
+		}
+		b.pdf.CellFormat(width, 7, title, "", 0, "L", false, b.classLinks[i],
+			"")
+		b.pdf.CellFormat(numberWidth, 7, number, "", 1, "R", false,
+			b.classLinks[i], "")
+	}
+}
+
+// layout writes the whole book, pages has the first page of each class or
+// nil in the first pass
+func layout(col *collection, rendered []*chapter, pages []int) *pdfBook {
+	c := col.courses[0]
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	pdf.SetMargins(pdfMargin, pdfMargin, pdfMargin)
+	pdf.SetAutoPageBreak(true, pdfMargin)
+	pdf.SetTitle(c.name, true)
+	pdf.SetSubject(col.name, true)
+	b := &pdfBook{
+		pdf:    pdf,
+		tr:     pdf.UnicodeTranslatorFromDescriptor(""),
+		col:    col,
+		images: make(map[string]*gofpdf.ImageInfoType),
+		links:  make(map[string]int),
+	}
+	pdf.SetFooterFunc(func() {
+		if pdf.PageNo() == 1 {
+			return
+		}
+		pdf.SetY(-15)
+		b.setFont(pdfStyle{size: 9})
+		pdf.CellFormat(0, 10, strconv.Itoa(pdf.PageNo()), "", 0, "C", false,
+			0, "")
+	})
+	for _, cl := range c.classes {
+		link := pdf.AddLink()
+		b.classLinks = append(b.classLinks, link)
+		b.links[col.slug+"/"+c.slug+"/"+cl.slug] = link
+	}
+	b.cover()
+	b.contents(pages)
+	for i, ch := range rendered {
+		b.class = ch.class
+		pdf.AddPage()
+		pdf.SetLink(b.classLinks[i], 0, -1)
+		pdf.Bookmark(b.tr(ch.class.title), 0, -1)
+		b.pages = append(b.pages, pdf.PageNo())
+		for _, n := range ch.nodes {
+			if n.Type == html.ElementNode && blockElements[n.DataAtom] {
+				b.newLine()
+				b.block(n)
+				continue
+			}
+			b.inline(n, pdfStyle{})
+		}
+	}
+	return b
+}
+
+// writePDF writes a course as a PDF with a cover, a table of contents and
+// a chapter for each class
+func writePDF(col *collection, w io.Writer) error {
+	rendered, err := chapters(col.courses[0])
+	if err != nil {
+		return err
+	}
+	// The first pass finds the pages of the classes for the contents
+	first := layout(col, rendered, nil)
+	if err = first.pdf.Error(); err != nil {
+		return err
+	}
+	return layout(col, rendered, first.pages).pdf.Output(w)
+}
@@ -0,0 +1,439 @@
+package export
+
+import (
+	"archive/zip"
+	"errors"
+	"github.com/chromz/wiki-backend/internal/job"
+	"github.com/chromz/wiki-backend/internal/textclass"
+	"github.com/chromz/wiki-backend/pkg/markdown"
+	"html"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var headingRegex = regexp.MustCompile(`(?s)<h([1-6]) id="([^"]*)">(.*?)</h[1-6]>`)
+
+var tagRegex = regexp.MustCompile(`<[^>]*>`)
+
+// wikiLinkRegex matches the anchors to classes written by mdproc for wiki
+// links, see permalink.Path
+var wikiLinkRegex = regexp.MustCompile(`(?s)<a href="/wiki/([^"/#?]+)/([^"/#?]+)/([^"/#?]+)(#[^"]*)?"([^>]*)>(.*?)</a>`)
+
+const siteStyle = `body {
+	margin: 0 auto;
+	max-width: 50em;
+	padding: 1em;
+	font-family: sans-serif;
+	line-height: 1.5;
+	color: #222;
+}
+nav.breadcrumbs, nav.pages {
+	font-size: 0.9em;
+	margin: 1em 0;
+}
+nav.pages {
+	display: flex;
+	justify-content: space-between;
+	border-top: 1px solid #ddd;
+	padding-top: 1em;
+}
+nav.toc {
+	background: #f5f5f5;
+	padding: 0.5em 1em;
+}
+nav.toc ul {
+	list-style: none;
+	padding: 0;
+}
+.level-2 { padding-left: 1em; }
+.level-3 { padding-left: 2em; }
+.level-4, .level-5, .level-6 { padding-left: 3em; }
+img { max-width: 100%; height: auto; }
+pre { overflow: auto; background: #f5f5f5; padding: 0.5em; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 0.25em 0.5em; }
+`
+
+var siteTemplates = template.Must(template.New("site").Parse(`
+{{define "head"}}<!DOCTYPE html>
+<html lang="es">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<link rel="stylesheet" href="{{.Root}}style.css">
+{{with .Script}}<script src="{{.}}"></script>
+{{end}}</head>
+<body>
+{{end}}
+{{define "index"}}{{template "head" .}}<header><h1>{{.Title}}</h1>
+{{with .Description}}<p>{{.}}</p>{{end}}</header>
+<main>
+{{range .Courses}}<section>
+<h2><a href="{{.URL}}">{{.Title}}</a></h2>
+<ol>
+{{range .Classes}}<li><a href="{{.URL}}">{{.Title}}</a></li>
+{{end}}</ol>
+</section>
+{{end}}</main>
+</body>
+</html>
+{{end}}
+{{define "course"}}{{template "head" .}}<nav class="breadcrumbs"><a href="../index.html">{{.Grade}}</a></nav>
+<header><h1>{{.Title}}</h1>
+{{with .Description}}<p>{{.}}</p>{{end}}</header>
+<main>
+<ol>
+{{range .Classes}}<li><a href="{{.URL}}">{{.Title}}</a></li>
+{{end}}</ol>
+</main>
+</body>
+</html>
+{{end}}
+{{define "package"}}{{template "head" .}}<main>
+{{.Content}}
+</main>
+</body>
+</html>
+{{end}}
+{{define "class"}}{{template "head" .}}<nav class="breadcrumbs"><a href="../index.html">{{.Grade}}</a> /
+<a href="index.html">{{.Course}}</a></nav>
+{{if .Headings}}<nav class="toc">
+<ul>
+{{range .Headings}}<li class="level-{{.Level}}"><a href="#{{.ID}}">{{.Text}}</a></li>
+{{end}}</ul>
+</nav>
+{{end}}<main>
+{{.Content}}
+</main>
+<nav class="pages">
+<span>{{with .Previous}}<a href="{{.URL}}">&larr; {{.Title}}</a>{{end}}</span>
+<span>{{with .Next}}<a href="{{.URL}}">{{.Title}} &rarr;</a>{{end}}</span>
+</nav>
+</body>
+</html>
+{{end}}
+`))
+
+type heading struct {
+	Level int
+	ID    string
+	Text  string
+}
+
+type link struct {
+	Title string
+	URL   string
+}
+
+type courseEntry struct {
+	link
+	Classes []link
+}
+
+type page struct {
+	Title       string
+	Description string
+	Root        string
+	Grade       string
+	Course      string
+	Courses     []courseEntry
+	Classes     []link
+	Headings    []heading
+	Content     template.HTML
+	Previous    *link
+	Next        *link
+	Script      string
+}
+
+// site writes a collection as static html pages in a zip, every link is
+// relative so it can be opened from a file system
+type site struct {
+	col    *collection
+	writer *zip.Writer
+	// pages maps the wiki paths of the exported classes to their pages
+	pages map[string]string
+}
+
+func coursePath(c *course) string {
+	return c.slug + "/"
+}
+
+func classPath(cl *class) string {
+	return cl.slug + ".html"
+}
+
+// headings returns the headings of rendered html to build a table of
+// contents
+func headings(rendered string) []heading {
+	var result []heading
+	for _, match := range headingRegex.FindAllStringSubmatch(rendered, -1) {
+		level, _ := strconv.Atoi(match[1])
+		text := html.UnescapeString(tagRegex.ReplaceAllString(match[3], ""))
+		result = append(result, heading{
+			Level: level,
+			ID:    html.UnescapeString(match[2]),
+			Text:  strings.TrimSpace(text),
+		})
+	}
+	return result
+}
+
+// relativeAssets points the links to the assets served by the wiki to
+// the assets directory of the site, root is the path from the file to the
+// root of the site
+func relativeAssets(cl *class, content, root string) string {
+	for _, uri := range []string{cl.baseURI, textclass.BaseURI()} {
+		if uri != "" {
+			content = strings.Replace(content, uri, root+"assets/", -1)
+		}
+	}
+	return content
+}
+
+// rewrite points the assets and the wiki links of a rendered class to the
+// copies inside the site, links to classes that are not exported are left
+// as plain text
+func (s *site) rewrite(cl *class, rendered string) string {
+	rendered = relativeAssets(cl, rendered, "../")
+	return wikiLinkRegex.ReplaceAllStringFunc(rendered, func(anchor string) string {
+		match := wikiLinkRegex.FindStringSubmatch(anchor)
+		target, ok := s.pages[match[1]+"/"+match[2]+"/"+match[3]]
+		if !ok {
+			return match[6]
+		}
+		return `<a href="` + html.EscapeString(target+match[4]) + `"` +
+			match[5] + `>` + match[6] + `</a>`
+	})
+}
+
+func (s *site) create(name string) (io.Writer, error) {
+	return s.writer.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+}
+
+func (s *site) writePage(name, templateName string, p *page) error {
+	writer, err := s.create(name)
+	if err != nil {
+		return err
+	}
+	return siteTemplates.ExecuteTemplate(writer, templateName, p)
+}
+
+// copyAssets adds the assets of a class, with the resources downloaded
+// by mdproc, under the same directories they are served from. The pages
+// downloaded by mdproc link their resources through the base uri, those
+// links are made relative. It returns the names of the copies
+func (s *site) copyAssets(c *course, cl *class) ([]string, error) {
+	_, assets := textclass.Dirs(s.col.gradeID, c.id, cl.id)
+	midDir := strings.TrimPrefix(assets, textclass.SyncDir())
+	var names []string
+	err := filepath.Walk(assets, func(name string, info os.FileInfo,
+		err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || info.IsDir() {
+			return err
+		}
+		relative, err := filepath.Rel(assets, name)
+		if err != nil {
+			return err
+		}
+		copyName := midDir + filepath.ToSlash(relative)
+		writer, err := s.create(copyName)
+		if err != nil {
+			return err
+		}
+		names = append(names, copyName)
+		if isPage(name) {
+			content, err := ioutil.ReadFile(name)
+			if err != nil {
+				return err
+			}
+			root := strings.Repeat("../", strings.Count(copyName, "/"))
+			_, err = io.WriteString(writer, relativeAssets(cl,
+				string(content), root))
+			return err
+		}
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(writer, file)
+		return err
+	})
+	return names, err
+}
+
+// isPage tells whether an asset is an html page
+func isPage(name string) bool {
+	extension := strings.ToLower(filepath.Ext(name))
+	return extension == ".html" || extension == ".htm"
+}
+
+func (s *site) writeClass(c *course, index int) error {
+	cl := c.classes[index]
+	content, err := cl.content()
+	if err != nil {
+		return err
+	}
+	rendered, err := markdown.Render(content)
+	if err != nil {
+		return err
+	}
+	p := &page{
+		Title:    cl.title,
+		Root:     "../",
+		Grade:    s.col.name,
+		Course:   c.name,
+		Headings: headings(string(rendered)),
+		Content:  template.HTML(s.rewrite(cl, string(rendered))),
+	}
+	if index > 0 {
+		previous := c.classes[index-1]
+		p.Previous = &link{Title: previous.title, URL: classPath(previous)}
+	}
+	if index < len(c.classes)-1 {
+		next := c.classes[index+1]
+		p.Next = &link{Title: next.title, URL: classPath(next)}
+	}
+	if err = s.writePage(coursePath(c)+classPath(cl), "class", p); err != nil {
+		return err
+	}
+	_, err = s.copyAssets(c, cl)
+	return err
+}
+
+func (s *site) writeIndexes() error {
+	index := &page{
+		Title:       s.col.name,
+		Description: s.col.description,
+		Root:        "",
+	}
+	for _, c := range s.col.courses {
+		entry := courseEntry{link: link{
+			Title: c.name,
+			URL:   coursePath(c) + "index.html",
+		}}
+		coursePage := &page{
+			Title:       c.name,
+			Description: c.description,
+			Root:        "../",
+			Grade:       s.col.name,
+		}
+		for _, cl := range c.classes {
+			coursePage.Classes = append(coursePage.Classes, link{
+				Title: cl.title,
+				URL:   classPath(cl),
+			})
+			entry.Classes = append(entry.Classes, link{
+				Title: cl.title,
+				URL:   coursePath(c) + classPath(cl),
+			})
+		}
+		err := s.writePage(coursePath(c)+"index.html", "course", coursePage)
+		if err != nil {
+			return err
+		}
+		index.Courses = append(index.Courses, entry)
+	}
+	if err := s.writePage("index.html", "index", index); err != nil {
+		return err
+	}
+	writer, err := s.create("style.css")
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(writer, siteStyle)
+	return err
+}
+
+func (s *site) write(j *job.Job) error {
+	for _, c := range s.col.courses {
+		for i := range c.classes {
+			if err := s.writeClass(c, i); err != nil {
+				return err
+			}
+			j.Advance()
+		}
+	}
+	return s.writeIndexes()
+}
+
+// siteName is the name of the downloaded zip
+func siteName(col *collection) string {
+	name := col.slug
+	if len(col.courses) == 1 {
+		name += "-" + col.courses[0].slug
+	}
+	return name + ".zip"
+}
+
+func runSite(j *job.Job, col *collection, userID string) {
+	s := &site{col: col, pages: make(map[string]string)}
+	for _, c := range col.courses {
+		for _, cl := range c.classes {
+			s.pages[col.slug+"/"+c.slug+"/"+cl.slug] = "../" +
+				coursePath(c) + classPath(cl)
+		}
+	}
+	if err := os.MkdirAll(exportDir(), 0700); err != nil {
+		logger.Error("Unable to create export directory", err)
+		j.Fail(errors.New("Unable to write export"))
+		return
+	}
+	fileName := exportDir() + j.ID + ".zip"
+	file, err := os.OpenFile(fileName+".tmp",
+		os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		logger.Error("Unable to create export file", err)
+		j.Fail(errors.New("Unable to write export"))
+		return
+	}
+	s.writer = zip.NewWriter(file)
+	err = s.write(j)
+	if closeErr := s.writer.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(fileName+".tmp", fileName)
+	}
+	if err != nil {
+		logger.Error("Unable to export site", err)
+		os.Remove(fileName + ".tmp")
+		j.Fail(errors.New("Unable to write export"))
+		return
+	}
+	info, err := os.Stat(fileName)
+	if err != nil {
+		j.Fail(errors.New("Unable to write export"))
+		return
+	}
+	register(j.ID, &download{
+		fileName:  fileName,
+		name:      siteName(col),
+		userID:    userID,
+		createdAt: time.Now(),
+	})
+	logger.Info("Export job finished: " + j.ID)
+	j.Finish(&Result{
+		URL:     "/export/" + j.ID,
+		Size:    info.Size(),
+		Classes: col.classCount(),
+	})
+}
@@ -1,8 +1,10 @@
 package grade
 
 import (
+	"database/sql"
 	"encoding/json"
 	"errors"
+	"github.com/chromz/wiki-backend/internal/permalink"
 	"github.com/chromz/wiki-backend/internal/session"
 	"github.com/chromz/wiki-backend/internal/textclass"
 	"github.com/chromz/wiki-backend/pkg/errormessages"
@@ -19,7 +21,8 @@ const GradeDDL = `
 CREATE TABLE IF NOT EXISTS "grade" (
 	"id"	INTEGER PRIMARY KEY AUTOINCREMENT UNIQUE,
 	"name"	TEXT NOT NULL,
-	"description"	TEXT
+	"description"	TEXT,
+	"slug"	TEXT NOT NULL DEFAULT ''
 );
 `
 
@@ -28,6 +31,7 @@ type Grade struct {
 	ID          int64  `json:"id"`
 	Name        string `json:"name"`
 	Description string `json:"description"`
+	Slug        string `json:"slug"`
 }
 
 // Validate validates grade values
@@ -38,6 +42,72 @@ func (g *Grade) Validate() error {
 	return nil
 }
 
+// Insert adds the grade to the database inside a transaction
+func (g *Grade) Insert(tx *sql.Tx) error {
+	var err error
+	g.Slug, err = permalink.Grade.Unique(tx, 0, 0, g.Name)
+	if err != nil {
+		return err
+	}
+	insertQuery := `
+		INSERT INTO grade(name, description, slug)
+		VALUES(?, ?, ?)
+	`
+	res, err := tx.Exec(insertQuery, g.Name, g.Description, g.Slug)
+	if err != nil {
+		return err
+	}
+	g.ID, err = res.LastInsertId()
+	return err
+}
+
+// Save updates the grade inside a transaction, it returns sql.ErrNoRows
+// when the grade does not exist. The old slug redirects to the grade
+// when the name changes
+func (g *Grade) Save(tx *sql.Tx) error {
+	var oldSlug string
+	findQuery := `
+		SELECT slug
+		FROM grade
+		WHERE id = ?
+	`
+	if err := tx.QueryRow(findQuery, g.ID).Scan(&oldSlug); err != nil {
+		return err
+	}
+	var err error
+	g.Slug, err = permalink.Grade.Unique(tx, 0, g.ID, g.Name)
+	if err != nil {
+		return err
+	}
+	updateQuery := `
+		UPDATE grade
+		SET name = ?, description = ?, slug = ?
+		WHERE id = ?
+	`
+	_, err = tx.Exec(updateQuery, g.Name, g.Description, g.Slug, g.ID)
+	if err != nil {
+		return err
+	}
+	return permalink.Grade.Rename(tx, 0, g.ID, oldSlug, g.Slug)
+}
+
+// Remove deletes a grade inside a transaction, it returns sql.ErrNoRows
+// when the grade does not exist
+func Remove(tx *sql.Tx, gradeID int64) error {
+	deleteQuery := `
+		DELETE FROM grade
+		WHERE id = ?
+	`
+	res, err := tx.Exec(deleteQuery, gradeID)
+	if err != nil {
+		return err
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected != 1 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
 // Create creates a grade resource
 func Create(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
@@ -69,18 +139,13 @@ func Create(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		return
 	}
 
-	insertQuery := `
-		INSERT INTO grade(name, description)
-		VALUES(?, ?)
-	`
-	res, err := tx.Exec(insertQuery, grade.Name, grade.Description)
+	err = grade.Insert(tx)
 	if err != nil {
 		errormessages.WriteErrorMessage(w, "Unable to add grade",
 			http.StatusInternalServerError)
 		tx.Rollback()
 		return
 	}
-	grade.ID, _ = res.LastInsertId()
 	dirName := textclass.SyncDir() + strconv.FormatInt(grade.ID, 10) + "/"
 	if err = os.Mkdir(dirName, 0700); err != nil {
 		errormessages.WriteErrorMessage(w, "Unable  to create grade",
@@ -131,7 +196,7 @@ func Read(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	}
 	db := persistence.GetDb()
 	findQuery := `
-		SELECT id, name, description
+		SELECT id, name, description, slug
 		FROM grade
 		WHERE id > ?
 		LIMIT ?
@@ -152,7 +217,8 @@ func Read(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	var grades []Grade
 	for rows.Next() {
 		grade := Grade{}
-		err = rows.Scan(&grade.ID, &grade.Name, &grade.Description)
+		err = rows.Scan(&grade.ID, &grade.Name, &grade.Description,
+			&grade.Slug)
 		if err != nil {
 			errormessages.WriteErrorMessage(w,
 				"Unable to find grades",
@@ -172,6 +238,43 @@ func Read(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	json.NewEncoder(w).Encode(page)
 }
 
+// ReadBySlug returns a grade by its slug, old slugs redirect to the
+// current one
+func ReadBySlug(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	db := persistence.GetDb()
+	ids, slugs, redirected, err := permalink.ResolvePath(db,
+		p.ByName("grade"))
+	if err == sql.ErrNoRows {
+		errormessages.WriteErrorInterface(w, "Grade does not exists",
+			http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to find grade",
+			http.StatusInternalServerError)
+		return
+	}
+	if redirected {
+		permalink.Redirect(w, r, slugs)
+		return
+	}
+	grade := &Grade{}
+	findQuery := `
+		SELECT id, name, IFNULL(description, ''), slug
+		FROM grade
+		WHERE id = ?
+	`
+	err = db.QueryRow(findQuery, ids[0]).Scan(&grade.ID, &grade.Name,
+		&grade.Description, &grade.Slug)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to find grade",
+			http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(grade)
+}
+
 // Update updates a grade resource
 func Update(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 
@@ -210,22 +313,31 @@ func Update(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		return
 	}
 	db := persistence.GetDb()
-	updateQuery := `
-		UPDATE grade
-		SET name = ?, description = ?
-		WHERE id = ?
-	`
-	res, err := db.Exec(updateQuery, grade.Name, grade.Description, grade.ID)
-	rowsAffected, _ := res.RowsAffected()
-	if rowsAffected != 1 {
+	tx, err := db.Begin()
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to reach database",
+			http.StatusInternalServerError)
+		return
+	}
+	err = grade.Save(tx)
+	if err == sql.ErrNoRows {
 		errormessages.WriteErrorInterface(w, "Id not found",
 			http.StatusNotFound)
+		tx.Rollback()
 		return
-
 	}
 	if err != nil {
 		errormessages.WriteErrorInterface(w, "Unable to update grade",
 			http.StatusInternalServerError)
+		tx.Rollback()
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		errString := "Unable to update grade"
+		errormessages.WriteErrorMessage(w, errString,
+			http.StatusInternalServerError)
+		tx.Rollback()
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
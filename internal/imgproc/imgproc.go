@@ -0,0 +1,499 @@
+package imgproc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"github.com/chai2010/webp"
+	"github.com/chromz/wiki-backend/pkg/exif"
+	"github.com/chromz/wiki-backend/pkg/log"
+	"github.com/chromz/wiki-backend/pkg/persistence"
+	"github.com/disintegration/imaging"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ImageDDL is the query to create the table of processed images, sources
+// are paths relative to the assets directory
+const ImageDDL = `
+CREATE TABLE IF NOT EXISTS "image" (
+	"source"	TEXT NOT NULL PRIMARY KEY,
+	"hash"	TEXT NOT NULL,
+	"width"	INTEGER NOT NULL,
+	"height"	INTEGER NOT NULL,
+	"processed_at"	INTEGER NOT NULL
+);
+`
+
+// VariantDDL is the query to create the table of resized copies and
+// thumbnails of the images
+const VariantDDL = `
+CREATE TABLE IF NOT EXISTS "image_variant" (
+	"source"	TEXT NOT NULL,
+	"file_name"	TEXT NOT NULL,
+	"kind"	TEXT NOT NULL,
+	"format"	TEXT NOT NULL,
+	"width"	INTEGER NOT NULL,
+	"height"	INTEGER NOT NULL,
+	PRIMARY KEY("source","file_name"),
+	FOREIGN KEY("source") REFERENCES "image"("source") ON DELETE CASCADE
+);
+`
+
+// Kinds of variants
+const (
+	Resized   = "resized"
+	Thumbnail = "thumbnail"
+)
+
+// variantsDir is the directory next to an image holding its variants, it
+// is never processed itself
+const variantsDir = "_variants"
+
+// maxPixels is the largest image that is decoded, bigger images are
+// recorded as broken so a small file can not expand into gigabytes
+const maxPixels = 40000000
+
+// settle is how long a file must stay untouched before it is processed so
+// downloads in progress are not read
+const settle = 2 * time.Second
+
+var extensions = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".webp": true,
+}
+
+var logger = log.GetLogger()
+
+var errTooLarge = errors.New("Image is too large")
+
+// Processor is a struct that processes the images of the assets directory
+// every polling rate
+type Processor struct {
+	ticker *time.Ticker
+}
+
+var assetsDir string
+var widths []int
+var thumbnailSize int
+var quality int
+
+// NewProcessor constructor of the image processor, images are resized to
+// every width smaller than them and encoded with the quality
+func NewProcessor(directory string, pollingRate int, widthsFlag []int,
+	thumbnailFlag, qualityFlag int) *Processor {
+	assetsDir = directory + "assets/"
+	widths = widthsFlag
+	thumbnailSize = thumbnailFlag
+	quality = qualityFlag
+	return &Processor{
+		ticker: time.NewTicker(time.Millisecond * time.Duration(pollingRate)),
+	}
+}
+
+// Variant is a resized copy or a thumbnail of an image
+type Variant struct {
+	FileName string
+	Kind     string
+	Format   string
+	Width    int
+	Height   int
+	data     []byte
+}
+
+func hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// clean strips the metadata of an image, images rotated by their EXIF
+// orientation are re-encoded upright since the orientation is lost.
+// Images over maxPixels are rejected before they are decoded
+func clean(data []byte) ([]byte, image.Image, string, error) {
+	stripped, rotation, err := exif.Strip(data)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(stripped))
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if config.Width <= 0 || config.Height <= 0 ||
+		int64(config.Width)*int64(config.Height) > maxPixels {
+		return nil, nil, "", errTooLarge
+	}
+	img, format, err := image.Decode(bytes.NewReader(stripped))
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if rotation == 1 {
+		return stripped, img, format, nil
+	}
+	img, err = imaging.Decode(bytes.NewReader(data),
+		imaging.AutoOrientation(true))
+	if err != nil {
+		return nil, nil, "", err
+	}
+	var out bytes.Buffer
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&out, img, &jpeg.Options{Quality: 92})
+	case "png":
+		err = png.Encode(&out, img)
+	default:
+		err = webp.Encode(&out, img, &webp.Options{Quality: 92})
+	}
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return out.Bytes(), img, format, nil
+}
+
+func opaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
+
+// encode returns the variant of an image in a format
+func encode(img image.Image, name, kind, format string) (*Variant, error) {
+	var out bytes.Buffer
+	var err error
+	extension := "." + format
+	switch format {
+	case "webp":
+		err = webp.Encode(&out, img, &webp.Options{Quality: float32(quality)})
+	case "jpeg":
+		extension = ".jpg"
+		err = jpeg.Encode(&out, img, &jpeg.Options{Quality: quality})
+	default:
+		encoder := &png.Encoder{CompressionLevel: png.BestCompression}
+		err = encoder.Encode(&out, img)
+	}
+	if err != nil {
+		return nil, err
+	}
+	bounds := img.Bounds()
+	return &Variant{
+		FileName: name + extension,
+		Kind:     kind,
+		Format:   format,
+		Width:    bounds.Dx(),
+		Height:   bounds.Dy(),
+		data:     out.Bytes(),
+	}, nil
+}
+
+// variants resizes an image to the widths smaller than it plus its own
+// width and crops a square thumbnail, each one as WebP and as a fallback
+// for browsers without WebP support
+func variants(source string, img image.Image, format string) ([]*Variant,
+	error) {
+	fallback := "jpeg"
+	if format == "png" || !opaque(img) {
+		fallback = "png"
+	}
+	dir, base := path.Split(source)
+	prefix := dir + variantsDir + "/" + base
+	bounds := img.Bounds()
+	var sizes []int
+	for _, width := range widths {
+		if width < bounds.Dx() {
+			sizes = append(sizes, width)
+		}
+	}
+	sizes = append(sizes, bounds.Dx())
+	var result []*Variant
+	for _, width := range sizes {
+		resized := img
+		if width != bounds.Dx() {
+			resized = imaging.Resize(img, width, 0, imaging.Lanczos)
+		}
+		name := prefix + "-" + strconv.Itoa(width) + "w"
+		for _, variantFormat := range []string{"webp", fallback} {
+			variant, err := encode(resized, name, Resized, variantFormat)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, variant)
+		}
+	}
+	thumbnail := imaging.Fill(img, thumbnailSize, thumbnailSize,
+		imaging.Center, imaging.Lanczos)
+	for _, variantFormat := range []string{"webp", fallback} {
+		variant, err := encode(thumbnail, prefix+"-thumb", Thumbnail,
+			variantFormat)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, variant)
+	}
+	return result, nil
+}
+
+// writeFile replaces a file atomically so readers never see it partially
+// written
+func writeFile(fileName string, data []byte) error {
+	dir := filepath.Dir(fileName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(dir, ".imgproc")
+	if err != nil {
+		return err
+	}
+	_, err = tmpFile.Write(data)
+	tmpFile.Close()
+	if err == nil {
+		err = os.Chmod(tmpFile.Name(), 0600)
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), fileName)
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+	}
+	return err
+}
+
+// requeue marks the class owning an asset as unprocessed so its markdown
+// picks up the new variants
+func requeue(db *sql.DB, source string) {
+	parts := strings.Split(source, "/")
+	if len(parts) < 4 {
+		return
+	}
+	classID, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return
+	}
+	updateQuery := `
+		UPDATE text_class
+		SET proc_file_name = ''
+		WHERE id = ?
+		AND proc_file_name != ''
+	`
+	if _, err = db.Exec(updateQuery, classID); err != nil {
+		logger.Error("Unable to requeue text class", err)
+	}
+}
+
+// processImage strips an image and generates its variants, images whose
+// content did not change since the last run are skipped
+func processImage(db *sql.DB, source string) error {
+	fileName := assetsDir + source
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	var storedHash string
+	findQuery := `
+		SELECT hash
+		FROM image
+		WHERE source = ?
+	`
+	err = db.QueryRow(findQuery, source).Scan(&storedHash)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if storedHash == hash(data) {
+		return nil
+	}
+	cleaned, img, format, err := clean(data)
+	if err != nil {
+		// Broken images are recorded so they are not retried until they
+		// change
+		if storeErr := store(db, source, hash(data), 0, 0,
+			nil); storeErr != nil {
+			return storeErr
+		}
+		return err
+	}
+	cleanedHash := hash(cleaned)
+	if !bytes.Equal(cleaned, data) {
+		if err = writeFile(fileName, cleaned); err != nil {
+			return err
+		}
+	}
+	if storedHash == cleanedHash {
+		// The image was downloaded again with its metadata
+		return nil
+	}
+	newVariants, err := variants(source, img, format)
+	if err != nil {
+		return err
+	}
+	for _, variant := range newVariants {
+		if err = writeFile(assetsDir+variant.FileName, variant.data); err != nil {
+			return err
+		}
+	}
+	bounds := img.Bounds()
+	err = store(db, source, cleanedHash, bounds.Dx(), bounds.Dy(),
+		newVariants)
+	if err != nil {
+		return err
+	}
+	logger.Info("Processed image: " + fileName)
+	requeue(db, source)
+	return nil
+}
+
+// store replaces the variants of an image and removes the files of the
+// variants that are no longer generated
+func store(db *sql.DB, source, imageHash string, width, height int,
+	newVariants []*Variant) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	old, err := Variants(tx, source)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	upsertQuery := `
+		INSERT INTO image(source, hash, width, height, processed_at)
+		VALUES(?, ?, ?, ?, ?)
+		ON CONFLICT(source) DO UPDATE
+		SET hash = excluded.hash,
+		width = excluded.width,
+		height = excluded.height,
+		processed_at = excluded.processed_at
+	`
+	_, err = tx.Exec(upsertQuery, source, imageHash, width, height,
+		time.Now().Unix())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	deleteQuery := `
+		DELETE FROM image_variant
+		WHERE source = ?
+	`
+	if _, err = tx.Exec(deleteQuery, source); err != nil {
+		tx.Rollback()
+		return err
+	}
+	insertQuery := `
+		INSERT INTO image_variant(source, file_name, kind, format, width,
+		height)
+		VALUES(?, ?, ?, ?, ?, ?)
+	`
+	current := make(map[string]bool)
+	for _, variant := range newVariants {
+		current[variant.FileName] = true
+		_, err = tx.Exec(insertQuery, source, variant.FileName,
+			variant.Kind, variant.Format, variant.Width, variant.Height)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	for _, variant := range old {
+		if !current[variant.FileName] {
+			os.Remove(assetsDir + variant.FileName)
+		}
+	}
+	return nil
+}
+
+// remove deletes the variants of the images that no longer exist
+func remove(db *sql.DB, seen map[string]bool) error {
+	rows, err := db.Query("SELECT source FROM image")
+	if err != nil {
+		return err
+	}
+	var gone []string
+	for rows.Next() {
+		var source string
+		if err = rows.Scan(&source); err != nil {
+			rows.Close()
+			return err
+		}
+		if !seen[source] {
+			gone = append(gone, source)
+		}
+	}
+	rows.Close()
+	for _, source := range gone {
+		old, err := Variants(db, source)
+		if err != nil {
+			return err
+		}
+		if _, err = db.Exec("DELETE FROM image WHERE source = ?",
+			source); err != nil {
+			return err
+		}
+		for _, variant := range old {
+			os.Remove(assetsDir + variant.FileName)
+		}
+		logger.Info("Removed variants of image: " + source)
+		requeue(db, source)
+	}
+	return nil
+}
+
+func process() {
+	db := persistence.GetDb()
+	seen := make(map[string]bool)
+	settled := time.Now().Add(-settle)
+	err := filepath.Walk(assetsDir, func(fileName string, info os.FileInfo,
+		err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == variantsDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		extension := strings.ToLower(filepath.Ext(fileName))
+		if !extensions[extension] {
+			return nil
+		}
+		source := filepath.ToSlash(strings.TrimPrefix(fileName, assetsDir))
+		seen[source] = true
+		if info.ModTime().After(settled) {
+			return nil
+		}
+		if err := processImage(db, source); err != nil {
+			logger.Error("Unable to process image "+fileName, err)
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Error("Unable to walk assets", err)
+		return
+	}
+	if err = remove(db, seen); err != nil {
+		logger.Error("Unable to remove variants", err)
+	}
+}
+
+// Run starts the processor
+func (processor *Processor) Run() {
+	for {
+		select {
+		case <-processor.ticker.C:
+			process()
+		}
+	}
+}
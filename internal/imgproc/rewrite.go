@@ -0,0 +1,130 @@
+package imgproc
+
+import (
+	"database/sql"
+	"github.com/chromz/wiki-backend/pkg/markdown"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// imageRegex matches markdown images with an optional title
+var imageRegex = regexp.MustCompile(
+	`!\[([^\]\n]*)\]\(\s*<?([^)\s>]+)>?(?:\s+"([^"\n]*)")?\s*\)`)
+
+// queryer is satisfied by both *sql.DB and *sql.Tx
+type queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Variants returns the variants of an image ordered by width
+func Variants(q queryer, source string) ([]Variant, error) {
+	findQuery := `
+		SELECT file_name, kind, format, width, height
+		FROM image_variant
+		WHERE source = ?
+		ORDER BY kind, width, format
+	`
+	rows, err := q.Query(findQuery, source)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []Variant
+	for rows.Next() {
+		var variant Variant
+		err = rows.Scan(&variant.FileName, &variant.Kind, &variant.Format,
+			&variant.Width, &variant.Height)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, variant)
+	}
+	return result, rows.Err()
+}
+
+// srcset lists the resized variants of a format as image candidates
+func srcset(baseURI string, resized []Variant, format string) string {
+	var candidates []string
+	for _, variant := range resized {
+		if variant.Format == format {
+			candidates = append(candidates, baseURI+variant.FileName+" "+
+				strconv.Itoa(variant.Width)+"w")
+		}
+	}
+	return strings.Join(candidates, ", ")
+}
+
+// picture returns the html of an image that lets the browser pick the
+// variant that fits the screen, WebP is preferred when it is supported
+func picture(baseURI, src, alt, title string, resized []Variant) string {
+	largest := resized[len(resized)-1]
+	fallback := "jpeg"
+	for _, variant := range resized {
+		if variant.Format == "png" {
+			fallback = "png"
+		}
+	}
+	sizes := "(max-width: " + strconv.Itoa(largest.Width) + "px) 100vw, " +
+		strconv.Itoa(largest.Width) + "px"
+	var builder strings.Builder
+	builder.WriteString(`<picture><source type="image/webp" srcset="`)
+	builder.WriteString(html.EscapeString(srcset(baseURI, resized, "webp")))
+	builder.WriteString(`" sizes="` + sizes + `"><img src="`)
+	builder.WriteString(html.EscapeString(src))
+	builder.WriteString(`" srcset="`)
+	builder.WriteString(html.EscapeString(srcset(baseURI, resized, fallback)))
+	builder.WriteString(`" sizes="` + sizes + `" alt="`)
+	builder.WriteString(html.EscapeString(alt))
+	builder.WriteString(`"`)
+	if title != "" {
+		builder.WriteString(` title="` + html.EscapeString(title) + `"`)
+	}
+	builder.WriteString(` width="` + strconv.Itoa(largest.Width) +
+		`" height="` + strconv.Itoa(largest.Height) + `"></picture>`)
+	return builder.String()
+}
+
+// Rewrite replaces the images of a markdown that have variants under the
+// base uri with pictures listing the variants in their srcset, other
+// images are left as they are
+func Rewrite(q queryer, baseURI, text string) (string, error) {
+	if baseURI == "" {
+		return text, nil
+	}
+	masked := markdown.MaskCode(text)
+	var builder strings.Builder
+	last := 0
+	for _, match := range imageRegex.FindAllStringSubmatchIndex(masked, -1) {
+		src := text[match[4]:match[5]]
+		if !strings.HasPrefix(src, baseURI) {
+			continue
+		}
+		all, err := Variants(q, strings.TrimPrefix(src, baseURI))
+		if err != nil {
+			return "", err
+		}
+		var resized []Variant
+		for _, variant := range all {
+			if variant.Kind == Resized {
+				resized = append(resized, variant)
+			}
+		}
+		if len(resized) == 0 {
+			continue
+		}
+		var title string
+		if match[6] >= 0 {
+			title = text[match[6]:match[7]]
+		}
+		builder.WriteString(text[last:match[0]])
+		builder.WriteString(picture(baseURI, src, text[match[2]:match[3]],
+			title, resized))
+		last = match[1]
+	}
+	builder.WriteString(text[last:])
+	return builder.String(), nil
+}
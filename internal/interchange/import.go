@@ -0,0 +1,657 @@
+package interchange
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/chromz/wiki-backend/internal/course"
+	"github.com/chromz/wiki-backend/internal/editlock"
+	"github.com/chromz/wiki-backend/internal/grade"
+	"github.com/chromz/wiki-backend/internal/publication"
+	"github.com/chromz/wiki-backend/internal/revision"
+	"github.com/chromz/wiki-backend/internal/session"
+	"github.com/chromz/wiki-backend/internal/tag"
+	"github.com/chromz/wiki-backend/internal/textclass"
+	"github.com/chromz/wiki-backend/pkg/errormessages"
+	"github.com/chromz/wiki-backend/pkg/persistence"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxDocumentSize is the maximum size of an imported document
+const maxDocumentSize = 200 << 20
+
+// importMessage is the message of the revisions written by imports
+const importMessage = "Imported from interchange document"
+
+// Conflict strategies, a grade, course or class conflicts with an existing
+// one with the same slug or, when there is none, the same name or title
+// under the same parent.
+//
+// Skip keeps what exists, conflicting grades and courses receive the new
+// content and conflicting classes are left untouched. Update does the same
+// but replaces the descriptions of grades and courses and the markdown,
+// tags and assets of classes. Copy always creates new resources
+const (
+	Skip   = "skip"
+	Update = "update"
+	Copy   = "copy"
+)
+
+// Actions of the changes of an import
+const (
+	ActionCreate    = "create"
+	ActionUpdate    = "update"
+	ActionMatch     = "match"
+	ActionSkip      = "skip"
+	ActionUnchanged = "unchanged"
+)
+
+// Change is what an import does with a grade, course or class of the
+// document. SourceID is its id in the document and ID the one in this
+// instance, it is 0 for resources a dry run would create. Conflict tells
+// if it matched an existing resource by slug or title
+type Change struct {
+	Kind     string `json:"kind"`
+	Action   string `json:"action"`
+	SourceID int64  `json:"sourceId"`
+	ID       int64  `json:"id"`
+	Title    string `json:"title"`
+	Conflict string `json:"conflict,omitempty"`
+}
+
+// Report is the result of an import, Assets is the number of asset files
+// written
+type Report struct {
+	DryRun  bool     `json:"dryRun"`
+	Changes []Change `json:"changes"`
+	Assets  int      `json:"assets"`
+}
+
+// pendingClass is a class whose content is stored once every class of the
+// document has a row, so wiki links between them resolve
+type pendingClass struct {
+	class    *Class
+	gradeID  int64
+	courseID int64
+	change   int
+	existing bool
+}
+
+type importer struct {
+	tx         *sql.Tx
+	doc        *Document
+	onConflict string
+	dryRun     bool
+	authorID   string
+	report     *Report
+	pending    []*pendingClass
+	// createdDirs are removed and replaced files restored when the import
+	// fails, replaced holds the previous content of the files, nil for
+	// the ones that did not exist
+	createdDirs []string
+	replaced    map[string][]byte
+}
+
+func (im *importer) add(change Change) int {
+	im.report.Changes = append(im.report.Changes, change)
+	return len(im.report.Changes) - 1
+}
+
+func (im *importer) mkdirs(dirs ...string) error {
+	for _, dir := range dirs {
+		if _, err := os.Stat(dir); err == nil {
+			continue
+		}
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+		im.createdDirs = append(im.createdDirs, dir)
+	}
+	return nil
+}
+
+// backup keeps the content of a file before it is first replaced
+func (im *importer) backup(fileName string) error {
+	if _, ok := im.replaced[fileName]; ok {
+		return nil
+	}
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		im.replaced[fileName] = nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	im.replaced[fileName] = data
+	return nil
+}
+
+// cleanup restores the files replaced by a failed import and removes the
+// directories it created
+func (im *importer) cleanup() {
+	for fileName, data := range im.replaced {
+		var err error
+		if data == nil {
+			err = os.Remove(fileName)
+		} else {
+			err = ioutil.WriteFile(fileName, data, 0600)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			logger.Error("Unable to restore imported file", err)
+		}
+	}
+	for i := len(im.createdDirs) - 1; i >= 0; i-- {
+		os.RemoveAll(im.createdDirs[i])
+	}
+}
+
+// find returns the id of the resource a grade, course or class of the
+// document conflicts with and what matched, parentID is 0 for parents that
+// do not exist yet
+func (im *importer) find(table, nameColumn, parentColumn string,
+	parentID int64, slug, name string) (int64, string, error) {
+	filter := "1"
+	args := []interface{}{}
+	if parentColumn != "" {
+		if parentID == 0 {
+			return 0, "", nil
+		}
+		filter = parentColumn + " = ?"
+		args = append(args, parentID)
+	}
+	keys := []struct {
+		column   string
+		value    string
+		conflict string
+	}{
+		{"slug", slug, "slug"},
+		{nameColumn, name, "title"},
+	}
+	for _, key := range keys {
+		if key.value == "" {
+			continue
+		}
+		findQuery := `
+			SELECT id
+			FROM "` + table + `"
+			WHERE ` + filter + ` AND ` + key.column + ` = ?
+			ORDER BY id
+			LIMIT 1
+		`
+		var id int64
+		err := im.tx.QueryRow(findQuery, append(args, key.value)...).Scan(&id)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return 0, "", err
+		}
+		return id, key.conflict, nil
+	}
+	return 0, "", nil
+}
+
+// updateDescription replaces the description of a grade or course, it
+// reports if it changed
+func (im *importer) updateDescription(table string, id int64,
+	description string) (bool, error) {
+	if im.dryRun {
+		var count int
+		countQuery := `
+			SELECT COUNT(*)
+			FROM "` + table + `"
+			WHERE id = ? AND IFNULL(description, '') != ?
+		`
+		err := im.tx.QueryRow(countQuery, id, description).Scan(&count)
+		return count > 0, err
+	}
+	updateQuery := `
+		UPDATE "` + table + `"
+		SET description = ?
+		WHERE id = ? AND IFNULL(description, '') != ?
+	`
+	res, err := im.tx.Exec(updateQuery, description, id, description)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := res.RowsAffected()
+	return rowsAffected > 0, err
+}
+
+func status(value string) string {
+	if value == "" {
+		return publication.Draft
+	}
+	return value
+}
+
+// importGrade creates or matches a grade, targetID is the grade receiving
+// the courses when the import is into an existing grade
+func (im *importer) importGrade(g *Grade, targetID int64) error {
+	gradeID := targetID
+	if gradeID == 0 {
+		id, conflict, err := im.find("grade", "name", "", 0, g.Slug, g.Name)
+		if err != nil {
+			return err
+		}
+		change := Change{Kind: "grade", SourceID: g.ID, Title: g.Name,
+			Conflict: conflict}
+		if id != 0 && im.onConflict != Copy {
+			gradeID, change.ID, change.Action = id, id, ActionMatch
+			if im.onConflict == Update {
+				updated, err := im.updateDescription("grade", id,
+					g.Description)
+				if err != nil {
+					return err
+				}
+				if updated {
+					change.Action = ActionUpdate
+				}
+			}
+		} else {
+			change.Action = ActionCreate
+			if !im.dryRun {
+				newGrade := &grade.Grade{Name: g.Name,
+					Description: g.Description}
+				if err = newGrade.Insert(im.tx); err != nil {
+					return err
+				}
+				gradeID, change.ID = newGrade.ID, newGrade.ID
+				if err = im.mkdirs(textclass.Dirs(gradeID)); err != nil {
+					return err
+				}
+			}
+		}
+		im.add(change)
+	}
+	for _, c := range g.Courses {
+		if err := im.importCourse(gradeID, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (im *importer) importCourse(gradeID int64, c *Course) error {
+	id, conflict, err := im.find("course", "name", "grade_id", gradeID,
+		c.Slug, c.Name)
+	if err != nil {
+		return err
+	}
+	change := Change{Kind: "course", SourceID: c.ID, Title: c.Name,
+		Conflict: conflict}
+	courseID := id
+	if id != 0 && im.onConflict != Copy {
+		change.ID, change.Action = id, ActionMatch
+		if im.onConflict == Update {
+			updated, err := im.updateDescription("course", id,
+				c.Description)
+			if err != nil {
+				return err
+			}
+			if updated {
+				change.Action = ActionUpdate
+			}
+		}
+	} else {
+		courseID, change.Action = 0, ActionCreate
+		if !im.dryRun {
+			newCourse := &course.Course{
+				GradeID:     gradeID,
+				Name:        c.Name,
+				Description: c.Description,
+				Status:      status(c.Status),
+			}
+			if err = newCourse.Insert(im.tx); err != nil {
+				return err
+			}
+			courseID, change.ID = newCourse.ID, newCourse.ID
+			err = im.mkdirs(textclass.Dirs(gradeID, courseID))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	im.add(change)
+	for _, cl := range c.Classes {
+		if err = im.importClass(gradeID, courseID, cl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (im *importer) importClass(gradeID, courseID int64, cl *Class) error {
+	id, conflict, err := im.find("text_class", "title", "course_id",
+		courseID, cl.Slug, cl.Title)
+	if err != nil {
+		return err
+	}
+	change := Change{Kind: "textclass", SourceID: cl.ID, Title: cl.Title,
+		Conflict: conflict, ID: id}
+	pending := &pendingClass{class: cl, gradeID: gradeID,
+		courseID: courseID}
+	switch {
+	case id != 0 && im.onConflict == Skip:
+		change.Action = ActionSkip
+		im.add(change)
+		return nil
+	case id != 0 && im.onConflict == Update:
+		// The action depends on what differs, it is set with the content
+		pending.existing = true
+	default:
+		change.ID, change.Action = 0, ActionCreate
+		if !im.dryRun {
+			newClass := &textclass.TextClass{
+				CourseID: courseID,
+				Title:    cl.Title,
+				Status:   status(cl.Status),
+			}
+			if err = newClass.Insert(im.tx); err != nil {
+				return err
+			}
+			change.ID = newClass.ID
+			err = im.mkdirs(textclass.Dirs(gradeID, courseID, newClass.ID))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	pending.change = im.add(change)
+	im.pending = append(im.pending, pending)
+	return nil
+}
+
+func sameTags(current, tags []string) bool {
+	wanted := make(map[string]bool)
+	for _, name := range tags {
+		wanted[name] = true
+	}
+	if len(current) != len(wanted) {
+		return false
+	}
+	for _, name := range current {
+		if !wanted[name] {
+			return false
+		}
+	}
+	return true
+}
+
+func (im *importer) currentTags(classID int64) ([]string, error) {
+	findQuery := `
+		SELECT tag.name
+		FROM tag
+		JOIN text_class_tag ON text_class_tag.tag_id = tag.id
+		WHERE text_class_tag.text_class_id = ?
+	`
+	rows, err := im.tx.Query(findQuery, classID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// changedAssets returns the assets of a class that are missing or differ
+// from the files in its assets directory
+func changedAssets(assets string, list []Asset) []Asset {
+	var changed []Asset
+	for _, asset := range list {
+		data, err := ioutil.ReadFile(assets + filepath.FromSlash(asset.Path))
+		if err != nil || revision.Hash(data) != asset.SHA256 {
+			changed = append(changed, asset)
+		}
+	}
+	return changed
+}
+
+func (im *importer) writeAssets(assets string, list []Asset) error {
+	for _, asset := range list {
+		fileName := assets + filepath.FromSlash(asset.Path)
+		if err := os.MkdirAll(filepath.Dir(fileName), 0700); err != nil {
+			return err
+		}
+		if err := im.backup(fileName); err != nil {
+			return err
+		}
+		err := ioutil.WriteFile(fileName, im.doc.Blobs[asset.SHA256], 0600)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storeClass writes the markdown, tags and assets of a class, matched
+// classes are only written when something differs. The files it replaces
+// are kept so a failed import can restore them
+func (im *importer) storeClass(p *pendingClass) error {
+	change := &im.report.Changes[p.change]
+	classID := change.ID
+	_, assets := textclass.Dirs(p.gradeID, p.courseID, classID)
+	midDir := strings.TrimPrefix(assets, textclass.SyncDir()+"assets/")
+	content := strings.Replace(p.class.Markdown, assetScheme,
+		textclass.BaseURI()+midDir, -1)
+	changed := p.class.Assets
+	contentChanged := content != ""
+	tagsChanged := len(p.class.Tags) > 0
+	if p.existing {
+		changed = changedAssets(assets, p.class.Assets)
+		var fileName string
+		findQuery := `
+			SELECT file_name
+			FROM text_class
+			WHERE id = ?
+		`
+		err := im.tx.QueryRow(findQuery, classID).Scan(&fileName)
+		if err != nil {
+			return err
+		}
+		var current []byte
+		if fileName != "" {
+			current, err = ioutil.ReadFile(fileName)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		contentChanged = string(current) != content
+		tags, err := im.currentTags(classID)
+		if err != nil {
+			return err
+		}
+		tagsChanged = !sameTags(tags, p.class.Tags)
+		change.Action = ActionUnchanged
+		if contentChanged || tagsChanged || len(changed) > 0 {
+			change.Action = ActionUpdate
+			err = editlock.Guard(im.tx, classID, im.authorID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	im.report.Assets += len(changed)
+	if im.dryRun {
+		return nil
+	}
+	if err := im.writeAssets(assets, changed); err != nil {
+		return err
+	}
+	if tagsChanged {
+		if err := tag.Set(im.tx, classID, p.class.Tags); err != nil {
+			return err
+		}
+	}
+	if contentChanged {
+		fileName, err := textclass.MarkdownFile(im.tx, classID)
+		if err != nil {
+			return err
+		}
+		if err = im.backup(fileName); err != nil {
+			return err
+		}
+		_, err = textclass.StoreMarkdown(im.tx, classID, im.authorID,
+			importMessage, []byte(content))
+		return err
+	}
+	return nil
+}
+
+func (im *importer) run(targetID int64) error {
+	for _, g := range im.doc.Grades {
+		if err := im.importGrade(g, targetID); err != nil {
+			return err
+		}
+	}
+	for _, p := range im.pending {
+		if err := im.storeClass(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func importDocument(w http.ResponseWriter, r *http.Request,
+	targetID int64) {
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	params := r.URL.Query()
+	dryRun := false
+	if value := params.Get("dryRun"); value != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(value); err != nil {
+			errormessages.WriteErrorMessage(w, "Invalid dry run",
+				http.StatusBadRequest)
+			return
+		}
+	}
+	onConflict := params.Get("onConflict")
+	if onConflict == "" {
+		onConflict = Skip
+	}
+	if onConflict != Skip && onConflict != Update && onConflict != Copy {
+		errormessages.WriteErrorMessage(w, "Invalid conflict strategy",
+			http.StatusBadRequest)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxDocumentSize)
+	doc := &Document{}
+	if err := json.NewDecoder(r.Body).Decode(doc); err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid body type",
+			http.StatusBadRequest)
+		return
+	}
+	if err := doc.Validate(); err != nil {
+		errormessages.WriteErrorMessage(w, err.Error(),
+			http.StatusBadRequest)
+		return
+	}
+	for _, g := range doc.Grades {
+		for _, c := range g.Courses {
+			for _, cl := range c.Classes {
+				sort.Strings(cl.Tags)
+			}
+		}
+	}
+
+	unlock := revision.LockAll()
+	defer unlock()
+	db := persistence.GetDb()
+	tx, err := db.Begin()
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to reach database",
+			http.StatusInternalServerError)
+		return
+	}
+	im := &importer{
+		tx:         tx,
+		doc:        doc,
+		onConflict: onConflict,
+		dryRun:     dryRun,
+		authorID:   claims.UserID,
+		report:     &Report{DryRun: dryRun, Changes: []Change{}},
+		replaced:   make(map[string][]byte),
+	}
+	err = im.run(targetID)
+	if err == nil && dryRun {
+		err = tx.Rollback()
+	} else if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		tx.Rollback()
+		im.cleanup()
+		if editlock.WriteError(w, err) {
+			return
+		}
+		logger.Error("Unable to import document", err)
+		errormessages.WriteErrorMessage(w, "Unable to import document",
+			http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(im.report)
+}
+
+// Import is an endpoint that imports the grades of an interchange
+// document, with the dryRun query parameter it only reports the changes.
+// The onConflict parameter is one of skip, update or copy
+func Import(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	if claims.Role != "TEACHER" {
+		errormessages.WriteErrorInterface(w, "Not enough privileges",
+			http.StatusUnauthorized)
+		return
+	}
+	importDocument(w, r, 0)
+}
+
+// ImportGrade is an endpoint that imports the courses of an interchange
+// document into an existing grade, see Import
+func ImportGrade(w http.ResponseWriter, r *http.Request,
+	p httprouter.Params) {
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	if claims.Role != "TEACHER" {
+		errormessages.WriteErrorInterface(w, "Not enough privileges",
+			http.StatusUnauthorized)
+		return
+	}
+	gradeID, err := strconv.ParseInt(p.ByName("id"), 0, 64)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid id",
+			http.StatusBadRequest)
+		return
+	}
+	var exists int
+	existsQuery := `
+		SELECT COUNT(*)
+		FROM grade
+		WHERE id = ?
+	`
+	db := persistence.GetDb()
+	if err = db.QueryRow(existsQuery, gradeID).Scan(&exists); err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to find grade",
+			http.StatusInternalServerError)
+		return
+	}
+	if exists == 0 {
+		errormessages.WriteErrorInterface(w, "Grade does not exists",
+			http.StatusNotFound)
+		return
+	}
+	importDocument(w, r, gradeID)
+}
@@ -0,0 +1,438 @@
+// Package interchange moves grades, courses and text classes between wiki
+// instances as a JSON document. Version 1 of the format is
+//
+//	{
+//		"format": "wiki-interchange",
+//		"version": 1,
+//		"exportedAt": "2020-01-31T12:00:00Z",
+//		"grades": [{
+//			"id": 1,
+//			"name": "First grade",
+//			"description": "",
+//			"slug": "first-grade",
+//			"courses": [{
+//				"id": 3,
+//				"name": "Science",
+//				"description": "",
+//				"slug": "science",
+//				"status": "published",
+//				"classes": [{
+//					"id": 7,
+//					"title": "Plants",
+//					"slug": "plants",
+//					"status": "draft",
+//					"tags": ["biology"],
+//					"markdown": "# Plants\n![Leaf](assets://imported/leaf.png)",
+//					"assets": [{
+//						"path": "imported/leaf.png",
+//						"sha256": "<hex sha256 of the content>",
+//						"size": 1024
+//					}]
+//				}]
+//			}]
+//		}],
+//		"blobs": {"<hex sha256>": "<base64 content>"}
+//	}
+//
+// Ids are the ones of the exporting instance, they only relate the entries
+// of a document and are remapped on import. The markdown is the one written
+// by the teachers, links to the assets of a class are written as
+// assets://<path>. Blobs hold the content of the assets once per hash.
+// Processed markdown, image variants and the resources downloaded by
+// mdproc are not exported since they are rebuilt after an import, neither
+// are the attachment records although their files are assets
+package interchange
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/chromz/wiki-backend/internal/publication"
+	"github.com/chromz/wiki-backend/internal/revision"
+	"github.com/chromz/wiki-backend/internal/session"
+	"github.com/chromz/wiki-backend/internal/tag"
+	"github.com/chromz/wiki-backend/internal/textclass"
+	"github.com/chromz/wiki-backend/pkg/errormessages"
+	"github.com/chromz/wiki-backend/pkg/log"
+	"github.com/chromz/wiki-backend/pkg/persistence"
+	"github.com/chromz/wiki-backend/pkg/relpath"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var logger = log.GetLogger()
+
+// Format and Version identify the documents, Version changes when a
+// document of an older version can not be read the same way
+const (
+	Format  = "wiki-interchange"
+	Version = 1
+)
+
+// assetScheme replaces the base uri and directory of the assets of a
+// class in the exported markdown
+const assetScheme = "assets://"
+
+// Asset is a file of the assets of a class, its content is the blob with
+// the same hash
+type Asset struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// Class is an exported text class
+type Class struct {
+	ID       int64    `json:"id"`
+	Title    string   `json:"title"`
+	Slug     string   `json:"slug"`
+	Status   string   `json:"status"`
+	Tags     []string `json:"tags"`
+	Markdown string   `json:"markdown"`
+	Assets   []Asset  `json:"assets"`
+}
+
+// Course is an exported course with its classes in order
+type Course struct {
+	ID          int64    `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Slug        string   `json:"slug"`
+	Status      string   `json:"status"`
+	Classes     []*Class `json:"classes"`
+}
+
+// Grade is an exported grade with its courses in order
+type Grade struct {
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Slug        string    `json:"slug"`
+	Courses     []*Course `json:"courses"`
+}
+
+// Document is an interchange document, blobs are encoded as base64
+type Document struct {
+	Format     string            `json:"format"`
+	Version    int               `json:"version"`
+	ExportedAt time.Time         `json:"exportedAt"`
+	Grades     []*Grade          `json:"grades"`
+	Blobs      map[string][]byte `json:"blobs"`
+}
+
+// derived reports if a directory of the assets is rebuilt by the
+// processors
+func derived(name string) bool {
+	return name == "_variants" || strings.HasSuffix(name, "_resources")
+}
+
+// Validate checks a document before it is imported, every asset must have
+// a blob matching its hash and size
+func (doc *Document) Validate() error {
+	if doc.Format != Format {
+		return errors.New("Invalid document format")
+	}
+	if doc.Version < 1 || doc.Version > Version {
+		return errors.New("Unsupported document version")
+	}
+	for hash, blob := range doc.Blobs {
+		if revision.Hash(blob) != hash {
+			return errors.New("Blob does not match its hash " + hash)
+		}
+	}
+	for _, g := range doc.Grades {
+		if strings.TrimSpace(g.Name) == "" {
+			return errors.New("Grade name is missing")
+		}
+		for _, c := range g.Courses {
+			if strings.TrimSpace(c.Name) == "" {
+				return errors.New("Course name is missing")
+			}
+			if err := validateStatus(c.Status); err != nil {
+				return err
+			}
+			for _, cl := range c.Classes {
+				if err := validateClass(doc, cl); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func validateStatus(status string) error {
+	switch status {
+	case "", publication.Draft, publication.Published, publication.Archived:
+		return nil
+	}
+	return errors.New("Invalid status " + status)
+}
+
+func validateClass(doc *Document, cl *Class) error {
+	if strings.TrimSpace(cl.Title) == "" {
+		return errors.New("Class title is missing")
+	}
+	if err := validateStatus(cl.Status); err != nil {
+		return err
+	}
+	for i, name := range cl.Tags {
+		t := &tag.Tag{Name: tag.Normalize(name)}
+		if err := t.Validate(); err != nil {
+			return err
+		}
+		cl.Tags[i] = t.Name
+	}
+	for _, asset := range cl.Assets {
+		if !relpath.Valid(asset.Path) {
+			return errors.New("Invalid asset path " + asset.Path)
+		}
+		blob, ok := doc.Blobs[asset.SHA256]
+		if !ok || int64(len(blob)) != asset.Size {
+			return errors.New("Missing content of asset " + asset.Path)
+		}
+	}
+	return nil
+}
+
+// exporter builds a document from the database and the sync directory
+type exporter struct {
+	db  *sql.DB
+	doc *Document
+}
+
+func (ex *exporter) loadTags(cl *Class) error {
+	findQuery := `
+		SELECT tag.name
+		FROM tag
+		JOIN text_class_tag ON text_class_tag.tag_id = tag.id
+		WHERE text_class_tag.text_class_id = ?
+		ORDER BY tag.name
+	`
+	rows, err := ex.db.Query(findQuery, cl.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return err
+		}
+		cl.Tags = append(cl.Tags, name)
+	}
+	return rows.Err()
+}
+
+// loadAssets adds the files of the assets of a class and their blobs
+func (ex *exporter) loadAssets(cl *Class, assets string) error {
+	return filepath.Walk(assets, func(name string, info os.FileInfo,
+		err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if derived(info.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		relative, err := filepath.Rel(assets, name)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		hash := revision.Hash(data)
+		ex.doc.Blobs[hash] = data
+		cl.Assets = append(cl.Assets, Asset{
+			Path:   filepath.ToSlash(relative),
+			SHA256: hash,
+			Size:   int64(len(data)),
+		})
+		return nil
+	})
+}
+
+type classRow struct {
+	class    *Class
+	fileName string
+	baseURI  string
+}
+
+func (ex *exporter) loadClasses(gradeID int64, c *Course) error {
+	findQuery := `
+		SELECT id, title, slug, status, file_name, base_uri
+		FROM text_class
+		WHERE course_id = ?
+		ORDER BY id
+	`
+	rows, err := ex.db.Query(findQuery, c.ID)
+	if err != nil {
+		return err
+	}
+	var classes []*classRow
+	for rows.Next() {
+		row := &classRow{class: &Class{Tags: []string{}, Assets: []Asset{}}}
+		err = rows.Scan(&row.class.ID, &row.class.Title, &row.class.Slug,
+			&row.class.Status, &row.fileName, &row.baseURI)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		classes = append(classes, row)
+	}
+	rows.Close()
+	for _, row := range classes {
+		cl := row.class
+		if err = ex.loadTags(cl); err != nil {
+			return err
+		}
+		_, assets := textclass.Dirs(gradeID, c.ID, cl.ID)
+		if err = ex.loadAssets(cl, assets); err != nil {
+			return err
+		}
+		if row.fileName != "" {
+			content, err := ioutil.ReadFile(row.fileName)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			midDir := strings.TrimPrefix(assets, textclass.SyncDir()+"assets/")
+			cl.Markdown = strings.NewReplacer(
+				row.baseURI+midDir, assetScheme,
+				textclass.BaseURI()+midDir, assetScheme,
+			).Replace(string(content))
+		}
+		c.Classes = append(c.Classes, cl)
+	}
+	return nil
+}
+
+// export returns the document of a grade, or only one of its courses when
+// courseID is not 0
+func export(gradeID, courseID int64) (*Document, error) {
+	ex := &exporter{
+		db: persistence.GetDb(),
+		doc: &Document{
+			Format:     Format,
+			Version:    Version,
+			ExportedAt: time.Now().UTC().Truncate(time.Second),
+			Blobs:      make(map[string][]byte),
+		},
+	}
+	g := &Grade{Courses: []*Course{}}
+	findQuery := `
+		SELECT id, name, IFNULL(description, ''), slug
+		FROM grade
+		WHERE id = ?
+	`
+	err := ex.db.QueryRow(findQuery, gradeID).Scan(&g.ID, &g.Name,
+		&g.Description, &g.Slug)
+	if err != nil {
+		return nil, err
+	}
+	coursesQuery := `
+		SELECT id, name, IFNULL(description, ''), slug, status
+		FROM course
+		WHERE grade_id = ?
+		AND (? = 0 OR id = ?)
+		ORDER BY id
+	`
+	rows, err := ex.db.Query(coursesQuery, gradeID, courseID, courseID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		c := &Course{Classes: []*Class{}}
+		err = rows.Scan(&c.ID, &c.Name, &c.Description, &c.Slug, &c.Status)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		g.Courses = append(g.Courses, c)
+	}
+	rows.Close()
+	if courseID != 0 && len(g.Courses) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	for _, c := range g.Courses {
+		if err = ex.loadClasses(gradeID, c); err != nil {
+			return nil, err
+		}
+	}
+	ex.doc.Grades = []*Grade{g}
+	return ex.doc, nil
+}
+
+func writeExport(w http.ResponseWriter, r *http.Request, gradeID,
+	courseID int64) {
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	if claims.Role != "TEACHER" {
+		errormessages.WriteErrorInterface(w, "Not enough privileges",
+			http.StatusUnauthorized)
+		return
+	}
+	doc, err := export(gradeID, courseID)
+	if err == sql.ErrNoRows {
+		errormessages.WriteErrorInterface(w, "Resource does not exists",
+			http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.Error("Unable to export content", err)
+		errormessages.WriteErrorMessage(w, "Unable to export content",
+			http.StatusInternalServerError)
+		return
+	}
+	name := doc.Grades[0].Slug
+	if courseID != 0 {
+		name += "-" + doc.Grades[0].Courses[0].Slug
+	}
+	w.Header().Set("Content-Disposition",
+		`attachment; filename="`+name+`.json"`)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(doc)
+}
+
+// ExportGrade is an endpoint that returns a grade with its courses and
+// classes as an interchange document
+func ExportGrade(w http.ResponseWriter, r *http.Request,
+	p httprouter.Params) {
+	gradeID, err := strconv.ParseInt(p.ByName("id"), 0, 64)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid id",
+			http.StatusBadRequest)
+		return
+	}
+	writeExport(w, r, gradeID, 0)
+}
+
+// ExportCourse is an endpoint that returns a course with its classes as an
+// interchange document, the grade is included without its other courses
+func ExportCourse(w http.ResponseWriter, r *http.Request,
+	p httprouter.Params) {
+	gradeID, err := strconv.ParseInt(p.ByName("id"), 0, 64)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid id",
+			http.StatusBadRequest)
+		return
+	}
+	courseID, err := strconv.ParseInt(p.ByName("courseid"), 0, 64)
+	if err != nil || courseID <= 0 {
+		errormessages.WriteErrorMessage(w, "Invalid id",
+			http.StatusBadRequest)
+		return
+	}
+	writeExport(w, r, gradeID, courseID)
+}
@@ -0,0 +1,132 @@
+package job
+
+import (
+	"encoding/json"
+	"github.com/chromz/wiki-backend/internal/session"
+	"github.com/chromz/wiki-backend/pkg/errormessages"
+	"github.com/google/uuid"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Running is the status of a job that has not finished
+	Running = "running"
+	// Done is the status of a job that finished successfully
+	Done = "done"
+	// Failed is the status of a job that stopped because of an error
+	Failed = "failed"
+)
+
+// retention is how long finished jobs are kept in memory
+const retention = time.Hour
+
+// Job represents a long running background task
+type Job struct {
+	ID         string      `json:"id"`
+	Kind       string      `json:"kind"`
+	Status     string      `json:"status"`
+	Done       int         `json:"done"`
+	Total      int         `json:"total"`
+	Result     interface{} `json:"result,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	CreatedAt  time.Time   `json:"createdAt"`
+	FinishedAt *time.Time  `json:"finishedAt,omitempty"`
+	userID     string
+	mutex      sync.Mutex
+}
+
+var (
+	jobs  = make(map[string]*Job)
+	mutex sync.Mutex
+)
+
+// New registers a new running job owned by a user
+func New(kind, userID string) *Job {
+	j := &Job{
+		ID:        uuid.New().String(),
+		Kind:      kind,
+		Status:    Running,
+		CreatedAt: time.Now().UTC(),
+		userID:    userID,
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	for id, old := range jobs {
+		old.mutex.Lock()
+		expired := old.FinishedAt != nil &&
+			time.Since(*old.FinishedAt) > retention
+		old.mutex.Unlock()
+		if expired {
+			delete(jobs, id)
+		}
+	}
+	jobs[j.ID] = j
+	return j
+}
+
+// Get returns a job by id
+func Get(id string) (*Job, bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	j, ok := jobs[id]
+	return j, ok
+}
+
+// SetTotal sets the number of steps of the job
+func (j *Job) SetTotal(total int) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.Total = total
+}
+
+// Advance marks a step of the job as completed
+func (j *Job) Advance() {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.Done++
+}
+
+// Finish marks the job as done with a result
+func (j *Job) Finish(result interface{}) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	now := time.Now().UTC()
+	j.Status = Done
+	j.Result = result
+	j.Done = j.Total
+	j.FinishedAt = &now
+}
+
+// Fail marks the job as failed
+func (j *Job) Fail(err error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	now := time.Now().UTC()
+	j.Status = Failed
+	j.Error = err.Error()
+	j.FinishedAt = &now
+}
+
+// Write encodes a snapshot of the job as the response
+func (j *Job) Write(w http.ResponseWriter, status int) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(j)
+}
+
+// Read is an endpoint that returns the progress of a job, only the user
+// that started the job can see it
+func Read(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	j, ok := Get(p.ByName("jobid"))
+	if !ok || j.userID != claims.UserID {
+		errormessages.WriteErrorInterface(w, "Job not found",
+			http.StatusNotFound)
+		return
+	}
+	j.Write(w, http.StatusOK)
+}
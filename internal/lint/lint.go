@@ -0,0 +1,271 @@
+package lint
+
+import (
+	"github.com/chromz/wiki-backend/pkg/frontmatter"
+	"github.com/chromz/wiki-backend/pkg/markdown"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/text"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Severities of the issues, only errors make strict uploads fail
+const (
+	Error   = "error"
+	Warning = "warning"
+)
+
+// Rules reported by Check
+const (
+	InvalidUTF8        = "invalid-utf8"
+	InvalidFrontMatter = "invalid-front-matter"
+	UnclosedFence      = "unclosed-fence"
+	MalformedLink      = "malformed-link"
+	MissingAlt         = "missing-alt"
+	BrokenLink         = "broken-relative-link"
+	SkippedHeading     = "skipped-heading-level"
+)
+
+// maxIssuesPerRule keeps the reports of broken files short
+const maxIssuesPerRule = 100
+
+// linkRegex finds links the same way mdproc does, see ticker, links it
+// would cut short are reported
+var linkRegex = regexp.MustCompile(`(!?)\[(.*?)\]\((.*?)\)`)
+
+var mdParser = goldmark.New(goldmark.WithExtensions(extension.GFM)).Parser()
+
+// Issue is a problem found in a markdown file, lines start at one
+type Issue struct {
+	Rule     string `json:"rule"`
+	Severity string `json:"severity"`
+	Line     int    `json:"line"`
+	Message  string `json:"message"`
+}
+
+// Report is the result of checking a markdown file
+type Report struct {
+	RevisionID int64     `json:"revisionId,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+	Errors     int       `json:"errors"`
+	Warnings   int       `json:"warnings"`
+	Issues     []Issue   `json:"issues"`
+}
+
+func (report *Report) add(rule, severity string, line int, message string) {
+	count := 0
+	for _, issue := range report.Issues {
+		if issue.Rule == rule {
+			count++
+		}
+	}
+	if count >= maxIssuesPerRule {
+		return
+	}
+	if severity == Error {
+		report.Errors++
+	} else {
+		report.Warnings++
+	}
+	report.Issues = append(report.Issues, Issue{
+		Rule:     rule,
+		Severity: severity,
+		Line:     line,
+		Message:  message,
+	})
+}
+
+// checkEncoding reports the lines that are not valid UTF-8
+func (report *Report) checkEncoding(lines []string) {
+	for i, line := range lines {
+		if !utf8.ValidString(line) {
+			report.add(InvalidUTF8, Error, i+1, "Line is not valid UTF-8")
+		}
+	}
+}
+
+// fence returns the marker of a line opening or closing a code block
+func fence(line string) string {
+	trimmed := strings.TrimLeft(line, " ")
+	if len(line)-len(trimmed) > 3 || len(trimmed) < 3 ||
+		(trimmed[0] != '`' && trimmed[0] != '~') {
+		return ""
+	}
+	marker := trimmed[:len(trimmed)-len(strings.TrimLeft(trimmed,
+		trimmed[:1]))]
+	if len(marker) < 3 {
+		return ""
+	}
+	return marker
+}
+
+// checkFences reports code blocks that are never closed, the rest of the
+// file would be shown as code
+func (report *Report) checkFences(lines []string) {
+	open, openLine := "", 0
+	for i, line := range lines {
+		marker := fence(strings.TrimRight(line, "\r\n"))
+		if marker == "" {
+			continue
+		}
+		if open == "" {
+			open, openLine = marker, i+1
+			continue
+		}
+		rest := strings.TrimSpace(strings.TrimLeft(line, " ")[len(marker):])
+		if marker[0] == open[0] && len(marker) >= len(open) && rest == "" {
+			open = ""
+		}
+	}
+	if open != "" {
+		report.add(UnclosedFence, Error, openLine,
+			"Code block opened with "+open+" is never closed")
+	}
+}
+
+func isRelative(destination string) bool {
+	u, err := url.Parse(destination)
+	return err == nil && u.Scheme == "" && u.Host == "" &&
+		u.Path != "" && !strings.HasPrefix(u.Path, "/")
+}
+
+// checkLink reports a link found by linkRegex, relative links are looked
+// up in the assets of the class
+func (report *Report) checkLink(line int, image bool, label,
+	destination, assets string) {
+	destination = strings.TrimSpace(destination)
+	switch {
+	case destination == "":
+		report.add(MalformedLink, Error, line, "Link has no destination")
+		return
+	case strings.HasPrefix(destination, "<"):
+		report.add(MalformedLink, Error, line,
+			"Links between angle brackets are not supported: "+destination)
+		return
+	case strings.Contains(destination, "("):
+		report.add(MalformedLink, Error, line,
+			"Link is cut at the first closing parenthesis: "+destination+
+				"), escape the parentheses as %28 and %29")
+		return
+	}
+	fields := strings.Fields(destination)
+	if len(fields) > 1 && !strings.HasPrefix(fields[1], `"`) &&
+		!strings.HasPrefix(fields[1], "'") {
+		report.add(MalformedLink, Error, line,
+			"Link has spaces, escape them as %20: "+destination)
+		return
+	}
+	if image && strings.TrimSpace(label) == "" {
+		report.add(MissingAlt, Warning, line,
+			"Image has no alternative text: "+fields[0])
+	}
+	if !isRelative(fields[0]) {
+		return
+	}
+	u, _ := url.Parse(fields[0])
+	relative := path.Clean("/" + u.Path)[1:]
+	if _, err := os.Stat(filepath.Join(assets,
+		filepath.FromSlash(relative))); err != nil {
+		report.add(BrokenLink, Warning, line,
+			"Relative link to a missing file: "+fields[0])
+	}
+}
+
+func (report *Report) checkLinks(lines []string, assets string) {
+	for i, line := range lines {
+		for _, match := range linkRegex.FindAllStringSubmatch(line, -1) {
+			report.checkLink(i+1, match[1] == "!", match[2], match[3],
+				assets)
+		}
+	}
+}
+
+// checkHeadings reports headings that are more than one level deeper than
+// the previous one
+func (report *Report) checkHeadings(source []byte) {
+	var starts []int
+	for i, c := range source {
+		if c == '\n' {
+			starts = append(starts, i+1)
+		}
+	}
+	lineOf := func(offset int) int {
+		return sort.SearchInts(starts, offset+1) + 1
+	}
+	document := mdParser.Parse(text.NewReader(source))
+	previous := 0
+	ast.Walk(document, func(n ast.Node, entering bool) (ast.WalkStatus,
+		error) {
+		heading, ok := n.(*ast.Heading)
+		if !ok || !entering {
+			return ast.WalkContinue, nil
+		}
+		if previous > 0 && heading.Level > previous+1 {
+			line := 0
+			if heading.Lines().Len() > 0 {
+				line = lineOf(heading.Lines().At(0).Start)
+			}
+			report.add(SkippedHeading, Warning, line,
+				"Heading of level "+strconv.Itoa(heading.Level)+
+					" follows one of level "+strconv.Itoa(previous)+": "+
+					strings.TrimSpace(string(heading.Text(source))))
+		}
+		previous = heading.Level
+		return ast.WalkSkipChildren, nil
+	})
+}
+
+// Check lints markdown before it is stored, assets is the directory the
+// relative links of the class point to
+func Check(content []byte, assets string) *Report {
+	report := &Report{CreatedAt: time.Now(), Issues: []Issue{}}
+	lines := strings.SplitAfter(string(content), "\n")
+	report.checkEncoding(lines)
+	valid := strings.ToValidUTF8(string(content), "�")
+	if _, body, ok := frontmatter.Split([]byte(valid)); ok {
+		_, _, err := frontmatter.Parse([]byte(valid))
+		if err != nil {
+			report.add(InvalidFrontMatter, Error, 1,
+				"Invalid front matter: "+err.Error())
+		}
+		// The front matter is blanked so the lines keep their numbers
+		front := valid[:len(valid)-len(body)]
+		valid = strings.Repeat("\n", strings.Count(front, "\n")) +
+			string(body)
+	}
+	lines = strings.SplitAfter(valid, "\n")
+	report.checkFences(lines)
+	report.checkLinks(strings.SplitAfter(markdown.MaskCode(valid), "\n"),
+		assets)
+	report.checkHeadings([]byte(valid))
+	sort.SliceStable(report.Issues, func(i, j int) bool {
+		return report.Issues[i].Line < report.Issues[j].Line
+	})
+	return report
+}
+
+// Valid reports if the markdown has no errors, warnings are allowed
+func (report *Report) Valid() bool {
+	return report.Errors == 0
+}
+
+// Readable reports if the markdown is valid UTF-8 and its front matter
+// can be read, files that are not are rejected even outside strict mode
+func (report *Report) Readable() bool {
+	for _, issue := range report.Issues {
+		if issue.Rule == InvalidUTF8 || issue.Rule == InvalidFrontMatter {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,91 @@
+package lint
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/chromz/wiki-backend/internal/session"
+	"github.com/chromz/wiki-backend/pkg/errormessages"
+	"github.com/chromz/wiki-backend/pkg/persistence"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"strconv"
+)
+
+// ReportDDL is the query to create the table of the last report of each
+// text class
+const ReportDDL = `
+CREATE TABLE IF NOT EXISTS "lint_report" (
+	"text_class_id"	INTEGER NOT NULL PRIMARY KEY,
+	"revision_id"	INTEGER NOT NULL,
+	"created_at"	INTEGER NOT NULL,
+	"report"	TEXT NOT NULL,
+	FOREIGN KEY("text_class_id") REFERENCES "text_class"("id") ON DELETE CASCADE
+);
+`
+
+// Save stores the report of the revision of a class, replacing the one of
+// the previous revision
+func Save(tx *sql.Tx, classID, revisionID int64, report *Report) error {
+	report.RevisionID = revisionID
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	insertQuery := `
+		INSERT OR REPLACE INTO lint_report
+		(text_class_id, revision_id, created_at, report)
+		VALUES (?, ?, ?, ?)
+	`
+	_, err = tx.Exec(insertQuery, classID, revisionID,
+		report.CreatedAt.Unix(), string(data))
+	return err
+}
+
+// Find returns the last report of a class
+func Find(classID int64) (*Report, error) {
+	db := persistence.GetDb()
+	findQuery := `
+		SELECT report
+		FROM lint_report
+		WHERE text_class_id = ?
+	`
+	var data string
+	if err := db.QueryRow(findQuery, classID).Scan(&data); err != nil {
+		return nil, err
+	}
+	report := &Report{}
+	if err := json.Unmarshal([]byte(data), report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// Read is an endpoint that returns the report of the last revision of a
+// text class
+func Read(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	if claims.Role != "TEACHER" {
+		errormessages.WriteErrorInterface(w, "Not enough privileges",
+			http.StatusUnauthorized)
+		return
+	}
+	classID, err := strconv.ParseInt(p.ByName("classid"), 0, 64)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid id",
+			http.StatusBadRequest)
+		return
+	}
+	report, err := Find(classID)
+	if err == sql.ErrNoRows {
+		errormessages.WriteErrorInterface(w,
+			"There is no report for the class", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to find report",
+			http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(report)
+}
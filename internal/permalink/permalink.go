@@ -0,0 +1,311 @@
+package permalink
+
+import (
+	"database/sql"
+	"github.com/chromz/wiki-backend/pkg/persistence"
+	"github.com/chromz/wiki-backend/pkg/slug"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// RedirectDDL is the query to create the table of slugs that are no
+// longer in use and the resource they point to
+const RedirectDDL = `
+CREATE TABLE IF NOT EXISTS "slug_redirect" (
+	"resource"	TEXT NOT NULL,
+	"parent_id"	INTEGER NOT NULL,
+	"slug"	TEXT NOT NULL,
+	"target_id"	INTEGER NOT NULL,
+	PRIMARY KEY("resource", "parent_id", "slug")
+);
+`
+
+// Triggers drop the redirects of deleted rows, ids of deleted rows can
+// be reused so an old slug must not outlive the row it points to. Rows
+// deleted by a cascade fire them too
+var Triggers = []string{
+	redirectTrigger(Grade),
+	redirectTrigger(Course),
+	redirectTrigger(TextClass),
+}
+
+// Cleanup removes the redirects left by rows deleted before the triggers
+// existed
+var Cleanup = []string{
+	redirectCleanup(Grade),
+	redirectCleanup(Course),
+	redirectCleanup(TextClass),
+}
+
+func redirectTrigger(res Resource) string {
+	return `CREATE TRIGGER IF NOT EXISTS "slug_redirect_` + res.Table +
+		`_delete"
+	AFTER DELETE ON "` + res.Table + `"
+	BEGIN
+		DELETE FROM slug_redirect
+		WHERE resource = '` + res.Table + `'
+		AND target_id = OLD.id;
+	END`
+}
+
+func redirectCleanup(res Resource) string {
+	return `DELETE FROM slug_redirect
+	WHERE resource = '` + res.Table + `'
+	AND target_id NOT IN (SELECT id FROM "` + res.Table + `")`
+}
+
+// Columns are the queries that add the slug columns and their unique
+// per parent indexes
+var Columns = []string{
+	`ALTER TABLE "grade" ADD COLUMN "slug" TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE "course" ADD COLUMN "slug" TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE "text_class" ADD COLUMN "slug" TEXT NOT NULL DEFAULT ''`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS "grade_slug"
+	ON "grade"("slug") WHERE "slug" != ''`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS "course_slug"
+	ON "course"("grade_id", "slug") WHERE "slug" != ''`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS "text_class_slug"
+	ON "text_class"("course_id", "slug") WHERE "slug" != ''`,
+}
+
+// Resource describes a table whose rows have a slug unique among the
+// rows sharing the same parent
+type Resource struct {
+	Table        string
+	ParentColumn string
+	Fallback     string
+}
+
+var (
+	// Grade is the slug resource of grades, they have no parent
+	Grade = Resource{"grade", "", "grade"}
+	// Course is the slug resource of courses, unique per grade
+	Course = Resource{"course", "grade_id", "course"}
+	// TextClass is the slug resource of text classes, unique per course
+	TextClass = Resource{"text_class", "course_id", "class"}
+)
+
+// queryer is satisfied by both *sql.DB and *sql.Tx
+type queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func (res Resource) parentFilter() string {
+	if res.ParentColumn == "" {
+		return "? = 0"
+	}
+	return res.ParentColumn + " = ?"
+}
+
+// targetFilter is the sql condition that the target of a redirect, joined
+// as target, is still under the parent the redirect was recorded in
+func (res Resource) targetFilter() string {
+	if res.ParentColumn == "" {
+		return "1"
+	}
+	return "target." + res.ParentColumn + " = slug_redirect.parent_id"
+}
+
+// Unique returns a slug for the title that is not used by any sibling
+// of the row with the given id, a numeric suffix is added on collision.
+// Old slugs that redirect to a sibling are taken too, so they keep
+// pointing to the row that had them
+func (res Resource) Unique(q queryer, parentID, id int64,
+	title string) (string, error) {
+	base := slug.Make(title)
+	if base == "" {
+		base = res.Fallback
+	}
+	findQuery := `
+		SELECT slug
+		FROM ` + res.Table + `
+		WHERE ` + res.parentFilter() + `
+		AND id != ?
+		AND (slug = ? OR slug LIKE ?)
+		UNION
+		SELECT slug
+		FROM slug_redirect
+		WHERE resource = ?
+		AND parent_id = ?
+		AND target_id != ?
+		AND target_id IN (
+			SELECT id FROM ` + res.Table + ` AS target
+			WHERE ` + res.targetFilter() + `
+		)
+		AND (slug = ? OR slug LIKE ?)
+	`
+	rows, err := q.Query(findQuery, parentID, id, base, base+"-%",
+		res.Table, parentID, id, base, base+"-%")
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	used := make(map[string]bool)
+	for rows.Next() {
+		var existing string
+		if err = rows.Scan(&existing); err != nil {
+			return "", err
+		}
+		used[existing] = true
+	}
+	candidate := base
+	for i := 2; used[candidate]; i++ {
+		candidate = base + "-" + strconv.Itoa(i)
+	}
+	return candidate, nil
+}
+
+// Rename records that the old slug of a row now redirects to it
+func (res Resource) Rename(q queryer, parentID, id int64,
+	oldSlug, newSlug string) error {
+	if oldSlug == "" || oldSlug == newSlug {
+		return nil
+	}
+	insertQuery := `
+		INSERT OR REPLACE INTO slug_redirect(resource, parent_id, slug,
+		target_id)
+		VALUES(?, ?, ?, ?)
+	`
+	_, err := q.Exec(insertQuery, res.Table, parentID, oldSlug, id)
+	return err
+}
+
+// Resolve finds the row with a slug under a parent. When the slug is an
+// old one the current slug of the row is returned and redirected is true
+func (res Resource) Resolve(q queryer, parentID int64,
+	s string) (id int64, current string, redirected bool, err error) {
+	findQuery := `
+		SELECT id
+		FROM ` + res.Table + `
+		WHERE ` + res.parentFilter() + `
+		AND slug = ?
+	`
+	err = q.QueryRow(findQuery, parentID, s).Scan(&id)
+	if err == nil {
+		return id, s, false, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, "", false, err
+	}
+	redirectQuery := `
+		SELECT target.id, target.slug
+		FROM slug_redirect
+		JOIN ` + res.Table + ` AS target
+		ON target.id = slug_redirect.target_id
+		AND ` + res.targetFilter() + `
+		WHERE slug_redirect.resource = ?
+		AND slug_redirect.parent_id = ?
+		AND slug_redirect.slug = ?
+	`
+	err = q.QueryRow(redirectQuery, res.Table, parentID,
+		s).Scan(&id, &current)
+	if err != nil {
+		return 0, "", false, err
+	}
+	return id, current, true, nil
+}
+
+// ResolvePath resolves a grade, course and class slug chain, any prefix
+// of it is accepted. It returns the ids and current slugs of each level
+// and whether any of the slugs was an old one
+func ResolvePath(q queryer, slugs ...string) ([]int64, []string, bool,
+	error) {
+	resources := []Resource{Grade, Course, TextClass}
+	ids := make([]int64, len(slugs))
+	current := make([]string, len(slugs))
+	redirected := false
+	var parentID int64
+	for i, s := range slugs {
+		id, currentSlug, moved, err := resources[i].Resolve(q, parentID, s)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		ids[i] = id
+		current[i] = currentSlug
+		redirected = redirected || moved
+		parentID = id
+	}
+	return ids, current, redirected, nil
+}
+
+// Redirect sends the client to the current url of a resource when it
+// was requested with an old slug
+func Redirect(w http.ResponseWriter, r *http.Request, slugs []string) {
+	location := Path(slugs...)
+	if r.URL.RawQuery != "" {
+		location += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, location, http.StatusMovedPermanently)
+}
+
+// Path builds the slug based url of a resource, the slugs are escaped
+func Path(slugs ...string) string {
+	escaped := make([]string, len(slugs))
+	for i, s := range slugs {
+		escaped[i] = url.PathEscape(s)
+	}
+	return "/wiki/" + strings.Join(escaped, "/")
+}
+
+// Backfill generates slugs for rows created before slugs existed
+func Backfill() error {
+	db := persistence.GetDb()
+	resources := []struct {
+		res   Resource
+		title string
+	}{
+		{Grade, "name"},
+		{Course, "name"},
+		{TextClass, "title"},
+	}
+	for _, r := range resources {
+		parent := "0"
+		if r.res.ParentColumn != "" {
+			parent = r.res.ParentColumn
+		}
+		findQuery := `
+			SELECT id, ` + parent + `, ` + r.title + `
+			FROM ` + r.res.Table + `
+			WHERE slug = ''
+			ORDER BY id
+		`
+		rows, err := db.Query(findQuery)
+		if err != nil {
+			return err
+		}
+		type pending struct {
+			id, parentID int64
+			title        string
+		}
+		var missing []pending
+		for rows.Next() {
+			row := pending{}
+			if err = rows.Scan(&row.id, &row.parentID,
+				&row.title); err != nil {
+				rows.Close()
+				return err
+			}
+			missing = append(missing, row)
+		}
+		rows.Close()
+		updateQuery := `
+			UPDATE ` + r.res.Table + `
+			SET slug = ?
+			WHERE id = ?
+		`
+		for _, row := range missing {
+			s, err := r.res.Unique(db, row.parentID, row.id, row.title)
+			if err != nil {
+				return err
+			}
+			if _, err = db.Exec(updateQuery, s, row.id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
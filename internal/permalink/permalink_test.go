@@ -0,0 +1,153 @@
+package permalink
+
+import (
+	"database/sql"
+	_ "github.com/mattn/go-sqlite3"
+	"testing"
+)
+
+func openDb(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:?_foreign_keys=on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	statements := []string{
+		`CREATE TABLE "course" (
+			"id"	INTEGER PRIMARY KEY,
+			"grade_id"	INTEGER NOT NULL,
+			"slug"	TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE TABLE "text_class" (
+			"id"	INTEGER PRIMARY KEY,
+			"course_id"	INTEGER NOT NULL,
+			"slug"	TEXT NOT NULL DEFAULT '',
+			FOREIGN KEY("course_id") REFERENCES "course"("id")
+			ON DELETE CASCADE
+		)`,
+		RedirectDDL,
+	}
+	statements = append(statements, Triggers[1:]...)
+	for _, statement := range statements {
+		if _, err = db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func exec(t *testing.T, db *sql.DB, query string, args ...interface{}) {
+	t.Helper()
+	if _, err := db.Exec(query, args...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUniqueSkipsSiblingRedirects(t *testing.T) {
+	db := openDb(t)
+	exec(t, db, `INSERT INTO course(id, grade_id) VALUES(1, 1), (2, 1)`)
+	exec(t, db, `INSERT INTO text_class(id, course_id, slug)
+		VALUES(1, 1, 'fracciones-2'), (2, 2, 'otra')`)
+	if err := TextClass.Rename(db, 1, 1, "fracciones",
+		"fracciones-2"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		parentID int64
+		id       int64
+		want     string
+	}{
+		{"new sibling", 1, 0, "fracciones-3"},
+		{"row owning the redirect", 1, 1, "fracciones"},
+		{"other course", 2, 0, "fracciones"},
+	}
+	for _, test := range tests {
+		got, err := TextClass.Unique(db, test.parentID, test.id,
+			"Fracciones")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("%s: Unique = %q, want %q", test.name, got,
+				test.want)
+		}
+	}
+}
+
+func TestResolveRedirect(t *testing.T) {
+	db := openDb(t)
+	exec(t, db, `INSERT INTO course(id, grade_id) VALUES(1, 1), (2, 1)`)
+	exec(t, db, `INSERT INTO text_class(id, course_id, slug)
+		VALUES(1, 1, 'nuevo')`)
+	if err := TextClass.Rename(db, 1, 1, "viejo", "nuevo"); err != nil {
+		t.Fatal(err)
+	}
+	id, current, redirected, err := TextClass.Resolve(db, 1, "viejo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 1 || current != "nuevo" || !redirected {
+		t.Errorf("Resolve = %d, %q, %v, want 1, \"nuevo\", true", id,
+			current, redirected)
+	}
+}
+
+func TestResolveRedirectOfReusedID(t *testing.T) {
+	db := openDb(t)
+	exec(t, db, `INSERT INTO course(id, grade_id) VALUES(1, 1), (2, 1)`)
+	exec(t, db, `INSERT INTO text_class(id, course_id, slug)
+		VALUES(1, 1, 'nuevo')`)
+	if err := TextClass.Rename(db, 1, 1, "viejo", "nuevo"); err != nil {
+		t.Fatal(err)
+	}
+	exec(t, db, `DELETE FROM text_class WHERE id = 1`)
+	exec(t, db, `INSERT INTO text_class(id, course_id, slug)
+		VALUES(1, 2, 'ajeno')`)
+	_, _, _, err := TextClass.Resolve(db, 1, "viejo")
+	if err != sql.ErrNoRows {
+		t.Errorf("Resolve of a deleted row's slug: err = %v, want %v",
+			err, sql.ErrNoRows)
+	}
+}
+
+func TestResolveRedirectOfMovedRow(t *testing.T) {
+	db := openDb(t)
+	exec(t, db, `INSERT INTO course(id, grade_id) VALUES(1, 1), (2, 1)`)
+	exec(t, db, `INSERT INTO text_class(id, course_id, slug)
+		VALUES(1, 1, 'nuevo')`)
+	if err := TextClass.Rename(db, 1, 1, "viejo", "nuevo"); err != nil {
+		t.Fatal(err)
+	}
+	exec(t, db, `UPDATE text_class SET course_id = 2 WHERE id = 1`)
+	_, _, _, err := TextClass.Resolve(db, 1, "viejo")
+	if err != sql.ErrNoRows {
+		t.Errorf("Resolve across courses: err = %v, want %v", err,
+			sql.ErrNoRows)
+	}
+}
+
+func TestTriggersDropRedirectsOnCascade(t *testing.T) {
+	db := openDb(t)
+	exec(t, db, `INSERT INTO course(id, grade_id) VALUES(1, 1)`)
+	exec(t, db, `INSERT INTO text_class(id, course_id, slug)
+		VALUES(1, 1, 'nuevo')`)
+	if err := TextClass.Rename(db, 1, 1, "viejo", "nuevo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Course.Rename(db, 1, 1, "curso-viejo",
+		"curso"); err != nil {
+		t.Fatal(err)
+	}
+	exec(t, db, `DELETE FROM course WHERE id = 1`)
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM slug_redirect`).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("%d redirects left after deleting the course, want 0",
+			count)
+	}
+}
@@ -0,0 +1,161 @@
+package publication
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/chromz/wiki-backend/internal/session"
+	"github.com/chromz/wiki-backend/pkg/log"
+	"github.com/chromz/wiki-backend/pkg/persistence"
+	"strings"
+	"time"
+)
+
+const (
+	// Draft is the status of content that only teachers can see
+	Draft = "draft"
+	// Published is the status of content visible to everyone
+	Published = "published"
+	// Archived is the status of content that is no longer visible to
+	// students
+	Archived = "archived"
+)
+
+// Columns are the ALTER queries that add the publication columns to
+// existing text_class and course tables
+var Columns = []string{
+	`ALTER TABLE "text_class" ADD COLUMN "status" TEXT NOT NULL DEFAULT 'published'`,
+	`ALTER TABLE "text_class" ADD COLUMN "publish_at" INTEGER`,
+	`ALTER TABLE "text_class" ADD COLUMN "unpublish_at" INTEGER`,
+	`ALTER TABLE "course" ADD COLUMN "status" TEXT NOT NULL DEFAULT 'published'`,
+	`ALTER TABLE "course" ADD COLUMN "publish_at" INTEGER`,
+	`ALTER TABLE "course" ADD COLUMN "unpublish_at" INTEGER`,
+}
+
+// RoleFilter is the sql condition, taking the role of the user, that lets
+// teachers and administrators see every status
+const RoleFilter = `? IN ('TEACHER', '` + session.AdminRole + `')`
+
+var logger = log.GetLogger()
+
+// SeesAll reports if a role can see draft and archived content
+func SeesAll(role string) bool {
+	return role == "TEACHER" || role == session.AdminRole
+}
+
+// Schedule tells which publishing dates a json body sets. Dates that are
+// left out keep their stored value, null clears them
+type Schedule struct {
+	PublishAt   bool
+	UnpublishAt bool
+}
+
+// ReadSchedule finds the publishing dates set by a json object, keys are
+// matched ignoring case like encoding/json does
+func ReadSchedule(data []byte) (Schedule, error) {
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return Schedule{}, err
+	}
+	schedule := Schedule{}
+	for key := range fields {
+		if strings.EqualFold(key, "publishAt") {
+			schedule.PublishAt = true
+		}
+		if strings.EqualFold(key, "unpublishAt") {
+			schedule.UnpublishAt = true
+		}
+	}
+	return schedule, nil
+}
+
+// Scheduler is a struct that publishes and archives content on time
+type Scheduler struct {
+	ticker *time.Ticker
+}
+
+// ValidateSchedule checks the status and the publishing window of a
+// resource, an empty status is accepted and means unchanged
+func ValidateSchedule(status string, publishAt, unpublishAt *time.Time) error {
+	if status != "" && status != Draft && status != Published &&
+		status != Archived {
+		return errors.New("Invalid status")
+	}
+	if publishAt != nil && unpublishAt != nil &&
+		!unpublishAt.After(*publishAt) {
+		return errors.New("Unpublish date must be after publish date")
+	}
+	return nil
+}
+
+// Unix converts an optional time to a value that can be stored in
+// the database
+func Unix(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.Unix()
+}
+
+// Time converts a nullable database timestamp to an optional time
+func Time(n sql.NullInt64) *time.Time {
+	if !n.Valid {
+		return nil
+	}
+	t := time.Unix(n.Int64, 0).UTC()
+	return &t
+}
+
+// NewScheduler constructor of the publication scheduler
+func NewScheduler(pollingRate int) *Scheduler {
+	return &Scheduler{
+		ticker: time.NewTicker(time.Millisecond * time.Duration(pollingRate)),
+	}
+}
+
+func apply() {
+	db := persistence.GetDb()
+	now := time.Now().Unix()
+	publishQueries := []string{
+		`
+		UPDATE text_class
+		SET status = 'published', publish_at = NULL
+		WHERE status = 'draft'
+		AND publish_at <= ?
+		`,
+		`
+		UPDATE text_class
+		SET status = 'archived', unpublish_at = NULL
+		WHERE status = 'published'
+		AND unpublish_at <= ?
+		`,
+		`
+		UPDATE course
+		SET status = 'published', publish_at = NULL
+		WHERE status = 'draft'
+		AND publish_at <= ?
+		`,
+		`
+		UPDATE course
+		SET status = 'archived', unpublish_at = NULL
+		WHERE status = 'published'
+		AND unpublish_at <= ?
+		`,
+	}
+	for _, query := range publishQueries {
+		if _, err := db.Exec(query, now); err != nil {
+			logger.Error("Unable to apply publication schedule", err)
+			return
+		}
+	}
+}
+
+// Run starts the scheduler
+func (scheduler *Scheduler) Run() {
+	for {
+		select {
+		case <-scheduler.ticker.C:
+			apply()
+		}
+	}
+}
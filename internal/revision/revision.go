@@ -0,0 +1,387 @@
+package revision
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/chromz/wiki-backend/internal/session"
+	"github.com/chromz/wiki-backend/pkg/diff"
+	"github.com/chromz/wiki-backend/pkg/errormessages"
+	"github.com/chromz/wiki-backend/pkg/pagination"
+	"github.com/chromz/wiki-backend/pkg/persistence"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RevisionDDL is the query to create the revision table
+const RevisionDDL = `
+CREATE TABLE IF NOT EXISTS "revision" (
+	"id"	INTEGER PRIMARY KEY AUTOINCREMENT UNIQUE,
+	"text_class_id"	INTEGER NOT NULL,
+	"author_id"	TEXT NOT NULL,
+	"created_at"	INTEGER NOT NULL,
+	"hash"	TEXT NOT NULL,
+	"message"	TEXT NOT NULL DEFAULT '',
+	"file_name"	TEXT NOT NULL,
+	"size"	INTEGER NOT NULL,
+	FOREIGN KEY("text_class_id") REFERENCES "text_class"("id") ON DELETE CASCADE
+);
+`
+
+// dirName is the directory inside a class directory holding the
+// content of every revision, files are named after their hash
+const dirName = "revisions/"
+
+// Revision is an immutable version of the markdown of a text class
+type Revision struct {
+	ID        int64     `json:"id"`
+	ClassID   int64     `json:"classId"`
+	AuthorID  string    `json:"authorId"`
+	Author    string    `json:"author"`
+	CreatedAt time.Time `json:"createdAt"`
+	Hash      string    `json:"hash"`
+	Message   string    `json:"message"`
+	Size      int64     `json:"size"`
+	Content   *string   `json:"content,omitempty"`
+	fileName  string
+}
+
+// Comparison is the line diff between two revisions
+type Comparison struct {
+	From     int64  `json:"from"`
+	To       int64  `json:"to"`
+	Inserted int    `json:"inserted"`
+	Deleted  int    `json:"deleted"`
+	Unified  string `json:"unified"`
+}
+
+// classMutex serializes the changes to the markdown of a class, holders
+// counts the goroutines using it so it is forgotten once it is free
+type classMutex struct {
+	sync.Mutex
+	holders int
+}
+
+var (
+	// allMutex is held for reading by every class lock and for writing
+	// by changes to many classes at once
+	allMutex     sync.RWMutex
+	mapMutex     sync.Mutex
+	classMutexes = make(map[int64]*classMutex)
+)
+
+// Lock serializes the changes to the markdown of a class, whatever a
+// change was based on must be checked while holding it
+func Lock(classID int64) (unlock func()) {
+	allMutex.RLock()
+	mapMutex.Lock()
+	mutex := classMutexes[classID]
+	if mutex == nil {
+		mutex = &classMutex{}
+		classMutexes[classID] = mutex
+	}
+	mutex.holders++
+	mapMutex.Unlock()
+	mutex.Lock()
+	return func() {
+		mutex.Unlock()
+		mapMutex.Lock()
+		mutex.holders--
+		if mutex.holders == 0 {
+			delete(classMutexes, classID)
+		}
+		mapMutex.Unlock()
+		allMutex.RUnlock()
+	}
+}
+
+// LockAll is Lock for changes to the markdown of many classes, it waits
+// for the changes to single classes to finish
+func LockAll() (unlock func()) {
+	allMutex.Lock()
+	return allMutex.Unlock
+}
+
+// Hash returns the hex encoded sha256 of a content
+func Hash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// Record stores the content as a new revision of a class, dir is the
+// directory of the class inside the sync dir
+func Record(tx *sql.Tx, classID int64, authorID, message, dir string,
+	content []byte) (*Revision, error) {
+	revision := &Revision{
+		ClassID:   classID,
+		AuthorID:  authorID,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+		Hash:      Hash(content),
+		Message:   message,
+		Size:      int64(len(content)),
+	}
+	revisionsDir := dir + dirName
+	if err := os.MkdirAll(revisionsDir, 0700); err != nil {
+		return nil, err
+	}
+	revision.fileName = revisionsDir + revision.Hash + ".md"
+	if _, err := os.Stat(revision.fileName); os.IsNotExist(err) {
+		err = ioutil.WriteFile(revision.fileName, content, 0400)
+		if err != nil {
+			return nil, err
+		}
+	}
+	insertQuery := `
+		INSERT INTO revision(text_class_id, author_id, created_at, hash,
+		message, file_name, size)
+		VALUES(?, ?, ?, ?, ?, ?, ?)
+	`
+	res, err := tx.Exec(insertQuery, revision.ClassID, revision.AuthorID,
+		revision.CreatedAt.Unix(), revision.Hash, revision.Message,
+		revision.fileName, revision.Size)
+	if err != nil {
+		return nil, err
+	}
+	revision.ID, err = res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	authorQuery := `
+		SELECT username
+		FROM user
+		WHERE id = ?
+	`
+	err = tx.QueryRow(authorQuery, authorID).Scan(&revision.Author)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return revision, nil
+}
+
+const selectRevision = `
+	SELECT revision.id, text_class_id, author_id,
+	IFNULL(user.username, ''), created_at, hash, message, size,
+	revision.file_name
+	FROM revision
+	LEFT JOIN user ON user.id = revision.author_id
+`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scan(row scanner) (*Revision, error) {
+	revision := &Revision{}
+	var createdAt int64
+	err := row.Scan(&revision.ID, &revision.ClassID, &revision.AuthorID,
+		&revision.Author, &createdAt, &revision.Hash, &revision.Message,
+		&revision.Size, &revision.fileName)
+	if err != nil {
+		return nil, err
+	}
+	revision.CreatedAt = time.Unix(createdAt, 0).UTC()
+	return revision, nil
+}
+
+// Find returns a revision of a text class
+func Find(classID, revisionID int64) (*Revision, error) {
+	db := persistence.GetDb()
+	findQuery := selectRevision + `
+		WHERE revision.id = ?
+		AND text_class_id = ?
+	`
+	return scan(db.QueryRow(findQuery, revisionID, classID))
+}
+
+// Markdown reads the stored markdown of a revision
+func (r *Revision) Markdown() ([]byte, error) {
+	return ioutil.ReadFile(r.fileName)
+}
+
+func teacherOnly(w http.ResponseWriter, r *http.Request) bool {
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	if claims.Role != "TEACHER" {
+		errormessages.WriteErrorInterface(w, "Not enough privileges",
+			http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// List returns the revisions of a text class, paginated
+func List(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if !teacherOnly(w, r) {
+		return
+	}
+	params := r.URL.Query()
+	classID, err := strconv.ParseInt(p.ByName("classid"), 0, 64)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid id",
+			http.StatusBadRequest)
+		return
+	}
+	size, err := strconv.Atoi(params.Get("size"))
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid size",
+			http.StatusBadRequest)
+		return
+	}
+	nextToken, err := strconv.ParseInt(params.Get("nextToken"), 0, 64)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid next token",
+			http.StatusBadRequest)
+		return
+	}
+	page := &pagination.Page{
+		Size:      size,
+		NextToken: nextToken,
+	}
+	if err = page.Validate(); err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid pagination",
+			http.StatusBadRequest)
+		return
+	}
+
+	db := persistence.GetDb()
+	findQuery := selectRevision + `
+		WHERE revision.id > ?
+		AND text_class_id = ?
+		ORDER BY revision.id
+		LIMIT ?
+	`
+	rows, err := db.Query(findQuery, page.NextToken, classID, page.Size)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to find revisions",
+			http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	var revisions []*Revision
+	for rows.Next() {
+		revision, err := scan(rows)
+		if err != nil {
+			errormessages.WriteErrorMessage(w,
+				"Unable to find revisions",
+				http.StatusInternalServerError)
+			return
+		}
+		revisions = append(revisions, revision)
+	}
+	page.Data = revisions
+	revisionsCount := len(revisions)
+	if revisionsCount > 0 {
+		page.NextToken = revisions[revisionsCount-1].ID
+	} else {
+		page.NextToken = -1
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(page)
+}
+
+// Read returns a single revision with its content
+func Read(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if !teacherOnly(w, r) {
+		return
+	}
+	classID, err := strconv.ParseInt(p.ByName("classid"), 0, 64)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid id",
+			http.StatusBadRequest)
+		return
+	}
+	revisionID, err := strconv.ParseInt(p.ByName("revisionid"), 0, 64)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid revision id",
+			http.StatusBadRequest)
+		return
+	}
+	revision, err := Find(classID, revisionID)
+	if err == sql.ErrNoRows {
+		errormessages.WriteErrorInterface(w, "Revision does not exists",
+			http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to find revision",
+			http.StatusInternalServerError)
+		return
+	}
+	content, err := revision.Markdown()
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to read revision",
+			http.StatusInternalServerError)
+		return
+	}
+	text := string(content)
+	revision.Content = &text
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(revision)
+}
+
+// Diff returns the line diff between the from and to revisions of a
+// text class
+func Diff(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if !teacherOnly(w, r) {
+		return
+	}
+	params := r.URL.Query()
+	classID, err := strconv.ParseInt(p.ByName("classid"), 0, 64)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid id",
+			http.StatusBadRequest)
+		return
+	}
+	fromID, err := strconv.ParseInt(params.Get("from"), 0, 64)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid from revision",
+			http.StatusBadRequest)
+		return
+	}
+	toID, err := strconv.ParseInt(params.Get("to"), 0, 64)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid to revision",
+			http.StatusBadRequest)
+		return
+	}
+	var contents [2]string
+	for i, revisionID := range []int64{fromID, toID} {
+		revision, err := Find(classID, revisionID)
+		if err == sql.ErrNoRows {
+			errormessages.WriteErrorInterface(w,
+				"Revision does not exists",
+				http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			errormessages.WriteErrorMessage(w,
+				"Unable to find revision",
+				http.StatusInternalServerError)
+			return
+		}
+		content, err := revision.Markdown()
+		if err != nil {
+			errormessages.WriteErrorMessage(w,
+				"Unable to read revision",
+				http.StatusInternalServerError)
+			return
+		}
+		contents[i] = string(content)
+	}
+	comparison := &Comparison{
+		From: fromID,
+		To:   toID,
+		Unified: diff.Unified("revision/"+strconv.FormatInt(fromID, 10),
+			"revision/"+strconv.FormatInt(toID, 10), contents[0],
+			contents[1]),
+	}
+	comparison.Inserted, comparison.Deleted = diff.Stats(
+		diff.Lines(diff.Split(contents[0]), diff.Split(contents[1])))
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(comparison)
+}
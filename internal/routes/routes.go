@@ -1,11 +1,25 @@
 package routes
 
 import (
+	"github.com/chromz/wiki-backend/internal/attachment"
+	"github.com/chromz/wiki-backend/internal/batch"
+	"github.com/chromz/wiki-backend/internal/bulkimport"
+	"github.com/chromz/wiki-backend/internal/clone"
+	"github.com/chromz/wiki-backend/internal/collab"
 	"github.com/chromz/wiki-backend/internal/course"
+	"github.com/chromz/wiki-backend/internal/editlock"
+	"github.com/chromz/wiki-backend/internal/export"
 	"github.com/chromz/wiki-backend/internal/grade"
+	"github.com/chromz/wiki-backend/internal/interchange"
+	"github.com/chromz/wiki-backend/internal/job"
+	"github.com/chromz/wiki-backend/internal/lint"
+	"github.com/chromz/wiki-backend/internal/revision"
+	"github.com/chromz/wiki-backend/internal/search"
 	"github.com/chromz/wiki-backend/internal/session"
+	"github.com/chromz/wiki-backend/internal/tag"
 	"github.com/chromz/wiki-backend/internal/textclass"
 	"github.com/chromz/wiki-backend/internal/users"
+	"github.com/chromz/wiki-backend/internal/wikilink"
 	"github.com/julienschmidt/httprouter"
 	"net/http"
 )
@@ -17,7 +31,7 @@ func cors(w http.ResponseWriter, r *http.Request) {
 		header.Set("Access-Control-Allow-Methods", header.Get("Allow"))
 		header.Set("Access-Control-Allow-Origin", "*")
 		header.Set("Access-Control-Allow-Headers",
-			"Authorization, Content-Type")
+			"Authorization, Content-Type, If-Match, If-None-Match")
 	}
 
 	// Adjust status code to 204
@@ -28,6 +42,7 @@ func originMiddleware(next httprouter.Handle) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request,
 		p httprouter.Params) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag")
 		w.Header().Set("Content-Type", "application/json")
 		next(w, r, p)
 	}
@@ -54,6 +69,24 @@ func RouteHandler() http.Handler {
 	router.DELETE("/grade/:id",
 		originMiddleware(session.AuthMiddleware(grade.Delete)),
 	)
+	router.GET("/grade/:id/textclass",
+		originMiddleware(session.AuthMiddleware(textclass.ReadByGrade)),
+	)
+	router.GET("/grade/:id/readability",
+		originMiddleware(session.AuthMiddleware(textclass.ReadReadability)),
+	)
+	router.POST("/grade/:id/clone",
+		originMiddleware(session.AuthMiddleware(clone.Grade)),
+	)
+	router.POST("/grade/:id/export",
+		originMiddleware(session.AuthMiddleware(export.Grade)),
+	)
+	router.GET("/grade/:id/interchange",
+		originMiddleware(session.AuthMiddleware(interchange.ExportGrade)),
+	)
+	router.POST("/grade/:id/interchange",
+		originMiddleware(session.AuthMiddleware(interchange.ImportGrade)),
+	)
 	router.POST("/grade/:id/course",
 		originMiddleware(session.AuthMiddleware(course.Create)),
 	)
@@ -66,6 +99,24 @@ func RouteHandler() http.Handler {
 	router.DELETE("/grade/:id/course/:courseid",
 		originMiddleware(session.AuthMiddleware(course.Delete)),
 	)
+	router.POST("/grade/:id/course/:courseid/clone",
+		originMiddleware(session.AuthMiddleware(clone.Course)),
+	)
+	router.POST("/grade/:id/course/:courseid/export",
+		originMiddleware(session.AuthMiddleware(export.Course)),
+	)
+	router.GET("/grade/:id/course/:courseid/export/:format",
+		originMiddleware(session.AuthMiddleware(export.Book)),
+	)
+	router.GET("/grade/:id/course/:courseid/interchange",
+		originMiddleware(session.AuthMiddleware(interchange.ExportCourse)),
+	)
+	router.POST("/grade/:id/course/:courseid/import",
+		originMiddleware(session.AuthMiddleware(bulkimport.Course)),
+	)
+	router.GET("/grade/:id/course/:courseid/outline",
+		originMiddleware(session.AuthMiddleware(textclass.ReadCourseOutline)),
+	)
 	router.POST("/grade/:id/course/:courseid/textclass",
 		originMiddleware(session.AuthMiddleware(textclass.Create)),
 	)
@@ -75,15 +126,108 @@ func RouteHandler() http.Handler {
 	router.GET("/grade/:id/course/:courseid/textclass/:classid/file",
 		originMiddleware(session.AuthMiddleware(textclass.ReadFile)),
 	)
+	router.GET("/grade/:id/course/:courseid/textclass/:classid/outline",
+		originMiddleware(session.AuthMiddleware(textclass.ReadOutline)),
+	)
+	router.GET("/grade/:id/course/:courseid/textclass/:classid/html",
+		originMiddleware(session.AuthMiddleware(textclass.ReadHTML)),
+	)
+	router.GET("/grade/:id/course/:courseid/textclass/:classid/markdown",
+		originMiddleware(session.AuthMiddleware(textclass.ReadMarkdown)),
+	)
+	router.PUT("/grade/:id/course/:courseid/textclass/:classid/markdown",
+		originMiddleware(session.AuthMiddleware(textclass.WriteMarkdown)),
+	)
+	router.PATCH("/grade/:id/course/:courseid/textclass/:classid/markdown",
+		originMiddleware(session.AuthMiddleware(textclass.PatchMarkdown)),
+	)
+	router.GET("/grade/:id/course/:courseid/textclass/:classid/collab",
+		originMiddleware(session.SocketAuthMiddleware(collab.Connect)),
+	)
+	router.GET("/grade/:id/course/:courseid/textclass/:classid/lock",
+		originMiddleware(session.AuthMiddleware(editlock.Read)),
+	)
+	router.POST("/grade/:id/course/:courseid/textclass/:classid/lock",
+		originMiddleware(session.AuthMiddleware(editlock.Acquire)),
+	)
+	router.PUT("/grade/:id/course/:courseid/textclass/:classid/lock",
+		originMiddleware(session.AuthMiddleware(editlock.Renew)),
+	)
+	router.DELETE("/grade/:id/course/:courseid/textclass/:classid/lock",
+		originMiddleware(session.AuthMiddleware(editlock.Release)),
+	)
+	router.GET("/grade/:id/course/:courseid/textclass/:classid/backlinks",
+		originMiddleware(session.AuthMiddleware(wikilink.ReadBacklinks)),
+	)
+	router.GET("/grade/:id/course/:courseid/textclass/:classid/links/broken",
+		originMiddleware(session.AuthMiddleware(wikilink.ReadBroken)),
+	)
+	router.GET("/grade/:id/course/:courseid/textclass/:classid/attachment",
+		originMiddleware(session.AuthMiddleware(attachment.Read)),
+	)
+	router.POST("/grade/:id/course/:courseid/textclass/:classid/attachment",
+		originMiddleware(session.AuthMiddleware(attachment.Create)),
+	)
+	router.DELETE("/grade/:id/course/:courseid/textclass/:classid/attachment/:attachmentid",
+		originMiddleware(session.AuthMiddleware(attachment.Delete)),
+	)
+	router.GET("/grade/:id/course/:courseid/textclass/:classid/lint",
+		originMiddleware(session.AuthMiddleware(lint.Read)),
+	)
 	router.POST("/grade/:id/course/:courseid/textclass/:classid/file",
 		originMiddleware(session.AuthMiddleware(textclass.WriteFile)),
 	)
+	router.GET("/grade/:id/course/:courseid/textclass/:classid/revision",
+		originMiddleware(session.AuthMiddleware(revision.List)),
+	)
+	router.GET("/grade/:id/course/:courseid/textclass/:classid/revision/:revisionid",
+		originMiddleware(session.AuthMiddleware(revision.Read)),
+	)
+	router.POST("/grade/:id/course/:courseid/textclass/:classid/revision/:revisionid/restore",
+		originMiddleware(session.AuthMiddleware(textclass.RestoreRevision)),
+	)
+	router.GET("/grade/:id/course/:courseid/textclass/:classid/diff",
+		originMiddleware(session.AuthMiddleware(revision.Diff)),
+	)
 	router.PUT("/grade/:id/course/:courseid/textclass/:classid",
 		originMiddleware(session.AuthMiddleware(textclass.Update)),
 	)
 	router.DELETE("/grade/:id/course/:courseid/textclass/:classid",
 		originMiddleware(session.AuthMiddleware(textclass.Delete)),
 	)
+	router.POST("/grade/:id/course/:courseid/textclass/:classid/tag",
+		originMiddleware(session.AuthMiddleware(tag.Create)),
+	)
+	router.DELETE("/grade/:id/course/:courseid/textclass/:classid/tag/:tag",
+		originMiddleware(session.AuthMiddleware(tag.Delete)),
+	)
+	router.POST("/interchange",
+		originMiddleware(session.AuthMiddleware(interchange.Import)),
+	)
+	router.POST("/batch",
+		originMiddleware(session.AuthMiddleware(batch.Execute)),
+	)
+	router.GET("/wiki/:grade",
+		originMiddleware(session.AuthMiddleware(grade.ReadBySlug)),
+	)
+	router.GET("/wiki/:grade/:course",
+		originMiddleware(session.AuthMiddleware(course.ReadBySlug)),
+	)
+	router.GET("/wiki/:grade/:course/:class",
+		originMiddleware(session.AuthMiddleware(textclass.ReadBySlug)),
+	)
+	router.GET("/job/:jobid",
+		originMiddleware(session.AuthMiddleware(job.Read)),
+	)
+	router.GET("/export/:jobid",
+		originMiddleware(session.AuthMiddleware(export.Download)),
+	)
+	router.GET("/search",
+		originMiddleware(session.AuthMiddleware(search.Search)),
+	)
+	router.GET("/tag",
+		originMiddleware(session.AuthMiddleware(tag.Autocomplete)),
+	)
 
 	router.ServeFiles("/static/*filepath",
 		http.Dir(textclass.SyncDir()+"assets/"))
@@ -0,0 +1,56 @@
+package schema
+
+import (
+	"github.com/chromz/wiki-backend/internal/attachment"
+	"github.com/chromz/wiki-backend/internal/editlock"
+	"github.com/chromz/wiki-backend/internal/imgproc"
+	"github.com/chromz/wiki-backend/internal/lint"
+	"github.com/chromz/wiki-backend/internal/permalink"
+	"github.com/chromz/wiki-backend/internal/publication"
+	"github.com/chromz/wiki-backend/internal/revision"
+	"github.com/chromz/wiki-backend/internal/session"
+	"github.com/chromz/wiki-backend/internal/tag"
+	"github.com/chromz/wiki-backend/internal/textclass"
+	"github.com/chromz/wiki-backend/internal/wikilink"
+	"github.com/chromz/wiki-backend/pkg/persistence"
+)
+
+// migrations returns the statements applied in order every time a
+// binary starts, they must be safe to run more than once
+func migrations() []string {
+	statements := []string{
+		tag.TagDDL,
+		tag.TextClassTagDDL,
+		permalink.RedirectDDL,
+		revision.RevisionDDL,
+		editlock.LockDDL,
+		session.AdminRoleDML,
+		wikilink.LinkDDL,
+		wikilink.TargetIndexDDL,
+		attachment.AttachmentDDL,
+		imgproc.ImageDDL,
+		imgproc.VariantDDL,
+		lint.ReportDDL,
+	}
+	statements = append(statements, publication.Columns...)
+	statements = append(statements, permalink.Columns...)
+	statements = append(statements, permalink.Triggers...)
+	statements = append(statements, wikilink.Triggers...)
+	statements = append(statements, permalink.Cleanup...)
+	statements = append(statements, textclass.OutlineColumn)
+	statements = append(statements, textclass.FrontMatterColumns...)
+	statements = append(statements, textclass.ReadabilityColumn)
+	return statements
+}
+
+// Migrate brings the database schema up to date, the search index is
+// migrated apart by search.Migrate since it needs fts5
+func Migrate() error {
+	if err := persistence.Migrate(migrations()...); err != nil {
+		return err
+	}
+	if err := attachment.Migrate(); err != nil {
+		return err
+	}
+	return permalink.Backfill()
+}
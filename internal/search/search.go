@@ -0,0 +1,414 @@
+package search
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/chromz/wiki-backend/internal/publication"
+	"github.com/chromz/wiki-backend/internal/session"
+	"github.com/chromz/wiki-backend/pkg/errormessages"
+	"github.com/chromz/wiki-backend/pkg/frontmatter"
+	"github.com/chromz/wiki-backend/pkg/log"
+	"github.com/chromz/wiki-backend/pkg/markdown"
+	"github.com/chromz/wiki-backend/pkg/pagination"
+	"github.com/chromz/wiki-backend/pkg/persistence"
+	"github.com/julienschmidt/httprouter"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var logger = log.GetLogger()
+
+// IndexDDL is the query to create the full-text index of the text
+// classes, the rowid is the id of the class. Diacritics are removed so
+// searches in Spanish match with or without accents
+const IndexDDL = `
+CREATE VIRTUAL TABLE IF NOT EXISTS "search_index" USING fts5(
+	title,
+	body,
+	course,
+	grade,
+	tokenize = 'unicode61 remove_diacritics 2'
+);
+`
+
+// Triggers keep the titles and names of the index up to date, bodies are
+// indexed with Update since the markdown lives in files
+var Triggers = []string{
+	`CREATE TRIGGER IF NOT EXISTS "search_class_insert"
+	AFTER INSERT ON "text_class"
+	BEGIN
+		INSERT INTO search_index(rowid, title, body, course, grade)
+		SELECT NEW.id, NEW.title, '', course.name, grade.name
+		FROM course
+		JOIN grade ON grade.id = course.grade_id
+		WHERE course.id = NEW.course_id;
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS "search_class_title"
+	AFTER UPDATE OF title ON "text_class"
+	BEGIN
+		UPDATE search_index SET title = NEW.title WHERE rowid = NEW.id;
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS "search_class_delete"
+	AFTER DELETE ON "text_class"
+	BEGIN
+		DELETE FROM search_index WHERE rowid = OLD.id;
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS "search_course_name"
+	AFTER UPDATE OF name ON "course"
+	BEGIN
+		UPDATE search_index SET course = NEW.name
+		WHERE rowid IN (
+			SELECT id FROM text_class WHERE course_id = NEW.id
+		);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS "search_grade_name"
+	AFTER UPDATE OF name ON "grade"
+	BEGIN
+		UPDATE search_index SET grade = NEW.name
+		WHERE rowid IN (
+			SELECT text_class.id
+			FROM text_class
+			JOIN course ON course.id = text_class.course_id
+			WHERE course.grade_id = NEW.id
+		);
+	END`,
+}
+
+// Markers delimit the matches in highlights and snippets before they are
+// escaped, they are removed from the indexed bodies
+const (
+	openMarker  = "\x02"
+	closeMarker = "\x03"
+)
+
+// visibleFilter is the sql condition, taking the role of the user, for
+// the classes the user can find, the course of the class must be joined
+const visibleFilter = `(` + publication.RoleFilter + ` OR (
+			text_class.status = 'published'
+			AND course.status = 'published'
+		))`
+
+// snippetTokens is the number of tokens of a snippet
+const snippetTokens = 16
+
+// defaultSize is the page size when the request does not give one
+const defaultSize = 20
+
+// Result is a text class matching a search, the title and snippet are
+// html with the matches in mark elements
+type Result struct {
+	ClassID  int64   `json:"classId"`
+	CourseID int64   `json:"courseId"`
+	GradeID  int64   `json:"gradeId"`
+	Slug     string  `json:"slug"`
+	Title    string  `json:"title"`
+	Course   string  `json:"course"`
+	Grade    string  `json:"grade"`
+	Snippet  string  `json:"snippet"`
+	Rank     float64 `json:"rank"`
+}
+
+// indexed is false when sqlite was built without fts5, nothing is indexed
+// then and searches only match titles and names
+var indexed bool
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Migrate creates the index when sqlite was built with fts5 and indexes
+// the classes created before it existed. Binaries that write classes
+// must call it, the index can not be used without fts5 once it exists
+func Migrate() error {
+	db := persistence.GetDb()
+	err := db.QueryRow(`
+		SELECT sqlite_compileoption_used('ENABLE_FTS5')
+	`).Scan(&indexed)
+	if err != nil {
+		return err
+	}
+	if indexed {
+		statements := append([]string{IndexDDL}, Triggers...)
+		if err = persistence.Migrate(statements...); err != nil {
+			return err
+		}
+		return backfill()
+	}
+	var exists bool
+	err = db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1
+			FROM sqlite_master
+			WHERE name = 'search_index'
+		)
+	`).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errors.New("The search index needs sqlite with fts5, " +
+			"build with -tags sqlite_fts5")
+	}
+	logger.Info("Sqlite has no fts5, searches only match titles")
+	return nil
+}
+
+// Update indexes the markdown of a class as its body
+func Update(q execer, classID int64, content string) error {
+	if !indexed {
+		return nil
+	}
+	updateQuery := `
+		INSERT OR REPLACE INTO search_index(rowid, title, body, course,
+		grade)
+		SELECT text_class.id, text_class.title, ?, course.name, grade.name
+		FROM text_class
+		JOIN course ON course.id = text_class.course_id
+		JOIN grade ON grade.id = course.grade_id
+		WHERE text_class.id = ?
+	`
+	body := strings.NewReplacer(openMarker, "", closeMarker, "").
+		Replace(markdown.PlainText([]byte(content)))
+	_, err := q.Exec(updateQuery, body, classID)
+	return err
+}
+
+// backfill indexes the classes created before the index existed
+func backfill() error {
+	db := persistence.GetDb()
+	findQuery := `
+		SELECT id, file_name, proc_file_name
+		FROM text_class
+		WHERE id NOT IN (SELECT rowid FROM search_index)
+	`
+	rows, err := db.Query(findQuery)
+	if err != nil {
+		return err
+	}
+	files := make(map[int64]string)
+	uploaded := make(map[int64]bool)
+	for rows.Next() {
+		var classID int64
+		var fileName, procFileName string
+		if err = rows.Scan(&classID, &fileName, &procFileName); err != nil {
+			rows.Close()
+			return err
+		}
+		if procFileName != "" {
+			fileName = procFileName
+		}
+		files[classID] = fileName
+		uploaded[classID] = procFileName == ""
+	}
+	rows.Close()
+	for classID, fileName := range files {
+		var content []byte
+		if fileName != "" {
+			content, err = ioutil.ReadFile(fileName)
+			if err != nil {
+				logger.Error("Unable to read class to index", err)
+			}
+		}
+		if uploaded[classID] {
+			content = frontmatter.Strip(content)
+		}
+		if err = Update(db, classID, string(content)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// words returns the words of a search
+func words(search string) []string {
+	return strings.FieldsFunc(search, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// matchQuery turns the words of a search into an fts5 query matching all
+// of them, the last one as a prefix since it may not be finished yet
+func matchQuery(search string) string {
+	words := words(search)
+	for i, word := range words {
+		words[i] = `"` + word + `"`
+	}
+	if len(words) > 0 {
+		words[len(words)-1] += "*"
+	}
+	return strings.Join(words, " ")
+}
+
+// highlight escapes a highlight or snippet of the index and marks its
+// matches, the indexed text is not html. Blocks are joined in one line
+func highlight(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	return strings.NewReplacer(openMarker, "<mark>", closeMarker,
+		"</mark>").Replace(html.EscapeString(text))
+}
+
+func readID(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(value, 0, 64)
+}
+
+// matchIndex ranks the classes matching a search in the index
+func matchIndex(db *sql.DB, match string, gradeID, courseID int64,
+	role string, page *pagination.Page) (*sql.Rows, error) {
+	searchQuery := `
+		SELECT text_class.id, text_class.course_id, course.grade_id,
+		text_class.slug,
+		highlight(search_index, 0, ?, ?),
+		snippet(search_index, 1, ?, ?, '…', ?),
+		search_index.course, search_index.grade,
+		bm25(search_index, 10.0, 1.0, 2.0, 2.0) AS score
+		FROM search_index
+		JOIN text_class ON text_class.id = search_index.rowid
+		JOIN course ON course.id = text_class.course_id
+		WHERE search_index MATCH ?
+		AND (? = 0 OR course.grade_id = ?)
+		AND (? = 0 OR text_class.course_id = ?)
+		AND ` + visibleFilter + `
+		ORDER BY score
+		LIMIT ? OFFSET ?
+	`
+	return db.Query(searchQuery, openMarker, closeMarker, openMarker,
+		closeMarker, snippetTokens, match, gradeID, gradeID, courseID,
+		courseID, role, page.Size, page.NextToken)
+}
+
+// likeEscaper escapes the wildcards of a LIKE pattern
+var likeEscaper = strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_")
+
+// matchTitles finds the classes whose title, course or grade has every
+// word of a search, it is used without the index. They are sorted by
+// title and have no snippet
+func matchTitles(db *sql.DB, words []string, gradeID, courseID int64,
+	role string, page *pagination.Page) (*sql.Rows, error) {
+	var filter strings.Builder
+	var args []interface{}
+	for _, word := range words {
+		filter.WriteString(`
+		AND (text_class.title LIKE ? ESCAPE '\'
+			OR course.name LIKE ? ESCAPE '\'
+			OR grade.name LIKE ? ESCAPE '\')`)
+		pattern := "%" + likeEscaper.Replace(word) + "%"
+		args = append(args, pattern, pattern, pattern)
+	}
+	searchQuery := `
+		SELECT text_class.id, text_class.course_id, course.grade_id,
+		text_class.slug, text_class.title, '', course.name, grade.name, 0
+		FROM text_class
+		JOIN course ON course.id = text_class.course_id
+		JOIN grade ON grade.id = course.grade_id
+		WHERE (? = 0 OR course.grade_id = ?)
+		AND (? = 0 OR text_class.course_id = ?)
+		AND ` + visibleFilter + filter.String() + `
+		ORDER BY text_class.title, text_class.id
+		LIMIT ? OFFSET ?
+	`
+	args = append([]interface{}{gradeID, gradeID, courseID, courseID, role},
+		args...)
+	args = append(args, page.Size, page.NextToken)
+	return db.Query(searchQuery, args...)
+}
+
+// Search is an endpoint to search the text classes, results are ranked
+// with titles weighing more than bodies. Students only find published
+// classes of published courses. Without fts5 only titles and names are
+// searched and results are sorted by title
+func Search(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	params := r.URL.Query()
+	match := matchQuery(params.Get("q"))
+	if match == "" {
+		errormessages.WriteErrorMessage(w, "Missing search query",
+			http.StatusBadRequest)
+		return
+	}
+	gradeID, err := readID(params.Get("grade"))
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid grade id",
+			http.StatusBadRequest)
+		return
+	}
+	courseID, err := readID(params.Get("course"))
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid course id",
+			http.StatusBadRequest)
+		return
+	}
+	page := &pagination.Page{Size: defaultSize}
+	if size := params.Get("size"); size != "" {
+		page.Size, err = strconv.Atoi(size)
+		if err != nil {
+			errormessages.WriteErrorMessage(w, "Invalid size",
+				http.StatusBadRequest)
+			return
+		}
+	}
+	// The next token is the offset of the page in the ranking
+	page.NextToken, err = readID(params.Get("nextToken"))
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid next token",
+			http.StatusBadRequest)
+		return
+	}
+	if err = page.Validate(); err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid pagination",
+			http.StatusBadRequest)
+		return
+	}
+
+	db := persistence.GetDb()
+	var rows *sql.Rows
+	if indexed {
+		rows, err = matchIndex(db, match, gradeID, courseID, claims.Role,
+			page)
+	} else {
+		rows, err = matchTitles(db, words(params.Get("q")), gradeID,
+			courseID, claims.Role, page)
+	}
+	if err != nil {
+		logger.Error("Unable to search", err)
+		errormessages.WriteErrorMessage(w, "Unable to search",
+			http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	results := []Result{}
+	for rows.Next() {
+		result := Result{}
+		err = rows.Scan(&result.ClassID, &result.CourseID, &result.GradeID,
+			&result.Slug, &result.Title, &result.Snippet, &result.Course,
+			&result.Grade, &result.Rank)
+		if err != nil {
+			errormessages.WriteErrorMessage(w, "Unable to search",
+				http.StatusInternalServerError)
+			return
+		}
+		result.Title = highlight(result.Title)
+		result.Snippet = highlight(result.Snippet)
+		if indexed {
+			// bm25 is lower for better matches
+			result.Rank = -result.Rank
+		}
+		results = append(results, result)
+	}
+	page.Data = results
+	if len(results) == page.Size {
+		page.NextToken += int64(page.Size)
+	} else {
+		page.NextToken = -1
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(page)
+}
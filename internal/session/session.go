@@ -63,6 +63,17 @@ CREATE TABLE IF NOT EXISTS "user_role" (
 );
 `
 
+// AdminRole is the name of the role of administrators
+const AdminRole = "ADMIN"
+
+// AdminRoleDML adds the administrator role to databases created before it
+// existed
+const AdminRoleDML = `
+INSERT OR IGNORE INTO role(name, description)
+VALUES('` + AdminRole + `', 'Administrator role, can break the locks of ` +
+	`other users');
+`
+
 // Authenticate is a HandlerFunc that logins the user
 func Authenticate(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	credentials := &Credentials{}
@@ -176,6 +187,19 @@ func keyFunc(token *jwt.Token) (interface{}, error) {
 	return []byte(jwtSecret), nil
 }
 
+// parseClaims validates a JWT and returns its claims
+func parseClaims(tokenString string) (*Claims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, keyFunc)
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(*Claims)
+	if !ok || !token.Valid {
+		return nil, errors.New("Invalid token")
+	}
+	return claims, nil
+}
+
 // AuthMiddleware middleware that checks if the JWT token is valid
 func AuthMiddleware(next httprouter.Handle) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request,
@@ -188,23 +212,37 @@ func AuthMiddleware(next httprouter.Handle) httprouter.Handle {
 			return
 		}
 
-		token, err := jwt.ParseWithClaims(parsedHeader[1], &Claims{},
-			keyFunc)
+		claims, err := parseClaims(parsedHeader[1])
 		if err != nil {
 			errormessages.WriteErrorMessage(w,
 				"Incorrect or expired token",
 				http.StatusUnauthorized)
 			return
 		}
-		// Check if token is valid
-		if claims, ok := token.Claims.(*Claims); ok && token.Valid {
-			ctx := context.WithValue(r.Context(), ClaimsKey,
-				claims)
-			next(w, r.WithContext(ctx), p)
-		} else {
-			errormessages.WriteErrorMessage(w, "Invalid token",
+		ctx := context.WithValue(r.Context(), ClaimsKey, claims)
+		next(w, r.WithContext(ctx), p)
+	}
+}
+
+// SocketAuthMiddleware checks the JWT of a WebSocket handshake, browsers
+// can not set headers on WebSockets so the token may be sent as the token
+// query parameter instead
+func SocketAuthMiddleware(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request,
+		p httprouter.Params) {
+		tokenString := r.URL.Query().Get("token")
+		authorization := r.Header.Get("Authorization")
+		if strings.HasPrefix(authorization, "Bearer ") {
+			tokenString = strings.TrimPrefix(authorization, "Bearer ")
+		}
+		claims, err := parseClaims(tokenString)
+		if err != nil {
+			errormessages.WriteErrorMessage(w,
+				"Incorrect or expired token",
 				http.StatusUnauthorized)
+			return
 		}
-
+		ctx := context.WithValue(r.Context(), ClaimsKey, claims)
+		next(w, r.WithContext(ctx), p)
 	}
 }
@@ -0,0 +1,363 @@
+package tag
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/chromz/wiki-backend/internal/editlock"
+	"github.com/chromz/wiki-backend/internal/publication"
+	"github.com/chromz/wiki-backend/internal/session"
+	"github.com/chromz/wiki-backend/pkg/errormessages"
+	"github.com/chromz/wiki-backend/pkg/persistence"
+	"github.com/julienschmidt/httprouter"
+	"github.com/mattn/go-sqlite3"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// TagDDL is the query to create the tag table
+const TagDDL = `
+CREATE TABLE IF NOT EXISTS "tag" (
+	"id"	INTEGER PRIMARY KEY AUTOINCREMENT UNIQUE,
+	"name"	TEXT NOT NULL UNIQUE
+);
+`
+
+// TextClassTagDDL is the query to create the text class -> tag
+// intermediate table
+const TextClassTagDDL = `
+CREATE TABLE IF NOT EXISTS "text_class_tag" (
+	"text_class_id"	INTEGER NOT NULL,
+	"tag_id"	INTEGER NOT NULL,
+	FOREIGN KEY("text_class_id") REFERENCES "text_class"("id") ON DELETE CASCADE,
+	FOREIGN KEY("tag_id") REFERENCES "tag"("id") ON DELETE CASCADE,
+	PRIMARY KEY("text_class_id", "tag_id")
+);
+`
+
+const maxNameLength = 50
+const defaultSuggestions = 10
+
+// Tag represents a label that can be attached to text classes
+type Tag struct {
+	ID    int64  `json:"id"`
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+}
+
+// Normalize returns the canonical form of a tag name
+func Normalize(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// Validate checks if the tag is valid, it must be normalized first
+func (t *Tag) Validate() error {
+	if t.Name == "" {
+		return errors.New("Name is missing")
+	}
+	if len(t.Name) > maxNameLength {
+		return errors.New("Name is too long")
+	}
+	if strings.ContainsAny(t.Name, ",/") {
+		return errors.New("Name contains invalid characters")
+	}
+	return nil
+}
+
+// Set replaces the tags of a text class inside a transaction, the tags
+// that do not exist are created. Names must be normalized and valid, the
+// caller checks the edit lock of the class
+func Set(tx *sql.Tx, classID int64, names []string) error {
+	deleteQuery := `
+		DELETE FROM text_class_tag
+		WHERE text_class_id = ?
+	`
+	if _, err := tx.Exec(deleteQuery, classID); err != nil {
+		return err
+	}
+	insertTagQuery := `
+		INSERT OR IGNORE INTO tag(name)
+		VALUES(?)
+	`
+	linkQuery := `
+		INSERT OR IGNORE INTO text_class_tag(text_class_id, tag_id)
+		SELECT ?, id
+		FROM tag
+		WHERE name = ?
+	`
+	for _, name := range names {
+		if _, err := tx.Exec(insertTagQuery, name); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(linkQuery, classID, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Create is an endpoint that tags a text class, the tag is created if
+// it does not exist yet
+func Create(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	if claims.Role != "TEACHER" {
+		errormessages.WriteErrorInterface(w, "Not enough privileges",
+			http.StatusUnauthorized)
+		return
+	}
+	classID, err := strconv.ParseInt(p.ByName("classid"), 0, 64)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid id",
+			http.StatusBadRequest)
+		return
+	}
+	tag := &Tag{}
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(tag)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid body type",
+			http.StatusBadRequest)
+		return
+	}
+	tag.Name = Normalize(tag.Name)
+	if err = tag.Validate(); err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid tag",
+			http.StatusBadRequest)
+		return
+	}
+
+	db := persistence.GetDb()
+	tx, err := db.Begin()
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to reach database",
+			http.StatusInternalServerError)
+		return
+	}
+	if !editlock.Allow(w, tx, classID, claims.UserID) {
+		tx.Rollback()
+		return
+	}
+	insertTagQuery := `
+		INSERT OR IGNORE INTO tag(name)
+		VALUES(?)
+	`
+	if _, err = tx.Exec(insertTagQuery, tag.Name); err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to add tag",
+			http.StatusInternalServerError)
+		tx.Rollback()
+		return
+	}
+	findQuery := `
+		SELECT id
+		FROM tag
+		WHERE name = ?
+	`
+	if err = tx.QueryRow(findQuery, tag.Name).Scan(&tag.ID); err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to add tag",
+			http.StatusInternalServerError)
+		tx.Rollback()
+		return
+	}
+	linkQuery := `
+		INSERT OR IGNORE INTO text_class_tag(text_class_id, tag_id)
+		VALUES(?, ?)
+	`
+	_, err = tx.Exec(linkQuery, classID, tag.ID)
+	if err != nil {
+		if sqliteErr, ok := err.(sqlite3.Error); ok {
+			if sqliteErr.ExtendedCode == sqlite3.ErrConstraintForeignKey {
+				errormessages.WriteErrorMessage(w,
+					"Invalid class id",
+					http.StatusBadRequest)
+				tx.Rollback()
+				return
+			}
+		}
+		errormessages.WriteErrorMessage(w, "Unable to tag class",
+			http.StatusInternalServerError)
+		tx.Rollback()
+		return
+	}
+	countQuery := `
+		SELECT COUNT(*)
+		FROM text_class_tag
+		WHERE tag_id = ?
+	`
+	if err = tx.QueryRow(countQuery, tag.ID).Scan(&tag.Count); err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to tag class",
+			http.StatusInternalServerError)
+		tx.Rollback()
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		errString := "Unable to tag class"
+		errormessages.WriteErrorMessage(w, errString,
+			http.StatusInternalServerError)
+		tx.Rollback()
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tag)
+}
+
+// Delete is an endpoint that removes a tag from a text class, tags
+// that are no longer used are removed
+func Delete(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	if claims.Role != "TEACHER" {
+		errormessages.WriteErrorInterface(w, "Not enough privileges",
+			http.StatusUnauthorized)
+		return
+	}
+	classID, err := strconv.ParseInt(p.ByName("classid"), 0, 64)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid id",
+			http.StatusBadRequest)
+		return
+	}
+	name := Normalize(p.ByName("tag"))
+
+	db := persistence.GetDb()
+	tx, err := db.Begin()
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to reach database",
+			http.StatusInternalServerError)
+		return
+	}
+	if !editlock.Allow(w, tx, classID, claims.UserID) {
+		tx.Rollback()
+		return
+	}
+	var tagID int64
+	findQuery := `
+		SELECT id
+		FROM tag
+		WHERE name = ?
+	`
+	err = tx.QueryRow(findQuery, name).Scan(&tagID)
+	if err == sql.ErrNoRows {
+		errormessages.WriteErrorInterface(w, "Tag not found",
+			http.StatusNotFound)
+		tx.Rollback()
+		return
+	}
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to remove tag",
+			http.StatusInternalServerError)
+		tx.Rollback()
+		return
+	}
+	deleteQuery := `
+		DELETE FROM text_class_tag
+		WHERE text_class_id = ?
+		AND tag_id = ?
+	`
+	res, err := tx.Exec(deleteQuery, classID, tagID)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to remove tag",
+			http.StatusInternalServerError)
+		tx.Rollback()
+		return
+	}
+	affectedRows, _ := res.RowsAffected()
+	if affectedRows == 0 {
+		errormessages.WriteErrorInterface(w, "Tag not found",
+			http.StatusNotFound)
+		tx.Rollback()
+		return
+	}
+	cleanQuery := `
+		DELETE FROM tag
+		WHERE id = ?
+		AND NOT EXISTS (
+			SELECT 1 FROM text_class_tag WHERE tag_id = ?
+		)
+	`
+	if _, err = tx.Exec(cleanQuery, tagID, tagID); err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to remove tag",
+			http.StatusInternalServerError)
+		tx.Rollback()
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		errString := "Unable to remove tag"
+		errormessages.WriteErrorMessage(w, errString,
+			http.StatusInternalServerError)
+		tx.Rollback()
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// visibleFilter is the sql condition, taking the role of the user, for
+// the classes the user can see, like textclass.VisibleFilter
+const visibleFilter = `(` + publication.RoleFilter + ` OR (
+			text_class.status = 'published'
+			AND EXISTS (
+				SELECT 1
+				FROM course
+				WHERE course.id = text_class.course_id
+				AND course.status = 'published'
+			)
+		))`
+
+// Autocomplete returns the tags starting with the q parameter along
+// with the number of classes using them. Only the classes the user can
+// see are counted, students don't get the tags of hidden classes
+func Autocomplete(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	params := r.URL.Query()
+	prefix := Normalize(params.Get("q"))
+	size := defaultSuggestions
+	if params.Get("size") != "" {
+		var err error
+		size, err = strconv.Atoi(params.Get("size"))
+		if err != nil || size <= 0 || size > 200 {
+			errormessages.WriteErrorMessage(w, "Invalid size",
+				http.StatusBadRequest)
+			return
+		}
+	}
+	escaper := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+	pattern := escaper.Replace(prefix) + "%"
+
+	db := persistence.GetDb()
+	findQuery := `
+		SELECT tag.id, tag.name, COUNT(text_class.id)
+		FROM tag
+		LEFT JOIN text_class_tag ON text_class_tag.tag_id = tag.id
+		LEFT JOIN text_class
+		ON text_class.id = text_class_tag.text_class_id
+		AND ` + visibleFilter + `
+		WHERE tag.name LIKE ? ESCAPE '\'
+		GROUP BY tag.id
+		HAVING ` + publication.RoleFilter + ` OR COUNT(text_class.id) > 0
+		ORDER BY COUNT(text_class.id) DESC, tag.name
+		LIMIT ?
+	`
+	rows, err := db.Query(findQuery, claims.Role, pattern, claims.Role,
+		size)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to find tags",
+			http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	tags := []Tag{}
+	for rows.Next() {
+		tag := Tag{}
+		err = rows.Scan(&tag.ID, &tag.Name, &tag.Count)
+		if err != nil {
+			errormessages.WriteErrorMessage(w,
+				"Unable to find tags",
+				http.StatusInternalServerError)
+			return
+		}
+		tags = append(tags, tag)
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tags)
+}
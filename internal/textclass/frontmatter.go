@@ -0,0 +1,145 @@
+package textclass
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/chromz/wiki-backend/internal/publication"
+	"github.com/chromz/wiki-backend/internal/tag"
+	"github.com/chromz/wiki-backend/pkg/frontmatter"
+	"time"
+)
+
+// FrontMatterColumns are the ALTER queries that add the metadata read from
+// the front matter of the markdown to existing text_class tables
+var FrontMatterColumns = []string{
+	`ALTER TABLE "text_class" ADD COLUMN "summary" TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE "text_class" ADD COLUMN "author" TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE "text_class" ADD COLUMN "duration" INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE "text_class" ADD COLUMN "metadata" TEXT NOT NULL DEFAULT '{}'`,
+}
+
+// syncFrontMatter copies the front matter of the markdown of a class to
+// its columns inside a transaction. The summary, author, duration and
+// metadata only come from the front matter and are cleared without one,
+// the title, tags and publish date are only changed when it has them
+func syncFrontMatter(tx *sql.Tx, classID int64,
+	fm *frontmatter.FrontMatter) error {
+	if fm == nil {
+		fm = &frontmatter.FrontMatter{}
+	}
+	metadata := []byte("{}")
+	if len(fm.Extra) > 0 {
+		var err error
+		if metadata, err = json.Marshal(fm.Extra); err != nil {
+			return err
+		}
+	}
+	updateQuery := `
+		UPDATE text_class
+		SET summary = ?, author = ?, duration = ?, metadata = ?
+		WHERE id = ?
+	`
+	_, err := tx.Exec(updateQuery, fm.Summary, fm.Author, fm.Duration,
+		string(metadata), classID)
+	if err != nil {
+		return err
+	}
+	if fm.Title != "" {
+		if err = syncTitle(tx, classID, fm.Title); err != nil {
+			return err
+		}
+	}
+	if fm.Tags != nil {
+		if err = syncTags(tx, classID, fm.Tags); err != nil {
+			return err
+		}
+	}
+	if fm.PublishDate != nil {
+		return syncPublishDate(tx, classID, fm)
+	}
+	return nil
+}
+
+// SyncFrontMatter copies the front matter of markdown to its class, it is
+// used by mdproc for the files that did not come through the wiki. Files
+// with invalid front matter keep the metadata of the class
+func SyncFrontMatter(db *sql.DB, classID int64, content []byte) error {
+	fm, _, err := frontmatter.Parse(content)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = syncFrontMatter(tx, classID, fm); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func syncTitle(tx *sql.Tx, classID int64, title string) error {
+	var current string
+	findQuery := `
+		SELECT title
+		FROM text_class
+		WHERE id = ?
+	`
+	if err := tx.QueryRow(findQuery, classID).Scan(&current); err != nil {
+		return err
+	}
+	if current == title {
+		return nil
+	}
+	_, _, err := retitle(tx, classID, title)
+	return err
+}
+
+// syncTags replaces the tags of a class, invalid names are left out
+func syncTags(tx *sql.Tx, classID int64, names []string) error {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		t := &tag.Tag{Name: tag.Normalize(name)}
+		if t.Validate() != nil || seen[t.Name] {
+			continue
+		}
+		seen[t.Name] = true
+		tags = append(tags, t.Name)
+	}
+	return tag.Set(tx, classID, tags)
+}
+
+// syncPublishDate schedules the publication of a class. A past date only
+// reschedules a class that is already scheduled, otherwise it would
+// publish it on the next tick of the scheduler. The date is left out when
+// it is not before the unpublish date
+func syncPublishDate(tx *sql.Tx, classID int64,
+	fm *frontmatter.FrontMatter) error {
+	var publishAt, unpublishAt sql.NullInt64
+	findQuery := `
+		SELECT publish_at, unpublish_at
+		FROM text_class
+		WHERE id = ?
+	`
+	err := tx.QueryRow(findQuery, classID).Scan(&publishAt, &unpublishAt)
+	if err != nil {
+		return err
+	}
+	if !publishAt.Valid && !fm.PublishDate.After(time.Now()) {
+		return nil
+	}
+	err = publication.ValidateSchedule("", fm.PublishDate,
+		publication.Time(unpublishAt))
+	if err != nil {
+		return nil
+	}
+	updateQuery := `
+		UPDATE text_class
+		SET publish_at = ?
+		WHERE id = ?
+	`
+	_, err = tx.Exec(updateQuery, publication.Unix(fm.PublishDate), classID)
+	return err
+}
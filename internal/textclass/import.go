@@ -0,0 +1,81 @@
+package textclass
+
+import (
+	"github.com/chromz/wiki-backend/pkg/convert"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// importedDir is the directory of the class assets holding the images
+// extracted from imported documents
+const importedDir = "imported/"
+
+// importTypes and importExtensions map the documents converted to
+// markdown to their format. Files with a markdown extension, .txt
+// included, are never converted so plain text is only converted when it
+// comes with another name
+var importTypes = map[string]string{
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document": convert.DOCX,
+	"application/vnd.oasis.opendocument.text":                                 convert.ODT,
+	"text/html":  convert.HTML,
+	"text/plain": convert.Text,
+}
+
+var importExtensions = map[string]string{
+	".docx": convert.DOCX,
+	".odt":  convert.ODT,
+	".html": convert.HTML,
+	".htm":  convert.HTML,
+}
+
+// importFormat returns the format of an uploaded document that has to be
+// converted, it is empty for markdown and unsupported files
+func importFormat(contentType, fileName string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = ""
+	}
+	extension := strings.ToLower(filepath.Ext(fileName))
+	if format, ok := importExtensions[extension]; ok {
+		if genericTypes[mediaType] || importTypes[mediaType] == format ||
+			mediaType == "application/zip" {
+			return format
+		}
+		return ""
+	}
+	if markdownExtensions[extension] {
+		return ""
+	}
+	return importTypes[mediaType]
+}
+
+// convertDocument converts an uploaded document, its images are linked
+// from the assets of the class
+func (src *source) convertDocument(format string,
+	content []byte) (*convert.Document, error) {
+	midDir := strings.TrimPrefix(src.assets, syncDir+"assets/")
+	return convert.Convert(format, content, baseURI+midDir+importedDir)
+}
+
+// saveImport stores the images of a converted document and the original
+// document next to its markdown
+func (src *source) saveImport(doc *convert.Document, fileName string,
+	original []byte) error {
+	if len(doc.Images) > 0 {
+		if err := os.MkdirAll(src.assets+importedDir, 0700); err != nil {
+			return err
+		}
+	}
+	for _, image := range doc.Images {
+		err := ioutil.WriteFile(src.assets+importedDir+image.Name,
+			image.Data, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(src.directory+filepath.Base(fileName), original,
+		0600)
+}
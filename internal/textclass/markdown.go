@@ -0,0 +1,535 @@
+package textclass
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"github.com/chromz/wiki-backend/internal/editlock"
+	"github.com/chromz/wiki-backend/internal/lint"
+	"github.com/chromz/wiki-backend/internal/revision"
+	"github.com/chromz/wiki-backend/internal/search"
+	"github.com/chromz/wiki-backend/internal/session"
+	"github.com/chromz/wiki-backend/internal/wikilink"
+	"github.com/chromz/wiki-backend/pkg/diff"
+	"github.com/chromz/wiki-backend/pkg/errormessages"
+	"github.com/chromz/wiki-backend/pkg/frontmatter"
+	"github.com/chromz/wiki-backend/pkg/persistence"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// maxMarkdownSize is the maximum size of an uploaded markdown file
+const maxMarkdownSize = 10 << 20
+
+// markdownTypes are the content types accepted for markdown uploads,
+// generic types are only accepted for files with a markdown extension
+var markdownTypes = map[string]bool{
+	"text/markdown":   true,
+	"text/x-markdown": true,
+}
+
+var genericTypes = map[string]bool{
+	"":                         true,
+	"text/plain":               true,
+	"application/octet-stream": true,
+}
+
+var markdownExtensions = map[string]bool{
+	".md":       true,
+	".markdown": true,
+	".mdown":    true,
+	".txt":      true,
+}
+
+// isMarkdown checks the declared type and name of an uploaded file
+func isMarkdown(contentType, fileName string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = ""
+	}
+	if markdownTypes[mediaType] {
+		return true
+	}
+	extension := strings.ToLower(filepath.Ext(fileName))
+	return genericTypes[mediaType] && markdownExtensions[extension]
+}
+
+// source is where the markdown of a class is stored
+type source struct {
+	classID   int64
+	directory string
+	assets    string
+	fileName  string
+}
+
+// rowQueryer is satisfied by both *sql.DB and *sql.Tx
+type rowQueryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// findSource returns the stored markdown of a class, classes without a
+// file get one named after their slug
+func findSource(q rowQueryer, classID int64) (*source, error) {
+	findQuery := `
+		SELECT course.grade_id, text_class.course_id, text_class.file_name,
+		text_class.slug
+		FROM text_class
+		JOIN course ON course.id = text_class.course_id
+		WHERE text_class.id = ?
+	`
+	var gradeID, courseID int64
+	var fileName, classSlug string
+	err := q.QueryRow(findQuery, classID).Scan(&gradeID, &courseID,
+		&fileName, &classSlug)
+	if err != nil {
+		return nil, err
+	}
+	src := &source{classID: classID}
+	src.directory, src.assets = Dirs(gradeID, courseID, classID)
+	if fileName == "" {
+		fileName = src.directory + classSlug + ".md"
+	}
+	src.fileName = fileName
+	return src, nil
+}
+
+// MarkdownFile returns the file the markdown of a class is written to,
+// it may not exist yet
+func MarkdownFile(q rowQueryer, classID int64) (string, error) {
+	src, err := findSource(q, classID)
+	if err != nil {
+		return "", err
+	}
+	return src.fileName, nil
+}
+
+// content reads the current markdown, it is nil when there is no file
+func (src *source) content() ([]byte, error) {
+	content, err := ioutil.ReadFile(src.fileName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return content, err
+}
+
+// save writes a new version of the markdown as a revision and queues it
+// to be processed again, the metadata of its front matter is copied to
+// the class and its lint report replaces the previous one. It returns a
+// *editlock.LockedError when the class is checked out by someone other
+// than the author
+func (src *source) save(tx *sql.Tx, authorID, message string,
+	content []byte) (*revision.Revision, error) {
+	return src.saveChecked(tx, authorID, message, content,
+		lint.Check(content, src.assets))
+}
+
+// saveChecked is save for content that was already linted
+func (src *source) saveChecked(tx *sql.Tx, authorID, message string,
+	content []byte, report *lint.Report) (*revision.Revision, error) {
+	if err := editlock.Guard(tx, src.classID, authorID); err != nil {
+		return nil, err
+	}
+	updateQuery := `
+		UPDATE text_class
+		SET file_name = ?, proc_file_name = ''
+		WHERE id = ?
+	`
+	res, err := tx.Exec(updateQuery, src.fileName, src.classID)
+	if err != nil {
+		return nil, err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rowsAffected != 1 {
+		return nil, sql.ErrNoRows
+	}
+	// Files with invalid front matter keep the metadata of the class
+	body := content
+	if fm, stripped, err := frontmatter.Parse(content); err == nil {
+		body = stripped
+		if err = syncFrontMatter(tx, src.classID, fm); err != nil {
+			return nil, err
+		}
+	}
+	if err = wikilink.Update(tx, src.classID, string(body)); err != nil {
+		return nil, err
+	}
+	if err = search.Update(tx, src.classID, string(body)); err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(src.directory, 0700); err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(src.assets, 0700); err != nil {
+		return nil, err
+	}
+	rev, err := revision.Record(tx, src.classID, authorID, message,
+		src.directory, content)
+	if err != nil {
+		return nil, err
+	}
+	if err = lint.Save(tx, src.classID, rev.ID, report); err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(src.fileName, content, 0600); err != nil {
+		return nil, err
+	}
+	return rev, nil
+}
+
+// etag is the validator of the markdown of a class as it was written,
+// it is the only one accepted in If-Match
+func etag(content []byte) string {
+	return `"` + revision.Hash(content) + `"`
+}
+
+// weakETag is the validator of a representation derived from the
+// markdown, like the processed file or its html. It is weak so it can't
+// be mistaken for the validator of the markdown
+func weakETag(content []byte) string {
+	return "W/" + etag(content)
+}
+
+// checkIfMatch checks the If-Match header against the current content,
+// requests without the header always match. Weak validators are rejected
+// since they don't identify the written markdown. It writes the error
+// response when the request must not go on
+func checkIfMatch(w http.ResponseWriter, r *http.Request,
+	content []byte) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return true
+	}
+	if strings.TrimSpace(header) == "*" && content != nil {
+		return true
+	}
+	var current string
+	if content != nil {
+		current = etag(content)
+	}
+	for _, value := range strings.Split(header, ",") {
+		value = strings.TrimSpace(value)
+		if strings.HasPrefix(value, "W/") {
+			errormessages.WriteErrorMessage(w,
+				"If-Match needs the ETag of the markdown",
+				http.StatusBadRequest)
+			return false
+		}
+		if current != "" && value == current {
+			return true
+		}
+	}
+	errormessages.WriteErrorInterface(w,
+		"The class was changed by someone else",
+		http.StatusPreconditionFailed)
+	return false
+}
+
+func markdownClassID(w http.ResponseWriter, r *http.Request,
+	p httprouter.Params) (int64, bool) {
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	if claims.Role != "TEACHER" {
+		errormessages.WriteErrorInterface(w, "Not enough privileges",
+			http.StatusUnauthorized)
+		return 0, false
+	}
+	classID, err := strconv.ParseInt(p.ByName("classid"), 0, 64)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid id",
+			http.StatusBadRequest)
+		return 0, false
+	}
+	return classID, true
+}
+
+// ReadMarkdown is an endpoint to get the markdown of a class as it was
+// written, the ETag header must be sent back to change it. Requests with
+// a matching If-None-Match get a 304
+func ReadMarkdown(w http.ResponseWriter, r *http.Request,
+	p httprouter.Params) {
+	classID, ok := markdownClassID(w, r, p)
+	if !ok {
+		return
+	}
+	src, err := findSource(persistence.GetDb(), classID)
+	if err == sql.ErrNoRows {
+		errormessages.WriteErrorInterface(w, "Class does not exists",
+			http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to find class",
+			http.StatusInternalServerError)
+		return
+	}
+	content, err := src.content()
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Could not read os file",
+			http.StatusInternalServerError)
+		return
+	}
+	if content == nil {
+		errormessages.WriteErrorInterface(w,
+			"There is no file for the class",
+			http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	w.Header().Set("ETag", etag(content))
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+}
+
+// WriteMarkdown is an endpoint to replace the markdown of a class with
+// the request body
+func WriteMarkdown(w http.ResponseWriter, r *http.Request,
+	p httprouter.Params) {
+	editMarkdown(w, r, p, func(current, body []byte) ([]byte, int, string) {
+		return body, 0, ""
+	})
+}
+
+// PatchMarkdown is an endpoint to change the markdown of a class with a
+// unified diff sent as the request body
+func PatchMarkdown(w http.ResponseWriter, r *http.Request,
+	p httprouter.Params) {
+	editMarkdown(w, r, p, func(current, body []byte) ([]byte, int, string) {
+		patched, err := diff.Apply(string(current), string(body))
+		if err == diff.ErrMalformed {
+			return nil, http.StatusBadRequest, "Invalid patch"
+		}
+		if err != nil {
+			return nil, http.StatusConflict, "Patch does not apply"
+		}
+		return []byte(patched), 0, ""
+	})
+}
+
+// editMarkdown stores the content built by edit from the current
+// markdown and the request body, edit reports failures with a status
+// and a message
+func editMarkdown(w http.ResponseWriter, r *http.Request, p httprouter.Params,
+	edit func(current, body []byte) ([]byte, int, string)) {
+	classID, ok := markdownClassID(w, r, p)
+	if !ok {
+		return
+	}
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body,
+		maxMarkdownSize))
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to read body",
+			http.StatusBadRequest)
+		return
+	}
+
+	unlock := revision.Lock(classID)
+	defer unlock()
+	db := persistence.GetDb()
+	tx, err := db.Begin()
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to reach database",
+			http.StatusInternalServerError)
+		return
+	}
+	src, err := findSource(tx, classID)
+	if err == sql.ErrNoRows {
+		errormessages.WriteErrorInterface(w, "Class does not exists",
+			http.StatusNotFound)
+		tx.Rollback()
+		return
+	}
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to find class",
+			http.StatusInternalServerError)
+		tx.Rollback()
+		return
+	}
+	current, err := src.content()
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Could not read os file",
+			http.StatusInternalServerError)
+		tx.Rollback()
+		return
+	}
+	if !checkIfMatch(w, r, current) {
+		tx.Rollback()
+		return
+	}
+	content, status, message := edit(current, body)
+	if status != 0 {
+		errormessages.WriteErrorMessage(w, message, status)
+		tx.Rollback()
+		return
+	}
+	if !utf8.Valid(content) {
+		errormessages.WriteErrorMessage(w, "Invalid file",
+			http.StatusBadRequest)
+		tx.Rollback()
+		return
+	}
+	if _, _, err = frontmatter.Parse(content); err != nil {
+		errormessages.WriteErrorMessage(w,
+			"Invalid front matter: "+err.Error(), http.StatusBadRequest)
+		tx.Rollback()
+		return
+	}
+	rev, err := src.save(tx, claims.UserID, r.URL.Query().Get("message"),
+		content)
+	if editlock.WriteError(w, err) {
+		tx.Rollback()
+		return
+	}
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Could not write os file",
+			http.StatusInternalServerError)
+		tx.Rollback()
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		errString := "Unable to update text class"
+		errormessages.WriteErrorMessage(w, errString,
+			http.StatusInternalServerError)
+		tx.Rollback()
+		return
+	}
+	w.Header().Set("ETag", etag(content))
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(rev)
+}
+
+// RestoreRevision is an endpoint to make an older revision the current
+// markdown of a class, it is saved as a new revision
+func RestoreRevision(w http.ResponseWriter, r *http.Request,
+	p httprouter.Params) {
+	classID, ok := markdownClassID(w, r, p)
+	if !ok {
+		return
+	}
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	revisionID, err := strconv.ParseInt(p.ByName("revisionid"), 0, 64)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid revision id",
+			http.StatusBadRequest)
+		return
+	}
+	restored, err := revision.Find(classID, revisionID)
+	if err == sql.ErrNoRows {
+		errormessages.WriteErrorInterface(w, "Revision does not exists",
+			http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to find revision",
+			http.StatusInternalServerError)
+		return
+	}
+	content, err := restored.Markdown()
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to read revision",
+			http.StatusInternalServerError)
+		return
+	}
+
+	unlock := revision.Lock(classID)
+	defer unlock()
+	db := persistence.GetDb()
+	tx, err := db.Begin()
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to reach database",
+			http.StatusInternalServerError)
+		return
+	}
+	src, err := findSource(tx, classID)
+	if err == sql.ErrNoRows {
+		errormessages.WriteErrorInterface(w, "Class does not exists",
+			http.StatusNotFound)
+		tx.Rollback()
+		return
+	}
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to find class",
+			http.StatusInternalServerError)
+		tx.Rollback()
+		return
+	}
+	message := "Restored revision " + strconv.FormatInt(revisionID, 10)
+	rev, err := src.save(tx, claims.UserID, message, content)
+	if editlock.WriteError(w, err) {
+		tx.Rollback()
+		return
+	}
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to restore revision",
+			http.StatusInternalServerError)
+		tx.Rollback()
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		errString := "Unable to restore revision"
+		errormessages.WriteErrorMessage(w, errString,
+			http.StatusInternalServerError)
+		tx.Rollback()
+		return
+	}
+	w.Header().Set("ETag", etag(content))
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(rev)
+}
+
+// LoadMarkdown returns the current markdown of a class, it is empty when
+// the class has no file yet. Callers comparing it with a later write must
+// hold revision.Lock for the class
+func LoadMarkdown(classID int64) ([]byte, error) {
+	src, err := findSource(persistence.GetDb(), classID)
+	if err != nil {
+		return nil, err
+	}
+	content, err := src.content()
+	if err != nil || content == nil {
+		return []byte{}, err
+	}
+	return content, nil
+}
+
+// SaveMarkdown stores content as a new revision of the markdown of a
+// class and queues it to be processed again, callers must hold
+// revision.Lock for the class
+func SaveMarkdown(classID int64, authorID, message string,
+	content []byte) (*revision.Revision, error) {
+	db := persistence.GetDb()
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	rev, err := StoreMarkdown(tx, classID, authorID, message, content)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return rev, tx.Commit()
+}
+
+// StoreMarkdown is SaveMarkdown inside a transaction, the files are
+// written before the transaction is committed. Both return a
+// *editlock.LockedError when the class is checked out by someone other
+// than the author
+func StoreMarkdown(tx *sql.Tx, classID int64, authorID, message string,
+	content []byte) (*revision.Revision, error) {
+	src, err := findSource(tx, classID)
+	if err != nil {
+		return nil, err
+	}
+	return src.save(tx, authorID, message, content)
+}
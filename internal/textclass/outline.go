@@ -0,0 +1,182 @@
+package textclass
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/chromz/wiki-backend/internal/session"
+	"github.com/chromz/wiki-backend/pkg/errormessages"
+	"github.com/chromz/wiki-backend/pkg/frontmatter"
+	"github.com/chromz/wiki-backend/pkg/markdown"
+	"github.com/chromz/wiki-backend/pkg/persistence"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+// OutlineColumn is the ALTER query that adds the outline written by mdproc
+// to existing text_class tables
+const OutlineColumn = `ALTER TABLE "text_class" ADD COLUMN "outline" TEXT NOT NULL DEFAULT ''`
+
+// ClassOutline is the heading outline of a class, the ids are the anchors
+// of the headings in its html
+type ClassOutline struct {
+	ID      int64               `json:"id"`
+	Title   string              `json:"title"`
+	Slug    string              `json:"slug"`
+	Outline []*markdown.Heading `json:"outline"`
+}
+
+// outlineRow has what is needed to find the outline of a class
+type outlineRow struct {
+	fileName     string
+	procFileName string
+	outline      string
+}
+
+// read returns the outline stored by mdproc, it is built from the file when
+// the class has not been processed since it changed
+func (row *outlineRow) read() ([]*markdown.Heading, error) {
+	if row.procFileName != "" && row.outline != "" {
+		var outline []*markdown.Heading
+		err := json.Unmarshal([]byte(row.outline), &outline)
+		return outline, err
+	}
+	if row.procFileName != "" {
+		content, err := ioutil.ReadFile(row.procFileName)
+		if err != nil {
+			return nil, err
+		}
+		return markdown.Outline(content), nil
+	}
+	if row.fileName == "" {
+		return []*markdown.Heading{}, nil
+	}
+	content, err := ioutil.ReadFile(row.fileName)
+	if err != nil {
+		return nil, err
+	}
+	return markdown.Outline(frontmatter.Strip(content)), nil
+}
+
+// ReadOutline is an endpoint that returns the heading outline of a class
+func ReadOutline(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	courseID, err := strconv.ParseInt(p.ByName("courseid"), 0, 64)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid course id",
+			http.StatusBadRequest)
+		return
+	}
+	classID, err := strconv.ParseInt(p.ByName("classid"), 0, 64)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid id",
+			http.StatusBadRequest)
+		return
+	}
+	db := persistence.GetDb()
+	findQuery := `
+		SELECT id, title, slug, file_name, proc_file_name, outline
+		FROM text_class
+		WHERE id = ?
+		AND course_id = ?
+		AND ` + VisibleFilter + `
+	`
+	result := &ClassOutline{}
+	row := &outlineRow{}
+	err = db.QueryRow(findQuery, classID, courseID, claims.Role).Scan(
+		&result.ID, &result.Title, &result.Slug, &row.fileName,
+		&row.procFileName, &row.outline)
+	if err == sql.ErrNoRows {
+		errormessages.WriteErrorInterface(w, "Class does not exists",
+			http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to find class",
+			http.StatusInternalServerError)
+		return
+	}
+	result.Outline, err = row.read()
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to read outline",
+			http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
+}
+
+// ReadCourseOutline is an endpoint that returns the outlines of the
+// classes of a course in order, students only get the published classes
+func ReadCourseOutline(w http.ResponseWriter, r *http.Request,
+	p httprouter.Params) {
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	gradeID, err := strconv.ParseInt(p.ByName("id"), 0, 64)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid grade id",
+			http.StatusBadRequest)
+		return
+	}
+	courseID, err := strconv.ParseInt(p.ByName("courseid"), 0, 64)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid course id",
+			http.StatusBadRequest)
+		return
+	}
+	db := persistence.GetDb()
+	var exists bool
+	err = db.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM course WHERE id = ? AND grade_id = ?)
+	`, courseID, gradeID).Scan(&exists)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to find course",
+			http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		errormessages.WriteErrorInterface(w, "Course does not exists",
+			http.StatusNotFound)
+		return
+	}
+	findQuery := `
+		SELECT id, title, slug, file_name, proc_file_name, outline
+		FROM text_class
+		WHERE course_id = ?
+		AND ` + VisibleFilter + `
+		ORDER BY id
+	`
+	rows, err := db.Query(findQuery, courseID, claims.Role)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to find classes",
+			http.StatusInternalServerError)
+		return
+	}
+	classes := []*ClassOutline{}
+	var outlineRows []*outlineRow
+	for rows.Next() {
+		class := &ClassOutline{}
+		row := &outlineRow{}
+		err = rows.Scan(&class.ID, &class.Title, &class.Slug, &row.fileName,
+			&row.procFileName, &row.outline)
+		if err != nil {
+			rows.Close()
+			errormessages.WriteErrorMessage(w, "Unable to find classes",
+				http.StatusInternalServerError)
+			return
+		}
+		classes = append(classes, class)
+		outlineRows = append(outlineRows, row)
+	}
+	rows.Close()
+	for i, class := range classes {
+		class.Outline, err = outlineRows[i].read()
+		if err != nil {
+			errormessages.WriteErrorMessage(w, "Unable to read outline",
+				http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(classes)
+}
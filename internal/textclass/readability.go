@@ -0,0 +1,192 @@
+package textclass
+
+import (
+	"encoding/json"
+	"github.com/chromz/wiki-backend/internal/session"
+	"github.com/chromz/wiki-backend/pkg/errormessages"
+	"github.com/chromz/wiki-backend/pkg/frontmatter"
+	"github.com/chromz/wiki-backend/pkg/markdown"
+	"github.com/chromz/wiki-backend/pkg/persistence"
+	"github.com/chromz/wiki-backend/pkg/readability"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+// ReadabilityColumn is the ALTER query that adds the readability stats
+// written by mdproc to existing text_class tables
+const ReadabilityColumn = `ALTER TABLE "text_class" ADD COLUMN "readability" TEXT NOT NULL DEFAULT ''`
+
+// defaultTolerance is how many school years above the expected level a
+// class can be before it is flagged
+const defaultTolerance = 2
+
+// ClassReadability is a class in the readability report of a grade, the
+// readability is null when the file of the class can not be read
+type ClassReadability struct {
+	ID          int64              `json:"id"`
+	CourseID    int64              `json:"courseId"`
+	CourseName  string             `json:"courseName"`
+	Title       string             `json:"title"`
+	Slug        string             `json:"slug"`
+	Processed   bool               `json:"processed"`
+	Readability *readability.Stats `json:"readability"`
+	Flagged     bool               `json:"flagged"`
+}
+
+// ReadabilityReport is the readability of the classes of a grade, classes
+// more than Tolerance years above ExpectedLevel are flagged
+type ReadabilityReport struct {
+	GradeID       int64               `json:"gradeId"`
+	ExpectedLevel int                 `json:"expectedLevel"`
+	Tolerance     int                 `json:"tolerance"`
+	Flagged       int                 `json:"flagged"`
+	Classes       []*ClassReadability `json:"classes"`
+}
+
+// readabilityRow has what is needed to measure a class
+type readabilityRow struct {
+	fileName     string
+	procFileName string
+	stats        string
+}
+
+// read returns the stats stored by mdproc, they are measured from the file
+// when the class has not been processed since it changed
+func (row *readabilityRow) read() (*readability.Stats, error) {
+	if row.procFileName != "" && row.stats != "" {
+		stats := &readability.Stats{}
+		err := json.Unmarshal([]byte(row.stats), stats)
+		return stats, err
+	}
+	fileName := row.procFileName
+	if fileName == "" {
+		fileName = row.fileName
+	}
+	if fileName == "" {
+		return readability.Analyze(""), nil
+	}
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return readability.Analyze(markdown.PlainText(
+		frontmatter.Strip(content))), nil
+}
+
+// ReadReadability is an endpoint that returns the readability of every
+// class of a grade, drafts included, and flags the ones far above the
+// expected level. Classes whose file can not be read are not measured.
+// The level and tolerance query parameters are school years, the level is
+// required since the grades do not store their school year
+func ReadReadability(w http.ResponseWriter, r *http.Request,
+	p httprouter.Params) {
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	if claims.Role != "TEACHER" {
+		errormessages.WriteErrorInterface(w, "Not enough privileges",
+			http.StatusUnauthorized)
+		return
+	}
+	gradeID, err := strconv.ParseInt(p.ByName("id"), 0, 64)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid grade id",
+			http.StatusBadRequest)
+		return
+	}
+	report := &ReadabilityReport{
+		GradeID:   gradeID,
+		Tolerance: defaultTolerance,
+		Classes:   []*ClassReadability{},
+	}
+	query := r.URL.Query()
+	report.ExpectedLevel, err = strconv.Atoi(query.Get("level"))
+	if err != nil || report.ExpectedLevel < 1 {
+		errormessages.WriteErrorMessage(w, "Invalid level",
+			http.StatusBadRequest)
+		return
+	}
+	if value := query.Get("tolerance"); value != "" {
+		report.Tolerance, err = strconv.Atoi(value)
+		if err != nil || report.Tolerance < 0 {
+			errormessages.WriteErrorMessage(w, "Invalid tolerance",
+				http.StatusBadRequest)
+			return
+		}
+	}
+	db := persistence.GetDb()
+	var exists bool
+	err = db.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM grade WHERE id = ?)
+	`, gradeID).Scan(&exists)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to find grade",
+			http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		errormessages.WriteErrorInterface(w, "Grade does not exists",
+			http.StatusNotFound)
+		return
+	}
+	findQuery := `
+		SELECT text_class.id, text_class.course_id, course.name,
+		text_class.title, text_class.slug, text_class.file_name,
+		text_class.proc_file_name, text_class.readability
+		FROM text_class
+		INNER JOIN course ON course.id = text_class.course_id
+		WHERE course.grade_id = ?
+		ORDER BY text_class.course_id, text_class.id
+	`
+	rows, err := db.Query(findQuery, gradeID)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to find classes",
+			http.StatusInternalServerError)
+		return
+	}
+	var readabilityRows []*readabilityRow
+	for rows.Next() {
+		class := &ClassReadability{}
+		row := &readabilityRow{}
+		err = rows.Scan(&class.ID, &class.CourseID, &class.CourseName,
+			&class.Title, &class.Slug, &row.fileName, &row.procFileName,
+			&row.stats)
+		if err != nil {
+			rows.Close()
+			errormessages.WriteErrorMessage(w, "Unable to find classes",
+				http.StatusInternalServerError)
+			return
+		}
+		class.Processed = row.procFileName != ""
+		report.Classes = append(report.Classes, class)
+		readabilityRows = append(readabilityRows, row)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to find classes",
+			http.StatusInternalServerError)
+		return
+	}
+	// A class that can not be measured is left unmeasured instead of
+	// failing the report of the whole grade
+	for i, class := range report.Classes {
+		class.Readability, err = readabilityRows[i].read()
+		if err != nil {
+			class.Readability = nil
+		}
+	}
+	if report.ExpectedLevel < readability.MinLevel {
+		report.ExpectedLevel = readability.MinLevel
+	}
+	for _, class := range report.Classes {
+		class.Flagged = class.Readability != nil &&
+			class.Readability.Words > 0 &&
+			class.Readability.Level-report.ExpectedLevel > report.Tolerance
+		if class.Flagged {
+			report.Flagged++
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(report)
+}
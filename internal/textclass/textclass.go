@@ -1,19 +1,34 @@
 package textclass
 
 import (
+	"bytes"
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"github.com/chromz/wiki-backend/internal/editlock"
+	"github.com/chromz/wiki-backend/internal/lint"
+	"github.com/chromz/wiki-backend/internal/permalink"
+	"github.com/chromz/wiki-backend/internal/publication"
+	"github.com/chromz/wiki-backend/internal/revision"
 	"github.com/chromz/wiki-backend/internal/session"
+	"github.com/chromz/wiki-backend/internal/wikilink"
+	"github.com/chromz/wiki-backend/pkg/convert"
 	"github.com/chromz/wiki-backend/pkg/errormessages"
+	"github.com/chromz/wiki-backend/pkg/frontmatter"
+	"github.com/chromz/wiki-backend/pkg/markdown"
 	"github.com/chromz/wiki-backend/pkg/pagination"
 	"github.com/chromz/wiki-backend/pkg/persistence"
+	"github.com/chromz/wiki-backend/pkg/readability"
 	"github.com/julienschmidt/httprouter"
 	"github.com/mattn/go-sqlite3"
-	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 )
 
 var syncDir string
@@ -25,7 +40,31 @@ type TextClass struct {
 	CourseID     int64  `json:"courseId"`
 	Title        string `json:"title"`
 	procFileName string
-	Processed    bool `json:"processed"`
+	Processed    bool       `json:"processed"`
+	Tags         []string   `json:"tags"`
+	Status       string     `json:"status"`
+	PublishAt    *time.Time `json:"publishAt"`
+	UnpublishAt  *time.Time `json:"unpublishAt"`
+	Slug         string     `json:"slug"`
+	Summary      string     `json:"summary"`
+	Author       string     `json:"author"`
+	// Duration is the estimated duration in minutes
+	Duration    int                `json:"duration"`
+	Metadata    json.RawMessage    `json:"metadata"`
+	Readability *readability.Stats `json:"readability"`
+	schedule    publication.Schedule
+}
+
+// UnmarshalJSON reads a class and remembers which publishing dates the
+// body sets, so updates leave the missing ones unchanged
+func (t *TextClass) UnmarshalJSON(data []byte) error {
+	type plain TextClass
+	if err := json.Unmarshal(data, (*plain)(t)); err != nil {
+		return err
+	}
+	var err error
+	t.schedule, err = publication.ReadSchedule(data)
+	return err
 }
 
 // SyncDir sets the dir to synchronize
@@ -39,6 +78,21 @@ func NewSyncDir(dir string) {
 	syncDir = dir
 }
 
+// BaseURI returns the base path used for processed assets
+func BaseURI() string {
+	return baseURI
+}
+
+// Dirs returns the markdown and assets directories of a grade, course or
+// class, ids must be given in that order
+func Dirs(ids ...int64) (string, string) {
+	var midDir string
+	for _, id := range ids {
+		midDir += strconv.FormatInt(id, 10) + "/"
+	}
+	return syncDir + midDir, syncDir + "assets/" + midDir
+}
+
 // NewBaseURI sets a base path to the markdown processor
 func NewBaseURI(uri string) {
 	baseURI = uri
@@ -49,7 +103,8 @@ func (t *TextClass) Validate() error {
 	if t.Title == "" {
 		return errors.New("Title is missing")
 	}
-	return nil
+	return publication.ValidateSchedule(t.Status, t.PublishAt,
+		t.UnpublishAt)
 }
 
 // TextClassDDL query to create the text class table
@@ -61,11 +116,144 @@ CREATE TABLE IF NOT EXISTS "text_class" (
 	"proc_file_name"	TEXT DEFAULT '',
 	"base_uri"	TEXT NOT NULL DEFAULT '',
 	"title"	TEXT NOT NULL,
+	"status"	TEXT NOT NULL DEFAULT 'published',
+	"publish_at"	INTEGER,
+	"unpublish_at"	INTEGER,
+	"slug"	TEXT NOT NULL DEFAULT '',
+	"outline"	TEXT NOT NULL DEFAULT '',
+	"summary"	TEXT NOT NULL DEFAULT '',
+	"author"	TEXT NOT NULL DEFAULT '',
+	"duration"	INTEGER NOT NULL DEFAULT 0,
+	"metadata"	TEXT NOT NULL DEFAULT '{}',
+	"readability"	TEXT NOT NULL DEFAULT '',
 	FOREIGN KEY("course_id") REFERENCES "course"("id") ON DELETE CASCADE,
 	PRIMARY KEY("id")
 );
 `
 
+// Insert adds the text class to the database inside a transaction
+func (t *TextClass) Insert(tx *sql.Tx) error {
+	var err error
+	t.Slug, err = permalink.TextClass.Unique(tx, t.CourseID, 0, t.Title)
+	if err != nil {
+		return err
+	}
+	insertQuery := `
+		INSERT INTO text_class(course_id, title, base_uri, status,
+		publish_at, unpublish_at, slug)
+		VALUES(?, ?, ?, ?, ?, ?, ?)
+	`
+	res, err := tx.Exec(insertQuery, t.CourseID, t.Title, baseURI, t.Status,
+		publication.Unix(t.PublishAt), publication.Unix(t.UnpublishAt),
+		t.Slug)
+	if err != nil {
+		return err
+	}
+	t.ID, err = res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	t.Tags = []string{}
+	t.Metadata = json.RawMessage("{}")
+	return wikilink.Relink(tx, t.CourseID, t.Slug)
+}
+
+// Save updates the text class inside a transaction, it returns
+// sql.ErrNoRows when the class does not exist. The old slug redirects to
+// the class when the title changes, the status and the publishing dates
+// are only changed when they are given. It returns a *editlock.LockedError
+// when the class is checked out by someone other than the user
+func (t *TextClass) Save(tx *sql.Tx, userID string) error {
+	err := editlock.Guard(tx, t.ID, userID)
+	if err != nil {
+		return err
+	}
+	t.CourseID, t.Slug, err = retitle(tx, t.ID, t.Title)
+	if err != nil {
+		return err
+	}
+	updateQuery := `
+		UPDATE text_class
+		SET status = COALESCE(NULLIF(?, ''), status),
+		publish_at = CASE WHEN ? THEN ? ELSE publish_at END,
+		unpublish_at = CASE WHEN ? THEN ? ELSE unpublish_at END
+		WHERE id = ?
+	`
+	_, err = tx.Exec(updateQuery, t.Status, t.schedule.PublishAt,
+		publication.Unix(t.PublishAt), t.schedule.UnpublishAt,
+		publication.Unix(t.UnpublishAt), t.ID)
+	if err != nil {
+		return err
+	}
+	var publishAt, unpublishAt sql.NullInt64
+	findQuery := `
+		SELECT status, publish_at, unpublish_at
+		FROM text_class
+		WHERE id = ?
+	`
+	err = tx.QueryRow(findQuery, t.ID).Scan(&t.Status, &publishAt,
+		&unpublishAt)
+	t.PublishAt = publication.Time(publishAt)
+	t.UnpublishAt = publication.Time(unpublishAt)
+	return err
+}
+
+// retitle changes the title and the slug of a class inside a transaction,
+// the old slug redirects to the class. It returns the course of the class
+// and the new slug
+func retitle(tx *sql.Tx, classID int64, title string) (int64, string,
+	error) {
+	var courseID int64
+	var oldSlug string
+	findQuery := `
+		SELECT course_id, slug
+		FROM text_class
+		WHERE id = ?
+	`
+	err := tx.QueryRow(findQuery, classID).Scan(&courseID, &oldSlug)
+	if err != nil {
+		return 0, "", err
+	}
+	slug, err := permalink.TextClass.Unique(tx, courseID, classID, title)
+	if err != nil {
+		return 0, "", err
+	}
+	updateQuery := `
+		UPDATE text_class
+		SET title = ?, slug = ?
+		WHERE id = ?
+	`
+	if _, err = tx.Exec(updateQuery, title, slug, classID); err != nil {
+		return 0, "", err
+	}
+	err = permalink.TextClass.Rename(tx, courseID, classID, oldSlug, slug)
+	if err != nil || slug == oldSlug {
+		return courseID, slug, err
+	}
+	return courseID, slug, wikilink.Relink(tx, courseID, slug)
+}
+
+// Remove deletes a text class inside a transaction, it returns
+// sql.ErrNoRows when the class does not exist and a *editlock.LockedError
+// when it is checked out by someone other than the user
+func Remove(tx *sql.Tx, classID int64, userID string) error {
+	if err := editlock.Guard(tx, classID, userID); err != nil {
+		return err
+	}
+	deleteQuery := `
+		DELETE FROM text_class
+		WHERE id = ?
+	`
+	res, err := tx.Exec(deleteQuery, classID)
+	if err != nil {
+		return err
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected != 1 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
 // Create creates a new textclass in db, prepares for execution
 func Create(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
@@ -92,6 +280,9 @@ func Create(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 
 	}
 	textClass.CourseID = courseID
+	if textClass.Status == "" {
+		textClass.Status = publication.Draft
+	}
 	if err = textClass.Validate(); err != nil {
 		errormessages.WriteErrorMessage(w, "Invalid text class object",
 			http.StatusBadRequest)
@@ -107,12 +298,7 @@ func Create(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		return
 	}
 
-	insertQuery := `
-		INSERT INTO text_class(course_id, title, base_uri)
-		VALUES(?, ?, ?)
-	`
-	res, err := tx.Exec(insertQuery, textClass.CourseID, textClass.Title,
-		baseURI)
+	err = textClass.Insert(tx)
 	if err != nil {
 		if sqliteErr, ok := err.(sqlite3.Error); ok {
 			if sqliteErr.ExtendedCode == sqlite3.ErrConstraintForeignKey {
@@ -129,7 +315,6 @@ func Create(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		return
 	}
 
-	textClass.ID, err = res.LastInsertId()
 	err = tx.Commit()
 	if err != nil {
 		errString := "Unable to add text class"
@@ -143,33 +328,48 @@ func Create(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	json.NewEncoder(w).Encode(textClass)
 }
 
-// ReadFile is an endpoint to get the markdown file
+// classFile returns the processed markdown of a class visible for the
+// role, or the uploaded one when it has not been processed yet. processed
+// is false for uploaded files, which still have their front matter
+func classFile(classID int64, role string) (fileName string, processed bool,
+	err error) {
+	db := persistence.GetDb()
+	findQuery := `
+		SELECT file_name, proc_file_name
+		FROM text_class
+		WHERE id = ?
+		AND ` + VisibleFilter + `
+	`
+	row := db.QueryRow(findQuery, classID, role)
+	var procFileName string
+	if err = row.Scan(&fileName, &procFileName); err != nil {
+		return "", false, err
+	}
+	if procFileName != "" {
+		return procFileName, true, nil
+	}
+	return fileName, false, nil
+}
+
+// ReadFile is an endpoint to get the markdown file, requests with a
+// matching If-None-Match get a 304. The file may be processed or have its
+// front matter removed so its ETag is weak, changes must be based on the
+// ETag of ReadMarkdown
 func ReadFile(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
 	classID, err := strconv.ParseInt(p.ByName("classid"), 0, 64)
 	if err != nil {
 		errormessages.WriteErrorMessage(w, "Invalid id",
 			http.StatusBadRequest)
 		return
 	}
-	db := persistence.GetDb()
-	findQuery := `
-		SELECT file_name, proc_file_name
-		FROM text_class
-		WHERE id = ?
-	`
-	row := db.QueryRow(findQuery, classID)
-	var fileName, procFileName string
-	err = row.Scan(&fileName, &procFileName)
+	finalFileName, processed, err := classFile(classID, claims.Role)
 	if err == sql.ErrNoRows {
 		errormessages.WriteErrorInterface(w,
 			"Class does not exists",
 			http.StatusNotFound)
 		return
 	}
-	finalFileName := procFileName
-	if finalFileName == "" {
-		finalFileName = fileName
-	}
 
 	if finalFileName == "" {
 		errormessages.WriteErrorInterface(w,
@@ -177,28 +377,107 @@ func ReadFile(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 			http.StatusNotFound)
 		return
 	}
+	content, err := ioutil.ReadFile(finalFileName)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Could not read os file",
+			http.StatusInternalServerError)
+		return
+	}
+	if !processed {
+		content = frontmatter.Strip(content)
+	}
 	w.Header().Set("Content-Type", "text/markdown")
-	http.ServeFile(w, r, finalFileName)
+	w.Header().Set("ETag", weakETag(content))
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
 }
 
-// WriteFile is an endpoint to upload and process markdown text
-func WriteFile(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+// ReadHTML is an endpoint to get the markdown file rendered as sanitized
+// html, renders are cached by the hash of the markdown
+func ReadHTML(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
-	if claims.Role != "TEACHER" {
-		errormessages.WriteErrorInterface(w, "Not enough privileges",
-			http.StatusUnauthorized)
-		return
-	}
-	gradeID, err := strconv.ParseInt(p.ByName("id"), 0, 64)
+	classID, err := strconv.ParseInt(p.ByName("classid"), 0, 64)
 	if err != nil {
 		errormessages.WriteErrorMessage(w, "Invalid id",
 			http.StatusBadRequest)
 		return
 	}
-	courseID, err := strconv.ParseInt(p.ByName("courseid"), 0, 64)
+	fileName, processed, err := classFile(classID, claims.Role)
+	if err == sql.ErrNoRows {
+		errormessages.WriteErrorInterface(w,
+			"Class does not exists",
+			http.StatusNotFound)
+		return
+	}
+	if fileName == "" {
+		errormessages.WriteErrorInterface(w,
+			"There is no file for the class",
+			http.StatusNotFound)
+		return
+	}
+	content, err := ioutil.ReadFile(fileName)
 	if err != nil {
-		errormessages.WriteErrorMessage(w, "Invalid id",
-			http.StatusBadRequest)
+		errormessages.WriteErrorMessage(w, "Could not read os file",
+			http.StatusInternalServerError)
+		return
+	}
+	if !processed {
+		content = frontmatter.Strip(content)
+	}
+	hash := revision.Hash(content)
+	rendered, err := renderCached(hash, content)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to render class",
+			http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("ETag", `W/"`+hash+`"`)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(rendered))
+}
+
+// renderCached returns the html of a markdown content, it is rendered
+// only when there is no cached copy for its hash
+func renderCached(hash string, content []byte) ([]byte, error) {
+	cacheDir := syncDir + "rendered/"
+	cacheFile := cacheDir + markdown.Version + "_" + hash + ".html"
+	rendered, err := ioutil.ReadFile(cacheFile)
+	if err == nil {
+		return rendered, nil
+	}
+	rendered, err = markdown.Render(content)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(cacheDir, 0700); err != nil {
+		return nil, err
+	}
+	tmpFile, err := ioutil.TempFile(cacheDir, "render")
+	if err != nil {
+		return nil, err
+	}
+	_, err = tmpFile.Write(rendered)
+	tmpFile.Close()
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), cacheFile)
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return nil, err
+	}
+	return rendered, nil
+}
+
+// WriteFile is an endpoint to upload and process markdown text, Word,
+// OpenDocument, html and plain text documents are converted to markdown.
+// The markdown is linted and the report returned with the revision, in
+// strict mode files with errors are rejected. If-Match takes the ETag of
+// ReadMarkdown or of a previous write, the weak ones of ReadFile and
+// ReadHTML are rejected
+func WriteFile(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	if claims.Role != "TEACHER" {
+		errormessages.WriteErrorInterface(w, "Not enough privileges",
+			http.StatusUnauthorized)
 		return
 	}
 	classID, err := strconv.ParseInt(p.ByName("classid"), 0, 64)
@@ -218,85 +497,104 @@ func WriteFile(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	defer file.Close()
 
 	mimeType := multipartHeader.Header.Get("Content-Type")
-	if mimeType != "text/markdown" {
+	format := importFormat(mimeType, multipartHeader.Filename)
+	if format == "" && !isMarkdown(mimeType, multipartHeader.Filename) {
 		errormessages.WriteErrorMessage(w, "Invalid file",
 			http.StatusBadRequest)
 		return
 	}
+	content, err := ioutil.ReadAll(file)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to read file",
+			http.StatusBadRequest)
+		return
+	}
+	strict := false
+	if value := r.FormValue("strict"); value != "" {
+		if strict, err = strconv.ParseBool(value); err != nil {
+			errormessages.WriteErrorMessage(w, "Invalid strict",
+				http.StatusBadRequest)
+			return
+		}
+	}
 
-	gradeIDDir := strconv.FormatInt(gradeID, 10) + "/"
-	courseIDDir := strconv.FormatInt(courseID, 10) + "/"
-	classIDDir := strconv.FormatInt(classID, 10) + "/"
-	directory := syncDir + gradeIDDir + courseIDDir + classIDDir
-	imgDirectory := syncDir + "assets/" + gradeIDDir +
-		courseIDDir + classIDDir
-	fileName := directory + multipartHeader.Filename
-
+	unlock := revision.Lock(classID)
+	defer unlock()
 	db := persistence.GetDb()
 	tx, err := db.Begin()
 	if err != nil {
 		errormessages.WriteErrorMessage(w, "Unable to reach database",
 			http.StatusInternalServerError)
+		return
+	}
+	src, err := findSource(tx, classID)
+	if err == sql.ErrNoRows {
+		errormessages.WriteErrorInterface(w, "Id not found",
+			http.StatusNotFound)
 		tx.Rollback()
 		return
 	}
-	updateQuery := `
-		UPDATE text_class
-		SET file_name = ?, proc_file_name = ''
-		WHERE id = ?
-	`
-	res, err := tx.Exec(updateQuery, fileName, classID)
 	if err != nil {
-		errormessages.WriteErrorMessage(w, "Invalid course id",
+		errormessages.WriteErrorMessage(w, "Unable to find class",
 			http.StatusInternalServerError)
 		tx.Rollback()
 		return
 	}
-	rowsAffected, err := res.RowsAffected()
-	if rowsAffected != 1 {
-		errormessages.WriteErrorInterface(w, "Id not found",
-			http.StatusNotFound)
+	current, err := src.content()
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Could not read os file",
+			http.StatusInternalServerError)
 		tx.Rollback()
 		return
-
 	}
-
-	if _, err = os.Stat(directory); os.IsNotExist(err) {
-		err = os.Mkdir(directory, 0700)
-		if err != nil {
-			if os.IsNotExist(err) {
-				errormessages.WriteErrorMessage(w,
-					"Invalid grade/course id",
-					http.StatusInternalServerError)
-				tx.Rollback()
-				return
-
-			}
-			errormessages.WriteErrorMessage(w,
-				"Unable to create directory",
-				http.StatusInternalServerError)
-			tx.Rollback()
-			return
-		}
-		err = os.Mkdir(imgDirectory, 0700)
+	if !checkIfMatch(w, r, current) {
+		tx.Rollback()
+		return
+	}
+	src.fileName = src.directory + filepath.Base(multipartHeader.Filename)
+	original := content
+	var doc *convert.Document
+	if format != "" {
+		doc, err = src.convertDocument(format, content)
 		if err != nil {
-			errormessages.WriteErrorMessage(w,
-				"Unable to create assets directory",
-				http.StatusInternalServerError)
+			errormessages.WriteErrorMessage(w, "Unable to convert file",
+				http.StatusBadRequest)
 			tx.Rollback()
 			return
 		}
+		content = doc.Markdown
+		src.fileName = strings.TrimSuffix(src.fileName,
+			filepath.Ext(src.fileName)) + ".md"
+	}
+	// Unreadable files are always rejected, other errors only in strict
+	// mode
+	report := lint.Check(content, src.assets)
+	if !report.Readable() {
+		errormessages.WriteErrorInterface(w, report, http.StatusBadRequest)
+		tx.Rollback()
+		return
+	}
+	if strict && !report.Valid() {
+		errormessages.WriteErrorInterface(w, report,
+			http.StatusUnprocessableEntity)
+		tx.Rollback()
+		return
+	}
+	rev, err := src.saveChecked(tx, claims.UserID, r.FormValue("message"),
+		content, report)
+	if editlock.WriteError(w, err) {
+		tx.Rollback()
+		return
+	}
+	if err == nil && doc != nil {
+		err = src.saveImport(doc, multipartHeader.Filename, original)
 	}
-
-	osFile, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE, 0600)
 	if err != nil {
-		errormessages.WriteErrorMessage(w, "Could not open os file",
-			http.StatusBadRequest)
+		errormessages.WriteErrorMessage(w, "Could not write os file",
+			http.StatusInternalServerError)
 		tx.Rollback()
 		return
 	}
-	defer osFile.Close()
-	io.Copy(osFile, file)
 	err = tx.Commit()
 	if err != nil {
 		errString := "Unable to update text class"
@@ -305,10 +603,20 @@ func WriteFile(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		tx.Rollback()
 		return
 	}
-	w.WriteHeader(http.StatusNoContent)
+	w.Header().Set("ETag", etag(content))
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(&uploadResult{Revision: rev, Lint: report})
+}
+
+// uploadResult is the revision of an upload with the report of its
+// markdown
+type uploadResult struct {
+	*revision.Revision
+	Lint *lint.Report `json:"lint"`
 }
 
-// Read returns available text classess, paginated
+// Read returns available text classess, paginated, optionally filtered
+// by tag
 func Read(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	params := r.URL.Query()
 
@@ -320,63 +628,191 @@ func Read(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 
 	}
 
-	size, err := strconv.Atoi(params.Get("size"))
+	page, err := readPage(params)
 	if err != nil {
-		errormessages.WriteErrorMessage(w, "Invalid size",
+		errormessages.WriteErrorMessage(w, err.Error(),
 			http.StatusBadRequest)
 		return
 	}
-	nextToken, err := strconv.ParseInt(params.Get("nextToken"), 0, 64)
+
+	db := persistence.GetDb()
+	findQuery := `
+		SELECT text_class.id, course_id, title, proc_file_name,
+		IFNULL(GROUP_CONCAT(tag.name), ''), text_class.status,
+		text_class.publish_at, text_class.unpublish_at, text_class.slug,
+		text_class.summary, text_class.author, text_class.duration,
+		text_class.metadata, text_class.readability
+		FROM text_class
+		LEFT JOIN text_class_tag
+		ON text_class_tag.text_class_id = text_class.id
+		LEFT JOIN tag ON tag.id = text_class_tag.tag_id
+		WHERE text_class.id > ?
+		AND course_id = ?
+		AND ` + tagFilter + `
+		AND ` + VisibleFilter + `
+		GROUP BY text_class.id
+		ORDER BY text_class.id
+		LIMIT ?
+	`
+	tagName := strings.ToLower(strings.TrimSpace(params.Get("tag")))
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	rows, err := db.Query(findQuery, page.NextToken, courseID, tagName,
+		tagName, claims.Role, page.Size)
 	if err != nil {
-		errormessages.WriteErrorMessage(w, "Invalid next token",
-			http.StatusBadRequest)
+		errormessages.WriteErrorMessage(w, "Unable to find text classes",
+			http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	classes, err := scanClasses(rows)
+	if err != nil {
+		errormessages.WriteErrorMessage(w,
+			"Unable to find classes",
+			http.StatusInternalServerError)
 		return
 	}
+	writePage(w, page, classes)
+}
 
-	page := &pagination.Page{
-		Size:      size,
-		NextToken: nextToken,
+// ReadByGrade returns the text classes of every course in a grade,
+// paginated, optionally filtered by tag
+func ReadByGrade(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	params := r.URL.Query()
+
+	gradeID, err := strconv.ParseInt(p.ByName("id"), 0, 64)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid grade id",
+			http.StatusBadRequest)
+		return
 	}
 
-	if err = page.Validate(); err != nil {
-		errormessages.WriteErrorMessage(w, "Invalid pagination",
+	page, err := readPage(params)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, err.Error(),
 			http.StatusBadRequest)
 		return
 	}
 
 	db := persistence.GetDb()
 	findQuery := `
-		SELECT id, course_id, title, proc_file_name
+		SELECT text_class.id, course_id, title, proc_file_name,
+		IFNULL(GROUP_CONCAT(tag.name), ''), text_class.status,
+		text_class.publish_at, text_class.unpublish_at, text_class.slug,
+		text_class.summary, text_class.author, text_class.duration,
+		text_class.metadata, text_class.readability
 		FROM text_class
-		WHERE id > ?
-		AND course_id = ?
+		JOIN course ON course.id = text_class.course_id
+		LEFT JOIN text_class_tag
+		ON text_class_tag.text_class_id = text_class.id
+		LEFT JOIN tag ON tag.id = text_class_tag.tag_id
+		WHERE text_class.id > ?
+		AND course.grade_id = ?
+		AND ` + tagFilter + `
+		AND ` + VisibleFilter + `
+		GROUP BY text_class.id
+		ORDER BY text_class.id
 		LIMIT ?
 	`
-	rows, err := db.Query(findQuery, page.NextToken, courseID, page.Size)
+	tagName := strings.ToLower(strings.TrimSpace(params.Get("tag")))
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	rows, err := db.Query(findQuery, page.NextToken, gradeID, tagName,
+		tagName, claims.Role, page.Size)
 	if err != nil {
 		errormessages.WriteErrorMessage(w, "Unable to find text classes",
 			http.StatusInternalServerError)
 		return
 	}
 	defer rows.Close()
+	classes, err := scanClasses(rows)
+	if err != nil {
+		errormessages.WriteErrorMessage(w,
+			"Unable to find classes",
+			http.StatusInternalServerError)
+		return
+	}
+	writePage(w, page, classes)
+}
+
+// tagFilter matches every class when the tag parameter is empty
+const tagFilter = `(? = '' OR EXISTS (
+			SELECT 1
+			FROM text_class_tag AS filter_link
+			JOIN tag AS filter_tag ON filter_tag.id = filter_link.tag_id
+			WHERE filter_link.text_class_id = text_class.id
+			AND filter_tag.name = ?
+		))`
+
+// VisibleFilter is the sql condition, taking the role of the user, that
+// hides draft and archived classes, or classes of courses that are not
+// published, from everyone but teachers
+const VisibleFilter = `(` + publication.RoleFilter + ` OR (
+			text_class.status = 'published'
+			AND EXISTS (
+				SELECT 1
+				FROM course AS visible_course
+				WHERE visible_course.id = text_class.course_id
+				AND visible_course.status = 'published'
+			)
+		))`
+
+func readPage(params url.Values) (*pagination.Page, error) {
+	size, err := strconv.Atoi(params.Get("size"))
+	if err != nil {
+		return nil, errors.New("Invalid size")
+	}
+	nextToken, err := strconv.ParseInt(params.Get("nextToken"), 0, 64)
+	if err != nil {
+		return nil, errors.New("Invalid next token")
+	}
+
+	page := &pagination.Page{
+		Size:      size,
+		NextToken: nextToken,
+	}
+
+	if err = page.Validate(); err != nil {
+		return nil, errors.New("Invalid pagination")
+	}
+	return page, nil
+}
+
+func scanClasses(rows *sql.Rows) ([]TextClass, error) {
 	var classes []TextClass
 	for rows.Next() {
 		class := TextClass{}
-		err = rows.Scan(&class.ID, &class.CourseID, &class.Title,
-			&class.procFileName)
+		var tags string
+		var publishAt, unpublishAt sql.NullInt64
+		var metadata, stats string
+		err := rows.Scan(&class.ID, &class.CourseID, &class.Title,
+			&class.procFileName, &tags, &class.Status, &publishAt,
+			&unpublishAt, &class.Slug, &class.Summary, &class.Author,
+			&class.Duration, &metadata, &stats)
 		if err != nil {
-			errormessages.WriteErrorMessage(w,
-				"Unable to find classes",
-				http.StatusInternalServerError)
-			return
+			return nil, err
+		}
+		class.PublishAt = publication.Time(publishAt)
+		class.UnpublishAt = publication.Time(unpublishAt)
+		class.Processed = class.procFileName != ""
+		class.Metadata = json.RawMessage(metadata)
+		// Classes are measured when mdproc processes them
+		if class.Processed && stats != "" {
+			class.Readability = &readability.Stats{}
+			err = json.Unmarshal([]byte(stats), class.Readability)
+			if err != nil {
+				return nil, err
+			}
 		}
-		if class.procFileName != "" {
-			class.Processed = true
-		} else {
-			class.Processed = false
+		class.Tags = []string{}
+		if tags != "" {
+			class.Tags = strings.Split(tags, ",")
 		}
 		classes = append(classes, class)
 	}
+	return classes, nil
+}
+
+func writePage(w http.ResponseWriter, page *pagination.Page,
+	classes []TextClass) {
 	page.Data = classes
 	classesCount := len(classes)
 	if classesCount > 0 {
@@ -386,7 +822,63 @@ func Read(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	}
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(page)
+}
 
+// ReadBySlug returns a text class by its grade, course and class slugs,
+// old slugs redirect to the current ones
+func ReadBySlug(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	db := persistence.GetDb()
+	ids, slugs, redirected, err := permalink.ResolvePath(db,
+		p.ByName("grade"), p.ByName("course"), p.ByName("class"))
+	if err == sql.ErrNoRows {
+		errormessages.WriteErrorInterface(w, "Class does not exists",
+			http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to find class",
+			http.StatusInternalServerError)
+		return
+	}
+	if redirected {
+		permalink.Redirect(w, r, slugs)
+		return
+	}
+	findQuery := `
+		SELECT text_class.id, course_id, title, proc_file_name,
+		IFNULL(GROUP_CONCAT(tag.name), ''), text_class.status,
+		text_class.publish_at, text_class.unpublish_at, text_class.slug,
+		text_class.summary, text_class.author, text_class.duration,
+		text_class.metadata, text_class.readability
+		FROM text_class
+		LEFT JOIN text_class_tag
+		ON text_class_tag.text_class_id = text_class.id
+		LEFT JOIN tag ON tag.id = text_class_tag.tag_id
+		WHERE text_class.id = ?
+		AND ` + VisibleFilter + `
+		GROUP BY text_class.id
+	`
+	rows, err := db.Query(findQuery, ids[2], claims.Role)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to find class",
+			http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	classes, err := scanClasses(rows)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to find class",
+			http.StatusInternalServerError)
+		return
+	}
+	if len(classes) == 0 {
+		errormessages.WriteErrorInterface(w, "Class does not exists",
+			http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(classes[0])
 }
 
 // Update updates a text class resource
@@ -427,22 +919,35 @@ func Update(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	}
 
 	db := persistence.GetDb()
-	updateQuery := `
-		UPDATE text_class
-		SET title = ?
-		WHERE id = ?
-	`
-	res, err := db.Exec(updateQuery, textClass.Title, textClass.ID)
-	rowsAffected, _ := res.RowsAffected()
-	if rowsAffected != 1 {
+	tx, err := db.Begin()
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to reach database",
+			http.StatusInternalServerError)
+		return
+	}
+	err = textClass.Save(tx, claims.UserID)
+	if editlock.WriteError(w, err) {
+		tx.Rollback()
+		return
+	}
+	if err == sql.ErrNoRows {
 		errormessages.WriteErrorInterface(w, "Id not found",
 			http.StatusNotFound)
+		tx.Rollback()
+		return
+	}
+	if err != nil {
+		errormessages.WriteErrorInterface(w, "Unable to update class",
+			http.StatusInternalServerError)
+		tx.Rollback()
 		return
-
 	}
+	err = tx.Commit()
 	if err != nil {
-		errormessages.WriteErrorInterface(w, "Unable to update course",
+		errString := "Unable to update class"
+		errormessages.WriteErrorMessage(w, errString,
 			http.StatusInternalServerError)
+		tx.Rollback()
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
@@ -482,30 +987,29 @@ func Delete(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	}
 
 	db := persistence.GetDb()
-	deleteQuery := `
-		DELETE FROM text_class
-		WHERE id = ?
-	`
 	tx, err := db.Begin()
 	if err != nil {
 		errormessages.WriteErrorMessage(w, "Unable to reach database",
 			http.StatusInternalServerError)
 		return
 	}
-	res, err := tx.Exec(deleteQuery, classID)
-	if err != nil {
-		errormessages.WriteErrorMessage(w, "Unable to delete",
-			http.StatusInternalServerError)
+	err = Remove(tx, classID, claims.UserID)
+	if editlock.WriteError(w, err) {
 		tx.Rollback()
 		return
 	}
-	affectedRows, err := res.RowsAffected()
-	if affectedRows == 0 {
+	if err == sql.ErrNoRows {
 		errormessages.WriteErrorMessage(w, "Invalid id",
 			http.StatusBadRequest)
 		tx.Rollback()
 		return
 	}
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to delete",
+			http.StatusInternalServerError)
+		tx.Rollback()
+		return
+	}
 
 	gradeIDDir := strconv.FormatInt(gradeID, 10) + "/"
 	courseIDDir := strconv.FormatInt(courseID, 10) + "/"
@@ -2,9 +2,17 @@ package ticker
 
 import (
 	"database/sql"
+	"encoding/json"
 	"github.com/PuerkitoBio/goquery"
+	"github.com/chromz/wiki-backend/internal/imgproc"
+	"github.com/chromz/wiki-backend/internal/search"
+	"github.com/chromz/wiki-backend/internal/textclass"
+	"github.com/chromz/wiki-backend/internal/wikilink"
+	"github.com/chromz/wiki-backend/pkg/frontmatter"
 	"github.com/chromz/wiki-backend/pkg/log"
+	"github.com/chromz/wiki-backend/pkg/markdown"
 	"github.com/chromz/wiki-backend/pkg/persistence"
+	"github.com/chromz/wiki-backend/pkg/readability"
 	"github.com/gocolly/colly"
 	"io"
 	"io/ioutil"
@@ -152,6 +160,10 @@ func parseMarkdown(procFile file, basePath, markdownText,
 		if _, ok := processedLinks[mdURL]; ok {
 			continue
 		}
+		// Assets already served by the wiki, like attachments, are kept
+		if basePath != "" && strings.HasPrefix(mdURL, basePath) {
+			continue
+		}
 
 		urlStruct, err := url.Parse(mdURL)
 		if err != nil {
@@ -241,6 +253,14 @@ func parseMarkdown(procFile file, basePath, markdownText,
 }
 
 func processMarkdown(basePath string, procFile file, markdownText string) {
+	// Files written to the sync directory by other means than the wiki
+	// have not been read yet
+	err := textclass.SyncFrontMatter(db, procFile.classID,
+		[]byte(markdownText))
+	if err != nil {
+		logger.Error("Unable to read front matter", err)
+	}
+	markdownText = string(frontmatter.Strip([]byte(markdownText)))
 	classIDDir := strconv.FormatInt(procFile.classID, 10) + "/"
 	courseIDDir := strconv.FormatInt(procFile.courseID, 10) + "/"
 	gradeIDDir := strconv.FormatInt(procFile.gradeID, 10) + "/"
@@ -255,6 +275,22 @@ func processMarkdown(basePath string, procFile file, markdownText string) {
 	}
 	replacer := strings.NewReplacer(replaces...)
 	processedMarkdown := replacer.Replace(markdownText)
+	if err = wikilink.Update(db, procFile.classID, markdownText); err != nil {
+		logger.Error("Unable to update wiki links", err)
+	}
+	linkedMarkdown, err := wikilink.Rewrite(db, procFile.classID,
+		processedMarkdown)
+	if err != nil {
+		logger.Error("Unable to resolve wiki links", err)
+	} else {
+		processedMarkdown = linkedMarkdown
+	}
+	pictureMarkdown, err := imgproc.Rewrite(db, basePath, processedMarkdown)
+	if err != nil {
+		logger.Error("Unable to add image variants", err)
+	} else {
+		processedMarkdown = pictureMarkdown
+	}
 
 	baseName := filepath.Base(procFile.fileName)
 	processedFileName := destDir + midDir + "processed_" + baseName
@@ -265,12 +301,24 @@ func processMarkdown(basePath string, procFile file, markdownText string) {
 		return
 	}
 	logger.Info("Saved processed file to " + processedFileName)
+	outline, err := json.Marshal(markdown.Outline([]byte(processedMarkdown)))
+	if err != nil {
+		logger.Error("Unable to build outline", err)
+		return
+	}
+	stats, err := json.Marshal(readability.Analyze(
+		markdown.PlainText([]byte(processedMarkdown))))
+	if err != nil {
+		logger.Error("Unable to measure readability", err)
+		return
+	}
 	updateQuery := `
 		UPDATE text_class
-		SET proc_file_name = ?
+		SET proc_file_name = ?, outline = ?, readability = ?
 		WHERE id = ?
 	`
-	res, err := db.Exec(updateQuery, processedFileName, procFile.classID)
+	res, err := db.Exec(updateQuery, processedFileName, string(outline),
+		string(stats), procFile.classID)
 	if err != nil {
 		logger.Error("Unable to update text class", err)
 		return
@@ -281,6 +329,10 @@ func processMarkdown(basePath string, procFile file, markdownText string) {
 		return
 
 	}
+	err = search.Update(db, procFile.classID, processedMarkdown)
+	if err != nil {
+		logger.Error("Unable to index text class", err)
+	}
 }
 
 func process() {
@@ -0,0 +1,466 @@
+package wikilink
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/chromz/wiki-backend/internal/permalink"
+	"github.com/chromz/wiki-backend/internal/publication"
+	"github.com/chromz/wiki-backend/internal/session"
+	"github.com/chromz/wiki-backend/pkg/errormessages"
+	"github.com/chromz/wiki-backend/pkg/markdown"
+	"github.com/chromz/wiki-backend/pkg/persistence"
+	"github.com/chromz/wiki-backend/pkg/slug"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// LinkDDL is the query to create the table of links between text classes,
+// target_id is null while the link is broken
+const LinkDDL = `
+CREATE TABLE IF NOT EXISTS "wiki_link" (
+	"source_id"	INTEGER NOT NULL,
+	"position"	INTEGER NOT NULL,
+	"target"	TEXT NOT NULL,
+	"label"	TEXT NOT NULL,
+	"target_id"	INTEGER,
+	PRIMARY KEY("source_id", "position"),
+	FOREIGN KEY("source_id") REFERENCES "text_class"("id") ON DELETE CASCADE,
+	FOREIGN KEY("target_id") REFERENCES "text_class"("id") ON DELETE SET NULL
+);
+`
+
+// TargetIndexDDL is the query to index links by their target
+const TargetIndexDDL = `
+CREATE INDEX IF NOT EXISTS "wiki_link_target"
+ON "wiki_link"("target_id");
+`
+
+// Triggers queue again the classes linking to a class whose status or
+// whose course status changes, links are only rewritten to published
+// classes
+var Triggers = []string{
+	`CREATE TRIGGER IF NOT EXISTS "wiki_link_class_status"
+	AFTER UPDATE OF status ON "text_class"
+	WHEN NEW.status != OLD.status
+	BEGIN
+		UPDATE text_class
+		SET proc_file_name = ''
+		WHERE file_name != ''
+		AND id IN (
+			SELECT source_id FROM wiki_link WHERE target_id = NEW.id
+		);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS "wiki_link_course_status"
+	AFTER UPDATE OF status ON "course"
+	WHEN NEW.status != OLD.status
+	BEGIN
+		UPDATE text_class
+		SET proc_file_name = ''
+		WHERE file_name != ''
+		AND id IN (
+			SELECT wiki_link.source_id
+			FROM wiki_link
+			JOIN text_class AS target ON target.id = wiki_link.target_id
+			WHERE target.course_id = NEW.id
+		);
+	END`,
+}
+
+var linkRegex = regexp.MustCompile(`\[\[([^\[\]|\n]+)(?:\|([^\[\]\n]+))?\]\]`)
+
+// labelEscaper escapes the characters of a label that markdown would
+// interpret inside the text of a link
+var labelEscaper = strings.NewReplacer(
+	"\\", "\\\\", "`", "\\`", "*", "\\*", "_", "\\_", "[", "\\[",
+	"]", "\\]", "<", "\\<", ">", "\\>",
+)
+
+// Link is a [[Course/Lesson title|label]] link, the course may be
+// omitted to link inside the same course
+type Link struct {
+	Target string `json:"target"`
+	Label  string `json:"label"`
+	start  int
+	end    int
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx
+type queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Parse returns the wiki links of a markdown text in order
+func Parse(text string) []Link {
+	masked := markdown.MaskCode(text)
+	var links []Link
+	for _, match := range linkRegex.FindAllStringSubmatchIndex(masked, -1) {
+		link := Link{
+			Target: strings.TrimSpace(text[match[2]:match[3]]),
+			start:  match[0],
+			end:    match[1],
+		}
+		if match[4] >= 0 {
+			link.Label = strings.TrimSpace(text[match[4]:match[5]])
+		}
+		if link.Label == "" {
+			link.Label = link.Target
+			if i := strings.Index(link.Target, "/"); i >= 0 {
+				link.Label = strings.TrimSpace(link.Target[i+1:])
+			}
+		}
+		if link.Target != "" {
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+// source is the grade and course a link is resolved from
+type source struct {
+	gradeID  int64
+	courseID int64
+}
+
+func findSource(q queryer, classID int64) (*source, error) {
+	findQuery := `
+		SELECT course.grade_id, text_class.course_id
+		FROM text_class
+		JOIN course ON course.id = text_class.course_id
+		WHERE text_class.id = ?
+	`
+	src := &source{}
+	err := q.QueryRow(findQuery, classID).Scan(&src.gradeID, &src.courseID)
+	return src, err
+}
+
+// resolve finds the class a link points to. The text before the first
+// slash is the course when there is a course with that name in the
+// grade, otherwise the whole target is a title in the same course
+func (src *source) resolve(q queryer, target string) (int64, error) {
+	if i := strings.Index(target, "/"); i >= 0 {
+		courseID, _, _, err := permalink.Course.Resolve(q, src.gradeID,
+			slug.Make(target[:i]))
+		if err == nil {
+			classID, _, _, err := permalink.TextClass.Resolve(q, courseID,
+				slug.Make(target[i+1:]))
+			return classID, err
+		}
+		if err != sql.ErrNoRows {
+			return 0, err
+		}
+	}
+	classID, _, _, err := permalink.TextClass.Resolve(q, src.courseID,
+		slug.Make(target))
+	return classID, err
+}
+
+// Update replaces the stored links of a class with the ones of its new
+// markdown
+func Update(q queryer, classID int64, markdown string) error {
+	src, err := findSource(q, classID)
+	if err != nil {
+		return err
+	}
+	deleteQuery := `
+		DELETE FROM wiki_link
+		WHERE source_id = ?
+	`
+	if _, err = q.Exec(deleteQuery, classID); err != nil {
+		return err
+	}
+	insertQuery := `
+		INSERT INTO wiki_link(source_id, position, target, label, target_id)
+		VALUES(?, ?, ?, ?, ?)
+	`
+	for i, link := range Parse(markdown) {
+		var targetID interface{}
+		id, err := src.resolve(q, link.Target)
+		if err == nil {
+			targetID = id
+		} else if err != sql.ErrNoRows {
+			return err
+		}
+		_, err = q.Exec(insertQuery, classID, i, link.Target, link.Label,
+			targetID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Relink resolves again the broken links of the grade of a course, it is
+// used when a class or a course is created or renamed with the slug it
+// now has. Only the links whose target mentions that slug are resolved,
+// classes whose links are fixed are queued to be processed again
+func Relink(q queryer, courseID int64, changed string) error {
+	findQuery := `
+		SELECT wiki_link.source_id, wiki_link.position, wiki_link.target,
+		course.grade_id, text_class.course_id
+		FROM wiki_link
+		JOIN text_class ON text_class.id = wiki_link.source_id
+		JOIN course ON course.id = text_class.course_id
+		WHERE wiki_link.target_id IS NULL
+		AND course.grade_id = (
+			SELECT grade_id
+			FROM course
+			WHERE id = ?
+		)
+	`
+	rows, err := q.Query(findQuery, courseID)
+	if err != nil {
+		return err
+	}
+	type broken struct {
+		sourceID int64
+		position int
+		target   string
+		src      source
+	}
+	var links []broken
+	for rows.Next() {
+		link := broken{}
+		err = rows.Scan(&link.sourceID, &link.position, &link.target,
+			&link.src.gradeID, &link.src.courseID)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		links = append(links, link)
+	}
+	rows.Close()
+	updateQuery := `
+		UPDATE wiki_link
+		SET target_id = ?
+		WHERE source_id = ?
+		AND position = ?
+	`
+	requeueQuery := `
+		UPDATE text_class
+		SET proc_file_name = ''
+		WHERE id = ?
+		AND file_name != ''
+	`
+	for _, link := range links {
+		if !mentions(link.target, changed) {
+			continue
+		}
+		targetID, err := link.src.resolve(q, link.target)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		_, err = q.Exec(updateQuery, targetID, link.sourceID, link.position)
+		if err != nil {
+			return err
+		}
+		if _, err = q.Exec(requeueQuery, link.sourceID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mentions reports if a link target could resolve to a class or course
+// with a slug, see resolve
+func mentions(target, changed string) bool {
+	if slug.Make(target) == changed {
+		return true
+	}
+	i := strings.Index(target, "/")
+	return i >= 0 && (slug.Make(target[:i]) == changed ||
+		slug.Make(target[i+1:]) == changed)
+}
+
+// publishedPath returns the slug based url of a class, processed files
+// are read by every role so it is sql.ErrNoRows when the class or its
+// course is not published
+func publishedPath(q queryer, classID int64) (string, error) {
+	findQuery := `
+		SELECT grade.slug, course.slug, text_class.slug
+		FROM text_class
+		JOIN course ON course.id = text_class.course_id
+		JOIN grade ON grade.id = course.grade_id
+		WHERE text_class.id = ?
+		AND text_class.status = 'published'
+		AND course.status = 'published'
+	`
+	slugs := make([]string, 3)
+	err := q.QueryRow(findQuery, classID).Scan(&slugs[0], &slugs[1],
+		&slugs[2])
+	if err != nil {
+		return "", err
+	}
+	return permalink.Path(slugs...), nil
+}
+
+// Rewrite replaces the wiki links of a class with markdown links to the
+// classes they point to. Broken links and links to classes that are not
+// published are left as their label
+func Rewrite(q queryer, classID int64, markdown string) (string, error) {
+	src, err := findSource(q, classID)
+	if err != nil {
+		return "", err
+	}
+	var builder strings.Builder
+	last := 0
+	for _, link := range Parse(markdown) {
+		builder.WriteString(markdown[last:link.start])
+		last = link.end
+		targetID, err := src.resolve(q, link.Target)
+		var url string
+		if err == nil {
+			url, err = publishedPath(q, targetID)
+		}
+		if err == sql.ErrNoRows {
+			builder.WriteString(link.Label)
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		builder.WriteString("[" + labelEscaper.Replace(link.Label) + "](" +
+			url + ")")
+	}
+	builder.WriteString(markdown[last:])
+	return builder.String(), nil
+}
+
+// Backlink is a class that links to another one
+type Backlink struct {
+	ClassID  int64  `json:"classId"`
+	CourseID int64  `json:"courseId"`
+	Title    string `json:"title"`
+	Path     string `json:"path"`
+	Label    string `json:"label"`
+}
+
+// visibleFilter is the sql condition, taking the role of the user, for
+// the classes the user can see, the course of the class must be joined
+const visibleFilter = `(` + publication.RoleFilter + ` OR (
+		text_class.status = 'published'
+		AND course.status = 'published'
+	))`
+
+// ReadBacklinks returns the classes that link to a text class, students
+// only see the published ones and only of a class they can see
+func ReadBacklinks(w http.ResponseWriter, r *http.Request,
+	p httprouter.Params) {
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	classID, err := strconv.ParseInt(p.ByName("classid"), 0, 64)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid id",
+			http.StatusBadRequest)
+		return
+	}
+	db := persistence.GetDb()
+	var visible bool
+	err = db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1
+			FROM text_class
+			JOIN course ON course.id = text_class.course_id
+			WHERE text_class.id = ?
+			AND `+visibleFilter+`
+		)
+	`, classID, claims.Role).Scan(&visible)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to find class",
+			http.StatusInternalServerError)
+		return
+	}
+	if !visible {
+		errormessages.WriteErrorInterface(w, "Class does not exists",
+			http.StatusNotFound)
+		return
+	}
+	findQuery := `
+		SELECT text_class.id, text_class.course_id,
+		text_class.title, grade.slug, course.slug, text_class.slug,
+		wiki_link.label
+		FROM wiki_link
+		JOIN text_class ON text_class.id = wiki_link.source_id
+		JOIN course ON course.id = text_class.course_id
+		JOIN grade ON grade.id = course.grade_id
+		WHERE wiki_link.target_id = ?
+		AND ` + visibleFilter + `
+		GROUP BY text_class.id
+		ORDER BY text_class.id
+	`
+	rows, err := db.Query(findQuery, classID, claims.Role)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to find backlinks",
+			http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	backlinks := []Backlink{}
+	for rows.Next() {
+		backlink := Backlink{}
+		slugs := make([]string, 3)
+		err = rows.Scan(&backlink.ClassID, &backlink.CourseID,
+			&backlink.Title, &slugs[0], &slugs[1], &slugs[2],
+			&backlink.Label)
+		if err != nil {
+			errormessages.WriteErrorMessage(w,
+				"Unable to find backlinks",
+				http.StatusInternalServerError)
+			return
+		}
+		backlink.Path = permalink.Path(slugs...)
+		backlinks = append(backlinks, backlink)
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(backlinks)
+}
+
+// ReadBroken returns the wiki links of a text class that do not point to
+// any class
+func ReadBroken(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	claims := r.Context().Value(session.ClaimsKey).(*session.Claims)
+	if claims.Role != "TEACHER" {
+		errormessages.WriteErrorInterface(w, "Not enough privileges",
+			http.StatusUnauthorized)
+		return
+	}
+	classID, err := strconv.ParseInt(p.ByName("classid"), 0, 64)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Invalid id",
+			http.StatusBadRequest)
+		return
+	}
+	db := persistence.GetDb()
+	findQuery := `
+		SELECT target, label
+		FROM wiki_link
+		WHERE source_id = ?
+		AND target_id IS NULL
+		ORDER BY position
+	`
+	rows, err := db.Query(findQuery, classID)
+	if err != nil {
+		errormessages.WriteErrorMessage(w, "Unable to find links",
+			http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	links := []Link{}
+	for rows.Next() {
+		link := Link{}
+		if err = rows.Scan(&link.Target, &link.Label); err != nil {
+			errormessages.WriteErrorMessage(w, "Unable to find links",
+				http.StatusInternalServerError)
+			return
+		}
+		links = append(links, link)
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(links)
+}
@@ -0,0 +1,364 @@
+package convert
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Formats that can be converted to markdown
+const (
+	DOCX = "docx"
+	HTML = "html"
+	ODT  = "odt"
+	Text = "text"
+)
+
+// ErrFormat is returned when a document is not valid for its format
+var ErrFormat = errors.New("unsupported or malformed document")
+
+// imageExtensions are the embedded images kept, formats browsers can not
+// show like EMF are dropped
+var imageExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// Image is a picture embedded in a document, its name is generated from
+// its content
+type Image struct {
+	Name string
+	Data []byte
+}
+
+// Document is a document converted to markdown along with the images it
+// embeds, the markdown references them under the image prefix
+type Document struct {
+	Markdown []byte
+	Images   []Image
+	prefix   string
+}
+
+// Convert converts a document to markdown, images are referenced as the
+// prefix followed by their names
+func Convert(format string, data []byte, prefix string) (*Document, error) {
+	doc := &Document{prefix: prefix}
+	var blocks []block
+	var err error
+	switch format {
+	case DOCX:
+		blocks, err = convertDOCX(doc, data)
+	case HTML:
+		blocks, err = convertHTML(doc, data)
+	case ODT:
+		blocks, err = convertODT(doc, data)
+	case Text:
+		blocks, err = convertText(data)
+	default:
+		err = ErrFormat
+	}
+	if err != nil {
+		return nil, err
+	}
+	doc.Markdown = []byte(render(blocks))
+	return doc, nil
+}
+
+// image stores an embedded image and returns its markdown, unsupported
+// images are dropped
+func (doc *Document) image(data []byte, alt string) string {
+	extension, ok := imageExtensions[http.DetectContentType(data)]
+	if !ok {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	name := hex.EncodeToString(sum[:8]) + extension
+	found := false
+	for _, image := range doc.Images {
+		found = found || image.Name == name
+	}
+	if !found {
+		doc.Images = append(doc.Images, Image{Name: name, Data: data})
+	}
+	return "![" + escape(collapse(alt)) + "](" + doc.prefix + name + ")"
+}
+
+// Kinds of blocks
+const (
+	paragraphBlock = iota
+	headingBlock
+	itemBlock
+	tableBlock
+	codeBlock
+	quoteBlock
+	ruleBlock
+)
+
+// block is a markdown block, text is inline markdown except for code
+// blocks where it is raw and quotes where it is rendered markdown
+type block struct {
+	kind int
+	// level is the level of headings and the nesting of list items
+	// starting at 0
+	level    int
+	ordered  bool
+	text     string
+	language string
+	rows     [][]string
+}
+
+// hardBreak is a line break inside a paragraph
+const hardBreak = "\\\n"
+
+var markdownEscaper = strings.NewReplacer(
+	"\\", "\\\\", "`", "\\`", "*", "\\*", "_", "\\_", "[", "\\[",
+	"]", "\\]", "<", "\\<", ">", "\\>", "#", "\\#", "~", "\\~",
+)
+
+// escape escapes the characters of a text that markdown would interpret
+func escape(text string) string {
+	return markdownEscaper.Replace(text)
+}
+
+// collapse replaces runs of white space with a single space
+func collapse(text string) string {
+	var builder strings.Builder
+	space := false
+	for _, r := range text {
+		if r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == '\f' {
+			space = true
+			continue
+		}
+		if space {
+			builder.WriteByte(' ')
+		}
+		space = false
+		builder.WriteRune(r)
+	}
+	if space {
+		builder.WriteByte(' ')
+	}
+	return builder.String()
+}
+
+// wrap surrounds a text with an emphasis marker, the spaces and line
+// breaks around the text are kept outside so the emphasis is valid
+func wrap(marker, text string) string {
+	start, end := 0, len(text)
+	for start < end {
+		if strings.HasPrefix(text[start:end], hardBreak) {
+			start += len(hardBreak)
+		} else if strings.TrimLeft(text[start:start+1], " \n") == "" {
+			start++
+		} else {
+			break
+		}
+	}
+	for end > start {
+		if strings.HasSuffix(text[start:end], hardBreak) {
+			end -= len(hardBreak)
+		} else if strings.TrimRight(text[end-1:end], " \n") == "" {
+			end--
+		} else {
+			break
+		}
+	}
+	if start == end {
+		return text
+	}
+	return text[:start] + marker + text[start:end] + marker + text[end:]
+}
+
+// codeSpan returns an inline code span, the fence is longer than any
+// backtick run of the code
+func codeSpan(code string) string {
+	code = collapse(code)
+	if strings.TrimSpace(code) == "" {
+		return code
+	}
+	fence := "`"
+	for strings.Contains(code, fence) {
+		fence += "`"
+	}
+	if strings.HasPrefix(code, "`") || strings.HasSuffix(code, "`") {
+		code = " " + code + " "
+	}
+	return fence + code + fence
+}
+
+// destEscaper percent-encodes the characters that would end the
+// destination of a markdown link
+var destEscaper = strings.NewReplacer(
+	" ", "%20", "\t", "%09", "\n", "%0A", "\r", "%0D", "(", "%28",
+	")", "%29", "<", "%3C", ">", "%3E",
+)
+
+// link returns a markdown link, links without text show the url
+func link(text, href string) string {
+	href = strings.TrimSpace(href)
+	if href == "" || strings.HasPrefix(strings.ToLower(href), "javascript:") {
+		return text
+	}
+	if strings.TrimSpace(text) == "" {
+		text = escape(href)
+	}
+	return "[" + strings.TrimSpace(text) + "](" + destEscaper.Replace(href) +
+		")"
+}
+
+// clean tidies inline markdown, spaces around line breaks and empty
+// lines are removed
+func clean(text string) string {
+	var kept []string
+	for _, line := range strings.Split(text, hardBreak) {
+		line = strings.TrimSpace(strings.Replace(line, "\n", " ", -1))
+		if line != "" {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, hardBreak)
+}
+
+// flatten joins the lines of inline markdown for places where breaks are
+// not allowed like headings and table cells
+func flatten(text string) string {
+	return strings.Replace(clean(text), hardBreak, " ", -1)
+}
+
+func indent(text, prefix, first string) string {
+	lines := strings.Split(text, "\n")
+	for i := range lines {
+		if i == 0 {
+			lines[i] = first + lines[i]
+		} else if lines[i] != "" || strings.TrimSpace(prefix) != "" {
+			lines[i] = prefix + lines[i]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func renderTable(rows [][]string) string {
+	columns := 0
+	for _, row := range rows {
+		if len(row) > columns {
+			columns = len(row)
+		}
+	}
+	if columns == 0 {
+		return ""
+	}
+	cellEscaper := strings.NewReplacer("|", "\\|")
+	var lines []string
+	for i, row := range rows {
+		cells := make([]string, columns)
+		for j := range cells {
+			if j < len(row) {
+				cells[j] = cellEscaper.Replace(flatten(row[j]))
+			}
+		}
+		lines = append(lines, "| "+strings.Join(cells, " | ")+" |")
+		if i == 0 {
+			lines = append(lines, "|"+strings.Repeat(" --- |", columns))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func renderCode(code, language string) string {
+	fence := "```"
+	for strings.Contains(code, fence) {
+		fence += "`"
+	}
+	return fence + language + "\n" + strings.TrimRight(code, "\n") + "\n" +
+		fence
+}
+
+// render writes the blocks as markdown, consecutive list items form a
+// tight list and nested items are indented under their parents
+func render(blocks []block) string {
+	var out []string
+	// widths are the marker widths of the open list levels
+	var widths []int
+	var numbers []int
+	var kinds []bool
+	previousItem := false
+	for _, b := range blocks {
+		var text string
+		switch b.kind {
+		case paragraphBlock:
+			text = clean(b.text)
+		case headingBlock:
+			if heading := flatten(b.text); heading != "" {
+				level := b.level
+				if level < 1 {
+					level = 1
+				}
+				if level > 6 {
+					level = 6
+				}
+				text = strings.Repeat("#", level) + " " + heading
+			}
+		case itemBlock:
+			if !previousItem {
+				widths, numbers, kinds = nil, nil, nil
+			}
+			level := b.level
+			if level > len(widths) {
+				level = len(widths)
+			}
+			number := 1
+			if level < len(numbers) && kinds[level] == b.ordered {
+				number = numbers[level] + 1
+			}
+			widths, numbers = widths[:level], numbers[:level]
+			kinds = kinds[:level]
+			prefix := ""
+			for _, width := range widths {
+				prefix += strings.Repeat(" ", width)
+			}
+			marker := "- "
+			if b.ordered {
+				marker = strconv.Itoa(number) + ". "
+			}
+			widths = append(widths, len(marker))
+			numbers = append(numbers, number)
+			kinds = append(kinds, b.ordered)
+			item := indent(clean(b.text), prefix+strings.Repeat(" ",
+				len(marker)), prefix+marker)
+			if previousItem {
+				out[len(out)-1] += "\n" + item
+			} else {
+				out = append(out, item)
+			}
+			previousItem = true
+			continue
+		case tableBlock:
+			text = renderTable(b.rows)
+		case codeBlock:
+			if strings.TrimSpace(b.text) != "" {
+				text = renderCode(b.text, b.language)
+			}
+		case quoteBlock:
+			if quote := strings.TrimSpace(b.text); quote != "" {
+				text = indent(quote, "> ", "> ")
+				text = strings.Replace(text, "\n> \n", "\n>\n", -1)
+			}
+		case ruleBlock:
+			text = "---"
+		}
+		if text == "" {
+			continue
+		}
+		previousItem = false
+		out = append(out, text)
+	}
+	if len(out) == 0 {
+		return ""
+	}
+	return strings.Join(out, "\n\n") + "\n"
+}
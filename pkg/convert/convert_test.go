@@ -0,0 +1,173 @@
+package convert
+
+import (
+	"archive/zip"
+	"bytes"
+	"testing"
+)
+
+// archiveOf zips files in the given order
+func archiveOf(t *testing.T, files ...string) []byte {
+	t.Helper()
+	var buffer bytes.Buffer
+	writer := zip.NewWriter(&buffer)
+	for i := 0; i+1 < len(files); i += 2 {
+		file, err := writer.Create(files[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Write([]byte(files[i+1]))
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestConvertHTML(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"<h1>Title</h1><p>Hola <b>mundo</b> y <i>más</i></p>",
+			"# Title\n\nHola **mundo** y *más*\n"},
+		{"<ul><li>a</li><li>b<ul><li>c</li></ul></li></ul>",
+			"- a\n- b\n  - c\n"},
+		{`<p><a href="http://x.com/a b (c)">link</a></p>`,
+			"[link](http://x.com/a%20b%20%28c%29)\n"},
+		{`<p><a href="http://x.com/<a>">link</a></p>`,
+			"[link](http://x.com/%3Ca%3E)\n"},
+		{`<p><a href="javascript:alert(1)">bad</a></p>`, "bad\n"},
+		{`<p><a href="http://y.com">  </a></p>`,
+			"[http://y.com](http://y.com)\n"},
+		{"<table><tr><th>a</th><th>b</th></tr><tr><td>1|2</td><td>3</td></tr></table>",
+			"| a | b |\n| --- | --- |\n| 1\\|2 | 3 |\n"},
+		{"<pre><code>x := 1\n```</code></pre>", "````\nx := 1\n```\n````\n"},
+		{"<blockquote><p>q</p></blockquote><hr>", "> q\n\n---\n"},
+		{`<p>*not* _em_ [x] # 1. <script>alert(1)</script></p>`,
+			"\\*not\\* \\_em\\_ \\[x\\] \\# 1.\n"},
+		{"<html><head><meta charset=\"windows-1252\"></head>" +
+			"<body><p>caf\xe9</p></body></html>", "café\n"},
+	}
+	for _, test := range tests {
+		doc, err := Convert(HTML, []byte(test.in), "/img/")
+		if err != nil {
+			t.Errorf("Convert(%q) error = %v", test.in, err)
+			continue
+		}
+		if string(doc.Markdown) != test.want {
+			t.Errorf("Convert(%q) = %q, want %q", test.in, doc.Markdown,
+				test.want)
+		}
+	}
+}
+
+func TestConvertHTMLImages(t *testing.T) {
+	png := "data:image/png;base64,iVBORw0KGgo="
+	in := `<p><img src="` + png + `" alt="a"><img src="` + png +
+		`" alt="b"><img src="data:image/x-emf;base64,AAAA"></p>`
+	doc, err := Convert(HTML, []byte(in), "/img/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "![a](/img/4c4b6a3be1314ab8.png)![b](/img/4c4b6a3be1314ab8.png)\n"
+	if string(doc.Markdown) != want {
+		t.Errorf("Markdown = %q, want %q", doc.Markdown, want)
+	}
+	if len(doc.Images) != 1 || doc.Images[0].Name != "4c4b6a3be1314ab8.png" {
+		t.Errorf("Images = %v, want one png", doc.Images)
+	}
+}
+
+func TestConvertText(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Hola\nmundo\n\nOtro", "Hola\\\nmundo\n\nOtro\n"},
+		{"- a\n* b\n1. c", "- a\n- b\n1. c\n"},
+		{"# no\n+ x\n===", "\\# no\\\n\\+ x\\\n\\===\n"},
+		{"caf\xe9", "café\n"},
+		{"\ufeffbom\r\nline", "bom\\\nline\n"},
+	}
+	for _, test := range tests {
+		doc, err := Convert(Text, []byte(test.in), "")
+		if err != nil {
+			t.Errorf("Convert(%q) error = %v", test.in, err)
+			continue
+		}
+		if string(doc.Markdown) != test.want {
+			t.Errorf("Convert(%q) = %q, want %q", test.in, doc.Markdown,
+				test.want)
+		}
+	}
+}
+
+func TestConvertDOCX(t *testing.T) {
+	data := archiveOf(t,
+		"word/document.xml", `<w:document xmlns:w="w" xmlns:r="r"><w:body>
+<w:p><w:pPr><w:pStyle w:val="Heading1"/></w:pPr><w:r><w:t>Título</w:t></w:r></w:p>
+<w:p><w:r><w:rPr><w:b/></w:rPr><w:t>bold</w:t></w:r><w:r><w:t xml:space="preserve"> and </w:t></w:r><w:hyperlink r:id="rId1"><w:r><w:t>link</w:t></w:r></w:hyperlink></w:p>
+<w:p><w:pPr><w:numPr><w:ilvl w:val="0"/><w:numId w:val="1"/></w:numPr></w:pPr><w:r><w:t>item</w:t></w:r></w:p>
+</w:body></w:document>`,
+		"word/_rels/document.xml.rels", `<Relationships><Relationship Id="rId1" Target="http://e.com/a b" TargetMode="External"/></Relationships>`,
+		"word/styles.xml", `<w:styles xmlns:w="w"><w:style w:styleId="Heading1"><w:name w:val="heading 1"/></w:style></w:styles>`,
+		"word/numbering.xml", `<w:numbering xmlns:w="w"><w:abstractNum w:abstractNumId="0"><w:lvl w:ilvl="0"><w:numFmt w:val="decimal"/></w:lvl></w:abstractNum><w:num w:numId="1"><w:abstractNumId w:val="0"/></w:num></w:numbering>`,
+	)
+	doc, err := Convert(DOCX, data, "/img/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# Título\n\n**bold** and [link](http://e.com/a%20b)\n\n1. item\n"
+	if string(doc.Markdown) != want {
+		t.Errorf("Markdown = %q, want %q", doc.Markdown, want)
+	}
+}
+
+func TestConvertODT(t *testing.T) {
+	data := archiveOf(t,
+		"content.xml", `<office:document-content xmlns:office="o" xmlns:text="t" xmlns:style="s" xmlns:fo="f" xmlns:xlink="x"><office:automatic-styles><style:style style:name="T1"><style:text-properties fo:font-weight="bold"/></style:style></office:automatic-styles><office:body><office:text>
+<text:h text:outline-level="2">Sub</text:h><text:p>Hola <text:span text:style-name="T1">bold</text:span> <text:a xlink:href="http://e.com/(x)">l</text:a></text:p>
+<text:list><text:list-item><text:p>one</text:p></text:list-item></text:list>
+</office:text></office:body></office:document-content>`,
+		"styles.xml", `<office:document-styles xmlns:office="o"/>`,
+	)
+	doc, err := Convert(ODT, data, "/img/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "## Sub\n\nHola **bold** [l](http://e.com/%28x%29)\n\n- one\n"
+	if string(doc.Markdown) != want {
+		t.Errorf("Markdown = %q, want %q", doc.Markdown, want)
+	}
+}
+
+func TestConvertInvalid(t *testing.T) {
+	tests := []struct {
+		format string
+		data   []byte
+	}{
+		{DOCX, []byte("not a zip")},
+		{DOCX, archiveOf(t, "a.txt", "b")},
+		{ODT, archiveOf(t, "content.xml", "<a/>")},
+		{"pdf", nil},
+	}
+	for _, test := range tests {
+		if _, err := Convert(test.format, test.data, ""); err != ErrFormat {
+			t.Errorf("Convert(%s, %q) error = %v, want ErrFormat",
+				test.format, test.data, err)
+		}
+	}
+}
+
+func TestArchiveTotalSize(t *testing.T) {
+	a, err := openArchive(archiveOf(t, "a.xml", "<a/>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.read("a.xml"); err != nil {
+		t.Fatalf("read error = %v", err)
+	}
+	a.total = maxTotalSize - 3
+	if _, err = a.read("a.xml"); err != ErrFormat {
+		t.Errorf("read over the total size error = %v, want ErrFormat", err)
+	}
+}
@@ -0,0 +1,352 @@
+package convert
+
+import (
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// headingStyleRegex matches the names of the heading styles of Word, the
+// names are in English even in localized documents
+var headingStyleRegex = regexp.MustCompile(`^heading\s*([1-6])$`)
+
+// fieldLinkRegex reads the url of a HYPERLINK field
+var fieldLinkRegex = regexp.MustCompile(`HYPERLINK\s+"([^"]+)"`)
+
+type docxStyle struct {
+	name    string
+	basedOn string
+	outline int
+}
+
+type docxConverter struct {
+	doc     *Document
+	archive *archive
+	// rels maps relationship ids to their targets
+	rels   map[string]string
+	styles map[string]docxStyle
+	// ordered maps numbering ids and levels to whether they are numbered
+	ordered map[string]map[string]bool
+}
+
+func convertDOCX(doc *Document, data []byte) ([]block, error) {
+	a, err := openArchive(data)
+	if err != nil {
+		return nil, err
+	}
+	document, err := a.readXML("word/document.xml")
+	if err != nil {
+		return nil, err
+	}
+	body := document.find("body")
+	if body == nil {
+		return nil, ErrFormat
+	}
+	c := &docxConverter{doc: doc, archive: a}
+	if err = c.loadRels(); err != nil {
+		return nil, err
+	}
+	if err = c.loadStyles(); err != nil {
+		return nil, err
+	}
+	if err = c.loadNumbering(); err != nil {
+		return nil, err
+	}
+	return c.blocks(body), nil
+}
+
+func (c *docxConverter) loadRels() error {
+	rels, err := c.archive.readXML("word/_rels/document.xml.rels")
+	if err != nil {
+		return err
+	}
+	c.rels = make(map[string]string)
+	for _, rel := range rels.all("Relationship") {
+		target := rel.attr("Target")
+		if rel.attr("TargetMode") != "External" {
+			target = path.Join("word", target)
+			if strings.HasPrefix(rel.attr("Target"), "/") {
+				target = strings.TrimPrefix(rel.attr("Target"), "/")
+			}
+		}
+		c.rels[rel.attr("Id")] = target
+	}
+	return nil
+}
+
+func (c *docxConverter) loadStyles() error {
+	styles, err := c.archive.readXML("word/styles.xml")
+	if err != nil {
+		return err
+	}
+	c.styles = make(map[string]docxStyle)
+	for _, style := range styles.all("style") {
+		outline := -1
+		if level := style.child("pPr").child("outlineLvl"); level != nil {
+			if value, err := strconv.Atoi(level.attr("val")); err == nil {
+				outline = value
+			}
+		}
+		c.styles[style.attr("styleId")] = docxStyle{
+			name:    strings.ToLower(style.child("name").attr("val")),
+			basedOn: style.child("basedOn").attr("val"),
+			outline: outline,
+		}
+	}
+	return nil
+}
+
+func (c *docxConverter) loadNumbering() error {
+	numbering, err := c.archive.readXML("word/numbering.xml")
+	if err != nil {
+		return err
+	}
+	abstract := make(map[string]map[string]bool)
+	for _, definition := range numbering.all("abstractNum") {
+		levels := make(map[string]bool)
+		for _, level := range definition.all("lvl") {
+			format := level.child("numFmt").attr("val")
+			levels[level.attr("ilvl")] = format != "bullet" &&
+				format != "none" && format != ""
+		}
+		abstract[definition.attr("abstractNumId")] = levels
+	}
+	c.ordered = make(map[string]map[string]bool)
+	for _, num := range numbering.all("num") {
+		c.ordered[num.attr("numId")] =
+			abstract[num.child("abstractNumId").attr("val")]
+	}
+	return nil
+}
+
+// headingLevel returns the heading level of a paragraph style, following
+// the styles it is based on, 0 when it is not a heading
+func (c *docxConverter) headingLevel(styleID string) int {
+	for i := 0; i < 10 && styleID != ""; i++ {
+		style, ok := c.styles[styleID]
+		if !ok {
+			return 0
+		}
+		if match := headingStyleRegex.FindStringSubmatch(style.name); match != nil {
+			level, _ := strconv.Atoi(match[1])
+			return level
+		}
+		if style.name == "title" {
+			return 1
+		}
+		if style.outline >= 0 && style.outline < 6 {
+			return style.outline + 1
+		}
+		styleID = style.basedOn
+	}
+	return 0
+}
+
+func (c *docxConverter) blocks(body *node) []block {
+	var result []block
+	for _, child := range body.children {
+		switch child.name {
+		case "p":
+			if b, ok := c.paragraph(child); ok {
+				result = append(result, b)
+			}
+		case "tbl":
+			result = append(result, block{kind: tableBlock,
+				rows: c.rows(child)})
+		case "sdt":
+			result = append(result, c.blocks(child.child("sdtContent"))...)
+		}
+	}
+	return result
+}
+
+func (c *docxConverter) paragraph(p *node) (block, bool) {
+	properties := p.child("pPr")
+	styleID := properties.child("pStyle").attr("val")
+	text := c.inline(p)
+	if level := c.headingLevel(styleID); level > 0 {
+		return block{kind: headingBlock, level: level, text: text}, true
+	}
+	if numbering := properties.child("numPr"); numbering != nil {
+		numID := numbering.child("numId").attr("val")
+		level := numbering.child("ilvl").attr("val")
+		depth, _ := strconv.Atoi(level)
+		if numID != "0" {
+			return block{kind: itemBlock, level: depth,
+				ordered: c.ordered[numID][level], text: text}, true
+		}
+	}
+	if name := c.styles[styleID].name; name == "quote" ||
+		name == "intense quote" {
+		return block{kind: quoteBlock, text: clean(text)}, true
+	}
+	if strings.TrimSpace(text) == "" {
+		return block{}, false
+	}
+	return block{kind: paragraphBlock, text: text}, true
+}
+
+// on reads a toggle property like bold, it is on unless its value says
+// otherwise
+func on(property *node) bool {
+	if property == nil {
+		return false
+	}
+	value := property.attr("val")
+	return value != "0" && value != "false" && value != "none"
+}
+
+// runs collects the runs of a paragraph. Fields have their instruction
+// first and the result shown after the separate character, links are
+// read from the instruction
+type runs struct {
+	segments    []segment
+	instruction strings.Builder
+	result      []segment
+	inField     bool
+	inResult    bool
+}
+
+func (rs *runs) add(s segment) {
+	switch {
+	case rs.inResult:
+		rs.result = append(rs.result, s)
+	case !rs.inField:
+		rs.segments = append(rs.segments, s)
+	}
+}
+
+func (rs *runs) field(charType string) {
+	switch charType {
+	case "begin":
+		rs.inField, rs.inResult = true, false
+		rs.instruction.Reset()
+		rs.result = nil
+	case "separate":
+		rs.inResult = rs.inField
+	case "end":
+		text := joinSegments(rs.result)
+		match := fieldLinkRegex.FindStringSubmatch(rs.instruction.String())
+		if match != nil {
+			text = link(text, match[1])
+		}
+		rs.inField, rs.inResult = false, false
+		rs.segments = append(rs.segments, segment{text: text, raw: true})
+		rs.result = nil
+	}
+}
+
+// inline converts the runs of a paragraph to inline markdown
+func (c *docxConverter) inline(p *node) string {
+	rs := &runs{}
+	var walk func(n *node)
+	walk = func(n *node) {
+		for _, child := range n.children {
+			switch child.name {
+			case "r":
+				c.run(child, rs)
+			case "hyperlink":
+				before := rs.segments
+				rs.segments = nil
+				walk(child)
+				href := ""
+				if id := child.attr("id"); id != "" {
+					href = c.rels[id]
+				}
+				rs.segments = append(before, segment{
+					text: link(joinSegments(rs.segments), href),
+					raw:  true,
+				})
+			case "ins", "smartTag", "fldSimple", "customXml", "sdt",
+				"sdtContent":
+				walk(child)
+			}
+		}
+	}
+	walk(p)
+	if rs.inResult {
+		// The field goes on in the next paragraph, like tables of contents
+		rs.segments = append(rs.segments, rs.result...)
+	}
+	return joinSegments(rs.segments)
+}
+
+// run converts the text, breaks and images of a run
+func (c *docxConverter) run(r *node, rs *runs) {
+	properties := r.child("rPr")
+	format := segment{
+		bold:   on(properties.child("b")),
+		italic: on(properties.child("i")),
+		strike: on(properties.child("strike")) ||
+			on(properties.child("dstrike")),
+	}
+	for _, child := range r.children {
+		switch child.name {
+		case "t":
+			s := format
+			s.text = escape(child.content())
+			rs.add(s)
+		case "tab":
+			s := format
+			s.text = " "
+			rs.add(s)
+		case "br", "cr":
+			if child.attr("type") != "page" {
+				rs.add(segment{text: hardBreak, raw: true})
+			}
+		case "drawing", "pict":
+			if image := c.image(child); image != "" {
+				rs.add(segment{text: image, raw: true})
+			}
+		case "instrText":
+			rs.instruction.WriteString(child.content())
+		case "fldChar":
+			rs.field(child.attr("fldCharType"))
+		}
+	}
+}
+
+func (c *docxConverter) image(drawing *node) string {
+	id := drawing.find("blip").attr("embed")
+	if id == "" {
+		id = drawing.find("imagedata").attr("id")
+	}
+	target, ok := c.rels[id]
+	if !ok {
+		return ""
+	}
+	data, err := c.archive.read(target)
+	if err != nil || data == nil {
+		return ""
+	}
+	alt := drawing.find("docPr").attr("descr")
+	if alt == "" {
+		alt = drawing.find("imagedata").attr("title")
+	}
+	return c.doc.image(data, alt)
+}
+
+func (c *docxConverter) rows(table *node) [][]string {
+	var rows [][]string
+	for _, tr := range table.children {
+		if tr.name != "tr" {
+			continue
+		}
+		var row []string
+		for _, tc := range tr.children {
+			if tc.name != "tc" {
+				continue
+			}
+			var texts []string
+			for _, p := range tc.all("p") {
+				if text := flatten(c.inline(p)); text != "" {
+					texts = append(texts, text)
+				}
+			}
+			row = append(row, strings.Join(texts, " "))
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
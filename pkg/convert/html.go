@@ -0,0 +1,321 @@
+package convert
+
+import (
+	"encoding/base64"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// blockElements start a new block in html
+var blockElements = map[atom.Atom]bool{
+	atom.Address: true, atom.Article: true, atom.Aside: true,
+	atom.Blockquote: true, atom.Center: true, atom.Dd: true,
+	atom.Details: true, atom.Dialog: true, atom.Div: true, atom.Dl: true,
+	atom.Dt: true, atom.Fieldset: true, atom.Figcaption: true,
+	atom.Figure: true, atom.Footer: true, atom.Form: true, atom.H1: true,
+	atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+	atom.Header: true, atom.Hr: true, atom.Li: true, atom.Main: true,
+	atom.Nav: true, atom.Ol: true, atom.P: true, atom.Pre: true,
+	atom.Section: true, atom.Summary: true, atom.Table: true, atom.Ul: true,
+}
+
+// skippedElements are removed with their content
+var skippedElements = map[atom.Atom]bool{
+	atom.Head: true, atom.Script: true, atom.Style: true,
+	atom.Noscript: true, atom.Template: true, atom.Iframe: true,
+	atom.Object: true, atom.Svg: true, atom.Math: true, atom.Title: true,
+	atom.Button: true, atom.Select: true, atom.Textarea: true,
+}
+
+var headingLevels = map[atom.Atom]int{
+	atom.H1: 1, atom.H2: 2, atom.H3: 3, atom.H4: 4, atom.H5: 5, atom.H6: 6,
+}
+
+type htmlConverter struct {
+	doc *Document
+}
+
+func convertHTML(doc *Document, data []byte) ([]block, error) {
+	decoded, err := decode(data, "text/html")
+	if err != nil {
+		return nil, ErrFormat
+	}
+	root, err := html.Parse(strings.NewReader(string(decoded)))
+	if err != nil {
+		return nil, ErrFormat
+	}
+	c := &htmlConverter{doc: doc}
+	if body := findElement(root, atom.Body); body != nil {
+		root = body
+	}
+	return c.blocks(root, 0), nil
+}
+
+func findElement(n *html.Node, element atom.Atom) *html.Node {
+	if n.DataAtom == element {
+		return n
+	}
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if found := findElement(child, element); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// textContent returns the text of a node as it is, for code
+func textContent(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	if n.DataAtom == atom.Br {
+		return "\n"
+	}
+	var builder strings.Builder
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		builder.WriteString(textContent(child))
+	}
+	return builder.String()
+}
+
+// blocks converts the children of a node, inline content between block
+// elements becomes paragraphs and lists are nested from depth
+func (c *htmlConverter) blocks(n *html.Node, depth int) []block {
+	var result []block
+	var pending strings.Builder
+	flush := func() {
+		if strings.TrimSpace(pending.String()) != "" {
+			result = append(result, block{
+				kind: paragraphBlock,
+				text: pending.String(),
+			})
+		}
+		pending.Reset()
+	}
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type == html.ElementNode && skippedElements[child.DataAtom] {
+			continue
+		}
+		if child.Type != html.ElementNode || !blockElements[child.DataAtom] {
+			pending.WriteString(c.inline(child))
+			continue
+		}
+		flush()
+		result = append(result, c.block(child, depth)...)
+	}
+	flush()
+	return result
+}
+
+func (c *htmlConverter) block(n *html.Node, depth int) []block {
+	if level, ok := headingLevels[n.DataAtom]; ok {
+		return []block{{kind: headingBlock, level: level,
+			text: c.inlineChildren(n)}}
+	}
+	switch n.DataAtom {
+	case atom.Hr:
+		return []block{{kind: ruleBlock}}
+	case atom.Pre:
+		language := ""
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			if child.DataAtom != atom.Code {
+				continue
+			}
+			for _, class := range strings.Fields(attr(child, "class")) {
+				if strings.HasPrefix(class, "language-") {
+					language = strings.TrimPrefix(class, "language-")
+				}
+			}
+		}
+		return []block{{kind: codeBlock, text: textContent(n),
+			language: language}}
+	case atom.Blockquote:
+		return []block{{kind: quoteBlock,
+			text: render(c.blocks(n, 0))}}
+	case atom.Ul, atom.Ol:
+		return c.list(n, depth)
+	case atom.Li:
+		// A list item outside of a list
+		return c.item(n, depth, false)
+	case atom.Table:
+		return []block{{kind: tableBlock, rows: c.rows(n)}}
+	case atom.Dt, atom.Summary:
+		return []block{{kind: paragraphBlock,
+			text: wrap("**", c.inlineChildren(n))}}
+	}
+	return c.blocks(n, depth)
+}
+
+func (c *htmlConverter) list(n *html.Node, depth int) []block {
+	ordered := n.DataAtom == atom.Ol
+	var result []block
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		switch {
+		case child.DataAtom == atom.Li:
+			result = append(result, c.item(child, depth, ordered)...)
+		case child.DataAtom == atom.Ul || child.DataAtom == atom.Ol:
+			// Lists nested without an item
+			result = append(result, c.list(child, depth+1)...)
+		}
+	}
+	return result
+}
+
+// item converts a list item, its text is everything but the nested lists
+// which follow it one level deeper
+func (c *htmlConverter) item(n *html.Node, depth int, ordered bool) []block {
+	var text strings.Builder
+	var nested []block
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			switch {
+			case child.Type == html.ElementNode &&
+				skippedElements[child.DataAtom]:
+			case child.DataAtom == atom.Ul || child.DataAtom == atom.Ol:
+				nested = append(nested, c.list(child, depth+1)...)
+			case child.Type == html.ElementNode &&
+				blockElements[child.DataAtom]:
+				text.WriteString(hardBreak)
+				walk(child)
+				text.WriteString(hardBreak)
+			default:
+				text.WriteString(c.inline(child))
+			}
+		}
+	}
+	walk(n)
+	result := []block{{kind: itemBlock, level: depth, ordered: ordered,
+		text: text.String()}}
+	return append(result, nested...)
+}
+
+func (c *htmlConverter) rows(table *html.Node) [][]string {
+	var rows [][]string
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			if child.DataAtom != atom.Tr {
+				if child.DataAtom != atom.Table {
+					walk(child)
+				}
+				continue
+			}
+			var row []string
+			for cell := child.FirstChild; cell != nil; cell = cell.NextSibling {
+				if cell.DataAtom == atom.Td || cell.DataAtom == atom.Th {
+					row = append(row, c.inlineChildren(cell))
+				}
+			}
+			rows = append(rows, row)
+		}
+	}
+	walk(table)
+	return rows
+}
+
+func (c *htmlConverter) inlineChildren(n *html.Node) string {
+	var builder strings.Builder
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		builder.WriteString(c.inline(child))
+	}
+	return builder.String()
+}
+
+// styled reads the bold and italic of inline styles, as exported by
+// online editors
+func styled(n *html.Node) (bool, bool) {
+	style := strings.Replace(strings.ToLower(attr(n, "style")), " ", "", -1)
+	bold := strings.Contains(style, "font-weight:bold")
+	for weight := 600; weight <= 900; weight += 100 {
+		bold = bold || strings.Contains(style, "font-weight:"+
+			strconv.Itoa(weight))
+	}
+	return bold, strings.Contains(style, "font-style:italic")
+}
+
+// inline converts a node inside a paragraph to inline markdown, blocks
+// nested in inline elements become line breaks
+func (c *htmlConverter) inline(n *html.Node) string {
+	switch n.Type {
+	case html.TextNode:
+		return escape(collapse(n.Data))
+	case html.ElementNode:
+	default:
+		return ""
+	}
+	if skippedElements[n.DataAtom] {
+		return ""
+	}
+	switch n.DataAtom {
+	case atom.Br:
+		return hardBreak
+	case atom.Img:
+		return c.image(n)
+	case atom.Code, atom.Kbd, atom.Samp, atom.Tt:
+		return codeSpan(textContent(n))
+	}
+	text := c.inlineChildren(n)
+	if blockElements[n.DataAtom] {
+		return hardBreak + text + hardBreak
+	}
+	switch n.DataAtom {
+	case atom.Strong, atom.B:
+		return wrap("**", text)
+	case atom.Em, atom.I, atom.Cite, atom.Dfn:
+		return wrap("*", text)
+	case atom.Del, atom.S, atom.Strike:
+		return wrap("~~", text)
+	case atom.Sup, atom.Sub:
+		if strings.TrimSpace(text) == "" {
+			return text
+		}
+		return "<" + n.Data + ">" + text + "</" + n.Data + ">"
+	case atom.A:
+		return link(text, attr(n, "href"))
+	case atom.Span, atom.Font:
+		bold, italic := styled(n)
+		if bold {
+			text = wrap("**", text)
+		}
+		if italic {
+			text = wrap("*", text)
+		}
+	}
+	return text
+}
+
+// image converts an image, pictures embedded as data urls are extracted
+// and pictures that can not be reached are dropped
+func (c *htmlConverter) image(n *html.Node) string {
+	src := strings.TrimSpace(attr(n, "src"))
+	alt := attr(n, "alt")
+	if strings.HasPrefix(src, "data:") {
+		comma := strings.Index(src, ",")
+		if comma < 0 || !strings.HasSuffix(src[:comma], ";base64") {
+			return ""
+		}
+		data, err := base64.StdEncoding.DecodeString(src[comma+1:])
+		if err != nil {
+			return ""
+		}
+		return c.doc.image(data, alt)
+	}
+	u, err := url.Parse(src)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	return "![" + escape(collapse(alt)) + "](" + src + ")"
+}
@@ -0,0 +1,277 @@
+package convert
+
+import (
+	"strconv"
+	"strings"
+)
+
+type odtStyle struct {
+	parent string
+	bold   *bool
+	italic *bool
+	strike *bool
+}
+
+type odtConverter struct {
+	doc     *Document
+	archive *archive
+	styles  map[string]odtStyle
+	// lists maps list styles and levels to whether they are numbered
+	lists map[string]map[int]bool
+}
+
+func convertODT(doc *Document, data []byte) ([]block, error) {
+	a, err := openArchive(data)
+	if err != nil {
+		return nil, err
+	}
+	content, err := a.readXML("content.xml")
+	if err != nil {
+		return nil, err
+	}
+	text := content.find("body").child("text")
+	if text == nil {
+		return nil, ErrFormat
+	}
+	styles, err := a.readXML("styles.xml")
+	if err != nil {
+		return nil, err
+	}
+	c := &odtConverter{
+		doc:     doc,
+		archive: a,
+		styles:  make(map[string]odtStyle),
+		lists:   make(map[string]map[int]bool),
+	}
+	c.loadStyles(styles)
+	c.loadStyles(content)
+	return c.blocks(text, "", 0), nil
+}
+
+func flag(value bool) *bool {
+	return &value
+}
+
+// loadStyles reads the text formatting of the styles and the kind of
+// the list styles
+func (c *odtConverter) loadStyles(root *node) {
+	for _, style := range root.all("style") {
+		s := odtStyle{parent: style.attr("parent-style-name")}
+		if properties := style.child("text-properties"); properties != nil {
+			if weight := properties.attr("font-weight"); weight != "" {
+				number, _ := strconv.Atoi(weight)
+				s.bold = flag(weight == "bold" || number >= 600)
+			}
+			if italic := properties.attr("font-style"); italic != "" {
+				s.italic = flag(italic == "italic" || italic == "oblique")
+			}
+			if strike := properties.attr("text-line-through-style"); strike != "" {
+				s.strike = flag(strike != "none")
+			}
+		}
+		c.styles[style.attr("name")] = s
+	}
+	for _, list := range root.all("list-style") {
+		levels := make(map[int]bool)
+		for _, level := range list.children {
+			number, err := strconv.Atoi(level.attr("level"))
+			if err != nil {
+				continue
+			}
+			levels[number] = level.name == "list-level-style-number"
+		}
+		c.lists[list.attr("name")] = levels
+	}
+}
+
+// format applies a style, and the styles it inherits from, over a format
+func (c *odtConverter) format(name string, base segment) segment {
+	var bold, italic, strike *bool
+	for i := 0; i < 10 && name != ""; i++ {
+		style, ok := c.styles[name]
+		if !ok {
+			break
+		}
+		if bold == nil {
+			bold = style.bold
+		}
+		if italic == nil {
+			italic = style.italic
+		}
+		if strike == nil {
+			strike = style.strike
+		}
+		name = style.parent
+	}
+	if bold != nil {
+		base.bold = *bold
+	}
+	if italic != nil {
+		base.italic = *italic
+	}
+	if strike != nil {
+		base.strike = *strike
+	}
+	return base
+}
+
+func (c *odtConverter) blocks(parent *node, listStyle string,
+	depth int) []block {
+	var result []block
+	for _, child := range parent.children {
+		switch child.name {
+		case "h":
+			level, err := strconv.Atoi(child.attr("outline-level"))
+			if err != nil {
+				level = 1
+			}
+			result = append(result, block{kind: headingBlock, level: level,
+				text: c.inline(child, segment{})})
+		case "p":
+			text := c.inline(child, c.format(child.attr("style-name"),
+				segment{}))
+			if strings.TrimSpace(text) != "" {
+				result = append(result, block{kind: paragraphBlock,
+					text: text})
+			}
+		case "list":
+			style := child.attr("style-name")
+			if style == "" {
+				style = listStyle
+			}
+			result = append(result, c.list(child, style, depth)...)
+		case "table":
+			result = append(result, block{kind: tableBlock,
+				rows: c.rows(child)})
+		case "section", "deletion", "change-start":
+			result = append(result, c.blocks(child, listStyle, depth)...)
+		}
+	}
+	return result
+}
+
+// list converts the items of a list, paragraphs after the first one of
+// an item become line breaks and nested lists go one level deeper
+func (c *odtConverter) list(list *node, style string, depth int) []block {
+	ordered := c.lists[style][depth+1]
+	var result []block
+	for _, item := range list.children {
+		if item.name != "list-item" && item.name != "list-header" {
+			continue
+		}
+		var texts []string
+		var nested []block
+		for _, child := range item.children {
+			switch child.name {
+			case "p", "h":
+				texts = append(texts, c.inline(child,
+					c.format(child.attr("style-name"), segment{})))
+			case "list":
+				nestedStyle := child.attr("style-name")
+				if nestedStyle == "" {
+					nestedStyle = style
+				}
+				nested = append(nested, c.list(child, nestedStyle,
+					depth+1)...)
+			}
+		}
+		if len(texts) > 0 {
+			result = append(result, block{kind: itemBlock, level: depth,
+				ordered: ordered, text: strings.Join(texts, hardBreak)})
+		}
+		result = append(result, nested...)
+	}
+	return result
+}
+
+func (c *odtConverter) rows(table *node) [][]string {
+	var rows [][]string
+	for _, row := range table.all("table-row") {
+		var cells []string
+		for _, cell := range row.children {
+			if cell.name != "table-cell" {
+				continue
+			}
+			var texts []string
+			for _, p := range cell.children {
+				if p.name != "p" && p.name != "h" {
+					continue
+				}
+				if text := flatten(c.inline(p, segment{})); text != "" {
+					texts = append(texts, text)
+				}
+			}
+			cells = append(cells, strings.Join(texts, " "))
+		}
+		rows = append(rows, cells)
+	}
+	return rows
+}
+
+// inline converts the content of a paragraph with a base format
+func (c *odtConverter) inline(p *node, format segment) string {
+	var segments []segment
+	var walk func(n *node, format segment)
+	walk = func(n *node, format segment) {
+		for _, child := range n.children {
+			switch child.name {
+			case "":
+				s := format
+				s.text = escape(collapse(child.text))
+				segments = append(segments, s)
+			case "span":
+				walk(child, c.format(child.attr("style-name"), format))
+			case "a":
+				before := segments
+				segments = nil
+				walk(child, format)
+				segments = append(before, segment{
+					text: link(joinSegments(segments), child.attr("href")),
+					raw:  true,
+				})
+			case "s":
+				count, err := strconv.Atoi(child.attr("c"))
+				if err != nil {
+					count = 1
+				}
+				s := format
+				s.text = strings.Repeat(" ", count)
+				segments = append(segments, s)
+			case "tab":
+				s := format
+				s.text = " "
+				segments = append(segments, s)
+			case "line-break":
+				segments = append(segments, segment{text: hardBreak,
+					raw: true})
+			case "frame":
+				if image := c.image(child); image != "" {
+					segments = append(segments, segment{text: image,
+						raw: true})
+				}
+			case "note", "annotation", "bookmark", "bookmark-start",
+				"bookmark-end", "soft-page-break", "sequence-decls":
+			default:
+				walk(child, format)
+			}
+		}
+	}
+	walk(p, format)
+	return joinSegments(segments)
+}
+
+func (c *odtConverter) image(frame *node) string {
+	href := frame.find("image").attr("href")
+	if href == "" || strings.Contains(href, "://") {
+		return ""
+	}
+	data, err := c.archive.read(href)
+	if err != nil || data == nil {
+		return ""
+	}
+	alt := frame.child("desc").content()
+	if alt == "" {
+		alt = frame.child("title").content()
+	}
+	return c.doc.image(data, alt)
+}
@@ -0,0 +1,84 @@
+package convert
+
+import (
+	"golang.org/x/net/html/charset"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+// bulletRegex and numberRegex match the list items of plain text
+var bulletRegex = regexp.MustCompile(`^[-*•·]\s+`)
+var numberRegex = regexp.MustCompile(`^\d{1,3}[.)]\s+`)
+
+// blockStartRegex matches the start of lines that markdown would read as
+// a block like a list, a rule or a heading underline
+var blockStartRegex = regexp.MustCompile(`^([-+=|]|\d+[.)])`)
+
+// escapeLine escapes a line of text including the start of blocks
+func escapeLine(line string) string {
+	line = escape(line)
+	if match := blockStartRegex.FindString(line); match != "" {
+		return match[:len(match)-1] + "\\" + match[len(match)-1:] +
+			line[len(match):]
+	}
+	return line
+}
+
+// decode converts a text to UTF-8, the encoding comes from a byte order
+// mark or a meta tag and texts that are not valid UTF-8 are assumed to be
+// Windows-1252 as saved by most editors on Windows
+func decode(data []byte, contentType string) ([]byte, error) {
+	encoding, _, _ := charset.DetermineEncoding(data, contentType)
+	return ioutil.ReadAll(encoding.NewDecoder().Reader(
+		strings.NewReader(string(data))))
+}
+
+// convertText keeps the paragraphs and line breaks of plain text, lines
+// starting like list items become list items
+func convertText(data []byte) ([]block, error) {
+	decoded, err := decode(data, "text/plain")
+	if err != nil {
+		return nil, ErrFormat
+	}
+	text := strings.Replace(string(decoded), "\r\n", "\n", -1)
+	text = strings.TrimPrefix(text, "\ufeff")
+	var blocks []block
+	var paragraph []string
+	flush := func() {
+		if len(paragraph) > 0 {
+			blocks = append(blocks, block{
+				kind: paragraphBlock,
+				text: strings.Join(paragraph, hardBreak),
+			})
+			paragraph = nil
+		}
+	}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			flush()
+			continue
+		}
+		if marker := bulletRegex.FindString(line); marker != "" {
+			flush()
+			blocks = append(blocks, block{
+				kind: itemBlock,
+				text: escape(line[len(marker):]),
+			})
+			continue
+		}
+		if marker := numberRegex.FindString(line); marker != "" {
+			flush()
+			blocks = append(blocks, block{
+				kind:    itemBlock,
+				ordered: true,
+				text:    escape(line[len(marker):]),
+			})
+			continue
+		}
+		paragraph = append(paragraph, escapeLine(line))
+	}
+	flush()
+	return blocks, nil
+}
@@ -0,0 +1,218 @@
+package convert
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// maxEntrySize is the maximum uncompressed size of a file inside an
+// office document and maxTotalSize of all the files read from it
+const (
+	maxEntrySize = 50 << 20
+	maxTotalSize = 200 << 20
+)
+
+// node is an element of an xml document, names are local names without
+// their namespace. Text nodes have no name
+type node struct {
+	name     string
+	attrs    map[string]string
+	children []*node
+	text     string
+}
+
+func parseXML(data []byte) (*node, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = false
+	root := &node{}
+	stack := []*node{root}
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, ErrFormat
+		}
+		parent := stack[len(stack)-1]
+		switch t := token.(type) {
+		case xml.StartElement:
+			element := &node{name: t.Name.Local,
+				attrs: make(map[string]string)}
+			for _, a := range t.Attr {
+				element.attrs[a.Name.Local] = a.Value
+			}
+			parent.children = append(parent.children, element)
+			stack = append(stack, element)
+		case xml.EndElement:
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			parent.children = append(parent.children,
+				&node{text: string(t)})
+		}
+	}
+	return root, nil
+}
+
+func (n *node) attr(name string) string {
+	if n == nil {
+		return ""
+	}
+	return n.attrs[name]
+}
+
+// child returns the first child element with a name
+func (n *node) child(name string) *node {
+	if n == nil {
+		return nil
+	}
+	for _, child := range n.children {
+		if child.name == name {
+			return child
+		}
+	}
+	return nil
+}
+
+// find returns the first descendant element with a name
+func (n *node) find(name string) *node {
+	if n == nil {
+		return nil
+	}
+	for _, child := range n.children {
+		if child.name == name {
+			return child
+		}
+		if found := child.find(name); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// all returns every descendant element with a name
+func (n *node) all(name string) []*node {
+	if n == nil {
+		return nil
+	}
+	var result []*node
+	for _, child := range n.children {
+		if child.name == name {
+			result = append(result, child)
+		}
+		result = append(result, child.all(name)...)
+	}
+	return result
+}
+
+// content returns the text of a node and its descendants
+func (n *node) content() string {
+	if n == nil {
+		return ""
+	}
+	var builder strings.Builder
+	builder.WriteString(n.text)
+	for _, child := range n.children {
+		builder.WriteString(child.content())
+	}
+	return builder.String()
+}
+
+// archive is a zipped office document, total counts the uncompressed
+// bytes read so far
+type archive struct {
+	files map[string]*zip.File
+	total int
+}
+
+func openArchive(data []byte) (*archive, error) {
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, ErrFormat
+	}
+	a := &archive{files: make(map[string]*zip.File)}
+	for _, file := range reader.File {
+		a.files[file.Name] = file
+	}
+	return a, nil
+}
+
+// read returns a file of the archive, missing files are nil
+func (a *archive) read(name string) ([]byte, error) {
+	file, ok := a.files[strings.TrimPrefix(name, "/")]
+	if !ok {
+		return nil, nil
+	}
+	reader, err := file.Open()
+	if err != nil {
+		return nil, ErrFormat
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(reader, maxEntrySize+1))
+	a.total += len(data)
+	if err != nil || len(data) > maxEntrySize || a.total > maxTotalSize {
+		return nil, ErrFormat
+	}
+	return data, nil
+}
+
+// readXML parses a file of the archive, missing files are empty
+func (a *archive) readXML(name string) (*node, error) {
+	data, err := a.read(name)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return &node{}, nil
+	}
+	return parseXML(data)
+}
+
+// segment is a run of text with its formatting
+type segment struct {
+	text   string
+	bold   bool
+	italic bool
+	strike bool
+	// raw segments like links and images are not formatted
+	raw bool
+}
+
+// joinSegments writes formatted runs as inline markdown, runs with the
+// same formatting are merged first since editors split text in many runs
+func joinSegments(segments []segment) string {
+	var merged []segment
+	for _, s := range segments {
+		last := len(merged) - 1
+		if last >= 0 && !s.raw && !merged[last].raw &&
+			merged[last].bold == s.bold && merged[last].italic == s.italic &&
+			merged[last].strike == s.strike {
+			merged[last].text += s.text
+			continue
+		}
+		merged = append(merged, s)
+	}
+	var builder strings.Builder
+	for _, s := range merged {
+		text := s.text
+		if !s.raw {
+			if s.strike {
+				text = wrap("~~", text)
+			}
+			if s.italic {
+				text = wrap("*", text)
+			}
+			if s.bold {
+				text = wrap("**", text)
+			}
+		}
+		builder.WriteString(text)
+	}
+	return builder.String()
+}
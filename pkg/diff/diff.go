@@ -0,0 +1,354 @@
+package diff
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Op is the kind of change of a line
+type Op int
+
+const (
+	// Equal is a line present in both texts
+	Equal Op = iota
+	// Insert is a line only present in the new text
+	Insert
+	// Delete is a line only present in the old text
+	Delete
+)
+
+// Line is a line of a diff
+type Line struct {
+	Op   Op
+	Text string
+}
+
+const contextLines = 3
+
+// Split splits a text into lines without their line endings
+func Split(text string) []string {
+	if text == "" {
+		return []string{}
+	}
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	lines := strings.Split(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// Lines returns the shortest edit script between two lists of lines
+// using the linear space variant of the Myers algorithm, which splits the
+// texts at the middle snake of the edit path
+func Lines(a, b []string) []Line {
+	return compare(make([]Line, 0, len(a)+len(b)), a, b)
+}
+
+// compare appends the edit script of a and b to lines
+func compare(lines []Line, a, b []string) []Line {
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		lines = append(lines, Line{Equal, a[0]})
+		a, b = a[1:], b[1:]
+	}
+	suffix := 0
+	for suffix < len(a) && suffix < len(b) &&
+		a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	common := a[len(a)-suffix:]
+	a, b = a[:len(a)-suffix], b[:len(b)-suffix]
+	switch {
+	case len(a) == 0:
+		for _, line := range b {
+			lines = append(lines, Line{Insert, line})
+		}
+	case len(b) == 0:
+		for _, line := range a {
+			lines = append(lines, Line{Delete, line})
+		}
+	default:
+		// Without a common prefix or suffix at least two edits are needed,
+		// so both halves are smaller than the texts
+		x, y, u, v := middleSnake(a, b)
+		lines = compare(lines, a[:x], b[:y])
+		for _, line := range a[x:u] {
+			lines = append(lines, Line{Equal, line})
+		}
+		lines = compare(lines, a[u:], b[v:])
+	}
+	for _, line := range common {
+		lines = append(lines, Line{Equal, line})
+	}
+	return lines
+}
+
+// middleSnake searches the shortest edit path from both ends at once and
+// returns the diagonal where they meet, a[x:u] is equal to b[y:v]
+func middleSnake(a, b []string) (x, y, u, v int) {
+	n, m := len(a), len(b)
+	delta := n - m
+	odd := delta%2 != 0
+	max := (n + m + 1) / 2
+	offset := max + 1
+	forward := make([]int, 2*max+3)
+	backward := make([]int, 2*max+3)
+	for d := 0; d <= max; d++ {
+		for k := -d; k <= d; k += 2 {
+			if k == -d || (k != d &&
+				forward[offset+k-1] < forward[offset+k+1]) {
+				x = forward[offset+k+1]
+			} else {
+				x = forward[offset+k-1] + 1
+			}
+			y = x - k
+			u, v = x, y
+			for u < n && v < m && a[u] == b[v] {
+				u++
+				v++
+			}
+			forward[offset+k] = u
+			if odd && k >= delta-(d-1) && k <= delta+(d-1) &&
+				u+backward[offset+delta-k] >= n {
+				return x, y, u, v
+			}
+		}
+		// The backward search walks the reversed texts, its diagonal k is
+		// the forward diagonal delta - k
+		for k := -d; k <= d; k += 2 {
+			var rx int
+			if k == -d || (k != d &&
+				backward[offset+k-1] < backward[offset+k+1]) {
+				rx = backward[offset+k+1]
+			} else {
+				rx = backward[offset+k-1] + 1
+			}
+			ry := rx - k
+			ru, rv := rx, ry
+			for ru < n && rv < m && a[n-1-ru] == b[m-1-rv] {
+				ru++
+				rv++
+			}
+			backward[offset+k] = ru
+			if !odd && delta-k >= -d && delta-k <= d &&
+				forward[offset+delta-k]+ru >= n {
+				return n - ru, m - rv, n - rx, m - ry
+			}
+		}
+	}
+	// The paths always meet before d passes half of n + m
+	return 0, 0, 0, 0
+}
+
+// Stats counts the inserted and deleted lines of a diff
+func Stats(lines []Line) (inserted, deleted int) {
+	for _, line := range lines {
+		switch line.Op {
+		case Insert:
+			inserted++
+		case Delete:
+			deleted++
+		}
+	}
+	return inserted, deleted
+}
+
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start-1)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+// Unified formats the difference between two texts as a unified diff
+// with three lines of context, it is empty when the texts are equal
+func Unified(fromName, toName, from, to string) string {
+	lines := Lines(Split(from), Split(to))
+	var changes []int
+	for i, line := range lines {
+		if line.Op != Equal {
+			changes = append(changes, i)
+		}
+	}
+	if len(changes) == 0 {
+		return ""
+	}
+	var builder strings.Builder
+	builder.WriteString("--- " + fromName + "\n")
+	builder.WriteString("+++ " + toName + "\n")
+	for i := 0; i < len(changes); {
+		start := changes[i] - contextLines
+		if start < 0 {
+			start = 0
+		}
+		end := changes[i] + contextLines + 1
+		j := i + 1
+		for j < len(changes) && changes[j]-contextLines <= end {
+			end = changes[j] + contextLines + 1
+			j++
+		}
+		if end > len(lines) {
+			end = len(lines)
+		}
+		fromLine, toLine := 1, 1
+		for _, line := range lines[:start] {
+			if line.Op != Insert {
+				fromLine++
+			}
+			if line.Op != Delete {
+				toLine++
+			}
+		}
+		var fromCount, toCount int
+		var body strings.Builder
+		for _, line := range lines[start:end] {
+			switch line.Op {
+			case Equal:
+				fromCount++
+				toCount++
+				body.WriteString(" " + line.Text + "\n")
+			case Delete:
+				fromCount++
+				body.WriteString("-" + line.Text + "\n")
+			case Insert:
+				toCount++
+				body.WriteString("+" + line.Text + "\n")
+			}
+		}
+		builder.WriteString("@@ -" + hunkRange(fromLine, fromCount) +
+			" +" + hunkRange(toLine, toCount) + " @@\n")
+		builder.WriteString(body.String())
+		i = j
+	}
+	return builder.String()
+}
+
+var (
+	// ErrMalformed is returned when a patch is not a valid unified diff
+	ErrMalformed = errors.New("malformed patch")
+	// ErrConflict is returned when the context of a hunk is not found in
+	// the text being patched
+	ErrConflict = errors.New("patch does not apply")
+)
+
+var hunkHeader = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+type hunk struct {
+	oldStart int
+	oldLines []string
+	newLines []string
+}
+
+func parseCount(value string) int {
+	if value == "" {
+		return 1
+	}
+	count, _ := strconv.Atoi(value)
+	return count
+}
+
+func parseHunks(patch string) ([]hunk, error) {
+	lines := Split(patch)
+	var hunks []hunk
+	for i := 0; i < len(lines); i++ {
+		match := hunkHeader.FindStringSubmatch(lines[i])
+		if match == nil {
+			continue
+		}
+		h := hunk{}
+		h.oldStart, _ = strconv.Atoi(match[1])
+		oldCount, newCount := parseCount(match[2]), parseCount(match[4])
+		for oldCount > 0 || newCount > 0 {
+			i++
+			if i >= len(lines) {
+				return nil, ErrMalformed
+			}
+			line := lines[i]
+			if line == "" {
+				line = " "
+			}
+			switch line[0] {
+			case ' ':
+				h.oldLines = append(h.oldLines, line[1:])
+				h.newLines = append(h.newLines, line[1:])
+				oldCount--
+				newCount--
+			case '-':
+				h.oldLines = append(h.oldLines, line[1:])
+				oldCount--
+			case '+':
+				h.newLines = append(h.newLines, line[1:])
+				newCount--
+			case '\\':
+			default:
+				return nil, ErrMalformed
+			}
+			if oldCount < 0 || newCount < 0 {
+				return nil, ErrMalformed
+			}
+		}
+		if h.oldStart > 0 && len(h.oldLines) > 0 {
+			h.oldStart--
+		}
+		hunks = append(hunks, h)
+	}
+	if len(hunks) == 0 {
+		return nil, ErrMalformed
+	}
+	return hunks, nil
+}
+
+func matches(lines []string, at int, expected []string) bool {
+	if at < 0 || at+len(expected) > len(lines) {
+		return false
+	}
+	for i, line := range expected {
+		if lines[at+i] != line {
+			return false
+		}
+	}
+	return true
+}
+
+// Apply applies a unified diff to a text. Hunks are looked up around
+// their line numbers so a patch still applies when earlier lines moved,
+// but their context must match exactly
+func Apply(text, patch string) (string, error) {
+	hunks, err := parseHunks(patch)
+	if err != nil {
+		return "", err
+	}
+	lines := Split(text)
+	var result []string
+	position, shift := 0, 0
+	for _, h := range hunks {
+		expected := h.oldStart + shift
+		found := -1
+		for offset := 0; found < 0 && offset <= len(lines); offset++ {
+			for _, at := range []int{expected - offset, expected + offset} {
+				if at >= position && matches(lines, at, h.oldLines) {
+					found = at
+					break
+				}
+			}
+		}
+		if found < 0 {
+			return "", ErrConflict
+		}
+		result = append(result, lines[position:found]...)
+		result = append(result, h.newLines...)
+		position = found + len(h.oldLines)
+		shift = found - h.oldStart
+	}
+	result = append(result, lines[position:]...)
+	if len(result) == 0 {
+		return "", nil
+	}
+	return strings.Join(result, "\n") + "\n", nil
+}
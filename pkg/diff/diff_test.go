@@ -0,0 +1,180 @@
+package diff
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// lcs is the length of the longest common subsequence, the shortest edit
+// script has len(a) + len(b) - 2*lcs edits
+func lcs(a, b []string) int {
+	table := make([][]int, len(a)+1)
+	for i := range table {
+		table[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				table[i][j] = table[i+1][j+1] + 1
+			case table[i+1][j] > table[i][j+1]:
+				table[i][j] = table[i+1][j]
+			default:
+				table[i][j] = table[i][j+1]
+			}
+		}
+	}
+	return table[0][0]
+}
+
+// checkScript verifies that a diff turns a into b with the fewest edits
+func checkScript(t *testing.T, a, b []string) {
+	t.Helper()
+	lines := Lines(a, b)
+	var from, to []string
+	for _, line := range lines {
+		if line.Op != Insert {
+			from = append(from, line.Text)
+		}
+		if line.Op != Delete {
+			to = append(to, line.Text)
+		}
+	}
+	if strings.Join(from, "\n") != strings.Join(a, "\n") ||
+		len(from) != len(a) {
+		t.Fatalf("Lines(%q, %q) old side = %q", a, b, from)
+	}
+	if strings.Join(to, "\n") != strings.Join(b, "\n") || len(to) != len(b) {
+		t.Fatalf("Lines(%q, %q) new side = %q", a, b, to)
+	}
+	inserted, deleted := Stats(lines)
+	if want := len(a) + len(b) - 2*lcs(a, b); inserted+deleted != want {
+		t.Fatalf("Lines(%q, %q) has %d edits, want %d", a, b,
+			inserted+deleted, want)
+	}
+}
+
+func TestLines(t *testing.T) {
+	tests := []struct {
+		a, b string
+	}{
+		{"", ""},
+		{"", "a b c"},
+		{"a b c", ""},
+		{"a b c", "a b c"},
+		{"a b c a b b a", "c b a b a c"},
+		{"a", "b"},
+		{"a b", "b a"},
+		{"x a b c", "a b c y"},
+		{"a b c d e f", "a x c d y f"},
+	}
+	for _, test := range tests {
+		checkScript(t, strings.Fields(test.a), strings.Fields(test.b))
+	}
+}
+
+func TestLinesRandom(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	text := func() []string {
+		lines := make([]string, random.Intn(20))
+		for i := range lines {
+			lines[i] = string(rune('a' + random.Intn(4)))
+		}
+		return lines
+	}
+	for i := 0; i < 2000; i++ {
+		checkScript(t, text(), text())
+	}
+}
+
+func TestLinesLarge(t *testing.T) {
+	a := make([]string, 10000)
+	b := make([]string, 10000)
+	for i := range a {
+		a[i] = "a" + string(rune(i))
+		b[i] = "b" + string(rune(i))
+	}
+	inserted, deleted := Stats(Lines(a, b))
+	if inserted != len(b) || deleted != len(a) {
+		t.Fatalf("Stats = %d, %d, want %d, %d", inserted, deleted, len(b),
+			len(a))
+	}
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"", []string{}},
+		{"a", []string{"a"}},
+		{"a\n", []string{"a"}},
+		{"a\r\nb\r\n", []string{"a", "b"}},
+		{"a\n\nb", []string{"a", "", "b"}},
+	}
+	for _, test := range tests {
+		if got := Split(test.in); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Split(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestUnified(t *testing.T) {
+	from := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n"
+	to := "1\n2\n3\n4\nfive\n6\n7\n8\n9\n10\n11\n"
+	want := "--- a\n+++ b\n" +
+		"@@ -2,9 +2,10 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n 9\n 10\n+11\n"
+	if got := Unified("a", "b", from, to); got != want {
+		t.Errorf("Unified = %q, want %q", got, want)
+	}
+	if got := Unified("a", "b", from, from); got != "" {
+		t.Errorf("Unified of equal texts = %q, want empty", got)
+	}
+}
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		from, to string
+	}{
+		{"", "a\nb\n"},
+		{"a\nb\n", ""},
+		{"a\nb\nc\n", "a\nc\n"},
+		{"1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n", "0\n1\n2\n3\n4\n5\n6\n7\n9\n10\n"},
+	}
+	for _, test := range tests {
+		patch := Unified("a", "b", test.from, test.to)
+		got, err := Apply(test.from, patch)
+		if err != nil || got != test.to {
+			t.Errorf("Apply(%q, %q) = %q, %v, want %q", test.from, patch, got,
+				err, test.to)
+		}
+	}
+}
+
+func TestApplyMoved(t *testing.T) {
+	patch := Unified("a", "b", "a\nb\nc\n", "a\nB\nc\n")
+	got, err := Apply("x\ny\na\nb\nc\n", patch)
+	if want := "x\ny\na\nB\nc\n"; err != nil || got != want {
+		t.Errorf("Apply = %q, %v, want %q", got, err, want)
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	tests := []struct {
+		text, patch string
+		want        error
+	}{
+		{"a\n", "not a patch", ErrMalformed},
+		{"a\n", "@@ -1 +1 @@\n", ErrMalformed},
+		{"a\n", "@@ -1 +1 @@\n?a\n", ErrMalformed},
+		{"a\n", "@@ -1 +1 @@\n-b\n+c\n", ErrConflict},
+	}
+	for _, test := range tests {
+		if _, err := Apply(test.text, test.patch); err != test.want {
+			t.Errorf("Apply(%q, %q) error = %v, want %v", test.text,
+				test.patch, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// ErrFormat is returned when the data is not a JPEG, PNG or WebP image or
+// its structure is broken
+var ErrFormat = errors.New("unsupported or malformed image")
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// orientationTag is the TIFF tag holding how the camera was rotated
+const orientationTag = 0x0112
+
+// Strip removes the EXIF, XMP, IPTC and text metadata of a JPEG, PNG or
+// WebP image without decoding the pixels. It returns the stripped image
+// and the EXIF orientation, 1 when there is none, so callers can rotate
+// the pixels before the orientation is lost
+func Strip(data []byte) ([]byte, int, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8}):
+		return stripJPEG(data)
+	case bytes.HasPrefix(data, pngSignature):
+		return stripPNG(data)
+	case len(data) >= 12 && string(data[:4]) == "RIFF" &&
+		string(data[8:12]) == "WEBP":
+		return stripWebP(data)
+	}
+	return nil, 1, ErrFormat
+}
+
+// orientation reads the orientation of an EXIF block, the block may start
+// with the "Exif" header used by JPEG
+func orientation(block []byte) int {
+	block = bytes.TrimPrefix(block, []byte("Exif\x00\x00"))
+	if len(block) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(block[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	offset := int(order.Uint32(block[4:8]))
+	if offset < 8 || offset > len(block)-2 {
+		return 1
+	}
+	count := int(order.Uint16(block[offset:]))
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(block) {
+			return 1
+		}
+		if order.Uint16(block[entry:]) != orientationTag {
+			continue
+		}
+		value := int(order.Uint16(block[entry+8:]))
+		if value < 1 || value > 8 {
+			return 1
+		}
+		return value
+	}
+	return 1
+}
+
+// stripJPEG drops the APP1 (EXIF and XMP), APP13 (IPTC) and comment
+// segments, the ICC profile and Adobe segments are kept since they change
+// how colors are decoded
+func stripJPEG(data []byte) ([]byte, int, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+	rotation := 1
+	i := 2
+	for {
+		if i+2 > len(data) || data[i] != 0xff {
+			return nil, 1, ErrFormat
+		}
+		marker := data[i+1]
+		if marker == 0xff {
+			// Fill byte before a marker
+			i++
+			continue
+		}
+		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd9) {
+			out.Write(data[i : i+2])
+			i += 2
+			if marker == 0xd9 {
+				return out.Bytes(), rotation, nil
+			}
+			continue
+		}
+		if i+4 > len(data) {
+			return nil, 1, ErrFormat
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+		if end > len(data) || end < i+4 {
+			return nil, 1, ErrFormat
+		}
+		switch marker {
+		case 0xda:
+			// The entropy coded data follows the start of scan
+			out.Write(data[i:])
+			return out.Bytes(), rotation, nil
+		case 0xe1:
+			if segment := data[i+4 : end]; bytes.HasPrefix(segment,
+				[]byte("Exif\x00\x00")) && rotation == 1 {
+				rotation = orientation(segment)
+			}
+		case 0xed, 0xfe:
+		default:
+			out.Write(data[i:end])
+		}
+		i = end
+	}
+}
+
+// pngMetadata are the chunks removed from PNG images
+var pngMetadata = map[string]bool{
+	"eXIf": true, "tEXt": true, "zTXt": true, "iTXt": true, "tIME": true,
+}
+
+func stripPNG(data []byte) ([]byte, int, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(pngSignature)
+	rotation := 1
+	i := len(pngSignature)
+	for i < len(data) {
+		if i+12 > len(data) {
+			return nil, 1, ErrFormat
+		}
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		if length < 0 || length > len(data)-i-12 {
+			return nil, 1, ErrFormat
+		}
+		end := i + 12 + length
+		chunkType := string(data[i+4 : i+8])
+		if chunkType == "eXIf" {
+			rotation = orientation(data[i+8 : i+8+length])
+		}
+		if !pngMetadata[chunkType] {
+			out.Write(data[i:end])
+		}
+		i = end
+		if chunkType == "IEND" {
+			break
+		}
+	}
+	return out.Bytes(), rotation, nil
+}
+
+// VP8X flags announcing metadata chunks
+const (
+	webpXMPFlag  = 1 << 2
+	webpEXIFFlag = 1 << 3
+)
+
+func stripWebP(data []byte) ([]byte, int, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:12])
+	rotation := 1
+	i := 12
+	for i < len(data) {
+		if i+8 > len(data) {
+			return nil, 1, ErrFormat
+		}
+		length := int(binary.LittleEndian.Uint32(data[i+4:]))
+		if length < 0 || length > len(data)-i-8 {
+			return nil, 1, ErrFormat
+		}
+		end := i + 8 + length + length%2
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := data[i:end]
+		switch string(data[i : i+4]) {
+		case "EXIF":
+			rotation = orientation(data[i+8 : i+8+length])
+		case "XMP ":
+		case "VP8X":
+			if length < 1 {
+				return nil, 1, ErrFormat
+			}
+			chunk = append([]byte(nil), chunk...)
+			chunk[8] &^= webpXMPFlag | webpEXIFFlag
+			out.Write(chunk)
+		default:
+			out.Write(chunk)
+		}
+		i = end
+	}
+	stripped := out.Bytes()
+	binary.LittleEndian.PutUint32(stripped[4:], uint32(len(stripped)-8))
+	return stripped, rotation, nil
+}
@@ -0,0 +1,224 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// tiff builds an EXIF block with a single orientation entry
+func tiff(order binary.ByteOrder, value uint16) []byte {
+	block := make([]byte, 26)
+	if order == binary.LittleEndian {
+		copy(block, "II")
+	} else {
+		copy(block, "MM")
+	}
+	order.PutUint16(block[2:], 42)
+	order.PutUint32(block[4:], 8)
+	order.PutUint16(block[8:], 1)
+	order.PutUint16(block[10:], orientationTag)
+	order.PutUint16(block[12:], 3)
+	order.PutUint32(block[14:], 1)
+	order.PutUint16(block[18:], value)
+	return block
+}
+
+// segment builds a JPEG marker segment
+func segment(marker byte, payload []byte) []byte {
+	out := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(out[2:], uint16(len(payload)+2))
+	return append(out, payload...)
+}
+
+// chunk builds a PNG chunk, the CRC is not checked by Strip
+func chunk(chunkType string, payload []byte) []byte {
+	out := make([]byte, 8, 12+len(payload))
+	binary.BigEndian.PutUint32(out, uint32(len(payload)))
+	copy(out[4:], chunkType)
+	return append(append(out, payload...), 0, 0, 0, 0)
+}
+
+// riff builds a WebP chunk
+func riff(chunkType string, payload []byte) []byte {
+	out := make([]byte, 8, 9+len(payload))
+	copy(out, chunkType)
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(payload)))
+	out = append(out, payload...)
+	if len(payload)%2 == 1 {
+		out = append(out, 0)
+	}
+	return out
+}
+
+func webp(chunks ...[]byte) []byte {
+	data := []byte("RIFF\x00\x00\x00\x00WEBP")
+	for _, c := range chunks {
+		data = append(data, c...)
+	}
+	binary.LittleEndian.PutUint32(data[4:], uint32(len(data)-8))
+	return data
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestOrientation(t *testing.T) {
+	tests := []struct {
+		block []byte
+		want  int
+	}{
+		{tiff(binary.LittleEndian, 6), 6},
+		{tiff(binary.BigEndian, 8), 8},
+		{append([]byte("Exif\x00\x00"), tiff(binary.BigEndian, 3)...), 3},
+		{tiff(binary.LittleEndian, 0), 1},
+		{tiff(binary.LittleEndian, 9), 1},
+		{[]byte("XX\x00\x2a\x08\x00\x00\x00"), 1},
+		{[]byte("II"), 1},
+		{tiff(binary.LittleEndian, 6)[:20], 1},
+		{[]byte("II\x2a\x00\xff\xff\xff\xff"), 1},
+	}
+	for _, test := range tests {
+		if got := orientation(test.block); got != test.want {
+			t.Errorf("orientation(%x) = %d, want %d", test.block, got,
+				test.want)
+		}
+	}
+}
+
+func TestStrip(t *testing.T) {
+	exif := append([]byte("Exif\x00\x00"), tiff(binary.BigEndian, 6)...)
+	icc := segment(0xe2, []byte("ICC_PROFILE\x00data"))
+	scan := concat(segment(0xda, []byte{1, 2, 3}), []byte{9, 9, 0xff, 0xd9})
+	ihdr := chunk("IHDR", make([]byte, 13))
+	vp8 := riff("VP8 ", []byte{1, 2, 3})
+	tests := []struct {
+		name     string
+		in       []byte
+		want     []byte
+		rotation int
+	}{
+		{
+			"jpeg",
+			concat([]byte{0xff, 0xd8}, segment(0xe1, exif), icc,
+				segment(0xe1, []byte("http://ns.adobe.com/xap/1.0/\x00<x/>")),
+				segment(0xed, []byte("Photoshop 3.0\x00")),
+				segment(0xfe, []byte("comment")), scan),
+			concat([]byte{0xff, 0xd8}, icc, scan),
+			6,
+		},
+		{
+			"jpeg without metadata",
+			concat([]byte{0xff, 0xd8}, icc, scan),
+			concat([]byte{0xff, 0xd8}, icc, scan),
+			1,
+		},
+		{
+			"png",
+			concat(pngSignature, ihdr, chunk("eXIf", tiff(binary.LittleEndian, 3)),
+				chunk("tEXt", []byte("a\x00b")), chunk("IDAT", []byte{1}),
+				chunk("IEND", nil)),
+			concat(pngSignature, ihdr, chunk("IDAT", []byte{1}),
+				chunk("IEND", nil)),
+			3,
+		},
+		{
+			"webp",
+			webp(riff("VP8X", []byte{webpXMPFlag | webpEXIFFlag | 0x10, 0,
+				0, 0, 0, 0, 0, 0, 0, 0}), vp8,
+				riff("EXIF", tiff(binary.LittleEndian, 8)),
+				riff("XMP ", []byte("<x/>"))),
+			webp(riff("VP8X", []byte{0x10, 0, 0, 0, 0, 0, 0, 0, 0, 0}), vp8),
+			8,
+		},
+	}
+	for _, test := range tests {
+		got, rotation, err := Strip(test.in)
+		if err != nil {
+			t.Errorf("%s: Strip error = %v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(got, test.want) || rotation != test.rotation {
+			t.Errorf("%s: Strip = %x, %d, want %x, %d", test.name, got,
+				rotation, test.want, test.rotation)
+		}
+	}
+}
+
+func TestStripInvalid(t *testing.T) {
+	tests := [][]byte{
+		nil,
+		[]byte("GIF89a"),
+		{0xff, 0xd8},
+		{0xff, 0xd8, 0x00},
+		{0xff, 0xd8, 0xff, 0xe1, 0x00},
+		{0xff, 0xd8, 0xff, 0xe1, 0x00, 0x01},
+		{0xff, 0xd8, 0xff, 0xe1, 0xff, 0xff, 0x00},
+		concat(pngSignature, []byte{0, 0, 0}),
+		concat(pngSignature, []byte{0xff, 0xff, 0xff, 0xff}, []byte("IDAT"),
+			make([]byte, 8)),
+		webp([]byte("VP8 \xff\xff\xff\xff")),
+		webp(riff("VP8X", nil)),
+		webp([]byte("VP8")),
+	}
+	for _, in := range tests {
+		if got, _, err := Strip(in); err != ErrFormat {
+			t.Errorf("Strip(%x) = %x, %v, want ErrFormat", in, got, err)
+		}
+	}
+}
+
+// TestStripTruncated checks that no prefix of a valid image panics
+func TestStripTruncated(t *testing.T) {
+	exif := append([]byte("Exif\x00\x00"), tiff(binary.BigEndian, 6)...)
+	images := [][]byte{
+		concat([]byte{0xff, 0xd8}, segment(0xe1, exif),
+			segment(0xda, []byte{1, 2, 3}), []byte{0xff, 0xd9}),
+		concat(pngSignature, chunk("IHDR", make([]byte, 13)),
+			chunk("eXIf", tiff(binary.LittleEndian, 3)), chunk("IEND", nil)),
+		webp(riff("VP8X", make([]byte, 10)), riff("EXIF",
+			tiff(binary.LittleEndian, 8))),
+	}
+	for _, data := range images {
+		for i := range data {
+			Strip(data[:i])
+		}
+	}
+}
+
+// TestStripDecodes checks that stripped images still decode
+func TestStripDecodes(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 3))
+	img.Set(1, 1, color.RGBA{255, 0, 0, 255})
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, img); err != nil {
+		t.Fatal(err)
+	}
+	data := encoded.Bytes()
+	// The text chunk goes right after the header chunk
+	end := len(pngSignature) + 25
+	withText := concat(data[:end], chunk("tEXt", []byte("k\x00v")),
+		data[end:])
+	var jpegData bytes.Buffer
+	if err := jpeg.Encode(&jpegData, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, in := range [][]byte{withText, jpegData.Bytes()} {
+		stripped, _, err := Strip(in)
+		if err != nil {
+			t.Fatalf("Strip error = %v", err)
+		}
+		config, _, err := image.DecodeConfig(bytes.NewReader(stripped))
+		if err != nil || config.Width != 4 || config.Height != 3 {
+			t.Errorf("DecodeConfig = %v, %v, want 4x3", config, err)
+		}
+		if _, _, err = image.Decode(bytes.NewReader(stripped)); err != nil {
+			t.Errorf("Decode error = %v", err)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+// Package frontmatter reads the YAML block at the top of markdown files.
+// The block starts with a line with three dashes and ends with another one
+// or with three dots:
+//
+//	---
+//	title: Las fracciones
+//	summary: Suma y resta de fracciones
+//	tags: [matemática, fracciones]
+//	author: Ana López
+//	publishDate: 2020-03-01
+//	duration: 45
+//	---
+//
+// The duration is in minutes, "45 min" and "1h30m" are accepted too. Any
+// other key is kept in Extra, date too: editors write it as the date of
+// the writing, not of the publication
+package frontmatter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FrontMatter is the metadata of a markdown file
+type FrontMatter struct {
+	Title       string
+	Summary     string
+	Author      string
+	Tags        []string
+	PublishDate *time.Time
+	// Duration is the estimated duration in minutes
+	Duration int
+	Extra    map[string]interface{}
+}
+
+var bom = []byte("\xef\xbb\xbf")
+
+var dateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// Split returns the yaml of the front matter of markdown and the rest of
+// the content, ok is false when the content does not start with one
+func Split(content []byte) (front, body []byte, ok bool) {
+	rest := bytes.TrimPrefix(content, bom)
+	first := rest
+	if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+		first, rest = rest[:i], rest[i+1:]
+	} else {
+		return nil, content, false
+	}
+	if string(bytes.TrimRight(first, " \t\r")) != "---" {
+		return nil, content, false
+	}
+	start := rest
+	for len(rest) > 0 {
+		line := rest
+		next := []byte{}
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			line, next = rest[:i], rest[i+1:]
+		}
+		trimmed := string(bytes.TrimRight(line, " \t\r"))
+		if trimmed == "---" || trimmed == "..." {
+			return start[:len(start)-len(rest)], next, true
+		}
+		rest = next
+	}
+	return nil, content, false
+}
+
+// Strip removes the front matter of markdown
+func Strip(content []byte) []byte {
+	_, body, _ := Split(content)
+	return body
+}
+
+// Parse reads the front matter of markdown, it is nil when there is none.
+// The body is the content without it
+func Parse(content []byte) (*FrontMatter, []byte, error) {
+	front, body, ok := Split(content)
+	if !ok {
+		return nil, content, nil
+	}
+	values := yaml.MapSlice{}
+	if err := yaml.Unmarshal(front, &values); err != nil {
+		return nil, content, err
+	}
+	fm := &FrontMatter{Extra: make(map[string]interface{})}
+	for _, item := range values {
+		key, ok := item.Key.(string)
+		if !ok {
+			return nil, content, errors.New("Keys must be strings")
+		}
+		if err := fm.set(key, item.Value); err != nil {
+			return nil, content, fmt.Errorf("Invalid %s: %v", key, err)
+		}
+	}
+	return fm, body, nil
+}
+
+// set stores a value of the front matter, known keys are matched ignoring
+// case, dashes and underscores
+func (fm *FrontMatter) set(key string, value interface{}) error {
+	normalized := strings.ToLower(strings.NewReplacer("_", "", "-", "").
+		Replace(key))
+	var err error
+	switch normalized {
+	case "title":
+		fm.Title, err = text(value)
+	case "summary", "description":
+		fm.Summary, err = text(value)
+	case "author":
+		fm.Author, err = text(value)
+	case "tags":
+		fm.Tags, err = list(value)
+	case "publishdate":
+		fm.PublishDate, err = date(value)
+	case "duration", "estimatedduration":
+		fm.Duration, err = minutes(value)
+	default:
+		fm.Extra[key], err = jsonValue(value)
+	}
+	return err
+}
+
+func text(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return strings.TrimSpace(v), nil
+	case int, float64, bool:
+		return fmt.Sprint(v), nil
+	}
+	return "", errors.New("not a text")
+}
+
+// list accepts a yaml list or a comma separated text
+func list(value interface{}) ([]string, error) {
+	var items []string
+	switch v := value.(type) {
+	case nil:
+		return []string{}, nil
+	case string:
+		items = strings.Split(v, ",")
+	case []interface{}:
+		for _, item := range v {
+			s, err := text(item)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, s)
+		}
+	default:
+		return nil, errors.New("not a list")
+	}
+	result := []string{}
+	for _, item := range items {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result, nil
+}
+
+func date(value interface{}) (*time.Time, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case time.Time:
+		return &v, nil
+	case string:
+		for _, layout := range dateLayouts {
+			if t, err := time.Parse(layout, strings.TrimSpace(v)); err == nil {
+				return &t, nil
+			}
+		}
+	}
+	return nil, errors.New("not a date")
+}
+
+func minutes(value interface{}) (int, error) {
+	switch v := value.(type) {
+	case nil:
+		return 0, nil
+	case int:
+		if v >= 0 {
+			return v, nil
+		}
+	case string:
+		s := strings.TrimSpace(strings.ToLower(v))
+		for _, unit := range []string{"minutes", "minutos", "min"} {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit))
+		}
+		if n, err := strconv.Atoi(s); err == nil && n >= 0 {
+			return n, nil
+		}
+		if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+			return int(d.Minutes()), nil
+		}
+	}
+	return 0, errors.New("not a duration")
+}
+
+// jsonValue converts the maps decoded by yaml, which can have keys of any
+// type, to maps that can be written as json. Json has no numbers for
+// .nan and .inf, they are rejected
+func jsonValue(value interface{}) (interface{}, error) {
+	var err error
+	switch v := value.(type) {
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, errors.New("not a finite number")
+		}
+	case yaml.MapSlice:
+		result := make(map[string]interface{}, len(v))
+		for _, item := range v {
+			key := fmt.Sprint(item.Key)
+			if result[key], err = jsonValue(item.Value); err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			if result[fmt.Sprint(key)], err = jsonValue(item); err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			if result[i], err = jsonValue(item); err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	}
+	return value, nil
+}
@@ -0,0 +1,164 @@
+package frontmatter
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		in          string
+		front, body string
+		ok          bool
+	}{
+		{"---\ntitle: a\n---\nbody\n", "title: a\n", "body\n", true},
+		{"---\ntitle: a\n...\nbody", "title: a\n", "body", true},
+		{"\ufeff---\r\ntitle: a\r\n---\r\nbody", "title: a\r\n", "body", true},
+		{"--- \ntitle: a\n---  \n", "title: a\n", "", true},
+		{"---\n---\nbody", "", "body", true},
+		{"---\ntitle: a\n---", "title: a\n", "", true},
+		{"# title\n---\na: b\n---\n", "", "# title\n---\na: b\n---\n", false},
+		{"---\ntitle: a\n", "", "---\ntitle: a\n", false},
+		{"---", "", "---", false},
+		{"----\na: b\n----\n", "", "----\na: b\n----\n", false},
+		{"", "", "", false},
+	}
+	for _, test := range tests {
+		front, body, ok := Split([]byte(test.in))
+		if string(front) != test.front || string(body) != test.body ||
+			ok != test.ok {
+			t.Errorf("Split(%q) = %q, %q, %v, want %q, %q, %v", test.in,
+				front, body, ok, test.front, test.body, test.ok)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	date := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		in   string
+		want *FrontMatter
+	}{
+		{"# sin metadatos\n", nil},
+		{
+			"---\ntitle: Las fracciones\nsummary: Suma\n" +
+				"tags: [matemática, fracciones]\nauthor: Ana López\n" +
+				"publishDate: 2020-03-01\nduration: 45\n---\n# Hola\n",
+			&FrontMatter{
+				Title:       "Las fracciones",
+				Summary:     "Suma",
+				Author:      "Ana López",
+				Tags:        []string{"matemática", "fracciones"},
+				PublishDate: &date,
+				Duration:    45,
+				Extra:       map[string]interface{}{},
+			},
+		},
+		{
+			"---\nTitle: 2020\ndescription: x\ntags: a, , b\n" +
+				"publish_date: \"2020-03-01\"\nestimated-duration: 1h30m\n---\n",
+			&FrontMatter{
+				Title:       "2020",
+				Summary:     "x",
+				Tags:        []string{"a", "b"},
+				PublishDate: &date,
+				Duration:    90,
+				Extra:       map[string]interface{}{},
+			},
+		},
+		{
+			"---\nduration: 20 minutos\ntags:\nlevel: 3\n" +
+				"date: 2020-03-01\nrubric: {1: a, b: [1, 2.5]}\n---\n",
+			&FrontMatter{
+				Tags:     []string{},
+				Duration: 20,
+				Extra: map[string]interface{}{
+					"level": 3,
+					"date":  "2020-03-01",
+					"rubric": map[string]interface{}{
+						"1": "a",
+						"b": []interface{}{1, 2.5},
+					},
+				},
+			},
+		},
+	}
+	for _, test := range tests {
+		fm, _, err := Parse([]byte(test.in))
+		if err != nil {
+			t.Errorf("Parse(%q) error = %v", test.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(fm, test.want) {
+			t.Errorf("Parse(%q) = %+v, want %+v", test.in, fm, test.want)
+		}
+	}
+}
+
+func TestParseBody(t *testing.T) {
+	in := "---\ntitle: a\n---\n# Hola\n"
+	if _, body, _ := Parse([]byte(in)); string(body) != "# Hola\n" {
+		t.Errorf("Parse(%q) body = %q, want %q", in, body, "# Hola\n")
+	}
+	in = "---\n: [\n---\n# Hola\n"
+	if _, body, _ := Parse([]byte(in)); string(body) != in {
+		t.Errorf("Parse(%q) body = %q, want the content", in, body)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := []string{
+		"---\ntitle: [a\n---\n",
+		"---\n- a\n- b\n---\n",
+		"---\n1: a\n---\n",
+		"---\ntitle: [a, b]\n---\n",
+		"---\ntags: {a: b}\n---\n",
+		"---\ntags: [[a]]\n---\n",
+		"---\npublishDate: mañana\n---\n",
+		"---\nduration: -5\n---\n",
+		"---\nduration: 1.5\n---\n",
+		"---\nduration: pronto\n---\n",
+		"---\nscore: .nan\n---\n",
+		"---\nscore: -.inf\n---\n",
+		"---\nrubric: {a: [1, .inf]}\n---\n",
+	}
+	for _, in := range tests {
+		if fm, _, err := Parse([]byte(in)); err == nil {
+			t.Errorf("Parse(%q) = %+v, want an error", in, fm)
+		}
+	}
+}
+
+// TestExtraJSON checks that every accepted extra value can be written as
+// json
+func TestExtraJSON(t *testing.T) {
+	in := "---\na: 1\nb: [x, {c: true}]\nd: {1: {2: 3.5}}\ne: null\n" +
+		"f: 2020-03-01\n---\n"
+	fm, _, err := Parse([]byte(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(fm.Extra)
+	want := `{"a":1,"b":["x",{"c":true}],"d":{"1":{"2":3.5}},"e":null,` +
+		`"f":"2020-03-01"}`
+	if err != nil || string(data) != want {
+		t.Errorf("Marshal(Extra) = %s, %v, want %s", data, err, want)
+	}
+}
+
+func TestStrip(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"---\na: b\n---\nbody", "body"},
+		{"body", "body"},
+		{"---\na: b\n", "---\na: b\n"},
+	}
+	for _, test := range tests {
+		if got := Strip([]byte(test.in)); string(got) != test.want {
+			t.Errorf("Strip(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
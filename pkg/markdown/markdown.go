@@ -0,0 +1,189 @@
+package markdown
+
+import (
+	"bytes"
+	"github.com/chromz/wiki-backend/pkg/sanitize"
+	"github.com/chromz/wiki-backend/pkg/slug"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/text"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Version identifies the output of the renderer, it must change whenever
+// the rendered html changes so cached copies are discarded
+const Version = "2"
+
+var codeSpanRegex = regexp.MustCompile("`[^`\n]*`")
+
+// converter enables the github flavored extensions, table alignments are
+// rendered as attributes because the sanitizer removes inline styles
+var converter = goldmark.New(
+	goldmark.WithExtensions(
+		extension.NewTable(
+			extension.WithTableCellAlignMethod(
+				extension.TableCellAlignAttribute),
+		),
+		extension.Strikethrough,
+		extension.Linkify,
+		extension.TaskList,
+		extension.Footnote,
+	),
+	goldmark.WithParserOptions(parser.WithAutoHeadingID()),
+	goldmark.WithRendererOptions(html.WithUnsafe()),
+)
+
+// headingIDs generates accent-folded anchors for headings, repeated
+// titles get a numeric suffix
+type headingIDs struct {
+	used map[string]bool
+}
+
+func (ids *headingIDs) Generate(value []byte, kind ast.NodeKind) []byte {
+	base := slug.Make(string(value))
+	if base == "" {
+		base = "section"
+	}
+	id := base
+	for i := 1; ids.used[id]; i++ {
+		id = base + "-" + strconv.Itoa(i)
+	}
+	ids.used[id] = true
+	return []byte(id)
+}
+
+func (ids *headingIDs) Put(value []byte) {
+	ids.used[string(value)] = true
+}
+
+// Render converts github flavored markdown with footnotes into html,
+// the output is sanitized so raw html in the source is safe to serve
+func Render(source []byte) ([]byte, error) {
+	var rendered bytes.Buffer
+	context := parser.NewContext(parser.WithIDs(&headingIDs{
+		used: make(map[string]bool),
+	}))
+	err := converter.Convert(source, &rendered, parser.WithContext(context))
+	if err != nil {
+		return nil, err
+	}
+	return sanitize.Markdown.Sanitize(&rendered)
+}
+
+// MaskCode blanks fenced code blocks and code spans so the syntax inside
+// code is left alone by text rewrites, offsets are kept
+func MaskCode(markdown string) string {
+	lines := strings.SplitAfter(markdown, "\n")
+	fence := ""
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if fence == "" && (strings.HasPrefix(trimmed, "```") ||
+			strings.HasPrefix(trimmed, "~~~")) {
+			fence = trimmed[:3]
+			lines[i] = strings.Repeat(" ", len(line))
+			continue
+		}
+		if fence != "" {
+			if strings.HasPrefix(trimmed, fence) {
+				fence = ""
+			}
+			lines[i] = strings.Repeat(" ", len(line))
+			continue
+		}
+		lines[i] = codeSpanRegex.ReplaceAllStringFunc(line,
+			func(span string) string {
+				return strings.Repeat(" ", len(span))
+			})
+	}
+	return strings.Join(lines, "")
+}
+
+// PlainText returns the text of markdown without its syntax, blocks are
+// separated by new lines. Raw html is left out
+func PlainText(source []byte) string {
+	document := converter.Parser().Parse(text.NewReader(source))
+	var builder strings.Builder
+	ast.Walk(document, func(n ast.Node, entering bool) (ast.WalkStatus,
+		error) {
+		if n.Type() == ast.TypeBlock && !entering {
+			builder.WriteString("\n")
+			return ast.WalkContinue, nil
+		}
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch node := n.(type) {
+		case *ast.Text:
+			builder.Write(node.Segment.Value(source))
+			if node.SoftLineBreak() || node.HardLineBreak() {
+				builder.WriteString(" ")
+			}
+		case *ast.String:
+			builder.Write(node.Value)
+		case *ast.AutoLink:
+			builder.Write(node.Label(source))
+		case *ast.CodeBlock, *ast.FencedCodeBlock:
+			lines := n.Lines()
+			for i := 0; i < lines.Len(); i++ {
+				segment := lines.At(i)
+				builder.Write(segment.Value(source))
+			}
+		case *ast.HTMLBlock, *ast.RawHTML:
+			return ast.WalkSkipChildren, nil
+		}
+		return ast.WalkContinue, nil
+	})
+	return builder.String()
+}
+
+// Heading is an entry of the outline of a document, the headings that
+// follow it with a deeper level are its children
+type Heading struct {
+	Level    int        `json:"level"`
+	ID       string     `json:"id"`
+	Text     string     `json:"text"`
+	Children []*Heading `json:"children"`
+}
+
+// Outline returns the nested headings of markdown, the ids are the anchors
+// Render gives them. Headings that skip levels are nested in the closest
+// shallower one
+func Outline(source []byte) []*Heading {
+	context := parser.NewContext(parser.WithIDs(&headingIDs{
+		used: make(map[string]bool),
+	}))
+	document := converter.Parser().Parse(text.NewReader(source),
+		parser.WithContext(context))
+	outline := []*Heading{}
+	var open []*Heading
+	for n := document.FirstChild(); n != nil; n = n.NextSibling() {
+		node, ok := n.(*ast.Heading)
+		if !ok {
+			continue
+		}
+		h := &Heading{
+			Level:    node.Level,
+			Text:     strings.TrimSpace(string(node.Text(source))),
+			Children: []*Heading{},
+		}
+		if id, ok := node.AttributeString("id"); ok {
+			h.ID = string(id.([]byte))
+		}
+		for len(open) > 0 && open[len(open)-1].Level >= h.Level {
+			open = open[:len(open)-1]
+		}
+		if len(open) == 0 {
+			outline = append(outline, h)
+		} else {
+			parent := open[len(open)-1]
+			parent.Children = append(parent.Children, h)
+		}
+		open = append(open, h)
+	}
+	return outline
+}
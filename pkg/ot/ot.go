@@ -0,0 +1,269 @@
+package ot
+
+import (
+	"encoding/json"
+	"errors"
+	"unicode/utf8"
+)
+
+// ErrInvalid is returned when an operation does not fit the document or
+// is malformed
+var ErrInvalid = errors.New("invalid operation")
+
+// MaxLength is the largest retain or delete accepted when decoding, it is
+// far above the size of any class
+const MaxLength = 1 << 30
+
+// Component is a single step of an operation, exactly one of its fields
+// is set. Lengths and positions count unicode code points
+type Component struct {
+	Retain int
+	Insert string
+	Delete int
+}
+
+// Operation is a list of components that walks the whole document. It is
+// encoded in JSON as in ot.js, retains are positive numbers, inserts are
+// strings and deletes are negative numbers
+type Operation []Component
+
+// MarshalJSON encodes an operation as a mixed JSON array
+func (o Operation) MarshalJSON() ([]byte, error) {
+	values := make([]interface{}, len(o))
+	for i, c := range o {
+		switch {
+		case c.Retain > 0:
+			values[i] = c.Retain
+		case c.Delete > 0:
+			values[i] = -c.Delete
+		default:
+			values[i] = c.Insert
+		}
+	}
+	return json.Marshal(values)
+}
+
+// UnmarshalJSON decodes a mixed JSON array into a normalized operation
+func (o *Operation) UnmarshalJSON(data []byte) error {
+	var values []interface{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	var op Operation
+	for _, value := range values {
+		switch v := value.(type) {
+		case float64:
+			if v > MaxLength || v < -MaxLength {
+				return ErrInvalid
+			}
+			n := int(v)
+			if float64(n) != v || n == 0 {
+				return ErrInvalid
+			}
+			if n > 0 {
+				op = op.Retain(n)
+			} else {
+				op = op.Delete(-n)
+			}
+		case string:
+			if v == "" {
+				return ErrInvalid
+			}
+			op = op.Insert(v)
+		default:
+			return ErrInvalid
+		}
+	}
+	*o = op
+	return nil
+}
+
+// Retain appends a retain, merging it with a previous retain
+func (o Operation) Retain(n int) Operation {
+	if n <= 0 {
+		return o
+	}
+	if last := len(o) - 1; last >= 0 && o[last].Retain > 0 {
+		o[last].Retain += n
+		return o
+	}
+	return append(o, Component{Retain: n})
+}
+
+// Insert appends an insert, inserts are kept before deletes so equal
+// operations have a single representation
+func (o Operation) Insert(s string) Operation {
+	if s == "" {
+		return o
+	}
+	last := len(o) - 1
+	if last >= 0 && o[last].Insert != "" {
+		o[last].Insert += s
+		return o
+	}
+	if last >= 0 && o[last].Delete > 0 {
+		if last > 0 && o[last-1].Insert != "" {
+			o[last-1].Insert += s
+			return o
+		}
+		o = append(o, o[last])
+		o[last] = Component{Insert: s}
+		return o
+	}
+	return append(o, Component{Insert: s})
+}
+
+// Delete appends a delete, merging it with a previous delete
+func (o Operation) Delete(n int) Operation {
+	if n <= 0 {
+		return o
+	}
+	if last := len(o) - 1; last >= 0 && o[last].Delete > 0 {
+		o[last].Delete += n
+		return o
+	}
+	return append(o, Component{Delete: n})
+}
+
+// BaseLen is the length of the documents the operation applies to
+func (o Operation) BaseLen() int {
+	n := 0
+	for _, c := range o {
+		n += c.Retain + c.Delete
+	}
+	return n
+}
+
+// Apply applies the operation to a document, every retain and delete is
+// checked against the rest of the document before it is used
+func (o Operation) Apply(doc []rune) ([]rune, error) {
+	result := make([]rune, 0, len(doc))
+	position := 0
+	for _, c := range o {
+		switch {
+		case c.Retain > 0:
+			if c.Retain > len(doc)-position {
+				return nil, ErrInvalid
+			}
+			result = append(result, doc[position:position+c.Retain]...)
+			position += c.Retain
+		case c.Delete > 0:
+			if c.Delete > len(doc)-position {
+				return nil, ErrInvalid
+			}
+			position += c.Delete
+		case c.Retain < 0 || c.Delete < 0:
+			return nil, ErrInvalid
+		default:
+			result = append(result, []rune(c.Insert)...)
+		}
+	}
+	if position != len(doc) {
+		return nil, ErrInvalid
+	}
+	return result, nil
+}
+
+// Transform takes two operations a and b that apply to the same document
+// and returns a' and b' such that applying a then b' equals applying b
+// then a'. Inserts of a at the same position as inserts of b go first
+func Transform(a, b Operation) (Operation, Operation, error) {
+	if a.BaseLen() != b.BaseLen() {
+		return nil, nil, ErrInvalid
+	}
+	var aPrime, bPrime Operation
+	i, j := 0, 0
+	var ca, cb *Component
+	next := func(op Operation, index *int) *Component {
+		if *index >= len(op) {
+			return nil
+		}
+		c := op[*index]
+		*index++
+		return &c
+	}
+	ca, cb = next(a, &i), next(b, &j)
+	for ca != nil || cb != nil {
+		if ca != nil && ca.Insert != "" {
+			aPrime = aPrime.Insert(ca.Insert)
+			bPrime = bPrime.Retain(utf8.RuneCountInString(ca.Insert))
+			ca = next(a, &i)
+			continue
+		}
+		if cb != nil && cb.Insert != "" {
+			aPrime = aPrime.Retain(utf8.RuneCountInString(cb.Insert))
+			bPrime = bPrime.Insert(cb.Insert)
+			cb = next(b, &j)
+			continue
+		}
+		if ca == nil || cb == nil {
+			return nil, nil, ErrInvalid
+		}
+		lenA, lenB := ca.Retain+ca.Delete, cb.Retain+cb.Delete
+		n := lenA
+		if lenB < n {
+			n = lenB
+		}
+		switch {
+		case ca.Retain > 0 && cb.Retain > 0:
+			aPrime = aPrime.Retain(n)
+			bPrime = bPrime.Retain(n)
+		case ca.Delete > 0 && cb.Retain > 0:
+			aPrime = aPrime.Delete(n)
+		case ca.Retain > 0 && cb.Delete > 0:
+			bPrime = bPrime.Delete(n)
+		}
+		// Both deleting the same text leaves nothing to transform
+		ca = shorten(ca, n)
+		cb = shorten(cb, n)
+		if ca == nil {
+			ca = next(a, &i)
+		}
+		if cb == nil {
+			cb = next(b, &j)
+		}
+	}
+	return aPrime, bPrime, nil
+}
+
+// shorten consumes n code points of a retain or delete, it returns nil
+// when the component is used up
+func shorten(c *Component, n int) *Component {
+	if c.Retain > 0 {
+		c.Retain -= n
+		if c.Retain == 0 {
+			return nil
+		}
+		return c
+	}
+	c.Delete -= n
+	if c.Delete == 0 {
+		return nil
+	}
+	return c
+}
+
+// TransformIndex moves a position of the document, like a cursor, to
+// where it is after applying the operation
+func (o Operation) TransformIndex(index int) int {
+	newIndex := index
+	for _, c := range o {
+		switch {
+		case c.Retain > 0:
+			index -= c.Retain
+		case c.Delete > 0:
+			if index < c.Delete {
+				newIndex -= index
+			} else {
+				newIndex -= c.Delete
+			}
+			index -= c.Delete
+		default:
+			newIndex += utf8.RuneCountInString(c.Insert)
+		}
+		if index < 0 {
+			break
+		}
+	}
+	return newIndex
+}
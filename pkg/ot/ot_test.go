@@ -0,0 +1,208 @@
+package ot
+
+import (
+	"encoding/json"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Operation
+	}{
+		{`[]`, nil},
+		{`[3]`, Operation{{Retain: 3}}},
+		{`[1, 2, "a", "b", -1, -2]`,
+			Operation{{Retain: 3}, {Insert: "ab"}, {Delete: 3}}},
+		{`[-2, "x"]`, Operation{{Insert: "x"}, {Delete: 2}}},
+		{`["ñ", 1]`, Operation{{Insert: "ñ"}, {Retain: 1}}},
+	}
+	for _, test := range tests {
+		var op Operation
+		if err := json.Unmarshal([]byte(test.in), &op); err != nil {
+			t.Errorf("Unmarshal(%s) error = %v", test.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(op, test.want) {
+			t.Errorf("Unmarshal(%s) = %v, want %v", test.in, op, test.want)
+		}
+	}
+}
+
+func TestUnmarshalJSONInvalid(t *testing.T) {
+	tests := []string{
+		`{}`,
+		`[0]`,
+		`[1.5]`,
+		`[""]`,
+		`[true]`,
+		`[null]`,
+		`[[1]]`,
+		`[1e300]`,
+		`[-1e300]`,
+		`[1073741825]`,
+		`[-1073741825]`,
+	}
+	for _, in := range tests {
+		var op Operation
+		if err := json.Unmarshal([]byte(in), &op); err == nil {
+			t.Errorf("Unmarshal(%s) = %v, want an error", in, op)
+		}
+	}
+}
+
+func TestMarshalJSON(t *testing.T) {
+	op := Operation{{Retain: 2}, {Insert: "hola"}, {Delete: 3}}
+	data, err := json.Marshal(op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `[2,"hola",-3]`; string(data) != want {
+		t.Errorf("Marshal = %s, want %s", data, want)
+	}
+}
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		doc  string
+		op   string
+		want string
+	}{
+		{"", `["hola"]`, "hola"},
+		{"hola", `[4, " mundo"]`, "hola mundo"},
+		{"hola mundo", `[-5, 5]`, "mundo"},
+		{"año", `[1, -1, "n", 1]`, "ano"},
+	}
+	for _, test := range tests {
+		var op Operation
+		if err := json.Unmarshal([]byte(test.op), &op); err != nil {
+			t.Fatal(err)
+		}
+		got, err := op.Apply([]rune(test.doc))
+		if err != nil || string(got) != test.want {
+			t.Errorf("Apply(%q, %s) = %q, %v, want %q", test.doc, test.op,
+				string(got), err, test.want)
+		}
+	}
+}
+
+func TestApplyInvalid(t *testing.T) {
+	tests := []struct {
+		doc string
+		op  Operation
+	}{
+		{"abc", Operation{{Retain: 2}}},
+		{"abc", Operation{{Retain: 4}}},
+		{"abc", Operation{{Delete: 4}}},
+		{"abc", Operation{{Retain: 1}, {Delete: 1 << 30}}},
+		// The lengths add up to the document but overflow on the way
+		{"abc", Operation{{Retain: 1 << 62}, {Insert: "x"},
+			{Retain: 1 << 62}, {Insert: "x"}, {Retain: 1 << 62},
+			{Insert: "x"}, {Retain: 1<<62 + 3}}},
+		{"abc", Operation{{Retain: -1}, {Retain: 4}}},
+	}
+	for _, test := range tests {
+		if got, err := test.op.Apply([]rune(test.doc)); err != ErrInvalid {
+			t.Errorf("Apply(%q, %v) = %q, %v, want ErrInvalid", test.doc,
+				test.op, string(got), err)
+		}
+	}
+}
+
+// randomOperation builds a valid operation for a document of length n
+func randomOperation(random *rand.Rand, n int) Operation {
+	var op Operation
+	for n > 0 {
+		length := random.Intn(n) + 1
+		switch random.Intn(3) {
+		case 0:
+			op = op.Retain(length)
+			n -= length
+		case 1:
+			op = op.Delete(length)
+			n -= length
+		default:
+			op = op.Insert(string(rune('a' + random.Intn(26))))
+		}
+	}
+	if random.Intn(2) == 0 {
+		op = op.Insert("z")
+	}
+	return op
+}
+
+func TestTransform(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		doc := []rune("el gato come pescado")[:random.Intn(21)]
+		a := randomOperation(random, len(doc))
+		b := randomOperation(random, len(doc))
+		aPrime, bPrime, err := Transform(a, b)
+		if err != nil {
+			t.Fatalf("Transform(%v, %v) error = %v", a, b, err)
+		}
+		afterA, err := a.Apply(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		afterB, err := b.Apply(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		left, err := bPrime.Apply(afterA)
+		if err != nil {
+			t.Fatalf("Apply(b') error = %v", err)
+		}
+		right, err := aPrime.Apply(afterB)
+		if err != nil {
+			t.Fatalf("Apply(a') error = %v", err)
+		}
+		if string(left) != string(right) {
+			t.Fatalf("Transform(%v, %v) diverges: %q != %q", a, b,
+				string(left), string(right))
+		}
+	}
+}
+
+func TestTransformInsertOrder(t *testing.T) {
+	a := Operation{{Retain: 1}, {Insert: "a"}}
+	b := Operation{{Retain: 1}, {Insert: "b"}}
+	aPrime, _, err := Transform(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	afterB, _ := b.Apply([]rune("x"))
+	got, err := aPrime.Apply(afterB)
+	if err != nil || string(got) != "xab" {
+		t.Errorf("Apply(a') = %q, %v, want %q", string(got), err, "xab")
+	}
+}
+
+func TestTransformInvalid(t *testing.T) {
+	_, _, err := Transform(Operation{{Retain: 2}}, Operation{{Retain: 3}})
+	if err != ErrInvalid {
+		t.Errorf("Transform error = %v, want ErrInvalid", err)
+	}
+}
+
+func TestTransformIndex(t *testing.T) {
+	op := Operation{{Retain: 2}, {Insert: "xy"}, {Delete: 3}, {Retain: 5}}
+	tests := []struct {
+		index, want int
+	}{
+		{0, 0},
+		{2, 4},
+		{3, 4},
+		{5, 4},
+		{6, 5},
+		{10, 9},
+	}
+	for _, test := range tests {
+		if got := op.TransformIndex(test.index); got != test.want {
+			t.Errorf("TransformIndex(%d) = %d, want %d", test.index, got,
+				test.want)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package persistence
 import (
 	"database/sql"
 	"github.com/chromz/wiki-backend/pkg/log"
+	"strings"
 	"sync"
 )
 
@@ -29,3 +30,18 @@ func GetDb() *sql.DB {
 	})
 	return db
 }
+
+// Migrate executes the given DDL statements in order. Statements adding a
+// column that already exists are ignored so migrations can run on every
+// startup
+func Migrate(statements ...string) error {
+	db := GetDb()
+	for _, statement := range statements {
+		_, err := db.Exec(statement)
+		if err != nil &&
+			!strings.Contains(err.Error(), "duplicate column name") {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+// Package readability measures how hard a Spanish text is to read with the
+// Fernández-Huerta and Szigriszt-Pazos indices, both give higher values to
+// easier texts
+package readability
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// WordsPerMinute is the reading speed used to estimate reading times
+const WordsPerMinute = 200
+
+// Stats are the counts and indices of a text. Level is the school year
+// that can read it according to the Fernández-Huerta scale, years past 12
+// are university, it is zero for texts without words
+type Stats struct {
+	Words           int     `json:"words"`
+	Sentences       int     `json:"sentences"`
+	Syllables       int     `json:"syllables"`
+	ReadingTime     int     `json:"readingTime"`
+	FernandezHuerta float64 `json:"fernandezHuerta"`
+	SzigrisztPazos  float64 `json:"szigrisztPazos"`
+	Level           int     `json:"level"`
+}
+
+// levels maps the lowest Fernández-Huerta score of each band of the scale
+// to its school year, the scale does not tell the first years apart
+var levels = []struct {
+	score float64
+	year  int
+}{
+	{90, 4},
+	{80, 5},
+	{70, 6},
+	{60, 8},
+	{50, 11},
+	{30, 14},
+}
+
+// MinLevel is the easiest level the scale gives
+const MinLevel = 4
+
+const lastLevel = 16
+
+// sentenceEnds split sentences, the blocks of the text are separated by
+// new lines so headings and list items are sentences too
+const sentenceEnds = ".!?;:…\n"
+
+// Level returns the school year of a Fernández-Huerta score
+func Level(score float64) int {
+	for _, band := range levels {
+		if score >= band.score {
+			return band.year
+		}
+	}
+	return lastLevel
+}
+
+func isStrong(r rune) bool {
+	return strings.ContainsRune("aeoáéóíú", r)
+}
+
+func isVowel(r rune) bool {
+	return strings.ContainsRune("aeiouáéíóúü", r)
+}
+
+// Syllables counts the syllables of a Spanish word. Vowels next to each
+// other are one syllable unless both are strong, accented i and u are
+// strong since they break diphthongs
+func Syllables(word string) int {
+	runes := []rune(strings.ToLower(word))
+	count := 0
+	previous := rune(0)
+	for i, r := range runes {
+		// A final y sounds like a vowel, as in muy or hoy
+		if r == 'y' && i == len(runes)-1 && i > 0 {
+			r = 'i'
+		}
+		if !isVowel(r) {
+			previous = 0
+			continue
+		}
+		if previous == 0 || (isStrong(previous) && isStrong(r)) {
+			count++
+		}
+		previous = r
+	}
+	if count == 0 {
+		return 1
+	}
+	return count
+}
+
+func round(value float64) float64 {
+	return math.Round(value*10) / 10
+}
+
+// Analyze measures plain text, words are runs of letters and digits and
+// only the ones with letters count syllables. Fernández-Huerta uses the
+// words per sentence, as corrected by Law, instead of the sentences per
+// hundred words of the published formula
+func Analyze(text string) *Stats {
+	stats := &Stats{}
+	for _, sentence := range strings.FieldsFunc(text, func(r rune) bool {
+		return strings.ContainsRune(sentenceEnds, r)
+	}) {
+		words := strings.FieldsFunc(sentence, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		if len(words) == 0 {
+			continue
+		}
+		stats.Sentences++
+		stats.Words += len(words)
+		for _, word := range words {
+			if strings.IndexFunc(word, unicode.IsLetter) >= 0 {
+				stats.Syllables += Syllables(word)
+			}
+		}
+	}
+	if stats.Words == 0 {
+		return stats
+	}
+	words := float64(stats.Words)
+	syllables := float64(stats.Syllables)
+	sentences := float64(stats.Sentences)
+	stats.ReadingTime = int(math.Ceil(words / WordsPerMinute))
+	stats.FernandezHuerta = round(206.84 - 60*(syllables/words) -
+		1.02*(words/sentences))
+	stats.SzigrisztPazos = round(206.835 - 62.3*(syllables/words) -
+		words/sentences)
+	stats.Level = Level(stats.FernandezHuerta)
+	return stats
+}
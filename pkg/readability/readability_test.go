@@ -0,0 +1,95 @@
+package readability
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSyllables(t *testing.T) {
+	tests := []struct {
+		word string
+		want int
+	}{
+		{"sol", 1},
+		{"casa", 2},
+		{"Mariposa", 4},
+		{"ciudad", 2},
+		{"aire", 2},
+		{"poeta", 3},
+		{"teatro", 3},
+		{"día", 2},
+		{"búho", 2},
+		{"pingüino", 3},
+		{"muy", 1},
+		{"hoy", 1},
+		{"y", 1},
+		{"rayo", 2},
+		{"pfff", 1},
+		{"ÁRBOL", 2},
+	}
+	for _, test := range tests {
+		if got := Syllables(test.word); got != test.want {
+			t.Errorf("Syllables(%q) = %d, want %d", test.word, got,
+				test.want)
+		}
+	}
+}
+
+func TestLevel(t *testing.T) {
+	tests := []struct {
+		score float64
+		want  int
+	}{
+		{120, 4},
+		{90, 4},
+		{89.9, 5},
+		{75, 6},
+		{60, 8},
+		{55, 11},
+		{30, 14},
+		{29.9, 16},
+		{-10, 16},
+	}
+	for _, test := range tests {
+		if got := Level(test.score); got != test.want {
+			t.Errorf("Level(%v) = %d, want %d", test.score, got, test.want)
+		}
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	tests := []struct {
+		text string
+		want Stats
+	}{
+		{"", Stats{}},
+		{"¡!... \n;", Stats{}},
+		{
+			"El sol sale. La casa es azul.",
+			Stats{Words: 7, Sentences: 2, Syllables: 10, ReadingTime: 1,
+				FernandezHuerta: 117.6, SzigrisztPazos: 114.3, Level: 4},
+		},
+		// Numbers are words without syllables, new lines end sentences
+		{
+			"Capítulo 3\nLa fotosíntesis transforma la energía luminosa",
+			Stats{Words: 8, Sentences: 2, Syllables: 22, ReadingTime: 1,
+				FernandezHuerta: 37.8, SzigrisztPazos: 31.5, Level: 14},
+		},
+	}
+	for _, test := range tests {
+		if got := Analyze(test.text); !reflect.DeepEqual(*got, test.want) {
+			t.Errorf("Analyze(%q) = %+v, want %+v", test.text, *got,
+				test.want)
+		}
+	}
+}
+
+func TestAnalyzeReadingTime(t *testing.T) {
+	text := strings.Repeat("uno ", WordsPerMinute) + "dos"
+	if got := Analyze(text); got.Words != WordsPerMinute+1 ||
+		got.ReadingTime != 2 {
+		t.Errorf("Analyze = %d words, %d minutes, want %d, 2", got.Words,
+			got.ReadingTime, WordsPerMinute+1)
+	}
+}
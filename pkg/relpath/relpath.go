@@ -0,0 +1,14 @@
+package relpath
+
+import (
+	"path"
+	"strings"
+)
+
+// Valid reports if a path is relative, clean and stays inside the
+// directory it is joined to
+func Valid(name string) bool {
+	return name != "" && !strings.HasPrefix(name, "/") &&
+		!strings.Contains(name, "\\") && path.Clean(name) == name &&
+		name != ".." && !strings.HasPrefix(name, "../")
+}
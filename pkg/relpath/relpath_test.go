@@ -0,0 +1,30 @@
+package relpath
+
+import "testing"
+
+func TestValid(t *testing.T) {
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{"a.png", true},
+		{"1/2/3/a.png", true},
+		{"a..b/c", true},
+		{"..a", true},
+		{"", false},
+		{".", true},
+		{"..", false},
+		{"../a", false},
+		{"a/../../b", false},
+		{"a/./b", false},
+		{"a//b", false},
+		{"a/", false},
+		{"/etc/passwd", false},
+		{"a\\..\\b", false},
+	}
+	for _, test := range tests {
+		if got := Valid(test.in); got != test.want {
+			t.Errorf("Valid(%q) = %v, want %v", test.in, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package sanitize
+
+import (
+	"bytes"
+	"golang.org/x/net/html"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// Policy is a whitelist of elements and attributes, anything not listed
+// is removed while the text inside unknown elements is kept
+type Policy struct {
+	// Elements maps every allowed element to its allowed attributes
+	Elements map[string][]string
+	// Global are attributes allowed on every allowed element
+	Global []string
+	// URLAttributes are attributes whose value must be a safe url
+	URLAttributes []string
+	// SrcsetAttributes are attributes holding a list of image candidates,
+	// every url of the list must be safe
+	SrcsetAttributes []string
+	// Schemes are the allowed schemes of absolute urls
+	Schemes []string
+	// Drop are elements removed along with their content
+	Drop []string
+}
+
+// voidElements have no end tag
+var voidElements = map[string]bool{
+	"br": true, "hr": true, "img": true, "input": true, "source": true,
+	"wbr": true,
+}
+
+// Markdown is the policy for html rendered from markdown, it keeps
+// tables, task lists, footnotes and heading anchors
+var Markdown = &Policy{
+	Elements: map[string][]string{
+		"a":          {"href", "title", "class", "role"},
+		"abbr":       {"title"},
+		"b":          nil,
+		"blockquote": {"cite"},
+		"br":         nil,
+		"code":       {"class"},
+		"dd":         nil,
+		"del":        nil,
+		"details":    {"open"},
+		"div":        nil,
+		"dl":         nil,
+		"dt":         nil,
+		"em":         nil,
+		"h1":         nil,
+		"h2":         nil,
+		"h3":         nil,
+		"h4":         nil,
+		"h5":         nil,
+		"h6":         nil,
+		"hr":         nil,
+		"i":          nil,
+		"img":        {"src", "srcset", "sizes", "alt", "title", "width", "height"},
+		"input":      {"type", "checked", "disabled"},
+		"ins":        nil,
+		"kbd":        nil,
+		"li":         {"role"},
+		"mark":       nil,
+		"ol":         {"start"},
+		"p":          nil,
+		"picture":    nil,
+		"pre":        nil,
+		"q":          {"cite"},
+		"s":          nil,
+		"section":    {"class", "role"},
+		"small":      nil,
+		"source":     {"srcset", "sizes", "type", "media"},
+		"span":       nil,
+		"strong":     nil,
+		"sub":        nil,
+		"summary":    nil,
+		"sup":        nil,
+		"table":      nil,
+		"tbody":      nil,
+		"td":         {"align"},
+		"tfoot":      nil,
+		"th":         {"align"},
+		"thead":      nil,
+		"tr":         nil,
+		"u":          nil,
+		"ul":         nil,
+	},
+	Global:           []string{"id", "lang", "dir"},
+	URLAttributes:    []string{"href", "src", "cite"},
+	SrcsetAttributes: []string{"srcset"},
+	Schemes:          []string{"http", "https", "mailto"},
+	Drop: []string{"script", "style", "iframe", "object", "embed",
+		"noscript", "template", "textarea", "select", "svg", "math"},
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// safeURL accepts relative urls, fragments and absolute urls with an
+// allowed scheme
+func (p *Policy) safeURL(value string) bool {
+	u, err := url.Parse(strings.TrimSpace(value))
+	if err != nil {
+		return false
+	}
+	if u.Scheme == "" {
+		return u.Opaque == ""
+	}
+	return contains(p.Schemes, strings.ToLower(u.Scheme))
+}
+
+// safeSrcset checks every url of a comma separated list of image
+// candidates like "a.webp 320w, b.webp 640w"
+func (p *Policy) safeSrcset(value string) bool {
+	for _, candidate := range strings.Split(value, ",") {
+		fields := strings.Fields(candidate)
+		if len(fields) == 0 || len(fields) > 2 || !p.safeURL(fields[0]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *Policy) attributes(token html.Token) []html.Attribute {
+	allowed := p.Elements[token.Data]
+	var attrs []html.Attribute
+	for _, attr := range token.Attr {
+		if attr.Namespace != "" {
+			continue
+		}
+		if !contains(allowed, attr.Key) && !contains(p.Global, attr.Key) {
+			continue
+		}
+		if contains(p.URLAttributes, attr.Key) && !p.safeURL(attr.Val) {
+			continue
+		}
+		if contains(p.SrcsetAttributes, attr.Key) && !p.safeSrcset(attr.Val) {
+			continue
+		}
+		attrs = append(attrs, attr)
+	}
+	if token.Data == "input" {
+		// Only the read only checkboxes of task lists are kept
+		checkbox := false
+		for _, attr := range attrs {
+			checkbox = checkbox || (attr.Key == "type" && attr.Val == "checkbox")
+		}
+		if !checkbox {
+			return nil
+		}
+		if !contains(keys(attrs), "disabled") {
+			attrs = append(attrs, html.Attribute{Key: "disabled"})
+		}
+	}
+	return attrs
+}
+
+func keys(attrs []html.Attribute) []string {
+	result := make([]string, len(attrs))
+	for i, attr := range attrs {
+		result[i] = attr.Key
+	}
+	return result
+}
+
+// Sanitize removes every element and attribute not allowed by the policy
+// and closes the elements left open
+func (p *Policy) Sanitize(r io.Reader) ([]byte, error) {
+	var out bytes.Buffer
+	tokenizer := html.NewTokenizer(r)
+	var open []string
+	var dropping string
+	dropDepth := 0
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			if err := tokenizer.Err(); err != io.EOF {
+				return nil, err
+			}
+			break
+		}
+		token := tokenizer.Token()
+		if dropping != "" {
+			switch {
+			case tokenType == html.StartTagToken && token.Data == dropping:
+				dropDepth++
+			case tokenType == html.EndTagToken && token.Data == dropping:
+				dropDepth--
+				if dropDepth == 0 {
+					dropping = ""
+				}
+			}
+			continue
+		}
+		switch tokenType {
+		case html.TextToken:
+			out.WriteString(html.EscapeString(token.Data))
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if contains(p.Drop, token.Data) {
+				if tokenType == html.StartTagToken {
+					dropping = token.Data
+					dropDepth = 1
+				}
+				continue
+			}
+			if _, ok := p.Elements[token.Data]; !ok {
+				continue
+			}
+			token.Attr = p.attributes(token)
+			if token.Data == "input" && token.Attr == nil {
+				continue
+			}
+			token.Type = html.StartTagToken
+			out.WriteString(token.String())
+			if voidElements[token.Data] {
+				continue
+			}
+			if tokenType == html.SelfClosingTagToken {
+				out.WriteString("</" + token.Data + ">")
+				continue
+			}
+			open = append(open, token.Data)
+		case html.EndTagToken:
+			if voidElements[token.Data] {
+				continue
+			}
+			index := -1
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] == token.Data {
+					index = i
+					break
+				}
+			}
+			if index < 0 {
+				continue
+			}
+			for i := len(open) - 1; i >= index; i-- {
+				out.WriteString("</" + open[i] + ">")
+			}
+			open = open[:index]
+		}
+	}
+	for i := len(open) - 1; i >= 0; i-- {
+		out.WriteString("</" + open[i] + ">")
+	}
+	return out.Bytes(), nil
+}
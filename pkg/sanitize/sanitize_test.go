@@ -0,0 +1,74 @@
+package sanitize
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{`<p>Hola <strong>mundo</strong></p>`,
+			`<p>Hola <strong>mundo</strong></p>`},
+		{`<p onclick="alert(1)">x</p>`, `<p>x</p>`},
+		{`<script>alert(1)</script><p>x</p>`, `<p>x</p>`},
+		{`<style>p { color: red }</style>ok`, `ok`},
+		{`<div><script><script>x</script></script>y</div>`, `<div>y</div>`},
+		{`<blink>text</blink>`, `text`},
+		{`<a href="javascript:alert(1)">x</a>`, `<a>x</a>`},
+		{`<a href="JaVaScRiPt:alert(1)">x</a>`, `<a>x</a>`},
+		{`<a href="https://example.com" title="t">x</a>`,
+			`<a href="https://example.com" title="t">x</a>`},
+		{`<a href="#sec">x</a>`, `<a href="#sec">x</a>`},
+		{`<a href="mailto:a@b.c">x</a>`, `<a href="mailto:a@b.c">x</a>`},
+		{`<img src="data:image/png;base64,AAAA" alt="a">`, `<img alt="a">`},
+		{`<img src="a.png" srcset="a.webp 320w, javascript:x 640w">`,
+			`<img src="a.png">`},
+		{`<img src="a.png" srcset="a.webp 320w, b.webp 640w">`,
+			`<img src="a.png" srcset="a.webp 320w, b.webp 640w">`},
+		{`<input type="text" value="x">`, ``},
+		{`<input type="checkbox" checked>`,
+			`<input type="checkbox" checked="" disabled="">`},
+		{`<p><em>open`, `<p><em>open</em></p>`},
+		{`<p>a</em>b</p>`, `<p>ab</p>`},
+		{`<ul><li>a<li>b</ul>`, `<ul><li>a<li>b</li></li></ul>`},
+		{`<span/>x`, `<span></span>x`},
+		{`<h2 id="intro" class="x">I</h2>`, `<h2 id="intro">I</h2>`},
+		{`1 &lt; 2 &amp; 3`, `1 &lt; 2 &amp; 3`},
+		{`<svg><a href="x">y</a></svg>z`, `z`},
+	}
+	for _, test := range tests {
+		got, err := Markdown.Sanitize(strings.NewReader(test.in))
+		if err != nil {
+			t.Errorf("Sanitize(%q) error = %v", test.in, err)
+			continue
+		}
+		if string(got) != test.want {
+			t.Errorf("Sanitize(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestSafeURL(t *testing.T) {
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{"a.png", true},
+		{"../assets/a.png", true},
+		{"/static/a.png", true},
+		{"#top", true},
+		{"http://example.com", true},
+		{"  https://example.com", true},
+		{"javascript:alert(1)", false},
+		{"vbscript:x", false},
+		{"data:text/html,x", false},
+		{"ftp://example.com", false},
+	}
+	for _, test := range tests {
+		if got := Markdown.safeURL(test.in); got != test.want {
+			t.Errorf("safeURL(%q) = %v, want %v", test.in, got, test.want)
+		}
+	}
+}
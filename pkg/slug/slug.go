@@ -0,0 +1,46 @@
+package slug
+
+import (
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+	"strings"
+	"unicode"
+)
+
+// maxLength is the maximum number of characters of a slug
+const maxLength = 80
+
+// Fold removes accents and diacritics from a string, "Añadir Lección"
+// becomes "Anadir Leccion"
+func Fold(s string) string {
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)),
+		norm.NFC)
+	folded, _, err := transform.String(t, s)
+	if err != nil {
+		return s
+	}
+	return folded
+}
+
+// Make generates a lowercase, accent-folded, dash separated slug
+func Make(s string) string {
+	var builder strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(Fold(s)) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if dash && builder.Len() > 0 {
+				builder.WriteByte('-')
+			}
+			builder.WriteRune(r)
+			dash = false
+			continue
+		}
+		dash = true
+	}
+	result := builder.String()
+	if len(result) > maxLength {
+		result = strings.TrimRight(result[:maxLength], "-")
+	}
+	return result
+}
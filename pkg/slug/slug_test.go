@@ -0,0 +1,43 @@
+package slug
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFold(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Añadir Lección", "Anadir Leccion"},
+		{"pingüino", "pinguino"},
+		{"ÁÉÍÓÚ", "AEIOU"},
+		{"plain", "plain"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := Fold(test.in); got != test.want {
+			t.Errorf("Fold(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestMake(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Añadir Lección", "anadir-leccion"},
+		{"  Las   fracciones  ", "las-fracciones"},
+		{"¿Qué es 1/2?", "que-es-1-2"},
+		{"---", ""},
+		{"Ñandú", "nandu"},
+		{"日本語", ""},
+		{strings.Repeat("ab ", 40), strings.TrimRight(
+			strings.Repeat("ab-", 27), "-")},
+	}
+	for _, test := range tests {
+		if got := Make(test.in); got != test.want {
+			t.Errorf("Make(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}